@@ -3,6 +3,10 @@ package client
 import (
 	"errors"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,23 +16,79 @@ const (
 )
 
 type ClientBuilder struct {
-	network, address string
-	capacity         int
-	bufSize          int
-	id               string
+	network   string
+	addresses []string
+	capacity  int
+	bufSize   int
+	id        string
+	logger    Logger
 	//c                chan Message
+
+	// address is changed to the leader by dial, so it is guarded by lock.
+	address_lock sync.Mutex
+	address      string
+}
+
+// bufferSize returns the buffer size of subscriptions, the builder isn't
+// changed, so that it can be used by goroutines at the same time.
+func (self *ClientBuilder) bufferSize() int {
+	if self.bufSize == 0 {
+		return 512
+	}
+	return self.bufSize
+}
+
+// queueCapacity returns the capacity of the channel of PubClient, it is
+// 200 if it isn't set.
+func (self *ClientBuilder) queueCapacity() int {
+	if self.capacity == 0 {
+		return 200
+	}
+	return self.capacity
+}
+
+func (self *ClientBuilder) getAddress() string {
+	self.address_lock.Lock()
+	defer self.address_lock.Unlock()
+	return self.address
+}
+
+func (self *ClientBuilder) setAddress(address string) {
+	self.address_lock.Lock()
+	self.address = address
+	self.address_lock.Unlock()
 }
 
 func (self *ClientBuilder) Clone() *ClientBuilder {
 	return &ClientBuilder{
-		network:  self.network,
-		address:  self.address,
-		capacity: self.capacity,
-		bufSize:  self.bufSize,
-		id:       self.id,
+		network:   self.network,
+		address:   self.getAddress(),
+		addresses: self.addresses,
+		capacity:  self.capacity,
+		bufSize:   self.bufSize,
+		id:        self.id,
+		logger:    self.logger,
 	}
 }
 
+// Logger - 设置日志, 默认是 DefaultLogger
+func (self *ClientBuilder) Logger(logger Logger) *ClientBuilder {
+	self.logger = logger
+	return self
+}
+
+// log returns the logger with the id of client.
+func (self *ClientBuilder) log() Logger {
+	logger := self.logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	if self.id == "" {
+		return logger
+	}
+	return LoggerWith(logger, "client", self.id)
+}
+
 func (self *ClientBuilder) Id(name string) *ClientBuilder {
 	self.id = name
 	return self
@@ -70,28 +130,11 @@ func (self *ClientBuilder) To(typ, name string) (*SimplePubClient, error) {
 }
 
 func (self *ClientBuilder) to(msg Message) (*SimplePubClient, error) {
-	conn, err := connect(self.network, self.address)
-	if err != nil {
-		return nil, err
-	}
-
-	if self.id != "" {
-		sendId(conn, self.id)
-	}
-
-	err = exec(conn, msg)
+	conn, err := self.dial(msg)
 	if err != nil {
 		return nil, err
 	}
 
-	if self.capacity == 0 {
-		self.capacity = 200
-	}
-
-	if self.bufSize == 0 {
-		self.bufSize = 512
-	}
-
 	return &SimplePubClient{conn: conn}, nil
 }
 
@@ -117,25 +160,13 @@ func (self *ClientBuilder) toV2(msg Message) (*PubClient, error) {
 	// }
 
 	v2 := &PubClient{
-		C: make(chan Message, self.capacity),
+		C:      make(chan Message, self.queueCapacity()),
+		logger: self.log(),
 	}
 
 	v2.runItInGoroutine(func() {
 		v2.runLoop(self, func(builder *ClientBuilder) (net.Conn, error) {
-			conn, err := connect(self.network, self.address)
-			if err != nil {
-				return nil, err
-			}
-
-			if self.id != "" {
-				sendId(conn, self.id)
-			}
-
-			err = exec(conn, msg)
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
+			return self.dial(msg)
 		})
 	})
 
@@ -167,34 +198,170 @@ func (self *ClientBuilder) Subscribe(typ, name string, cb func(cli *Subscription
 	return self.subscribe(msg, cb)
 }
 
-func (self *ClientBuilder) subscribe(msg Message, cb func(cli *Subscription, msg Message)) error {
-	conn, err := connect(self.network, self.address)
+// SubscribeWith - 订阅时可以指定选项, 如 "headers=true" 接收消息头
+func (self *ClientBuilder) SubscribeWith(typ, name string, options map[string]string, cb func(cli *Subscription, msg Message)) error {
+	sub, err := self.Listen(typ, name, options)
 	if err != nil {
 		return err
 	}
+	defer sub.Close()
+
+	return sub.Run(cb)
+}
+
+// Listen - 创建一个订阅, 调用 Run 接收消息, 调用 Close 中断它
+func (self *ClientBuilder) Listen(typ, name string, options map[string]string) (*Subscription, error) {
+	msg := BuildCommand(MSG_SUB, typ, name, options)
 
-	if self.id != "" {
-		sendId(conn, self.id)
+	conn, err := self.dial(msg)
+	if err != nil {
+		return nil, err
 	}
 
-	err = exec(conn, msg)
+	return &Subscription{conn: conn, bufSize: self.bufferSize()}, nil
+}
+
+// Peek - 查看队列头部的 count 个消息, 消息仍然留在队列中
+func (self *ClientBuilder) Peek(name string, count int) ([]Message, error) {
+	conn, err := self.dial(BuildCommand(MSG_PEEK, QUEUE, name,
+		map[string]string{"count": strconv.Itoa(count)}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var msgs []Message
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Command() {
+		case MSG_ACK:
+			return msgs, nil
+		case MSG_DATA, MSG_HDATA:
+			msgs = append(msgs, msg)
+		case MSG_NOOP:
+		case MSG_ERROR:
+			return nil, ToError(msg)
+		default:
+			return nil, ErrUnexceptedMessage
+		}
+	}
+}
+
+// Commit - 保存日志模式的主题上消费者 consumer 的位置, offset 是下一个要读取的消息的偏移量
+func (self *ClientBuilder) Commit(name, consumer string, offset uint64) error {
+	conn, err := self.dial(BuildCommand(MSG_COMMIT, TOPIC, name, map[string]string{
+		"consumer": consumer,
+		"offset":   strconv.FormatUint(offset, 10),
+	}))
 	if err != nil {
-		conn.Close()
 		return err
 	}
+	return conn.Close()
+}
 
-	if self.capacity == 0 {
-		self.capacity = 200
+// BuildCommand - 创建 MSG_PUB, MSG_SUB, MSG_PEEK 或 MSG_COMMIT 命令, 选项每行一个 'key=value'
+func BuildCommand(cmd byte, typ, name string, options map[string]string) Message {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	if self.bufSize == 0 {
-		self.bufSize = 512
+	builder := NewMessageWriter(cmd, len(name)+HEAD_LENGTH+8).
+		Append([]byte(typ)).
+		Append([]byte(" ")).
+		Append([]byte(name)).
+		Append([]byte("\n"))
+	for _, k := range keys {
+		builder.WriteString(k)
+		builder.WriteString("=")
+		builder.WriteString(options[k])
+		builder.WriteString("\n")
+	}
+	return builder.Build()
+}
+
+func (self *ClientBuilder) subscribe(msg Message, cb func(cli *Subscription, msg Message)) error {
+	conn, err := self.dial(msg)
+	if err != nil {
+		return err
 	}
 
 	var sub = Subscription{conn: conn}
 	defer conn.Close()
 
-	return sub.subscribe(self.bufSize, cb)
+	return sub.subscribe(self.bufferSize(), cb)
+}
+
+// dial - 连接服务器并执行命令, 如果服务器不是复制队列的主节点则转到主节点
+func (self *ClientBuilder) dial(msg Message) (net.Conn, error) {
+	address := self.getAddress()
+	var lastErr error
+	for i := 0; i < 10; i++ {
+		conn, err := connect(self.network, address)
+		if err == nil {
+			if self.id != "" {
+				sendId(conn, self.id)
+			}
+
+			err = exec(conn, msg)
+			if err == nil {
+				self.setAddress(address)
+				return conn, nil
+			}
+			conn.Close()
+
+			leader, ok := IsNotLeader(err)
+			if !ok {
+				return nil, err
+			}
+			if leader != "" {
+				address = leader
+				lastErr = err
+				continue
+			}
+		}
+		if len(self.addresses) == 0 {
+			return nil, err
+		}
+		lastErr = err
+
+		// try next node while the leader is unknown or unreachable.
+		address = self.nextAddress(address)
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, lastErr
+}
+
+func (self *ClientBuilder) nextAddress(address string) string {
+	for idx, addr := range self.addresses {
+		if addr == address {
+			return self.addresses[(idx+1)%len(self.addresses)]
+		}
+	}
+	return self.addresses[0]
+}
+
+// IsNotLeader - 判断错误是否为 "不是主节点", 并返回主节点的地址, 地址未知时为空
+func IsNotLeader(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	s := err.Error()
+	if !strings.HasPrefix(s, "not leader") {
+		return "", false
+	}
+	if !strings.HasPrefix(s, "not leader, leader is ") {
+		return "", true
+	}
+	leader := strings.TrimSuffix(strings.TrimPrefix(s, "not leader, leader is "), ".")
+	if leader == "unknown" {
+		return "", true
+	}
+	return leader, true
 }
 
 func connect(network, address string) (net.Conn, error) {
@@ -204,7 +371,13 @@ func connect(network, address string) (net.Conn, error) {
 	if "" == address {
 		return nil, errors.New("address is missing.")
 	}
-	conn, err := net.Dial(network, address)
+	var conn net.Conn
+	var err error
+	if network == "ws" {
+		conn, err = dialWebSocket(address)
+	} else {
+		conn, err = net.Dial(network, address)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -267,6 +440,16 @@ func exec(conn net.Conn, msg Message) error {
 		ToCommandName(recvMsg.Command()))
 }
 
+// Connect - 连接服务器, network 为 ws 时通过 http 的 websocket 连接, address 可以带路径, 如 127.0.0.1:4150/mq/ws
 func Connect(network, address string) *ClientBuilder {
 	return &ClientBuilder{network: network, address: address}
 }
+
+// ConnectCluster - 连接到一个集群, 客户端会自动转到复制队列的主节点
+func ConnectCluster(network string, addresses ...string) *ClientBuilder {
+	builder := &ClientBuilder{network: network, addresses: addresses}
+	if len(addresses) > 0 {
+		builder.address = addresses[0]
+	}
+	return builder
+}
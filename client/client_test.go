@@ -44,3 +44,18 @@ func TestConnectTimeout(t *testing.T) {
 	}
 	t.Log(err)
 }
+
+func TestBuilderDefaults(t *testing.T) {
+	builder := Connect("tcp", "127.0.0.1:4150")
+	if 200 != builder.queueCapacity() {
+		t.Error("excepted capacity is 200, actual is", builder.queueCapacity())
+	}
+	if 512 != builder.bufferSize() {
+		t.Error("excepted buffer size is 512, actual is", builder.bufferSize())
+	}
+
+	builder.SetQueueCapacity(10)
+	if 10 != builder.queueCapacity() {
+		t.Error("excepted capacity is 10, actual is", builder.queueCapacity())
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// system event format
+// the events of _sys.events are lines of text by default:
+//   type kind [name] [key=value ...]
+// the name and the values are query escaped. if the server is started with the json
+// format, an event is a json object:
+//   {"version":1,"type":"new","kind":"queue","name":"q1",
+//    "timestamp":"2006-01-02T15:04:05Z","server_id":1,"attributes":{}}
+// a json event always begins with '{', so both formats are read by ParseEvent.
+
+const EVENT_VERSION = 1
+
+var ErrEventInvalid = errors.New("event is invalid.")
+
+// Event - 系统事件
+type Event struct {
+	Version int `json:"version"`
+
+	// Type is 'new', 'del', 'kill', 'connect', 'disconnect', 'subscribe',
+	// 'unsubscribe' or 'overflow'.
+	Type string `json:"type"`
+
+	// Kind is 'queue', 'topic' or 'client'.
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+
+	// Timestamp and ServerID are empty in the text format.
+	Timestamp  time.Time         `json:"timestamp"`
+	ServerID   int64             `json:"server_id,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Attribute - 获取事件的属性
+func (self *Event) Attribute(key string) string {
+	return self.Attributes[key]
+}
+
+// Bytes - 按 json 格式编码事件
+func (self *Event) Bytes() []byte {
+	bs, _ := json.Marshal(self)
+	return bs
+}
+
+// Text - 按文本格式编码事件, keys 是属性的顺序
+func (self *Event) Text(keys ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(self.Type)
+	buf.WriteString(" ")
+	buf.WriteString(self.Kind)
+	if self.Name != "" {
+		buf.WriteString(" ")
+		buf.WriteString(url.QueryEscape(self.Name))
+	}
+	for _, key := range keys {
+		buf.WriteString(" ")
+		buf.WriteString(key)
+		buf.WriteString("=")
+		buf.WriteString(url.QueryEscape(self.Attributes[key]))
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// ParseEvent - 解析系统事件, 支持 json 和文本两种格式
+func ParseEvent(data []byte) (*Event, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, ErrEventInvalid
+	}
+
+	if data[0] == '{' {
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		if event.Version <= 0 || event.Type == "" || event.Kind == "" {
+			return nil, ErrEventInvalid
+		}
+		if event.Version > EVENT_VERSION {
+			return nil, errors.New("event version " + strconv.Itoa(event.Version) + " is unsupported.")
+		}
+		return &event, nil
+	}
+
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return nil, ErrEventInvalid
+	}
+	event := &Event{Version: EVENT_VERSION,
+		Type: string(fields[0]),
+		Kind: string(fields[1])}
+	fields = fields[2:]
+	if len(fields) > 0 && bytes.IndexByte(fields[0], '=') < 0 {
+		name, err := url.QueryUnescape(string(fields[0]))
+		if err != nil {
+			return nil, ErrEventInvalid
+		}
+		event.Name = name
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		idx := bytes.IndexByte(field, '=')
+		if idx < 0 {
+			return nil, ErrEventInvalid
+		}
+		value, err := url.QueryUnescape(string(field[idx+1:]))
+		if err != nil {
+			return nil, ErrEventInvalid
+		}
+		if event.Attributes == nil {
+			event.Attributes = map[string]string{}
+		}
+		event.Attributes[string(field[:idx])] = value
+	}
+	return event, nil
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"runtime"
 	"strings"
@@ -20,6 +19,16 @@ type Base struct {
 	closed int32
 	S      chan struct{}
 	wait   sync.WaitGroup
+
+	// Logger is DefaultLogger if it is nil.
+	Logger Logger
+}
+
+func (self *Base) log() Logger {
+	if self.Logger == nil {
+		return DefaultLogger
+	}
+	return self.Logger
 }
 
 func (self *Base) CloseWith(closeHandle func() error) error {
@@ -59,7 +68,7 @@ func (self *Base) CatchThrow(err *error) {
 		}
 
 		errMsg := buffer.String()
-		log.Println(errMsg)
+		self.log().Error(errMsg)
 		if err != nil {
 			*err = errors.New(errMsg)
 		}
@@ -115,7 +124,7 @@ func (self *Handler) Stats() map[string]interface{} {
 
 func (self *Handler) Shutdown() error {
 	close(self.c)
-	log.Println("[", self.Typ, self.RecvQname, self.SendQname, "] handler is closed")
+	self.log().Info("handler is closed", "type", self.Typ, "recv", self.RecvQname, "send", self.SendQname)
 	return nil
 }
 
@@ -135,7 +144,7 @@ func (self *Handler) runLoop(builder *ClientBuilder,
 			self.errLock.Unlock()
 
 			if conn_err_count < 5 || 0 == conn_err_count%50 {
-				log.Println("failed to connect mq server,", err)
+				builder.log().Warn("failed to connect mq server", "error", err)
 			}
 			if conn_err_count > 5 {
 				time.Sleep(2 * time.Second)
@@ -154,7 +163,8 @@ func (self *Handler) runLoop(builder *ClientBuilder,
 func (self *Handler) runWrite(builder *ClientBuilder) (err error) {
 	defer self.CatchThrow(&err)
 
-	log.Println("[mq] [" + self.SendQname + "] connect to mq server......")
+	logger := LoggerWith(builder.log(), "type", self.Typ, "dest", self.SendQname)
+	logger.Info("connect to mq server......")
 	atomic.StoreInt64(&self.write_connect_last_at, time.Now().UnixNano())
 	atomic.AddUint32(&self.write_connect_total, 1)
 
@@ -175,31 +185,29 @@ func (self *Handler) runWrite(builder *ClientBuilder) (err error) {
 				return nil
 			}
 			if err = w.Send(msg.ToBytes()); err != nil {
-				log.Println("[mq] ["+self.SendQname+"] send message fialed,", err)
+				logger.Warn("send message failed", "error", err)
 				return nil
 			}
 		case <-self.Base.S:
-			log.Println("[mq] [" + self.SendQname + "] mq server is closed")
+			logger.Info("mq server is closed")
 			return nil
 		case <-tick.C:
 			if len(self.c) > 0 {
 				break
 			}
 			if err = w.Send(MSG_NOOP_BYTES); err != nil {
-				log.Println("[mq] ["+self.SendQname+"] send message fialed,", err)
+				logger.Warn("send message failed", "error", err)
 				return nil
 			}
 		}
 	}
-
-	log.Println("[mq] [" + self.SendQname + "] mq server is closed")
-	return nil
 }
 
 func (self *Handler) runRead(builder *ClientBuilder) (err error) {
 	defer self.CatchThrow(&err)
 
-	log.Println("[mq] [" + self.RecvQname + "] subscribe to mq server......")
+	logger := LoggerWith(builder.log(), "type", self.Typ, "dest", self.RecvQname)
+	logger.Info("subscribe to mq server......")
 	atomic.StoreInt64(&self.read_connect_last_at, time.Now().UnixNano())
 	atomic.AddUint32(&self.read_connect_total, 1)
 
@@ -212,7 +220,7 @@ func (self *Handler) runRead(builder *ClientBuilder) (err error) {
 				return
 			}
 			if MSG_DATA != msg.Command() {
-				log.Println("[mq] ["+self.RecvQname+"] recv unexcepted message - ", ToCommandName(msg.Command()))
+				logger.Warn("recv unexcepted message", "command", ToCommandName(msg.Command()))
 				return
 			}
 
@@ -221,7 +229,7 @@ func (self *Handler) runRead(builder *ClientBuilder) (err error) {
 
 	if IsConnected(err) {
 		atomic.AddUint32(&self.read_disconnect, 1)
-		log.Println("[mq] ["+self.RecvQname+"] mq is disconnected, ", err)
+		logger.Warn("mq is disconnected", "error", err)
 		return nil
 	}
 	return err
@@ -239,6 +247,9 @@ func NewTopicHandler(builder *ClientBuilder, id, rqueue, squeue string,
 
 func NewHandler(base *Base, builder *ClientBuilder, id, typ, rqueue, squeue string,
 	cb func(msg Message, c chan Message)) *Handler {
+	if base.Logger == nil {
+		base.Logger = builder.logger
+	}
 	handler := &Handler{
 		Base:           base,
 		Typ:            typ,
@@ -307,7 +318,8 @@ func (self *QueueMgr) CloseDirect() error {
 	}
 	self.handlers = map[string]HandlerObject{}
 
-	log.Println("[", self.Qtype, self.Qname, self.qmatchType, self.qmatchName, "] queueMgr is closed")
+	self.log().Info("queueMgr is closed", "type", self.Qtype, "dest", self.Qname,
+		"match_type", self.qmatchType, "match_name", self.qmatchName)
 	return err
 }
 
@@ -319,7 +331,7 @@ func (self *QueueMgr) RunLoop(builder *ClientBuilder,
 			conn_err_count++
 
 			if conn_err_count < 5 || 0 == conn_err_count%50 {
-				log.Println("failed to connect mq server,", err)
+				builder.log().Warn("failed to connect mq server", "error", err)
 			} else {
 				time.Sleep(2 * time.Second)
 			}
@@ -369,26 +381,26 @@ func (self *QueueMgr) PollList() {
 	}
 	res, err := http.Get(url)
 	if nil != err {
-		log.Println("[mq] list queues failed,", err)
+		self.log().Warn("list queues failed", "url", url, "error", err)
 		return
 	}
 	defer res.Body.Close()
 
 	bs, err := ioutil.ReadAll(res.Body)
 	if nil != err {
-		log.Println("[mq] list queues failed,", err)
+		self.log().Warn("list queues failed", "url", url, "error", err)
 		return
 	}
 
 	if res.StatusCode != http.StatusOK {
-		log.Println("[mq] list queues failed - ["+url+"]:\r\n\t", string(bs))
+		self.log().Warn("list queues failed", "url", url, "status", res.StatusCode, "body", string(bs))
 		return
 	}
 
 	var queues []string
 	err = json.Unmarshal(bs, &queues)
 	if nil != err {
-		log.Println("[mq] list queues failed - ["+url+"],", err, "\r\n\t", string(bs))
+		self.log().Warn("list queues failed", "url", url, "error", err, "body", string(bs))
 		return
 	}
 
@@ -400,10 +412,9 @@ func (self *QueueMgr) PollList() {
 }
 
 func (self *QueueMgr) RunRead(builder *ClientBuilder) (err error) {
-	log.Println("[mq] subscribe to mq server at ", self.Qtype, self.Qname, "......")
+	logger := LoggerWith(builder.log(), "type", self.Qtype, "dest", self.Qname)
+	logger.Info("subscribe to mq server......")
 
-	qmatchType := []byte(self.qmatchType)
-	qmatchName := []byte(self.qmatchName)
 	err = builder.Subscribe(self.Qtype, self.Qname,
 		func(subscription *Subscription, msg Message) {
 			if MSG_NOOP == msg.Command() {
@@ -413,7 +424,7 @@ func (self *QueueMgr) RunRead(builder *ClientBuilder) (err error) {
 				return
 			}
 			if MSG_DATA != msg.Command() {
-				log.Println("[mq] recv unexcepted message - ", ToCommandName(msg.Command()))
+				logger.Warn("recv unexcepted message", "command", ToCommandName(msg.Command()))
 				return
 			}
 			data := msg.Data()
@@ -421,20 +432,21 @@ func (self *QueueMgr) RunRead(builder *ClientBuilder) (err error) {
 				return
 			}
 
-			fields := bytes.Fields(data)
-			if len(fields) != 3 {
+			event, err := ParseEvent(data)
+			if err != nil {
 				return
 			}
 
-			if bytes.Equal(fields[0], []byte("new")) &&
-				bytes.Equal(fields[1], qmatchType) &&
-				bytes.HasPrefix(fields[2], qmatchName) {
-				self.create(self, string(fields[2]))
+			if event.Type == "new" &&
+				event.Kind == self.qmatchType &&
+				event.Name != "" &&
+				strings.HasPrefix(event.Name, self.qmatchName) {
+				self.create(self, event.Name)
 			}
 		})
 
 	if IsConnected(err) {
-		log.Println("[mq] mq is disconnected, ", err)
+		logger.Warn("mq is disconnected", "error", err)
 		return nil
 	}
 	return err
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// data with headers format
+// headers is some lines of 'key: value' and ends with an empty line, the
+// rest of data is the body.
+//
+// MSG_HDATA is only sent to the subscribers that ask for headers, other
+// subscribers receive a MSG_DATA message with the body only.
+//
+// a key can't be empty or contain ':', a key and a value can't contain a
+// line break or start or end with spaces, a value may contain ':'.
+
+// Body - 获取消息的内容, 不包括消息头
+func (msg Message) Body() []byte {
+	data := msg.Data()
+	if MSG_HDATA != msg.Command() {
+		return data
+	}
+	if bytes.HasPrefix(data, []byte("\n")) {
+		return data[1:]
+	}
+	idx := bytes.Index(data, []byte("\n\n"))
+	if idx < 0 {
+		return nil
+	}
+	return data[idx+2:]
+}
+
+func (msg Message) rawHeaders() []byte {
+	if MSG_HDATA != msg.Command() {
+		return nil
+	}
+	data := msg.Data()
+	if bytes.HasPrefix(data, []byte("\n")) {
+		return nil
+	}
+	idx := bytes.Index(data, []byte("\n\n"))
+	if idx < 0 {
+		return data
+	}
+	return data[:idx+1]
+}
+
+// Header - 获取消息头的值
+func (msg Message) Header(key string) string {
+	value, _ := msg.LookupHeader(key)
+	return value
+}
+
+// LookupHeader - 获取消息头的值, 消息头不存在时 ok 为 false
+func (msg Message) LookupHeader(key string) (value string, ok bool) {
+	raw := msg.rawHeaders()
+	for len(raw) > 0 {
+		var line []byte
+		if idx := bytes.IndexByte(raw, '\n'); idx >= 0 {
+			line, raw = raw[:idx], raw[idx+1:]
+		} else {
+			line, raw = raw, nil
+		}
+
+		if k, v, ok := splitHeader(line); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Offset - 获取日志模式的主题中消息的偏移量
+func (msg Message) Offset() (uint64, bool) {
+	offset, err := strconv.ParseUint(msg.Header("offset"), 10, 64)
+	return offset, err == nil
+}
+
+// Key - 获取分区主题中消息的键
+func (msg Message) Key() string {
+	return msg.Header("key")
+}
+
+// Headers - 获取所有的消息头
+func (msg Message) Headers() map[string]string {
+	raw := msg.rawHeaders()
+	if len(raw) == 0 {
+		return nil
+	}
+
+	headers := map[string]string{}
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if k, v, ok := splitHeader(line); ok {
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+// WithHeaders - 返回一个增加了消息头的新消息, 原消息不变
+func (msg Message) WithHeaders(headers map[string]string) Message {
+	all := msg.Headers()
+	if all == nil {
+		all = map[string]string{}
+	}
+	for k, v := range headers {
+		all[k] = v
+	}
+	return BuildMessageWithHeaders(all, msg.Body())
+}
+
+// WithoutHeaders - 返回一个去掉了消息头的消息
+func (msg Message) WithoutHeaders() Message {
+	if MSG_HDATA != msg.Command() {
+		return msg
+	}
+	body := msg.Body()
+	return NewMessageWriter(MSG_DATA, len(body)).Append(body).Build()
+}
+
+// CheckHeaders - 检查消息头是否可以写入消息
+func CheckHeaders(headers map[string]string) error {
+	for k, v := range headers {
+		if k == "" || strings.ContainsAny(k, ":\r\n") || k != strings.TrimSpace(k) {
+			return errors.New("header key " + strconv.Quote(k) + " is invalid.")
+		}
+		if strings.ContainsAny(v, "\r\n") || v != strings.TrimSpace(v) {
+			return errors.New("header value " + strconv.Quote(v) + " of '" + k + "' is invalid.")
+		}
+	}
+	return nil
+}
+
+// BuildMessageWithHeaders - 创建一个带消息头的消息, 消息头无效时 panic,
+// 来自外部的消息头需要先用 CheckHeaders 检查
+func BuildMessageWithHeaders(headers map[string]string, body []byte) Message {
+	if err := CheckHeaders(headers); err != nil {
+		panic(err)
+	}
+	if len(headers) == 0 {
+		return NewMessageWriter(MSG_DATA, len(body)).Append(body).Build()
+	}
+
+	keys := make([]string, 0, len(headers))
+	size := 1 + len(body)
+	for k, v := range headers {
+		keys = append(keys, k)
+		size += len(k) + len(v) + 3
+	}
+	sort.Strings(keys)
+
+	builder := NewMessageWriter(MSG_HDATA, size)
+	for _, k := range keys {
+		builder.WriteString(k)
+		builder.WriteString(": ")
+		builder.WriteString(headers[k])
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	builder.Write(body)
+	return builder.Build()
+}
+
+// BuildMessageWithKey - 创建一个发往分区主题的消息, 键相同的消息保持顺序
+func BuildMessageWithKey(key string, body []byte) Message {
+	return BuildMessageWithHeaders(map[string]string{"key": key}, body)
+}
+
+func splitHeader(line []byte) (string, string, bool) {
+	idx := bytes.IndexByte(line, ':')
+	if idx <= 0 {
+		return "", "", false
+	}
+	return string(bytes.TrimSpace(line[:idx])), string(bytes.TrimSpace(line[idx+1:])), true
+}
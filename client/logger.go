@@ -0,0 +1,118 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// leveled logging
+// a Logger has the methods of *slog.Logger, args are pairs of key and value.
+// the keys of the fields are 'client' (the id of client), 'remote_addr',
+// 'type' (queue or topic), 'dest' (the name of queue or topic), 'command'
+// and 'error'.
+
+const (
+	LOG_TEXT = "text"
+	LOG_JSON = "json"
+)
+
+// Logger - 分级日志接口, *slog.Logger 实现了它
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// ParseLevel - 解析日志级别, 它是 debug, info, warn 或 error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, errors.New("log level '" + s + "' is unknown.")
+	}
+	return level, nil
+}
+
+// NewLogger - 创建一个 slog 日志, format 是 text 或 json
+func NewLogger(w io.Writer, format string, level slog.Leveler) (Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", LOG_TEXT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, errors.New("log format '" + format + "' is unknown.")
+	}
+}
+
+// NewStdLogger - 将 Logger 转换为 *log.Logger 的输出, 日志的格式是 'LEVEL: msg key=value ...'
+func NewStdLogger(logger *log.Logger, level slog.Level) Logger {
+	return &stdLogger{logger: logger, level: level}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	level  slog.Level
+}
+
+func (self *stdLogger) log(level slog.Level, msg string, args []any) {
+	if level < self.level {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteString(": ")
+	sb.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		sb.WriteString(" ")
+		if i+1 >= len(args) {
+			fmt.Fprint(&sb, "!BADKEY=", args[i])
+			break
+		}
+		fmt.Fprint(&sb, args[i], "=")
+		s := fmt.Sprint(args[i+1])
+		if strings.ContainsAny(s, " \t\r\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		sb.WriteString(s)
+	}
+	self.logger.Println(sb.String())
+}
+
+func (self *stdLogger) Debug(msg string, args ...any) { self.log(slog.LevelDebug, msg, args) }
+func (self *stdLogger) Info(msg string, args ...any)  { self.log(slog.LevelInfo, msg, args) }
+func (self *stdLogger) Warn(msg string, args ...any)  { self.log(slog.LevelWarn, msg, args) }
+func (self *stdLogger) Error(msg string, args ...any) { self.log(slog.LevelError, msg, args) }
+
+// DefaultLogger 是客户端默认的日志, 它输出到 log 包的标准日志
+var DefaultLogger Logger = NewStdLogger(log.Default(), slog.LevelInfo)
+
+// LoggerWith - 返回一个日志, 它的每条日志都包含 args 字段
+func LoggerWith(logger Logger, args ...any) Logger {
+	if len(args) == 0 {
+		return logger
+	}
+	if fl, ok := logger.(*fieldLogger); ok {
+		return &fieldLogger{logger: fl.logger, args: append(append([]any{}, fl.args...), args...)}
+	}
+	return &fieldLogger{logger: logger, args: args}
+}
+
+type fieldLogger struct {
+	logger Logger
+	args   []any
+}
+
+func (self *fieldLogger) fields(args []any) []any {
+	return append(append(make([]any, 0, len(self.args)+len(args)), self.args...), args...)
+}
+
+func (self *fieldLogger) Debug(msg string, args ...any) { self.logger.Debug(msg, self.fields(args)...) }
+func (self *fieldLogger) Info(msg string, args ...any)  { self.logger.Info(msg, self.fields(args)...) }
+func (self *fieldLogger) Warn(msg string, args ...any)  { self.logger.Warn(msg, self.fields(args)...) }
+func (self *fieldLogger) Error(msg string, args ...any) { self.logger.Error(msg, self.fields(args)...) }
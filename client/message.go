@@ -29,6 +29,7 @@ var (
 	MSG_NOOP_BYTES              = []byte{MSG_NOOP, ' ', ' ', ' ', ' ', ' ', '0', '\n'}
 	MSG_ACK_BYTES               = []byte{MSG_ACK, ' ', ' ', ' ', ' ', ' ', '0', '\n'}
 	MSG_CLOSE_BYTES             = []byte{MSG_CLOSE, ' ', ' ', ' ', ' ', ' ', '0', '\n'}
+	MSG_GOAWAY_BYTES            = []byte{MSG_GOAWAY, ' ', ' ', ' ', ' ', ' ', '0', '\n'}
 
 	ErrTimeout           = errors.New("timeout")
 	ErrAlreadyClosed     = errors.New("already closed.")
@@ -40,6 +41,7 @@ var (
 	ErrLengthExceed      = errors.New("message length is exceed.")
 	ErrLengthNotDigit    = errors.New("length field of message isn't number.")
 	ErrQueueFull         = errors.New("queue is full.")
+	ErrGoAway            = errors.New("server is going away.")
 )
 
 const (
@@ -52,6 +54,15 @@ const (
 	MSG_NOOP  = 'n'
 	MSG_CLOSE = 'c'
 	MSG_KILL  = 'k'
+
+	// MSG_GOAWAY - server is shutting down, client should reconnect later.
+	MSG_GOAWAY = 'g'
+	// MSG_HDATA - data with headers.
+	MSG_HDATA = 'h'
+	// MSG_PEEK - view the first messages of a queue without consuming them.
+	MSG_PEEK = 'v'
+	// MSG_COMMIT - commit the offset of a consumer of a log topic.
+	MSG_COMMIT = 'o'
 )
 
 func ToCommandName(cmd byte) string {
@@ -74,6 +85,14 @@ func ToCommandName(cmd byte) string {
 		return "MSG_CLOSE"
 	case MSG_KILL:
 		return "MSG_KILL"
+	case MSG_GOAWAY:
+		return "MSG_GOAWAY"
+	case MSG_HDATA:
+		return "MSG_HDATA"
+	case MSG_PEEK:
+		return "MSG_PEEK"
+	case MSG_COMMIT:
+		return "MSG_COMMIT"
 	default:
 		return "UNKNOWN-" + string(cmd)
 	}
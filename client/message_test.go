@@ -117,3 +117,122 @@ func TestMessageReadMuti(t *testing.T) {
 		//assertEq(t, &rd, s.input, s.excepted)
 	}
 }
+
+func TestMessageHeaders(t *testing.T) {
+	msg := NewMessageWriter(MSG_DATA, 10).Append([]byte("body")).Build()
+	if "body" != string(msg.Body()) {
+		t.Error("body is", string(msg.Body()))
+	}
+	if nil != msg.Headers() {
+		t.Error("headers is", msg.Headers())
+	}
+
+	msg = msg.WithHeaders(map[string]string{"b": "2", "a": "1"})
+	if MSG_HDATA != msg.Command() {
+		t.Error("command is", ToCommandName(msg.Command()))
+	}
+	if "a: 1\nb: 2\n\nbody" != string(msg.Data()) {
+		t.Error("data is", string(msg.Data()))
+	}
+	if "body" != string(msg.Body()) {
+		t.Error("body is", string(msg.Body()))
+	}
+	if "1" != msg.Header("a") || "2" != msg.Header("b") || "" != msg.Header("c") {
+		t.Error("headers is", msg.Headers())
+	}
+
+	msg = msg.WithHeaders(map[string]string{"a": "3"})
+	if "3" != msg.Header("a") || "2" != msg.Header("b") {
+		t.Error("headers is", msg.Headers())
+	}
+
+	msg = msg.WithoutHeaders()
+	if MSG_DATA != msg.Command() || "body" != string(msg.Data()) {
+		t.Error("message is", string(msg.ToBytes()))
+	}
+
+	msg = BuildMessageWithHeaders(map[string]string{"a": "1"}, []byte("\n\nbody"))
+	if "\n\nbody" != string(msg.Body()) {
+		t.Error("body is", string(msg.Body()))
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+	if err := CheckHeaders(map[string]string{"a": "1", "time": "10:00", "empty": ""}); err != nil {
+		t.Error(err)
+	}
+	for _, headers := range []map[string]string{
+		{"": "1"},
+		{"a:b": "1"},
+		{"a\nb": "1"},
+		{" a": "1"},
+		{"a": "1\nb: 2"},
+		{"a": "1\r"},
+		{"a": " 1"},
+	} {
+		if err := CheckHeaders(headers); err == nil {
+			t.Error("excepted error, actual is ok -", headers)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("excepted panic")
+			}
+		}()
+		BuildMessageWithHeaders(map[string]string{"a": "1\n\nbody"}, []byte("x"))
+	}()
+}
+
+func TestParseEvent(t *testing.T) {
+	event, err := ParseEvent([]byte("new queue q1\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if event.Type != "new" || event.Kind != QUEUE || event.Name != "q1" || event.Attributes != nil {
+		t.Error(event)
+	}
+
+	event, err = ParseEvent([]byte("connect client name=a+b remoteAddr=127.0.0.1%3A80\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if event.Type != "connect" || event.Name != "" ||
+		event.Attribute("name") != "a b" || event.Attribute("remoteAddr") != "127.0.0.1:80" {
+		t.Error(event)
+	}
+	if text := string(event.Text("name", "remoteAddr")); text != "connect client name=a+b remoteAddr=127.0.0.1%3A80\n" {
+		t.Error(text)
+	}
+
+	// the name is escaped like the attributes.
+	named := &Event{Type: "new", Kind: QUEUE, Name: "a=b c/d%"}
+	if text := string(named.Text()); text != "new queue a%3Db+c%2Fd%25\n" {
+		t.Error(text)
+	}
+	if parsed, err := ParseEvent(named.Text()); err != nil {
+		t.Error(err)
+	} else if parsed.Name != named.Name || parsed.Attributes != nil {
+		t.Error(parsed)
+	}
+
+	event.ServerID = 3
+	parsed, err := ParseEvent(event.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if parsed.Version != EVENT_VERSION || parsed.Type != "connect" || parsed.Kind != "client" ||
+		parsed.ServerID != 3 || parsed.Attribute("name") != "a b" {
+		t.Error(parsed)
+	}
+
+	for _, s := range []string{"", "new", "new queue q1 a", "{}", `{"version":2,"type":"new","kind":"queue"}`} {
+		if _, err := ParseEvent([]byte(s)); err == nil {
+			t.Error("'" + s + "' is parsed")
+		}
+	}
+}
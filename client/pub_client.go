@@ -1,7 +1,6 @@
 package client
 
 import (
-	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -86,6 +85,7 @@ type PubClient struct {
 	connect_total uint32
 	connect_ok    uint32
 	C             chan Message
+	logger        Logger
 }
 
 func (self *PubClient) Close() error {
@@ -130,7 +130,7 @@ func (self *PubClient) runLoop(builder *ClientBuilder, create func(builder *Clie
 		cli, err := create(builder)
 		if err != nil {
 			if (err_count % 100) < 5 {
-				log.Println("["+builder.id+"] connect failed,", err)
+				self.logger.Warn("connect failed", "error", err)
 			}
 			err_count++
 		} else {
@@ -138,7 +138,7 @@ func (self *PubClient) runLoop(builder *ClientBuilder, create func(builder *Clie
 			atomic.AddUint32(&self.connect_ok, 1)
 			err = self.runOnce(builder, cli)
 			if err != nil {
-				log.Println("["+builder.id+"] run failed,", err)
+				self.logger.Warn("run failed", "error", err)
 			}
 		}
 	}
@@ -203,7 +203,11 @@ func (self *PubClient) runWrite(conn net.Conn, signal chan *SignelData) (err err
 				err = ToError(msg)
 				goto exited
 			}
-			log.Println("recv a unexcepted message -", ToCommandName(msg.Command()))
+			if msg.Command() == MSG_GOAWAY {
+				err = ErrGoAway
+				goto exited
+			}
+			self.logger.Warn("recv a unexcepted message", "command", ToCommandName(msg.Command()))
 		}
 	}
 
@@ -20,8 +20,19 @@ func IsConnected(e error) bool {
 }
 
 type Subscription struct {
-	closed bool
-	conn   net.Conn
+	closed  bool
+	conn    net.Conn
+	bufSize int
+}
+
+// Run - 接收消息, 直到连接断开或调用了 Stop 或 Close
+func (self *Subscription) Run(cb func(cli *Subscription, msg Message)) error {
+	return self.subscribe(self.bufSize, cb)
+}
+
+// Close - 断开连接
+func (self *Subscription) Close() error {
+	return self.conn.Close()
 }
 
 func (self *Subscription) Stop() error {
@@ -64,6 +75,12 @@ func (self *Subscription) subscribe(bufSize int, cb func(cli *Subscription, msg
 				return &ErrDisconnect{ErrUnexceptedAck}
 			}
 
+			if recvMessage.Command() == MSG_GOAWAY {
+				// server keeps delivering until the queue is drained, and then
+				// closes the connection.
+				continue
+			}
+
 			cb(self, recvMessage)
 		}
 	}
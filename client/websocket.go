@@ -0,0 +1,305 @@
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WS_CONTINUATION = 0x0
+	WS_TEXT         = 0x1
+	WS_BINARY       = 0x2
+	WS_CLOSE        = 0x8
+	WS_PING         = 0x9
+	WS_PONG         = 0xA
+
+	// WS_CLOSE_PROTOCOL_ERROR is the status of the close frame that is sent
+	// if a frame breaks the protocol.
+	WS_CLOSE_PROTOCOL_ERROR = 1002
+
+	websocketGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketMaxPayload = 64 * 1024 * 1024
+)
+
+var (
+	ErrWebSocketPayloadTooLarge = errors.New("websocket payload is too large.")
+	ErrWebSocketUnmasked        = errors.New("websocket frame from client isn't masked.")
+	ErrWebSocketMasked          = errors.New("websocket frame from server is masked.")
+)
+
+// WebSocketAccept - 计算 Sec-WebSocket-Accept 的值
+func WebSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key)
+	io.WriteString(h, websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WebSocketConn - websocket 连接, Read 读取二进制消息的内容, 每次 Write 发送一个二进制消息
+type WebSocketConn struct {
+	net.Conn
+	br       *bufio.Reader
+	isClient bool
+	rbuf     []byte
+
+	wlock     sync.Mutex
+	closeOnce sync.Once
+}
+
+// NewWebSocketConn - 在握手完成的连接上创建 websocket 连接, br 可以为 nil
+func NewWebSocketConn(conn net.Conn, br *bufio.Reader, isClient bool) *WebSocketConn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &WebSocketConn{Conn: conn, br: br, isClient: isClient}
+}
+
+func (self *WebSocketConn) Read(b []byte) (int, error) {
+	for len(self.rbuf) == 0 {
+		_, payload, err := self.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		self.rbuf = payload
+	}
+
+	n := copy(b, self.rbuf)
+	self.rbuf = self.rbuf[n:]
+	return n, nil
+}
+
+func (self *WebSocketConn) Write(b []byte) (int, error) {
+	if err := self.WriteMessage(WS_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (self *WebSocketConn) Close() error {
+	self.closeOnce.Do(func() {
+		self.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		self.WriteMessage(WS_CLOSE, nil)
+	})
+	return self.Conn.Close()
+}
+
+// closeWith - 发送带状态码的 close 帧并关闭连接
+func (self *WebSocketConn) closeWith(code uint16) {
+	self.closeOnce.Do(func() {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], code)
+		self.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		self.WriteMessage(WS_CLOSE, payload[:])
+	})
+	self.Conn.Close()
+}
+
+// WriteMessage - 发送一个消息
+func (self *WebSocketConn) WriteMessage(op byte, payload []byte) error {
+	var head [14]byte
+	head[0] = 0x80 | op
+	n := 2
+	switch length := len(payload); {
+	case length < 126:
+		head[1] = byte(length)
+	case length <= 0xFFFF:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+		n = 4
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+		n = 10
+	}
+
+	// frames from client must be masked.
+	if self.isClient {
+		head[1] |= 0x80
+		if _, err := io.ReadFull(rand.Reader, head[n:n+4]); err != nil {
+			return err
+		}
+		mask := head[n : n+4]
+		n += 4
+
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err := SendFull(self.Conn, head[:n]); err != nil {
+		return err
+	}
+	return SendFull(self.Conn, payload)
+}
+
+// ReadMessage - 读取一个完整的消息, ping 和 close 等控制帧在这里处理
+func (self *WebSocketConn) ReadMessage() (byte, []byte, error) {
+	var op byte
+	var message []byte
+	for {
+		fin, frameOp, payload, err := self.readFrame()
+		if err != nil {
+			if err == ErrWebSocketUnmasked || err == ErrWebSocketMasked {
+				self.closeWith(WS_CLOSE_PROTOCOL_ERROR)
+			}
+			return 0, nil, err
+		}
+
+		switch frameOp {
+		case WS_PING:
+			if err := self.WriteMessage(WS_PONG, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WS_PONG:
+			continue
+		case WS_CLOSE:
+			self.closeOnce.Do(func() {
+				self.WriteMessage(WS_CLOSE, payload)
+			})
+			return 0, nil, io.EOF
+		case WS_CONTINUATION:
+		default:
+			op = frameOp
+		}
+
+		if len(message)+len(payload) > websocketMaxPayload {
+			return 0, nil, ErrWebSocketPayloadTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+func (self *WebSocketConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(self.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	// frames from client must be masked, and frames from server mustn't.
+	if !masked && !self.isClient {
+		err = ErrWebSocketUnmasked
+		return
+	}
+	if masked && self.isClient {
+		err = ErrWebSocketMasked
+		return
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(self.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(self.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > websocketMaxPayload {
+		err = ErrWebSocketPayloadTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(self.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(self.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// DialWebSocket - 连接 websocket 地址, 如 ws://127.0.0.1:4150/mq/ws?mode=json
+func DialWebSocket(rawurl string) (*WebSocketConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, errors.New("scheme '" + u.Scheme + "' is unsupported.")
+	}
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := "GET " + u.RequestURI() + " HTTP/1.1\r\nHost: " + u.Host +
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + key +
+		"\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if err := SendFull(conn, []byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	conn.SetReadDeadline(time.Time{})
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.New("websocket handshake failed, " + res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != WebSocketAccept(key) {
+		conn.Close()
+		return nil, errors.New("websocket handshake failed, accept key is mismatch.")
+	}
+	return NewWebSocketConn(conn, br, true), nil
+}
+
+// dialWebSocket - 以二进制模式连接, address 为 host:port 或 host:port/path
+func dialWebSocket(address string) (net.Conn, error) {
+	path := "/mq/ws"
+	if idx := strings.IndexByte(address, '/'); idx >= 0 {
+		address, path = address[:idx], address[idx:]
+	}
+	return DialWebSocket("ws://" + address + path + "?mode=binary")
+}
@@ -5,7 +5,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	mq_client "github.com/runner-mei/fastmq/client"
@@ -19,22 +25,80 @@ func main() {
 }
 
 type runCmd struct {
+	configFile string
+	flags      *server.ConfigFlags
 }
 
 func (self *runCmd) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	fs.StringVar(&self.configFile, "config", "", "the config file (json, yaml or toml), default is $"+server.ConfigEnvPrefix+"CONFIG.")
+	self.flags = server.NewConfigFlags(fs)
 	return fs
 }
 
 func (self *runCmd) Run(args []string) error {
-	opt := &server.Options{HttpEnabled: true}
+	cfg, err := server.ReadConfig(self.configFile, os.Environ(), self.flags)
+	if err != nil {
+		return err
+	}
+	opt, err := cfg.Options()
+	if err != nil {
+		return err
+	}
+	opt.ReloadConfig = func() (*server.Config, error) {
+		return server.ReadConfig(self.configFile, os.Environ(), self.flags)
+	}
 
 	srv, err := server.NewServer(opt)
 	if err != nil {
 		return err
 	}
 	defer srv.Close()
+	if err := cfg.Declare(srv); err != nil {
+		return err
+	}
 
-	srv.Wait()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(stopped)
+	}()
+
+	for {
+		select {
+		case sig := <-c:
+			if sig != syscall.SIGHUP {
+				return srv.Shutdown(time.Duration(srv.Config().ShutdownTimeout))
+			}
+			// the result is logged by the server.
+			srv.Reload()
+		case <-stopped:
+			return nil
+		}
+	}
+}
+
+type configCmd struct{}
+
+func (self *configCmd) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	return fs
+}
+
+func (self *configCmd) Run(args []string) error {
+	if len(args) != 2 || args[0] != "check" {
+		return errors.New("arguments error!\r\nUsage: fastmq config check filename")
+	}
+	cfg, err := server.LoadConfig(args[1])
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	fmt.Println("config '" + args[1] + "' is ok.")
 	return nil
 }
 
@@ -112,13 +176,41 @@ func (self *sendCmd) Run(args []string) error {
 	return nil
 }
 
+type snapshotCmd struct {
+	url string
+}
+
+func (self *snapshotCmd) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	fs.StringVar(&self.url, "url", "http://127.0.0.1:4150", "the http address of target mq server.")
+	return fs
+}
+
+func (self *snapshotCmd) Run(args []string) error {
+	res, err := http.Post(strings.TrimSuffix(self.url, "/")+"/mq/snapshot", "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	bs, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status + ": " + string(bs))
+	}
+	fmt.Println(string(bytes.TrimSpace(bs)))
+	return nil
+}
+
 type subscribeCmd struct {
-	address string
-	typ     string
-	id      string
-	forward string
-	console bool
-	stat    bool
+	address        string
+	typ            string
+	id             string
+	forward        string
+	forwardAddress string
+	console        bool
+	stat           bool
 	//repeat  uint
 }
 
@@ -126,7 +218,8 @@ func (self *subscribeCmd) Flags(fs *flag.FlagSet) *flag.FlagSet {
 	fs.StringVar(&self.address, "address", "127.0.0.1:4150", "the address of target mq server.")
 	fs.StringVar(&self.typ, "type", "queue", "send to topic or queue.")
 	fs.StringVar(&self.id, "id", "", "the name of client.")
-	fs.StringVar(&self.forward, "forward", "", "resend to address.")
+	fs.StringVar(&self.forward, "forward", "", "resend to the queue or topic with this name.")
+	fs.StringVar(&self.forwardAddress, "forward_address", "", "the address of mq server that messages are resent to, default is address.")
 	fs.BoolVar(&self.console, "console", true, "print message to console.")
 	fs.BoolVar(&self.stat, "stat", false, "stat message rate.")
 	//fs.UintVar(&self.repeat, "repeat", 1, "send message count.")
@@ -146,7 +239,11 @@ func (self *subscribeCmd) Run(args []string) error {
 	var forward *mq_client.SimplePubClient
 
 	if self.forward != "" {
-		forwardBuilder := mq_client.Connect("", self.address)
+		forwardAddress := self.forwardAddress
+		if forwardAddress == "" {
+			forwardAddress = self.address
+		}
+		forwardBuilder := mq_client.Connect("", forwardAddress)
 
 		if self.id != "" {
 			forwardBuilder.Id(self.id + ".forward")
@@ -213,4 +310,6 @@ func init() {
 	command.On("run", "run as mq server", &runCmd{}, nil)
 	command.On("send", "send messages to mq server", &sendCmd{}, nil)
 	command.On("subscribe", "subscribe messages from mq server", &subscribeCmd{}, nil)
+	command.On("snapshot", "write queued messages and topic logs of mq server to the snapshot file", &snapshotCmd{}, nil)
+	command.On("config", "check the config file of mq server", &configCmd{}, nil)
 }
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var (
+	ErrQueueNotFound   = errors.New("queue isn't found.")
+	ErrTopicNotFound   = errors.New("topic isn't found.")
+	ErrClientNotFound  = errors.New("client isn't found.")
+	ErrQueueReplicated = errors.New("queue is replicated.")
+)
+
+// rateMeter computes the rates of counters between two samples, a sample is
+// taken by a stats request at most once a second.
+type rateMeter struct {
+	lock      sync.Mutex
+	sample_at time.Time
+	in, out   uint64
+	in_rate   float64
+	out_rate  float64
+}
+
+func rate(current, last uint64, elapsed float64) float64 {
+	if current < last {
+		return 0
+	}
+	return float64(current-last) / elapsed
+}
+
+func (self *rateMeter) update(in, out uint64) (float64, float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	if self.sample_at.IsZero() {
+		self.sample_at, self.in, self.out = now, in, out
+		return 0, 0
+	}
+	if elapsed := now.Sub(self.sample_at).Seconds(); elapsed >= 1 {
+		self.in_rate = rate(in, self.in, elapsed)
+		self.out_rate = rate(out, self.out, elapsed)
+		self.sample_at, self.in, self.out = now, in, out
+	}
+	return self.in_rate, self.out_rate
+}
+
+func (self *Server) DeleteQueue(name string) error {
+	if self.cluster.isReplicated(name) {
+		return ErrQueueReplicated
+	}
+	queue := self.GetQueueIfExists(name)
+	if queue == nil {
+		return ErrQueueNotFound
+	}
+	if queue.Durable() {
+		queue.drain()
+	}
+	self.removeQueue(name)
+	return nil
+}
+
+// PurgeQueue drops all messages in the queue, it returns the count of them.
+func (self *Server) PurgeQueue(name string) (int, error) {
+	if self.cluster.isReplicated(name) {
+		return 0, ErrQueueReplicated
+	}
+	queue := self.GetQueueIfExists(name)
+	if queue == nil {
+		return 0, ErrQueueNotFound
+	}
+	return len(queue.drain()), nil
+}
+
+// countSubscribers returns how many clients subscribe to the queue or topic.
+func (self *Server) countSubscribers(typ, name string) (consumers, producers int) {
+	self.clients_lock.Lock()
+	defer self.clients_lock.Unlock()
+	for el := self.clients.Front(); el != nil; el = el.Next() {
+		cli, ok := el.Value.(*Client)
+		if !ok {
+			continue
+		}
+		cli.mu.Lock()
+		if cli.target_type == typ && cli.target == name {
+			if cli.role == "sub" {
+				consumers++
+			} else if cli.role == "pub" {
+				producers++
+			}
+		}
+		cli.mu.Unlock()
+	}
+	return
+}
+
+func (self *Server) GetQueueStats(name string) (map[string]interface{}, error) {
+	queue := self.GetQueueIfExists(name)
+	if queue == nil {
+		return nil, ErrQueueNotFound
+	}
+
+	depth := queue.Len()
+	enqueue := atomic.LoadUint64(&queue.enqueue_total)
+	var dequeue uint64
+	if enqueue > uint64(depth) {
+		dequeue = enqueue - uint64(depth)
+	}
+	enqueueRate, dequeueRate := queue.rates.update(enqueue, dequeue)
+	consumers, producers := self.countSubscribers(mq_client.QUEUE, name)
+
+	return map[string]interface{}{
+		"name":          name,
+		"depth":         depth,
+		"capacity":      queue.capacity,
+		"consumers":     consumers,
+		"producers":     producers,
+		"replicated":    queue.cluster != nil,
+		"enqueue_total": enqueue,
+		"dequeue_total": dequeue,
+		"enqueue_rate":  enqueueRate,
+		"dequeue_rate":  dequeueRate,
+	}, nil
+}
+
+const defaultPeekCount = 10
+
+// PeekMessage is a message that is returned by peek, Position is the index
+// of it in the queue.
+type PeekMessage struct {
+	Position int               `json:"position"`
+	Size     int               `json:"size"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     []byte            `json:"body"`
+}
+
+// PeekQueue returns the first count messages of the queue without removing
+// them, count is 10 if it is 0.
+func (self *Server) PeekQueue(name string, count int) ([]mq_client.Message, error) {
+	if err := self.CheckLeader(mq_client.QUEUE, name); err != nil {
+		return nil, err
+	}
+	queue := self.GetQueueIfExists(name)
+	if queue == nil {
+		return nil, ErrQueueNotFound
+	}
+	if count <= 0 {
+		count = defaultPeekCount
+	}
+	return queue.Peek(count), nil
+}
+
+func (self *Server) DeleteTopic(name string) error {
+	if self.GetTopicIfExists(name) == nil {
+		return ErrTopicNotFound
+	}
+	self.KillTopicIfExists(name)
+	return nil
+}
+
+func (self *Server) GetTopicStats(name string) (map[string]interface{}, error) {
+	topic := self.GetTopicIfExists(name)
+	if topic == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	topic.channels_lock.RLock()
+	subscribers := len(topic.channels)
+	topic.channels_lock.RUnlock()
+
+	publish := atomic.LoadUint64(&topic.publish_total)
+	publishRate, _ := topic.rates.update(publish, 0)
+	_, producers := self.countSubscribers(mq_client.TOPIC, name)
+
+	return map[string]interface{}{
+		"name":           name,
+		"capacity":       topic.capacity,
+		"subscribers":    subscribers,
+		"producers":      producers,
+		"publish_total":  publish,
+		"publish_rate":   publishRate,
+		"filter_total":   atomic.LoadUint64(&topic.filter_total),
+		"filtered_total": atomic.LoadUint64(&topic.filtered_total),
+		"filter_time_ns": atomic.LoadUint64(&topic.filter_nanos),
+	}, nil
+}
+
+// GetTopicSubscribers lists the consumers of topic, a consumer is owned by
+// a client, a http session or a http request.
+func (self *Server) GetTopicSubscribers(name string) ([]map[string]interface{}, error) {
+	topic := self.GetTopicIfExists(name)
+	if topic == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	owners := map[*Consumer]map[string]interface{}{}
+	func() {
+		self.clients_lock.Lock()
+		defer self.clients_lock.Unlock()
+		for el := self.clients.Front(); el != nil; el = el.Next() {
+			if cli, ok := el.Value.(*Client); ok {
+				cli.mu.Lock()
+				if cli.consumer != nil {
+					owners[cli.consumer] = map[string]interface{}{
+						"owner":       "client",
+						"client":      cli.name,
+						"remote_addr": cli.remoteAddr,
+					}
+				}
+				cli.mu.Unlock()
+			}
+		}
+	}()
+	func() {
+		self.sessions.lock.Lock()
+		defer self.sessions.lock.Unlock()
+		for _, session := range self.sessions.all {
+			owners[session.consumer] = map[string]interface{}{
+				"owner":   "session",
+				"session": session.id,
+			}
+		}
+	}()
+
+	topic.channels_lock.RLock()
+	defer topic.channels_lock.RUnlock()
+	results := make([]map[string]interface{}, 0, len(topic.channels))
+	for _, consumer := range topic.channels {
+		result := owners[consumer]
+		if result == nil {
+			result = map[string]interface{}{"owner": "http"}
+		}
+		result["id"] = consumer.id
+		result["pending"] = consumer.Pending()
+		result["message_count"] = atomic.LoadUint32(&consumer.Count)
+		result["discard_count"] = atomic.LoadUint32(&consumer.DiscardCount)
+		if consumer.filter != nil {
+			result["filter"] = consumer.filter.String()
+			result["filter_count"] = atomic.LoadUint32(&consumer.FilterCount)
+			result["filtered_count"] = atomic.LoadUint32(&consumer.FilteredCount)
+			result["filter_time_ns"] = atomic.LoadUint64(&consumer.filter_nanos)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// DisconnectClient closes the clients with the name, it returns the count
+// of them.
+func (self *Server) DisconnectClient(name string) (int, error) {
+	var clients []*Client
+	func() {
+		self.clients_lock.Lock()
+		defer self.clients_lock.Unlock()
+		for el := self.clients.Front(); el != nil; el = el.Next() {
+			if cli, ok := el.Value.(*Client); ok && cli.id() == name {
+				clients = append(clients, cli)
+			}
+		}
+	}()
+	if len(clients) == 0 {
+		return 0, ErrClientNotFound
+	}
+	for _, cli := range clients {
+		cli.Close()
+	}
+	self.watcher.onKill("client", name)
+	return len(clients), nil
+}
+
+// ErrorStatus returns the http status code of an error.
+func ErrorStatus(err error) int {
+	switch err {
+	case ErrQueueNotFound, ErrTopicNotFound, ErrClientNotFound,
+		ErrSessionNotFound, ErrShovelNotFound, ErrRouteNotFound:
+		return http.StatusNotFound
+	case ErrQueueReplicated, ErrShovelExists:
+		return http.StatusConflict
+	case ErrTopicNotLogged, ErrInvalidOffset, ErrNoConsumer, ErrTopicNotPartitioned,
+		ErrShovelLoop:
+		return http.StatusBadRequest
+	case ErrShuttingDown, ErrAlreadyClosed, ErrNotLeader:
+		return http.StatusServiceUnavailable
+	}
+	if _, ok := mq_client.IsNotLeader(err); ok {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorResult is the structured json error of the admin api.
+func ErrorResult(code int, err error) map[string]interface{} {
+	return map[string]interface{}{"code": code, "error": err.Error()}
+}
+
+// DoAdmin executes an admin request, typ is 'queue', 'topic' or 'client',
+// action is empty or the sub-resource that is split by SplitRoutePath. it returns the status code
+// and the json result.
+func (self *Server) DoAdmin(method, typ, name, action string) (int, interface{}) {
+	var result interface{}
+	var err error
+	switch {
+	case typ == "queue" && action == "" && method == "DELETE":
+		err = self.DeleteQueue(name)
+		result = map[string]interface{}{"deleted": name}
+	case typ == "queue" && action == "purge" && (method == "POST" || method == "PUT"):
+		var count int
+		count, err = self.PurgeQueue(name)
+		result = map[string]interface{}{"purged": count}
+	case typ == "queue" && action == "stats" && method == "GET":
+		result, err = self.GetQueueStats(name)
+	case typ == "topic" && action == "" && method == "DELETE":
+		err = self.DeleteTopic(name)
+		result = map[string]interface{}{"deleted": name}
+	case typ == "topic" && action == "stats" && method == "GET":
+		result, err = self.GetTopicStats(name)
+	case typ == "topic" && action == "subscribers" && method == "GET":
+		result, err = self.GetTopicSubscribers(name)
+	case typ == "topic" && action == "partitions" && method == "GET":
+		result, err = self.GetTopicPartitions(name)
+	case typ == "client" && action == "" && method == "DELETE":
+		var count int
+		count, err = self.DisconnectClient(name)
+		result = map[string]interface{}{"disconnected": count}
+	default:
+		return http.StatusMethodNotAllowed, ErrorResult(http.StatusMethodNotAllowed,
+			errors.New("method '"+method+"' isn't allowed."))
+	}
+	if err != nil {
+		code := ErrorStatus(err)
+		return code, ErrorResult(code, err)
+	}
+	return http.StatusOK, result
+}
+
+// destination routes
+// the path of a queue or a topic is '{name}' or '{name}/{action}', e.g.
+// 'q/peek', 't/events' or 't/sessions/{id}'. the path is escaped, a name
+// that contains '/' is sent as '%2F', e.g. 'a%2Fevents/stats' is the stats
+// of the topic 'a/events'.
+
+var ErrRouteNotFound = errors.New("resource isn't found.")
+
+var routeActions = map[string][]string{
+	"queue": {"peek", "purge", "stats"},
+	"topic": {"events", "offsets", "partitions", "sessions", "stats", "subscribers"},
+}
+
+func isRouteAction(typ, segment string) bool {
+	for _, action := range routeActions[typ] {
+		if segment == action {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitRoutePath splits the escaped path 'name/action' of typ, arg is the id
+// in 'name/sessions/{id}'. it returns ErrRouteNotFound if action isn't a
+// sub-resource of typ.
+func SplitRoutePath(typ, path string) (name, action, arg string, err error) {
+	segments := strings.SplitN(path, "/", 3)
+	if name, err = url.PathUnescape(segments[0]); err != nil || name == "" {
+		return "", "", "", ErrRouteNotFound
+	}
+	if len(segments) == 1 {
+		return name, "", "", nil
+	}
+	if action = segments[1]; !isRouteAction(typ, action) {
+		return "", "", "", ErrRouteNotFound
+	}
+	if len(segments) == 3 {
+		if action != "sessions" || strings.Contains(segments[2], "/") {
+			return "", "", "", ErrRouteNotFound
+		}
+		if arg, err = url.PathUnescape(segments[2]); err != nil {
+			return "", "", "", ErrRouteNotFound
+		}
+	}
+	return name, action, arg, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var ErrTooManyConnections = errors.New("too many connections.")
+var ErrTooManyConnectionsPerIP = errors.New("too many connections from this address.")
+
+type admission struct {
+	lock   sync.Mutex
+	count  int
+	per_ip map[string]int
+
+	// the limits are changed by Reload, max_connections and max_per_ip are
+	// guarded by lock, handshake_timeout is accessed atomically.
+	max_connections   int
+	max_per_ip        int
+	handshake_timeout int64
+
+	accepted_total          uint32
+	rejected_total          uint32
+	handshake_timeout_total uint32
+
+	// rejecting is the count of rejected connections that are being replied.
+	rejecting int32
+}
+
+// maxRejecting is the maximum count of rejected connections that are replied
+// at the same time, the others are closed at once, so a flood of connections
+// doesn't cost unbounded goroutines and file descriptors.
+const maxRejecting = 64
+
+// remoteHost returns the ip of addr, it is empty if addr isn't an ip
+// address, such as the peer of an unix socket.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// admit reserves a slot for the connection, the slot is released when the
+// returned connection is closed. the connections that don't come from an ip
+// address aren't limited by max_per_ip.
+func (self *Server) admit(conn net.Conn) (net.Conn, error) {
+	host := remoteHost(conn.RemoteAddr())
+
+	self.admission.lock.Lock()
+	if self.admission.max_connections > 0 &&
+		self.admission.count >= self.admission.max_connections {
+		self.admission.lock.Unlock()
+		return nil, ErrTooManyConnections
+	}
+	if host != "" && self.admission.max_per_ip > 0 &&
+		self.admission.per_ip[host] >= self.admission.max_per_ip {
+		self.admission.lock.Unlock()
+		return nil, ErrTooManyConnectionsPerIP
+	}
+	self.admission.count++
+	if host != "" {
+		self.admission.per_ip[host]++
+	}
+	self.admission.lock.Unlock()
+
+	atomic.AddUint32(&self.admission.accepted_total, 1)
+	return &admittedConn{Conn: conn, release: func() {
+		self.admission.lock.Lock()
+		self.admission.count--
+		if host != "" {
+			if n := self.admission.per_ip[host] - 1; n > 0 {
+				self.admission.per_ip[host] = n
+			} else {
+				delete(self.admission.per_ip, host)
+			}
+		}
+		self.admission.lock.Unlock()
+	}}, nil
+}
+
+// setLimits changes the connection limits, the connections that exceed
+// the new limits aren't closed.
+func (self *Server) setLimits(max_connections, max_per_ip int, handshake_timeout time.Duration) {
+	self.admission.lock.Lock()
+	self.admission.max_connections = max_connections
+	self.admission.max_per_ip = max_per_ip
+	self.admission.lock.Unlock()
+	atomic.StoreInt64(&self.admission.handshake_timeout, int64(handshake_timeout))
+}
+
+// handshakeTimeout returns the handshake timeout of the listener, it is the
+// timeout of server if the listener doesn't override it.
+func (self *Server) handshakeTimeout(listener *serverListener) time.Duration {
+	if listener != nil && listener.options.HandshakeTimeout > 0 {
+		return listener.options.HandshakeTimeout
+	}
+	return time.Duration(atomic.LoadInt64(&self.admission.handshake_timeout))
+}
+
+// reject tells the peer why it is refused, using an error frame for the
+// native protocol and a 503 response for http, then closes the connection.
+// the connection is closed without a reply if maxRejecting connections are
+// being replied.
+func (self *Server) reject(conn net.Conn, reason error) {
+	atomic.AddUint32(&self.admission.rejected_total, 1)
+	self.logger(LogTCP).info("client is rejected", "remote_addr", conn.RemoteAddr().String(), "error", reason)
+
+	if atomic.AddInt32(&self.admission.rejecting, 1) > maxRejecting {
+		atomic.AddInt32(&self.admission.rejecting, -1)
+		conn.Close()
+		return
+	}
+
+	self.RunItInGoroutine(func() {
+		defer atomic.AddInt32(&self.admission.rejecting, -1)
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(self.handshakeTimeout(nil)))
+		buf := make([]byte, len(mq_client.HEAD_MAGIC))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		if bytes.Equal(buf, mq_client.HEAD_MAGIC) {
+			if err := mq_client.SendFull(conn, mq_client.HEAD_MAGIC); err != nil {
+				return
+			}
+			if err := mq_client.SendFull(conn, mq_client.BuildErrorMessage(reason.Error()).ToBytes()); err != nil {
+				return
+			}
+		} else {
+			body := reason.Error()
+			if err := mq_client.SendFull(conn, []byte("HTTP/1.1 503 Service Unavailable\r\n"+
+				"Content-Type: text/plain\r\n"+
+				"Connection: close\r\n"+
+				"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)); err != nil {
+				return
+			}
+		}
+
+		// wait a moment for the peer to read the reply before the connection is reset.
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		io.Copy(ioutil.Discard, conn)
+	})
+}
+
+func (self *Server) Stats() map[string]interface{} {
+	self.admission.lock.Lock()
+	count := self.admission.count
+	self.admission.lock.Unlock()
+
+	return map[string]interface{}{
+		"connections":                count,
+		"connections_total":          atomic.LoadUint32(&self.admission.accepted_total),
+		"connections_rejected_total": atomic.LoadUint32(&self.admission.rejected_total),
+		"handshake_timeout_total":    atomic.LoadUint32(&self.admission.handshake_timeout_total),
+	}
+}
+
+type admittedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (self *admittedConn) Close() error {
+	err := self.Conn.Close()
+	self.once.Do(self.release)
+	return err
+}
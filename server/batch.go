@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// batch publish
+// a http PUT/POST request sends many messages if the 'batch' query parameter
+// is one of the following formats, or the Content-Type is 'application/x-ndjson':
+//
+//	json (or true) - a json array, a string element is sent as it is, other
+//	                 elements are sent as json.
+//	lines          - newline-delimited records, empty lines are skipped.
+//	binary         - records that are prefixed by a 4 bytes big-endian length.
+//
+// the items are sent in order until one of them fails, the rest aren't sent.
+
+const (
+	BATCH_JSON   = "json"
+	BATCH_LINES  = "lines"
+	BATCH_BINARY = "binary"
+)
+
+var ErrBatchItemSkipped = errors.New("skipped after a previous failure.")
+
+type BatchItemResult struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+	Total    int               `json:"total"`
+	Accepted int               `json:"accepted"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// BatchFormat returns the batch format of a publish request, it is empty if
+// the request sends a single message.
+func BatchFormat(query, contentType string) string {
+	switch strings.ToLower(query) {
+	case "true", BATCH_JSON:
+		return BATCH_JSON
+	case BATCH_LINES, "ndjson":
+		return BATCH_LINES
+	case BATCH_BINARY:
+		return BATCH_BINARY
+	}
+	if strings.HasPrefix(contentType, "application/x-ndjson") {
+		return BATCH_LINES
+	}
+	return ""
+}
+
+// ParseBatch splits the body of a batch request into messages.
+func ParseBatch(format string, body []byte) ([][]byte, error) {
+	var items [][]byte
+	switch format {
+	case BATCH_JSON:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(body, &elements); err != nil {
+			return nil, errors.New("batch body must is a json array, " + err.Error())
+		}
+		for _, element := range elements {
+			if len(element) > 0 && element[0] == '"' {
+				var s string
+				if err := json.Unmarshal(element, &s); err != nil {
+					return nil, err
+				}
+				items = append(items, []byte(s))
+			} else {
+				items = append(items, []byte(element))
+			}
+		}
+	case BATCH_LINES:
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) > 0 {
+				items = append(items, line)
+			}
+		}
+	case BATCH_BINARY:
+		for len(body) > 0 {
+			if len(body) < 4 {
+				return nil, errors.New("batch body is truncated.")
+			}
+			length := binary.BigEndian.Uint32(body)
+			body = body[4:]
+			if uint64(len(body)) < uint64(length) {
+				return nil, errors.New("batch body is truncated.")
+			}
+			items = append(items, body[:length])
+			body = body[length:]
+		}
+	default:
+		return nil, errors.New("batch format '" + format + "' is unsupported.")
+	}
+	return items, nil
+}
+
+// PublishBatch sends the items as MSG_DATA in order, it stops at the first
+// failure.
+func PublishBatch(send Producer, items [][]byte, timeout time.Duration) *BatchResult {
+	result := &BatchResult{Total: len(items), Results: make([]BatchItemResult, len(items))}
+	var failed error
+	for idx, item := range items {
+		if failed != nil {
+			result.Results[idx].Error = ErrBatchItemSkipped.Error()
+			continue
+		}
+
+		msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(item)+10).Append(item).Build()
+		var err error
+		if timeout == 0 {
+			err = send.Send(msg)
+		} else {
+			err = send.SendTimeout(msg, timeout)
+		}
+		if err != nil {
+			failed = err
+			result.Results[idx].Error = err.Error()
+			continue
+		}
+		result.Results[idx].Ok = true
+		result.Accepted++
+	}
+	return result
+}
+
+// batch consume
+// a http GET request receives many messages if the 'batch' query parameter
+// is true, or any of 'format', 'max', 'max_bytes' and 'wait' is given:
+//
+//	max       - the max count of messages, default is 100.
+//	max_bytes - the batch stops once the size of bodies reaches it.
+//	wait      - how long to wait for more messages after the first one.
+//	format    - the format of response, it is selected by the Accept header
+//	            if it is missing:
+//	  raw       - the bodies are joined by commas in '[' and ']', it is
+//	              the default for compatibility.
+//	  json      - a json array of {"headers": {...}, "body": "<base64>"}.
+//	  ndjson    - an object like json per line.
+//	  multipart - a 'multipart/mixed' body, a part per message and the
+//	              headers of message are the headers of part.
+
+const (
+	BATCH_RAW       = "raw"
+	BATCH_NDJSON    = "ndjson"
+	BATCH_MULTIPART = "multipart"
+
+	defaultBatchMax = 100
+)
+
+type BatchOptions struct {
+	Max      int
+	MaxBytes int
+	Wait     time.Duration
+}
+
+// IsBatchConsume checks the query parameters of a GET request.
+func IsBatchConsume(batch, format, max, maxBytes, wait string) bool {
+	return batch == "true" || format != "" || max != "" || maxBytes != "" || wait != ""
+}
+
+func ParseBatchOptions(max, maxBytes, wait string) BatchOptions {
+	opts := BatchOptions{Max: defaultBatchMax}
+	if i, err := strconv.Atoi(max); err == nil && i > 0 {
+		opts.Max = i
+	}
+	if i, err := strconv.Atoi(maxBytes); err == nil && i > 0 {
+		opts.MaxBytes = i
+	}
+	if d, err := time.ParseDuration(wait); err == nil && d > 0 {
+		opts.Wait = d
+	}
+	return opts
+}
+
+// ConsumeFormat returns the format of a batch response.
+func ConsumeFormat(format, accept string) (string, error) {
+	switch format {
+	case BATCH_RAW, BATCH_JSON, BATCH_NDJSON, BATCH_MULTIPART:
+		return format, nil
+	case "":
+	default:
+		return "", errors.New("batch format '" + format + "' is unsupported.")
+	}
+
+	switch {
+	case strings.Contains(accept, "application/x-ndjson"):
+		return BATCH_NDJSON, nil
+	case strings.Contains(accept, "multipart/mixed"):
+		return BATCH_MULTIPART, nil
+	case strings.Contains(accept, "application/json"):
+		return BATCH_JSON, nil
+	}
+	return BATCH_RAW, nil
+}
+
+// ReadBatch takes the messages after first until the batch is full, it
+// waits opts.Wait for more messages.
+func ReadBatch(receiver Receiver, first mq_client.Message, opts BatchOptions) []mq_client.Message {
+	if opts.Max <= 0 {
+		opts.Max = defaultBatchMax
+	}
+	results := append(make([]mq_client.Message, 0, 12), first)
+	size := len(first.Body())
+
+	var wait context.Context
+	if opts.Wait > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(context.Background(), opts.Wait)
+		defer cancel()
+	}
+
+	for len(results) < opts.Max {
+		if opts.MaxBytes > 0 && size >= opts.MaxBytes {
+			return results
+		}
+
+		msg, ok := receiver.TryRecv()
+		if !ok {
+			if wait == nil {
+				return results
+			}
+			var err error
+			if msg, err = receiver.Recv(wait); err != nil {
+				return results
+			}
+		}
+		results = append(results, msg)
+		size += len(msg.Body())
+	}
+	return results
+}
+
+type batchMessage struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body"`
+}
+
+// EncodeBatch encodes the messages, it returns the content type and body.
+func EncodeBatch(format string, msgs []mq_client.Message) (string, []byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case BATCH_JSON:
+		results := make([]batchMessage, 0, len(msgs))
+		for _, msg := range msgs {
+			results = append(results, batchMessage{Headers: msg.Headers(), Body: msg.Body()})
+		}
+		if err := json.NewEncoder(&buf).Encode(results); err != nil {
+			return "", nil, err
+		}
+		return "application/json", buf.Bytes(), nil
+	case BATCH_NDJSON:
+		encoder := json.NewEncoder(&buf)
+		for _, msg := range msgs {
+			if err := encoder.Encode(batchMessage{Headers: msg.Headers(), Body: msg.Body()}); err != nil {
+				return "", nil, err
+			}
+		}
+		return "application/x-ndjson", buf.Bytes(), nil
+	case BATCH_MULTIPART:
+		w := multipart.NewWriter(&buf)
+		for _, msg := range msgs {
+			header := textproto.MIMEHeader{}
+			for k, v := range msg.Headers() {
+				header.Set(k, v)
+			}
+			header.Set("Content-Type", "application/octet-stream")
+			part, err := w.CreatePart(header)
+			if err != nil {
+				return "", nil, err
+			}
+			if _, err := part.Write(msg.Body()); err != nil {
+				return "", nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return "", nil, err
+		}
+		return "multipart/mixed; boundary=" + w.Boundary(), buf.Bytes(), nil
+	default:
+		buf.WriteString("[")
+		is_frist := true
+		for _, m := range msgs {
+			if body := m.Body(); len(body) > 0 {
+				if is_frist {
+					is_frist = false
+				} else {
+					buf.WriteString(",")
+				}
+
+				buf.Write(body)
+			}
+		}
+		buf.WriteString("]")
+		return "text/plain", buf.Bytes(), nil
+	}
+}
@@ -2,9 +2,11 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,6 +21,35 @@ type Client struct {
 	srv        *Server
 	remoteAddr string
 	conn       net.Conn
+	goaway     chan struct{}
+	goawayOnce sync.Once
+
+	// the queue or topic that the client publishes to or subscribes, they
+	// are guarded by mu.
+	role        string
+	target_type string
+	target      string
+	consumer    *Consumer
+}
+
+func (self *Client) setTarget(role, typ, name string, consumer *Consumer) {
+	self.mu.Lock()
+	self.role = role
+	self.target_type = typ
+	self.target = name
+	self.consumer = consumer
+	self.mu.Unlock()
+}
+
+// messageContext returns the MessageContext of the queue or topic that the
+// client publishes to or subscribes.
+func (self *Client) messageContext() MessageContext {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return MessageContext{Type: self.target_type,
+		Name:       self.target,
+		Client:     self.name,
+		RemoteAddr: self.remoteAddr}
 }
 
 func (self *Client) id() string {
@@ -28,28 +59,105 @@ func (self *Client) id() string {
 	return id
 }
 
+// log returns the logger with the id, the address and the target of client.
+func (self *Client) log() *logger {
+	self.mu.Lock()
+	args := []any{"client", self.name, "remote_addr", self.remoteAddr}
+	if self.target != "" {
+		args = append(args, "type", self.target_type, "dest", self.target)
+	}
+	self.mu.Unlock()
+	return self.srv.logger(LogTCP).with(args...)
+}
+
+// info returns the ClientInfo of events.
+func (self *Client) info() ClientInfo {
+	return ClientInfo{Name: self.id(), RemoteAddr: self.remoteAddr}
+}
+
+func (self *Client) goAway() {
+	if self.goaway == nil {
+		return
+	}
+	self.goawayOnce.Do(func() {
+		close(self.goaway)
+	})
+}
+
 func (self *Client) Close() error {
 	if !atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
 		return ErrAlreadyClosed
 	}
 
 	self.conn.Close()
-	self.srv.logf("TCP: client(%s) [%s] is closed.", self.remoteAddr, self.id())
+	self.log().info("client is closed")
 	return nil
 }
 
 func (self *Client) runWrite(c chan interface{}) {
-	self.srv.logf("[write - %s] TCP: client(%s) is writing", self.remoteAddr, self.remoteAddr)
+	self.log().debug("client is writing")
 
 	conn := self.conn
 
 	tick := time.NewTicker(self.srv.options.NoopInterval)
 	defer tick.Stop()
 
-	var msg_ch chan mq_client.Message
+	var sub *receiving
+	var sub_opts subOptions
+	var deliver_ctx MessageContext
+	goaway := self.goaway
+
+	quit := make(chan struct{})
+	defer func() {
+		close(quit)
+		if sub != nil {
+			sub.cancel()
+		}
+	}()
+
+	// deliver sends a message of the subscription, it returns false if the
+	// message can't be sent.
+	deliver := func(data mq_client.Message) bool {
+		if len(self.srv.interceptors) > 0 {
+			data = self.srv.interceptors.deliver(&deliver_ctx, data)
+		}
+		if sub_opts.federation != "" {
+			var skip bool
+			if data, skip = self.srv.stampFederation(data, sub_opts.federation); skip {
+				return true
+			}
+		} else if !sub_opts.headers && data.Command() == mq_client.MSG_HDATA {
+			data = data.WithoutHeaders()
+		}
+		if err := mq_client.SendFull(conn, data.ToBytes()); err != nil {
+			self.log().warn("fail to send data message", "error", err)
+			return false
+		}
+		return true
+	}
+	// unsubscribe stops receiving, the messages that are already received
+	// are still sent.
+	unsubscribe := func() bool {
+		if sub == nil {
+			return true
+		}
+		msgs := sub.stop()
+		sub = nil
+		for _, data := range msgs {
+			if !deliver(data) {
+				return false
+			}
+		}
+		return true
+	}
 
 	for 0 == atomic.LoadInt32(&self.closed) &&
 		0 == atomic.LoadInt32(&self.srv.is_stopped) {
+		var received chan receivedMessage
+		if sub != nil {
+			received = sub.received
+		}
+
 		select {
 		case v, ok := <-c:
 			if !ok {
@@ -59,60 +167,94 @@ func (self *Client) runWrite(c chan interface{}) {
 			case *errorCommand:
 				if err := mq_client.SendFull(conn, cmd.msg.ToBytes()); err != nil {
 					if 0 == atomic.LoadInt32(&self.closed) {
-						self.srv.logf("[%s - %s] fail to send error message, %s", self.id(), self.remoteAddr, err)
+						self.log().warn("fail to send error message", "error", err)
 					}
 				}
 				return
 			case *subCommand:
+				if !unsubscribe() {
+					return
+				}
 				if err := mq_client.SendFull(conn, mq_client.MSG_ACK_BYTES); err != nil {
-					self.srv.logf("[%s - %s] fail to send ack message, %s", self.id(), self.remoteAddr, err)
+					self.log().warn("fail to send ack message", "error", err)
 					return
 				}
 
-				msg_ch = cmd.ch
+				sub = startReceiving(cmd.receiver, quit)
+				sub_opts = cmd.options
+				deliver_ctx = self.messageContext()
 			case *pubCommand:
-				msg_ch = nil
+				if !unsubscribe() {
+					return
+				}
 
 				if err := mq_client.SendFull(conn, mq_client.MSG_ACK_BYTES); err != nil {
-					self.srv.logf("[%s - %s] fail to send ack message, %s", self.id(), self.remoteAddr, err)
+					self.log().warn("fail to send ack message", "error", err)
 					return
 				}
 
+			case *ackCommand:
+				if err := mq_client.SendFull(conn, mq_client.MSG_ACK_BYTES); err != nil {
+					self.log().warn("fail to send ack message", "error", err)
+					return
+				}
+			case *peekCommand:
+				if err := mq_client.SendFull(conn, mq_client.MSG_ACK_BYTES); err != nil {
+					self.log().warn("fail to send ack message", "error", err)
+					return
+				}
+				for _, data := range cmd.msgs {
+					if err := mq_client.SendFull(conn, data.ToBytes()); err != nil {
+						self.log().warn("fail to send data message", "error", err)
+						return
+					}
+				}
+				if err := mq_client.SendFull(conn, mq_client.MSG_ACK_BYTES); err != nil {
+					self.log().warn("fail to send ack message", "error", err)
+					return
+				}
 			case *closeCommand:
+				if !unsubscribe() {
+					return
+				}
 				if cmd.closer != nil {
 					if err := cmd.closer.Close(); err != nil {
-						self.srv.logf("[%s - %s] fail to exec close message, %s", self.id(), self.remoteAddr, err)
+						self.log().warn("fail to exec close message", "error", err)
 					}
 				}
 
-				msg_ch = nil
 				if err := mq_client.SendFull(conn, mq_client.MSG_ACK_BYTES); err != nil {
-					self.srv.logf("[%s - %s] fail to send ack message, %s", self.id(), self.remoteAddr, err)
+					self.log().warn("fail to send ack message", "error", err)
 					return
 				}
 			default:
-				self.srv.logf("[%s - %s] unknown command - %T", self.id(), self.remoteAddr, v)
+				self.log().error("unknown command", "command", fmt.Sprintf("%T", v))
 				return
 			}
-		case data, ok := <-msg_ch:
-			if !ok {
+		case r := <-received:
+			if r.err != nil {
 				msg := mq_client.BuildErrorMessage("message channel is closed.")
 				if err := mq_client.SendFull(conn, msg.ToBytes()); err != nil {
-					self.srv.logf("[%s - %s] fail to send closed message, %s", self.id(), self.remoteAddr, err)
+					self.log().warn("fail to send closed message", "error", err)
 				}
 				return
 			}
-			if err := mq_client.SendFull(conn, data.ToBytes()); err != nil {
-				self.srv.logf("[%s - %s] fail to send data message, %s", self.id(), self.remoteAddr, err)
+			if !deliver(r.msg) {
+				return
+			}
+		case <-goaway:
+			goaway = nil
+			if err := mq_client.SendFull(conn, mq_client.MSG_GOAWAY_BYTES); err != nil {
+				self.log().warn("fail to send goaway message", "error", err)
 				return
 			}
 		case <-tick.C:
-			if nil == msg_ch {
+			if nil == sub {
 				break
 			}
 
 			if err := mq_client.SendFull(conn, mq_client.MSG_NOOP_BYTES); err != nil {
-				self.srv.logf("[%s - %s] fail to send noop message, %s", self.id(), self.remoteAddr, err)
+				self.log().warn("fail to send noop message", "error", err)
 				return
 			}
 		}
@@ -120,7 +262,7 @@ func (self *Client) runWrite(c chan interface{}) {
 }
 
 func (self *Client) runRead(c chan interface{}) {
-	self.srv.logf("TCP: client(%s) is reading", self.remoteAddr)
+	self.log().debug("client is reading")
 
 	conn := self.conn
 
@@ -129,7 +271,7 @@ func (self *Client) runRead(c chan interface{}) {
 	ctx.srv = self.srv
 	ctx.client = self
 	defer ctx.Reset()
-	defer ctx.srv.catchThrow("["+self.name+"-"+self.remoteAddr+"] ["+mq_client.ToCommandName(ctx.currentCmd)+"]",
+	defer ctx.srv.catchThrow(self.log(),
 		func() {
 			conn.Close()
 		})
@@ -161,6 +303,10 @@ type execCtx struct {
 	producer   Producer
 	consumer   *Consumer
 	currentCmd byte
+
+	// the queue or topic of consumer, it is used by unsubscribe events.
+	sub_type string
+	sub_name string
 	//id       uint32
 }
 
@@ -177,8 +323,10 @@ func (ctx *execCtx) execute(msg mq_client.Message) bool {
 
 		if bytes.Equal(ss[0], []byte("queue")) {
 			ctx.srv.KillQueueIfExists(string(ss[1]))
+			ctx.srv.watcher.onKill(mq_client.QUEUE, string(ss[1]))
 		} else if bytes.Equal(ss[0], []byte("topic")) {
 			ctx.srv.KillTopicIfExists(string(ss[1]))
+			ctx.srv.watcher.onKill(mq_client.TOPIC, string(ss[1]))
 		} else {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
 		}
@@ -195,13 +343,14 @@ func (ctx *execCtx) execute(msg mq_client.Message) bool {
 		}
 		return true
 	case mq_client.MSG_ERROR:
-		ctx.srv.logf("ERROR: client(%s) recv error - %s", ctx.client.remoteAddr, string(msg.Data()))
+		ctx.client.log().error("recv error", "error", string(msg.Data()))
 		return false
 	case mq_client.MSG_CLOSE:
 		closer := &closeCommand{}
 		if ctx.consumer != nil {
 			closer.closer = ctx.consumer
 			ctx.consumer = nil
+			ctx.unsubscribed()
 		}
 		ctx.c <- closer
 
@@ -209,48 +358,108 @@ func (ctx *execCtx) execute(msg mq_client.Message) bool {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("failed to reset context, " + err.Error())}
 		}
 		return true
-	case mq_client.MSG_DATA:
+	case mq_client.MSG_DATA, mq_client.MSG_HDATA:
 		if ctx.producer == nil {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("state error.")}
 			return true
 		}
+		if ctx.srv.IsShuttingDown() {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(ErrShuttingDown.Error())}
+			return true
+		}
 
-		if err := ctx.producer.Send(msg); err != nil {
+		published, err := checkPublished(msg)
+		if err != nil {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("failed to send message, " + err.Error())}
+			return true
+		}
+		if err := ctx.producer.Send(published); err != nil {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("failed to send message, " + err.Error())}
 			return true
 		}
 		return true
 	case mq_client.MSG_PUB:
-		ss := bytes.Fields(msg.Data())
-		if 2 != len(ss) {
+		if ctx.srv.IsShuttingDown() {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(ErrShuttingDown.Error())}
+			return true
+		}
+		typ, name, _, ok := parseCommand(msg.Data())
+		if !ok {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
 			return true
 		}
 
+		if err := ctx.srv.CheckLeader(string(typ), string(name)); err != nil {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(err.Error())}
+			return true
+		}
+
 		var queue Channel
-		if bytes.Equal(ss[0], []byte("queue")) {
-			queue = ctx.srv.CreateQueueIfNotExists(string(ss[1]))
-		} else if bytes.Equal(ss[0], []byte("topic")) {
-			queue = ctx.srv.CreateTopicIfNotExists(string(ss[1]))
+		if bytes.Equal(typ, []byte("queue")) {
+			queue = ctx.srv.CreateQueueIfNotExists(string(name))
+		} else if bytes.Equal(typ, []byte("topic")) {
+			queue = ctx.srv.CreateTopicIfNotExists(string(name))
 		} else {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
 			return true
 		}
 
-		ctx.producer = queue.Connect()
+		ctx.producer = ctx.srv.intercept(MessageContext{Type: string(typ),
+			Name:       string(name),
+			RemoteAddr: ctx.client.remoteAddr}, ctx.client, queue.Connect())
+		ctx.client.setTarget("pub", string(typ), string(name), nil)
 		ctx.c <- &pubCommand{}
 		return true
+	case mq_client.MSG_PEEK:
+		typ, name, options, ok := parseCommand(msg.Data())
+		if !ok || !bytes.Equal(typ, []byte("queue")) {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
+			return true
+		}
+		count, _ := strconv.Atoi(options["count"])
+		msgs, err := ctx.srv.PeekQueue(string(name), count)
+		if err != nil {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(err.Error())}
+			return true
+		}
+		ctx.c <- &peekCommand{msgs: msgs}
+		return true
+	case mq_client.MSG_COMMIT:
+		typ, name, options, ok := parseCommand(msg.Data())
+		if !ok || !bytes.Equal(typ, []byte("topic")) {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
+			return true
+		}
+		offset, err := strconv.ParseUint(options["offset"], 10, 64)
+		if err != nil {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(ErrInvalidOffset.Error())}
+			return true
+		}
+		if err := ctx.srv.CommitOffset(string(name), options["consumer"], offset); err != nil {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(err.Error())}
+			return true
+		}
+		ctx.c <- &ackCommand{}
+		return true
 	case mq_client.MSG_SUB:
-		ss := bytes.Fields(msg.Data())
-		if 2 != len(ss) {
+		typ, name, options, ok := parseCommand(msg.Data())
+		if !ok {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
 			return true
 		}
+		if err := ctx.srv.CheckLeader(string(typ), string(name)); err != nil {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(err.Error())}
+			return true
+		}
+		if peer := options["federation"]; peer != "" && peer == strconv.FormatInt(ctx.srv.options.ID, 10) {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(ErrFederationSameID.Error())}
+			return true
+		}
 		var queue Channel
-		if bytes.Equal(ss[0], []byte("queue")) {
-			queue = ctx.srv.CreateQueueIfNotExists(string(ss[1]))
-		} else if bytes.Equal(ss[0], []byte("topic")) {
-			queue = ctx.srv.CreateTopicIfNotExists(string(ss[1]))
+		if bytes.Equal(typ, []byte("queue")) {
+			queue = ctx.srv.CreateQueueIfNotExists(string(name))
+		} else if bytes.Equal(typ, []byte("topic")) {
+			queue = ctx.srv.CreateTopicIfNotExists(string(name))
 		} else {
 			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage("invalid command - '" + string(msg.Data()) + "'.")}
 			return true
@@ -260,38 +469,157 @@ func (ctx *execCtx) execute(msg mq_client.Message) bool {
 			return true
 		}
 
-		ctx.consumer = queue.ListenOn()
-		ctx.c <- &subCommand{ch: ctx.consumer.C}
+		if topic, ok := queue.(*Topic); ok {
+			consumer, err := topic.ListenWith(options)
+			if err != nil {
+				ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(err.Error())}
+				return true
+			}
+			ctx.consumer = consumer
+		} else if options["filter"] != "" {
+			ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(ErrFilterUnsupported.Error())}
+			return true
+		} else {
+			ctx.consumer = queue.ListenOn()
+		}
+		ctx.client.setTarget("sub", string(typ), string(name), ctx.consumer)
+		ctx.sub_type, ctx.sub_name = string(typ), string(name)
+		ctx.srv.watcher.onSubscribe(ctx.sub_type, ctx.sub_name, ctx.client.info())
+		ctx.c <- &subCommand{receiver: ctx.consumer, options: newSubOptions(options)}
 		return true
 	default:
-		ctx.srv.logf("ERROR: client(%s) unknown command - %s", ctx.client.remoteAddr, mq_client.ToCommandName(msg.Command()))
+		ctx.client.log().error("unknown command", "command", mq_client.ToCommandName(msg.Command()))
 		ctx.c <- &errorCommand{msg: mq_client.BuildErrorMessage(fmt.Sprintf("unknown command - %v.", mq_client.ToCommandName(msg.Command())))}
 		return true // don't exit, write thread will exit when recv error.
 	}
 }
 
 func (self *execCtx) Reset() error {
+	self.client.setTarget("", "", "", nil)
 	if nil != self.consumer {
 		if err := self.consumer.Close(); err != nil {
 			return err
 		}
 		self.consumer = nil
+		self.unsubscribed()
 	}
 	self.producer = nil
 	return nil
 }
 
+func (self *execCtx) unsubscribed() {
+	if self.sub_name == "" {
+		return
+	}
+	self.srv.watcher.onUnsubscribe(self.sub_type, self.sub_name, self.client.info())
+	self.sub_type, self.sub_name = "", ""
+}
+
 type errorCommand struct {
 	msg mq_client.Message
 }
 
 type subCommand struct {
-	ch chan mq_client.Message
+	receiver Receiver
+	options  subOptions
+}
+
+type receivedMessage struct {
+	msg mq_client.Message
+	err error
+}
+
+// receiving receives the messages of a subscription in a goroutine, so that
+// runWrite waits for them together with the commands.
+type receiving struct {
+	cancel   context.CancelFunc
+	received chan receivedMessage
+}
+
+func startReceiving(receiver Receiver, quit <-chan struct{}) *receiving {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &receiving{cancel: cancel, received: make(chan receivedMessage)}
+	go func() {
+		defer close(r.received)
+		for {
+			msg, err := receiver.Recv(ctx)
+			select {
+			case r.received <- receivedMessage{msg: msg, err: err}:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// stop stops receiving, it returns the message that is received before it
+// is stopped.
+func (self *receiving) stop() []mq_client.Message {
+	self.cancel()
+	var msgs []mq_client.Message
+	for r := range self.received {
+		if r.err == nil {
+			msgs = append(msgs, r.msg)
+		}
+	}
+	return msgs
+}
+
+type subOptions struct {
+	headers bool
+
+	// federation is the id of the server that subscribes by a federation link.
+	federation string
+}
+
+func newSubOptions(options map[string]string) subOptions {
+	return subOptions{
+		headers:    options["headers"] == "true",
+		federation: options["federation"],
+	}
+}
+
+// parseCommand parses 'type name' in the first line and 'key=value' options
+// in the following lines.
+func parseCommand(data []byte) (typ, name []byte, options map[string]string, ok bool) {
+	lines := bytes.Split(data, []byte("\n"))
+	ss := bytes.Fields(lines[0])
+	if 2 != len(ss) {
+		return nil, nil, nil, false
+	}
+
+	for _, line := range lines[1:] {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		idx := bytes.IndexByte(line, '=')
+		if idx <= 0 {
+			return nil, nil, nil, false
+		}
+		if options == nil {
+			options = map[string]string{}
+		}
+		options[string(line[:idx])] = string(line[idx+1:])
+	}
+	return ss[0], ss[1], options, true
 }
 
 type pubCommand struct {
 }
 
+type ackCommand struct {
+}
+
+// peekCommand sends the messages between two ack messages.
+type peekCommand struct {
+	msgs []mq_client.Message
+}
+
 type closeCommand struct {
 	closer io.Closer
 }
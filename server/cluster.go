@@ -0,0 +1,391 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+const (
+	clusterOpNoop byte = iota
+	clusterOpEnqueue
+	clusterOpDequeue
+)
+
+const (
+	clusterProposeTimeout  = 5 * time.Second
+	clusterDequeueInterval = 100 * time.Millisecond
+)
+
+// ClusterOptions replicates the queues that are listed in Queues to all
+// nodes of the cluster, only the leader accepts publishers and subscribers
+// of them, the other nodes tell clients where the leader is.
+//
+// Messages are delivered at least once, the messages that are taken by the
+// consumers of the old leader just before it fails may be delivered again
+// by the new leader. The term, the vote and the log of a node are kept in
+// Dir, a node that is restarted with the same Address must keep its Dir.
+type ClusterOptions struct {
+	// Address is the address that the node listens on for other nodes.
+	Address string
+
+	// Advertise is the client address that is told to clients, default is
+	// TCPAddress (127.0.0.1 is used if the host is empty).
+	Advertise string
+
+	// Peers is the cluster addresses of other nodes.
+	Peers []string
+
+	// Queues is the names of the replicated queues.
+	Queues []string
+
+	// Dir is the directory that keeps the raft state of the node, it is
+	// required.
+	Dir string
+}
+
+var ErrClusterDirMissing = errors.New("cluster dir is required to keep the raft state.")
+
+type clusterOp struct {
+	Type  byte
+	Queue string
+	Data  []byte
+	Upto  uint64
+}
+
+type clusterQueueState struct {
+	FirstSeq uint64
+	Messages [][]byte
+}
+
+type clusterSnapshot struct {
+	Index  uint64
+	Term   uint64
+	Queues map[string]*clusterQueueState
+}
+
+type clusterQueue struct {
+	first_seq uint64
+	messages  []mq_client.Message
+	notify    chan struct{}
+
+	// fed_seq and proposed_seq are used by the leader only.
+	fed_seq      uint64
+	proposed_seq uint64
+}
+
+func (self *clusterQueue) lastSeq() uint64 {
+	return self.first_seq + uint64(len(self.messages)) - 1
+}
+
+type cluster struct {
+	srv   *Server
+	node  *raftNode
+	names map[string]bool
+
+	lock   sync.Mutex
+	queues map[string]*clusterQueue
+
+	leading_lock sync.Mutex
+	leading      chan struct{}
+	leadingGroup sync.WaitGroup
+}
+
+func newCluster(srv *Server, opts *ClusterOptions) (*cluster, error) {
+	if opts.Dir == "" {
+		return nil, ErrClusterDirMissing
+	}
+	advertise := opts.Advertise
+	if advertise == "" {
+		host, port, err := net.SplitHostPort(srv.options.TCPAddress)
+		if err != nil {
+			return nil, errors.New("invalid tcp address, " + err.Error())
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		advertise = net.JoinHostPort(host, port)
+	}
+
+	c := &cluster{
+		srv:    srv,
+		names:  map[string]bool{},
+		queues: map[string]*clusterQueue{},
+	}
+	for _, name := range opts.Queues {
+		c.names[name] = true
+	}
+
+	node, err := newRaftNode(srv, opts.Address, advertise, opts.Dir, opts.Peers, c)
+	if err != nil {
+		return nil, err
+	}
+	c.node = node
+	return c, nil
+}
+
+func (self *cluster) Close() error {
+	err := self.node.Close()
+	self.stopLeading()
+	return err
+}
+
+func (self *cluster) isReplicated(name string) bool {
+	return self != nil && self.names[name]
+}
+
+// queue needs the lock.
+func (self *cluster) queue(name string) *clusterQueue {
+	q, ok := self.queues[name]
+	if !ok {
+		q = &clusterQueue{first_seq: 1, notify: make(chan struct{}, 1)}
+		self.queues[name] = q
+	}
+	return q
+}
+
+func (self *cluster) apply(index uint64, op clusterOp) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	switch op.Type {
+	case clusterOpEnqueue:
+		q := self.queue(op.Queue)
+		q.messages = append(q.messages, mq_client.Message(op.Data))
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	case clusterOpDequeue:
+		q := self.queue(op.Queue)
+		if op.Upto < q.first_seq {
+			return
+		}
+		n := op.Upto - q.first_seq + 1
+		if n > uint64(len(q.messages)) {
+			n = uint64(len(q.messages))
+		}
+		q.messages = q.messages[n:]
+		q.first_seq += n
+	}
+}
+
+func (self *cluster) snapshot() map[string]*clusterQueueState {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	queues := make(map[string]*clusterQueueState, len(self.queues))
+	for name, q := range self.queues {
+		state := &clusterQueueState{FirstSeq: q.first_seq}
+		for _, msg := range q.messages {
+			state.Messages = append(state.Messages, []byte(msg))
+		}
+		queues[name] = state
+	}
+	return queues
+}
+
+func (self *cluster) restore(queues map[string]*clusterQueueState) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.queues = map[string]*clusterQueue{}
+	for name, state := range queues {
+		q := self.queue(name)
+		q.first_seq = state.FirstSeq
+		for _, data := range state.Messages {
+			q.messages = append(q.messages, mq_client.Message(data))
+		}
+	}
+}
+
+func (self *cluster) onRoleChanged(isLeader bool) {
+	if !isLeader {
+		self.stopLeading()
+		return
+	}
+
+	self.leading_lock.Lock()
+	defer self.leading_lock.Unlock()
+	if self.leading != nil {
+		return
+	}
+	self.leading = make(chan struct{})
+
+	self.lock.Lock()
+	for name := range self.names {
+		q := self.queue(name)
+		q.fed_seq = q.first_seq - 1
+		q.proposed_seq = q.first_seq - 1
+	}
+	self.lock.Unlock()
+
+	for name := range self.names {
+		self.runItInGoroutine(self.leading, name, self.runFeeder)
+	}
+	self.runItInGoroutine(self.leading, "", self.runDequeue)
+}
+
+func (self *cluster) runItInGoroutine(leading chan struct{}, name string, cb func(leading chan struct{}, name string)) {
+	self.leadingGroup.Add(1)
+	go func() {
+		defer self.leadingGroup.Done()
+		cb(leading, name)
+	}()
+}
+
+// stopLeading stops to deliver the replicated queues and disconnects their
+// subscribers, so that they reconnect to the new leader.
+func (self *cluster) stopLeading() {
+	self.leading_lock.Lock()
+	defer self.leading_lock.Unlock()
+	if self.leading == nil {
+		return
+	}
+	close(self.leading)
+	self.leadingGroup.Wait()
+	self.leading = nil
+
+	for name := range self.names {
+		self.srv.removeQueue(name)
+	}
+}
+
+// runFeeder moves the replicated messages into the local queue of leader.
+func (self *cluster) runFeeder(leading chan struct{}, name string) {
+	queue := self.srv.CreateQueueIfNotExists(name)
+	for {
+		var msg mq_client.Message
+		self.lock.Lock()
+		q := self.queue(name)
+		if q.fed_seq+1 < q.first_seq {
+			q.fed_seq = q.first_seq - 1
+		}
+		if idx := q.fed_seq + 1 - q.first_seq; idx < uint64(len(q.messages)) {
+			msg = q.messages[idx]
+		}
+		notify := q.notify
+		self.lock.Unlock()
+
+		if msg == nil {
+			select {
+			case <-leading:
+				return
+			case <-notify:
+			}
+			continue
+		}
+
+		if err := queue.enqueue(msg, -1, leading); err != nil {
+			return
+		}
+		self.lock.Lock()
+		q.fed_seq++
+		self.lock.Unlock()
+	}
+}
+
+// runDequeue replicates how many messages are taken by the consumers of the
+// leader, the local queue is FIFO, so they are all messages that are fed
+// except the messages that are still in the queue.
+func (self *cluster) runDequeue(leading chan struct{}, _ string) {
+	tick := time.NewTicker(clusterDequeueInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-leading:
+			return
+		case <-tick.C:
+		}
+
+		var ops []clusterOp
+		self.lock.Lock()
+		for name := range self.names {
+			queue := self.srv.GetQueueIfExists(name)
+			if queue == nil {
+				continue
+			}
+			q := self.queue(name)
+			pending := uint64(queue.Len())
+			if pending > q.fed_seq {
+				continue
+			}
+			if upto := q.fed_seq - pending; upto > q.proposed_seq {
+				q.proposed_seq = upto
+				ops = append(ops, clusterOp{Type: clusterOpDequeue, Queue: name, Upto: upto})
+			}
+		}
+		self.lock.Unlock()
+
+		for _, op := range ops {
+			if err := self.node.propose(op, clusterProposeTimeout); err != nil {
+				self.srv.logger(LogCluster).error("fail to replicate dequeue", "dest", op.Queue, "error", err)
+			}
+		}
+	}
+}
+
+func (self *cluster) notLeader() error {
+	leader, _ := self.node.Leader()
+	if leader == "" {
+		leader = "unknown"
+	}
+	return errors.New("not leader, leader is " + leader + ".")
+}
+
+func (self *cluster) checkLeader(typ, name string) error {
+	if typ != mq_client.QUEUE || !self.isReplicated(name) {
+		return nil
+	}
+	if _, isLeader := self.node.Leader(); !isLeader {
+		return self.notLeader()
+	}
+	return nil
+}
+
+func (self *cluster) enqueue(name string, msg mq_client.Message, timeout time.Duration) error {
+	err := self.node.propose(clusterOp{Type: clusterOpEnqueue, Queue: name, Data: []byte(msg)}, timeout)
+	if err == ErrNotLeader {
+		return self.notLeader()
+	}
+	return err
+}
+
+func (self *cluster) Stats() map[string]interface{} {
+	stats := self.node.Stats()
+
+	queues := map[string]interface{}{}
+	self.lock.Lock()
+	for name := range self.names {
+		q := self.queue(name)
+		queues[name] = map[string]interface{}{
+			"first_seq": q.first_seq,
+			"last_seq":  q.lastSeq(),
+			"pending":   len(q.messages),
+		}
+	}
+	self.lock.Unlock()
+
+	stats["queues"] = queues
+	return stats
+}
+
+// CheckLeader returns an error that tells where the leader is if the queue
+// is replicated and this node isn't the leader.
+func (self *Server) CheckLeader(typ, name string) error {
+	if self.cluster == nil {
+		return nil
+	}
+	return self.cluster.checkLeader(typ, name)
+}
+
+func (self *Server) GetCluster() map[string]interface{} {
+	if self.cluster == nil {
+		return nil
+	}
+	return self.cluster.Stats()
+}
@@ -0,0 +1,694 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// configuration
+// Config is the configuration of 'fastmq run'. it is read from a json, yaml
+// or toml file (by the extension of file), then it is overridden by the
+// environment variables and then by the command-line flags. a field that
+// isn't a list of objects has a key, the key is the names of the field and
+// its parents joined by '_', for example 'cluster_address'. the flag of a
+// field is '-<key>', the environment variable is 'FASTMQ_<KEY>' in upper
+// case. a list is separated by comma, a map is 'k1=v1,k2=v2', a duration is
+// '30s' or '1m'.
+
+const ConfigEnvPrefix = "FASTMQ_"
+
+// Duration is a time.Duration that is a string like '30s' in config files.
+type Duration time.Duration
+
+func (self Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(self).String())
+}
+
+func (self *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return errors.New("duration must be a string like '30s', " + string(bs) + " is invalid.")
+	}
+	return self.set(s)
+}
+
+func (self *Duration) set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("duration '" + s + "' is invalid.")
+	}
+	*self = Duration(d)
+	return nil
+}
+
+type Config struct {
+	ID              int64    `json:"id" usage:"the id of server, default is random and kept in the storage dir or next to the snapshot file, it is required by federation links if neither is set."`
+	Verbose         bool     `json:"verbose" usage:"the default level of logs is debug."`
+	Address         string   `json:"address" usage:"the address that the server listens on."`
+	UnixSocket      string   `json:"unix_socket" usage:"the path of unix socket that the server listens on too."`
+	ShutdownTimeout Duration `json:"shutdown_timeout" usage:"the maximum time to deliver remaining messages on SIGTERM."`
+	Snapshot        string   `json:"snapshot" usage:"the file that keeps queued messages while the server is restarted."`
+	EventFormat     string   `json:"event_format" usage:"the format of system events, text or json."`
+
+	SSL    SSLConfig    `json:"ssl"`
+	Msg    MsgConfig    `json:"msg"`
+	Limits LimitsConfig `json:"limits"`
+	HTTP   HTTPConfig   `json:"http"`
+	Log    LogConfig    `json:"log"`
+
+	TopicLog   TopicLogConfig `json:"topic_log"`
+	Partitions map[string]int `json:"partitions" usage:"the count of partitions of topics, name=count,..."`
+	Storage    StorageConfig  `json:"storage"`
+	Cluster    ClusterConfig  `json:"cluster"`
+
+	Listeners    []ListenerConfig    `json:"listeners"`
+	Federation   []FederationConfig  `json:"federation"`
+	Shovels      []Shovel            `json:"shovels"`
+	Destinations []DestinationConfig `json:"destinations"`
+
+	// Users and Policies are the access control lists, they are checked by
+	// 'config check' but they aren't enforced by the server yet.
+	Users    []UserConfig   `json:"users"`
+	Policies []PolicyConfig `json:"policies"`
+}
+
+type SSLConfig struct {
+	Address  string `json:"address" usage:"the address that the https server listens on."`
+	CertFile string `json:"cert_file" usage:"the certificate file of https."`
+	KeyFile  string `json:"key_file" usage:"the key file of https."`
+}
+
+type MsgConfig struct {
+	BufferSize    int      `json:"buffer_size" usage:"the buffer size of messages."`
+	Timeout       Duration `json:"timeout" usage:"the timeout of sending a message."`
+	QueueCapacity int      `json:"queue_capacity" usage:"the capacity of queues and subscribers."`
+	NoopInterval  Duration `json:"noop_interval" usage:"the interval of noop messages to subscribers."`
+}
+
+type LimitsConfig struct {
+	MaxConnections      int      `json:"max_connections" usage:"the maximum count of connections, 0 is unlimited."`
+	MaxConnectionsPerIP int      `json:"max_connections_per_ip" usage:"the maximum count of connections of an ip, 0 is unlimited."`
+	HandshakeTimeout    Duration `json:"handshake_timeout" usage:"the timeout of the handshake of connections."`
+}
+
+type HTTPConfig struct {
+	Enabled        bool     `json:"enabled" usage:"serve the http api."`
+	Prefix         string   `json:"prefix" usage:"the url prefix of the http api."`
+	RedirectUrl    string   `json:"redirect_url" usage:"the url that unknown http requests are redirected to."`
+	SessionExpires Duration `json:"session_expires" usage:"the default idle expiry of http consumer sessions."`
+}
+
+type LogConfig struct {
+	Level  string            `json:"level" usage:"the level of logs, debug, info, warn or error."`
+	Format string            `json:"format" usage:"the format of logs, text or json."`
+	Levels map[string]string `json:"levels" usage:"the levels of subsystems, subsystem=level,..."`
+}
+
+type TopicLogConfig struct {
+	Topics []string `json:"topics" usage:"the topics that keep logs, separated by comma."`
+	Size   int      `json:"size" usage:"the max count of messages in a topic log."`
+}
+
+type StorageConfig struct {
+	Engine       string            `json:"engine" usage:"the storage engine of queues and topic logs, memory, ring or disk."`
+	Engines      map[string]string `json:"engines" usage:"the storage engines of queues and topics, name=engine,..."`
+	Dir          string            `json:"dir" usage:"the directory of the disk engine."`
+	SegmentSize  int64             `json:"segment_size" usage:"the max size of segment files of the disk engine."`
+	Sync         string            `json:"sync" usage:"when the disk engine syncs messages to disk, always, interval or never."`
+	SyncInterval Duration          `json:"sync_interval" usage:"the interval of syncing messages if sync is interval."`
+}
+
+type ClusterConfig struct {
+	Address   string   `json:"address" usage:"the address that the node listens on for other nodes of cluster."`
+	Advertise string   `json:"advertise" usage:"the address that is told to clients, default is address."`
+	Peers     []string `json:"peers" usage:"the cluster addresses of other nodes, separated by comma."`
+	Queues    []string `json:"queues" usage:"the names of replicated queues, separated by comma."`
+	Dir       string   `json:"dir" usage:"the directory that keeps the raft state of node."`
+}
+
+type ListenerConfig struct {
+	Network          string   `json:"network"`
+	Address          string   `json:"address"`
+	Mode             string   `json:"mode"`
+	CertFile         string   `json:"cert_file"`
+	KeyFile          string   `json:"key_file"`
+	HttpEnabled      bool     `json:"http_enabled"`
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+}
+
+type FederationConfig struct {
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+	Queues  []string `json:"queues"`
+	MaxHops int      `json:"max_hops"`
+}
+
+// DestinationConfig declares a queue or a topic that is created when the
+// server is started.
+type DestinationConfig struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+
+	// Partitions and Log are used by topics only.
+	Partitions int    `json:"partitions"`
+	Log        bool   `json:"log"`
+	Engine     string `json:"engine"`
+}
+
+type UserConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// PolicyConfig allows a user ('*' is all users) the actions on queues or
+// topics, Name is a name or a prefix that ends with '*'.
+type PolicyConfig struct {
+	User    string   `json:"user"`
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+var policyActions = map[string]bool{"publish": true, "subscribe": true, "manage": true}
+
+// DefaultConfig returns the config that is used if a field isn't set.
+func DefaultConfig() *Config {
+	return &Config{Address: ":4150",
+		ShutdownTimeout: Duration(30 * time.Second),
+		EventFormat:     EventText,
+		HTTP:            HTTPConfig{Enabled: true},
+		Log:             LogConfig{Level: "info", Format: mq_client.LOG_TEXT}}
+}
+
+// LoadConfig reads the config file over the default config.
+func LoadConfig(file string) (*Config, error) {
+	cfg := DefaultConfig()
+	if err := cfg.ReadFile(file); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ReadConfig returns the config of the file, the environment variables and
+// the flags, a flag overrides the environment variable that overrides the
+// file. the file is $FASTMQ_CONFIG if file is empty, the config is default
+// if both are empty. flags may be nil.
+func ReadConfig(file string, environ []string, flags *ConfigFlags) (*Config, error) {
+	if file == "" {
+		for _, kv := range environ {
+			if strings.HasPrefix(kv, ConfigEnvPrefix+"CONFIG=") {
+				file = strings.TrimPrefix(kv, ConfigEnvPrefix+"CONFIG=")
+			}
+		}
+	}
+
+	cfg := DefaultConfig()
+	if file != "" {
+		if err := cfg.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(environ); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		if err := flags.Apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// ReadFile reads the config file over self, a field that isn't in the file
+// is kept, an unknown field is an error.
+func (self *Config) ReadFile(file string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		doc = json.RawMessage(bs)
+	case ".yaml", ".yml":
+		doc, err = parseYAML(bs)
+	case ".toml":
+		doc, err = parseTOML(bs)
+	default:
+		return errors.New("config '" + file + "' isn't json, yaml or toml.")
+	}
+	if err != nil {
+		return errors.New("config '" + file + "' is invalid, " + err.Error())
+	}
+	if _, ok := doc.(json.RawMessage); !ok {
+		doc = coerceConfig(doc, reflect.TypeOf(self))
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return errors.New("config '" + file + "' is invalid, " + err.Error())
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(self); err != nil {
+		return errors.New("config '" + file + "' is invalid, " + err.Error())
+	}
+	return nil
+}
+
+// configField is a field of Config that has a key.
+type configField struct {
+	key   string
+	usage string
+	value reflect.Value
+}
+
+func (self *Config) fields() []configField {
+	var fields []configField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			key := prefix + name
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Struct {
+				walk(key+"_", fv)
+				continue
+			}
+			if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct {
+				continue
+			}
+			fields = append(fields, configField{key: key, usage: f.Tag.Get("usage"), value: fv})
+		}
+	}
+	walk("", reflect.ValueOf(self).Elem())
+	return fields
+}
+
+func (self *configField) String() string {
+	v := self.value
+	switch v.Kind() {
+	case reflect.Slice:
+		var ss []string
+		for i := 0; i < v.Len(); i++ {
+			ss = append(ss, fmt.Sprint(v.Index(i).Interface()))
+		}
+		return strings.Join(ss, ",")
+	case reflect.Map:
+		var ss []string
+		for _, k := range v.MapKeys() {
+			ss = append(ss, fmt.Sprint(k.Interface())+"="+fmt.Sprint(v.MapIndex(k).Interface()))
+		}
+		sort.Strings(ss)
+		return strings.Join(ss, ",")
+	}
+	if d, ok := v.Interface().(Duration); ok {
+		return time.Duration(d).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (self *configField) set(s string) error {
+	v := self.value
+	if d, ok := v.Addr().Interface().(*Duration); ok {
+		return d.set(s)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("'" + s + "' isn't a bool.")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("'" + s + "' isn't an integer.")
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(splitConfigList(s)))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, item := range splitConfigList(s) {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return errors.New("'" + item + "' isn't 'key=value'.")
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if value.Kind() == reflect.Int {
+				i, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+				if err != nil {
+					return errors.New("'" + kv[1] + "' isn't an integer.")
+				}
+				value.SetInt(int64(i))
+			} else {
+				value.SetString(strings.TrimSpace(kv[1]))
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(kv[0])), value)
+		}
+		v.Set(m)
+	default:
+		return errors.New("type " + v.Type().String() + " is unsupported.")
+	}
+	return nil
+}
+
+func splitConfigList(s string) []string {
+	var ss []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ss = append(ss, item)
+		}
+	}
+	return ss
+}
+
+// Set sets the field of key.
+func (self *Config) Set(key, value string) error {
+	for _, field := range self.fields() {
+		if field.key == key {
+			if err := field.set(value); err != nil {
+				return errors.New("config '" + key + "' is invalid, " + err.Error())
+			}
+			return nil
+		}
+	}
+	return errors.New("config '" + key + "' is unknown.")
+}
+
+// ApplyEnv sets the fields by the environment variables, environ is the
+// list of 'KEY=value' like os.Environ().
+func (self *Config) ApplyEnv(environ []string) error {
+	values := map[string]string{}
+	for _, kv := range environ {
+		if idx := strings.IndexByte(kv, '='); idx > 0 && strings.HasPrefix(kv, ConfigEnvPrefix) {
+			values[kv[:idx]] = kv[idx+1:]
+		}
+	}
+	for _, field := range self.fields() {
+		name := ConfigEnvPrefix + strings.ToUpper(field.key)
+		if value, ok := values[name]; ok {
+			if err := field.set(value); err != nil {
+				return errors.New("environment variable " + name + " is invalid, " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigFlags are the command-line flags of Config, only the flags that are
+// set are applied.
+type ConfigFlags struct {
+	keys   []string
+	values map[string]string
+}
+
+type configFlag struct {
+	flags  *ConfigFlags
+	key    string
+	def    string
+	isBool bool
+}
+
+func (self *configFlag) String() string { return self.def }
+
+func (self *configFlag) IsBoolFlag() bool { return self.isBool }
+
+func (self *configFlag) Set(s string) error {
+	if err := DefaultConfig().Set(self.key, s); err != nil {
+		return err
+	}
+	if _, ok := self.flags.values[self.key]; !ok {
+		self.flags.keys = append(self.flags.keys, self.key)
+	}
+	self.flags.values[self.key] = s
+	return nil
+}
+
+// NewConfigFlags defines the flags of all keys in fs.
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	flags := &ConfigFlags{values: map[string]string{}}
+	for _, field := range DefaultConfig().fields() {
+		var def string
+		if !field.value.IsZero() {
+			def = field.String()
+		}
+		fs.Var(&configFlag{flags: flags,
+			key:    field.key,
+			def:    def,
+			isBool: field.value.Kind() == reflect.Bool}, field.key, field.usage)
+	}
+	return flags
+}
+
+// Apply sets the fields of the flags that are set.
+func (self *ConfigFlags) Apply(cfg *Config) error {
+	for _, key := range self.keys {
+		if err := cfg.Set(key, self.values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate returns all errors of the config.
+func (self *Config) Validate() error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch self.EventFormat {
+	case "", EventText, EventJSON:
+	default:
+		add(errors.New("event format '" + self.EventFormat + "' is unknown."))
+	}
+	opts, err := self.options()
+	add(err)
+	if err == nil {
+		_, err := newLoggers(opts)
+		add(err)
+		add(opts.Storage.validate())
+	}
+
+	if self.Cluster.Address != "" && self.Cluster.Dir == "" {
+		add(ErrClusterDirMissing)
+	}
+
+	for idx, link := range self.Federation {
+		if link.Address == "" {
+			add(fmt.Errorf("address of federation[%d] is missing.", idx))
+		}
+		if len(link.Topics) == 0 && len(link.Queues) == 0 {
+			add(fmt.Errorf("federation[%d] has no topics and queues.", idx))
+		}
+	}
+	for idx, shovel := range self.Shovels {
+		add(shovel.Source.validate(fmt.Sprintf("shovels[%d] source", idx)))
+		add(shovel.Destination.validate(fmt.Sprintf("shovels[%d] destination", idx)))
+	}
+
+	declared := map[string]bool{}
+	for idx, dest := range self.Destinations {
+		if dest.Type != mq_client.QUEUE && dest.Type != mq_client.TOPIC {
+			add(fmt.Errorf("type of destinations[%d] must is 'queue' or 'topic'.", idx))
+		}
+		if dest.Name == "" {
+			add(fmt.Errorf("name of destinations[%d] is missing.", idx))
+		}
+		if declared[dest.Type+"/"+dest.Name] {
+			add(fmt.Errorf("%s '%s' is declared twice.", dest.Type, dest.Name))
+		}
+		declared[dest.Type+"/"+dest.Name] = true
+		if dest.Type == mq_client.QUEUE && (dest.Partitions > 0 || dest.Log) {
+			add(fmt.Errorf("queue '%s' can't have partitions or log.", dest.Name))
+		}
+	}
+
+	users := map[string]bool{"*": true}
+	for idx, user := range self.Users {
+		if user.Name == "" || user.Name == "*" {
+			add(fmt.Errorf("name of users[%d] is invalid.", idx))
+		} else if users[user.Name] {
+			add(fmt.Errorf("user '%s' is declared twice.", user.Name))
+		}
+		users[user.Name] = true
+	}
+	for idx, policy := range self.Policies {
+		if !users[policy.User] {
+			add(fmt.Errorf("user '%s' of policies[%d] isn't found.", policy.User, idx))
+		}
+		if policy.Type != mq_client.QUEUE && policy.Type != mq_client.TOPIC && policy.Type != "*" {
+			add(fmt.Errorf("type of policies[%d] must is 'queue', 'topic' or '*'.", idx))
+		}
+		if policy.Name == "" {
+			add(fmt.Errorf("name of policies[%d] is missing.", idx))
+		}
+		if len(policy.Actions) == 0 {
+			add(fmt.Errorf("actions of policies[%d] are missing.", idx))
+		}
+		for _, action := range policy.Actions {
+			if !policyActions[action] {
+				add(fmt.Errorf("action '%s' of policies[%d] is unknown.", action, idx))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Options validates the config and returns the options of server.
+func (self *Config) Options() (*Options, error) {
+	if err := self.Validate(); err != nil {
+		return nil, err
+	}
+	return self.options()
+}
+
+func (self *Config) options() (*Options, error) {
+	opts := &Options{ID: self.ID,
+		Verbose:             self.Verbose,
+		TCPAddress:          self.Address,
+		SSLAddress:          self.SSL.Address,
+		SSLCertFile:         self.SSL.CertFile,
+		SSLKeyFile:          self.SSL.KeyFile,
+		MsgBufferSize:       self.Msg.BufferSize,
+		MsgTimeout:          time.Duration(self.Msg.Timeout),
+		MsgQueueCapacity:    self.Msg.QueueCapacity,
+		NoopInterval:        time.Duration(self.Msg.NoopInterval),
+		MaxConnections:      self.Limits.MaxConnections,
+		MaxConnectionsPerIP: self.Limits.MaxConnectionsPerIP,
+		HandshakeTimeout:    time.Duration(self.Limits.HandshakeTimeout),
+		HttpEnabled:         self.HTTP.Enabled,
+		HttpPrefix:          self.HTTP.Prefix,
+		HttpRedirectUrl:     self.HTTP.RedirectUrl,
+		SessionExpires:      time.Duration(self.HTTP.SessionExpires),
+		Log: LogOptions{Level: self.Log.Level,
+			Format: self.Log.Format,
+			Levels: self.Log.Levels},
+		EventFormat:  self.EventFormat,
+		SnapshotFile: self.Snapshot,
+		TopicLog: TopicLogOptions{Topics: append([]string(nil), self.TopicLog.Topics...),
+			Size: self.TopicLog.Size},
+		Storage: StorageOptions{Engine: self.Storage.Engine,
+			Engines:      map[string]string{},
+			Dir:          self.Storage.Dir,
+			SegmentSize:  self.Storage.SegmentSize,
+			Sync:         self.Storage.Sync,
+			SyncInterval: time.Duration(self.Storage.SyncInterval)},
+		Shovels: self.Shovels,
+		Cluster: ClusterOptions{Address: self.Cluster.Address,
+			Advertise: self.Cluster.Advertise,
+			Peers:     self.Cluster.Peers,
+			Queues:    self.Cluster.Queues,
+			Dir:       self.Cluster.Dir},
+		Config: self,
+	}
+	for name, engine := range self.Storage.Engines {
+		opts.Storage.Engines[name] = engine
+	}
+	if len(self.Partitions) > 0 {
+		opts.Partitions = map[string]int{}
+		for name, count := range self.Partitions {
+			opts.Partitions[name] = count
+		}
+	}
+
+	if self.UnixSocket != "" {
+		opts.Listeners = append(opts.Listeners, ListenerOptions{Network: "unix", Address: self.UnixSocket})
+	}
+	for idx, listener := range self.Listeners {
+		lopts := ListenerOptions{Network: listener.Network,
+			Address:          listener.Address,
+			CertFile:         listener.CertFile,
+			KeyFile:          listener.KeyFile,
+			HttpEnabled:      listener.HttpEnabled,
+			HandshakeTimeout: time.Duration(listener.HandshakeTimeout)}
+		switch lopts.Network {
+		case "", "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return nil, fmt.Errorf("network of listeners[%d] is unknown.", idx)
+		}
+		if listener.Mode != "" {
+			mode, err := strconv.ParseUint(listener.Mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mode of listeners[%d] isn't octal.", idx)
+			}
+			lopts.Mode = os.FileMode(mode)
+		}
+		opts.Listeners = append(opts.Listeners, lopts)
+	}
+
+	for _, link := range self.Federation {
+		opts.Federation = append(opts.Federation, FederationLink{Name: link.Name,
+			Address: link.Address,
+			Topics:  link.Topics,
+			Queues:  link.Queues,
+			MaxHops: link.MaxHops})
+	}
+
+	for _, dest := range self.Destinations {
+		if dest.Engine != "" {
+			opts.Storage.Engines[dest.Name] = dest.Engine
+		}
+		if dest.Type != mq_client.TOPIC {
+			continue
+		}
+		if dest.Partitions > 0 {
+			if opts.Partitions == nil {
+				opts.Partitions = map[string]int{}
+			}
+			opts.Partitions[dest.Name] = dest.Partitions
+		}
+		if dest.Log {
+			opts.TopicLog.Topics = append(opts.TopicLog.Topics, dest.Name)
+		}
+	}
+	return opts, nil
+}
+
+// Declare creates the queues and the topics of Destinations, it returns
+// the errors of the destinations whose storages can't be opened, the other
+// destinations are still created.
+func (self *Config) Declare(srv *Server) error {
+	var errs []error
+	for _, dest := range self.Destinations {
+		if dest.Type == mq_client.QUEUE {
+			if err := storageError(srv.CreateQueueIfNotExists(dest.Name).storage); err != nil {
+				errs = append(errs, err)
+			}
+		} else {
+			topic := srv.CreateTopicIfNotExists(dest.Name)
+			if topic.log == nil {
+				continue
+			}
+			if err := storageError(topic.log.storage); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
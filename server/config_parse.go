@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// config parsers
+// parseYAML and parseTOML decode the documents by gopkg.in/yaml.v3 and
+// github.com/BurntSushi/toml into maps, lists and scalars, which are
+// converted to Config by encoding/json. a plain yaml number keeps its text,
+// so that 'mode: 0660' is read by a string field as it is written.
+
+// yamlNumber is an int or a float in yaml, text is as it is written.
+type yamlNumber struct {
+	text  string
+	value interface{}
+}
+
+func (self yamlNumber) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.value)
+}
+
+func parseYAML(bs []byte) (interface{}, error) {
+	var doc yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(bs))
+	if err := decoder.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); err == nil {
+		return nil, errors.New("multiple documents are unsupported.")
+	}
+	return yamlValue(&doc)
+}
+
+func yamlValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return map[string]interface{}{}, nil
+		}
+		return yamlValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(node.Alias)
+	case yaml.SequenceNode:
+		list := make([]interface{}, 0, len(node.Content))
+		for _, item := range node.Content {
+			value, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		m := map[string]interface{}{}
+		var merged []map[string]interface{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, item := node.Content[i], node.Content[i+1]
+			value, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			if key.Tag == "!!merge" {
+				// '<<: *a' or '<<: [*a, *b]', the first one wins.
+				list, ok := value.([]interface{})
+				if !ok {
+					list = []interface{}{value}
+				}
+				for _, v := range list {
+					if mm, ok := v.(map[string]interface{}); ok {
+						merged = append(merged, mm)
+					} else {
+						return nil, fmt.Errorf("line %d: merge value isn't a mapping.", key.Line)
+					}
+				}
+				continue
+			}
+			m[key.Value] = value
+		}
+		for _, mm := range merged {
+			for k, v := range mm {
+				if _, ok := m[k]; !ok {
+					m[k] = v
+				}
+			}
+		}
+		return m, nil
+	}
+
+	switch node.Tag {
+	case "!!null":
+		return nil, nil
+	case "!!int", "!!float":
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return yamlNumber{text: node.Value, value: value}, nil
+	case "!!bool":
+		var value bool
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	return node.Value, nil
+}
+
+func parseTOML(bs []byte) (interface{}, error) {
+	doc := map[string]interface{}{}
+	if _, err := toml.NewDecoder(bytes.NewReader(bs)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// coerceConfig converts the scalars of doc to the types of the fields of t,
+// so that 'port: 80' is read by a string field.
+func coerceConfig(doc interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				name := strings.Split(f.Tag.Get("json"), ",")[0]
+				if value, ok := v[name]; ok {
+					v[name] = coerceConfig(value, f.Type)
+				}
+			}
+		case reflect.Map:
+			for key, value := range v {
+				v[key] = coerceConfig(value, t.Elem())
+			}
+		}
+		return v
+	case []interface{}:
+		if t.Kind() == reflect.Slice {
+			for idx, value := range v {
+				v[idx] = coerceConfig(value, t.Elem())
+			}
+		}
+		return v
+	case []map[string]interface{}:
+		// an array of tables in toml.
+		list := make([]interface{}, 0, len(v))
+		for _, value := range v {
+			list = append(list, value)
+		}
+		return coerceConfig(list, t)
+	case yamlNumber:
+		if t.Kind() == reflect.String {
+			return v.text
+		}
+		return v.value
+	case time.Time:
+		if t.Kind() == reflect.String {
+			// the local dates and times of toml.
+			switch v.Location().String() {
+			case "date-local":
+				return v.Format("2006-01-02")
+			case "time-local":
+				return v.Format("15:04:05.999999999")
+			case "datetime-local":
+				return v.Format("2006-01-02T15:04:05.999999999")
+			}
+			return v.Format(time.RFC3339Nano)
+		}
+	case int, int64, float64, bool:
+		if t.Kind() == reflect.String {
+			return fmt.Sprint(v)
+		}
+	}
+	return doc
+}
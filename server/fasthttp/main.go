@@ -1,25 +1,25 @@
 package fast
 
 import (
-	"bytes"
-	"encoding/json"
+	"bufio"
 	"errors"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"time"
 
-	mq_client "github.com/runner-mei/fastmq/client"
 	mq_server "github.com/runner-mei/fastmq/server"
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
 )
 
 var ErrHandlerType = errors.New("handler isn't fasthttp.RequestHandler.")
 
 func FastConnection(srv *mq_server.Server) (mq_server.ByPass, error) {
 	engine := &fastEngine{srv: srv,
-		prefix:       []byte(srv.GetOptions().HttpPrefix),
-		is_redirect:  "" != srv.GetOptions().HttpRedirectUrl,
-		redirect_url: srv.GetOptions().HttpRedirectUrl}
+		debug:  fasthttpadaptor.NewFastHTTPHandler(http.DefaultServeMux),
+		router: mq_server.NewHttpRouter(srv)}
 	if nil != srv.GetOptions().HttpHandler {
 		handler, ok := srv.GetOptions().HttpHandler.(fasthttp.RequestHandler)
 		if !ok {
@@ -34,19 +34,14 @@ func FastConnection(srv *mq_server.Server) (mq_server.ByPass, error) {
 		}
 	}
 
-	if len(engine.prefix) == 0 {
-		engine.prefix = nil
-	}
-
 	return engine, nil
 }
 
 type fastEngine struct {
-	srv          *mq_server.Server
-	handler      fasthttp.RequestHandler
-	prefix       []byte
-	is_redirect  bool
-	redirect_url string
+	srv     *mq_server.Server
+	handler fasthttp.RequestHandler
+	debug   fasthttp.RequestHandler
+	router  *mq_server.HttpRouter
 }
 
 func (self *fastEngine) Close() error {
@@ -55,54 +50,10 @@ func (self *fastEngine) Close() error {
 
 func (self *fastEngine) On(conn net.Conn) {
 	err := fasthttp.ServeConn(conn, func(ctx *fasthttp.RequestCtx) {
-		url_path := ctx.Path()
-		if nil != self.prefix {
-			if !bytes.HasPrefix(url_path, self.prefix) {
-				if self.is_redirect {
-					ctx.Redirect(self.redirect_url, fasthttp.StatusMovedPermanently)
-					return
-				}
-				ctx.NotFound()
-				return
-			}
-			url_path = bytes.TrimPrefix(url_path, self.prefix)
-		}
-
-		if bytes.Equal(url_path, []byte("/mq/queues")) {
-			self.queuesIndex(ctx)
-		} else if bytes.Equal(url_path, []byte("/mq/topics")) {
-			self.topicsIndex(ctx)
-		} else if bytes.Equal(url_path, []byte("/mq/clients")) {
-			self.clientsIndex(ctx)
-		} else if bytes.HasPrefix(url_path, []byte("/mq/queues/")) {
-			url_path = bytes.TrimPrefix(url_path, []byte("/mq/queues/"))
-			if len(url_path) == 0 {
-				self.queuesIndex(ctx)
-				return
-			}
-
-			self.doHandler(ctx, bytes.TrimPrefix(url_path, []byte("/mq/queues/")),
-				func(name []byte) *mq_server.Consumer {
-					return self.srv.CreateQueueIfNotExists(string(name)).ListenOn()
-				},
-				func(name []byte) mq_server.Producer {
-					return self.srv.CreateQueueIfNotExists(string(name))
-				})
-		} else if bytes.HasPrefix(url_path, []byte("/mq/topics/")) {
-			url_path = bytes.TrimPrefix(url_path, []byte("/mq/topics/"))
-			if len(url_path) == 0 {
-				self.queuesIndex(ctx)
-				return
-			}
-
-			self.doHandler(ctx, bytes.TrimPrefix(url_path, []byte("/mq/topics/")),
-				func(name []byte) *mq_server.Consumer {
-					return self.srv.CreateTopicIfNotExists(string(name)).ListenOn()
-				},
-				func(name []byte) mq_server.Producer {
-					return self.srv.CreateTopicIfNotExists(string(name))
-				})
-		} else {
+		switch self.router.Serve(&fastContext{ctx: ctx}) {
+		case mq_server.ROUTE_DEBUG:
+			self.debug(ctx)
+		case mq_server.ROUTE_HANDLER:
 			self.handler(ctx)
 		}
 	})
@@ -112,87 +63,70 @@ func (self *fastEngine) On(conn net.Conn) {
 	}
 }
 
-func (self *fastEngine) doHandler(ctx *fasthttp.RequestCtx,
-	url_path []byte, recv_cb func(name []byte) *mq_server.Consumer,
-	send_cb func(name []byte) mq_server.Producer) {
-	url_path = bytes.TrimSuffix(url_path, []byte("/"))
-	uri := ctx.URI()
-
-	method := ctx.Method()
-	if bytes.Equal(method, []byte("GET")) {
-		timeout := GetTimeout(uri, 1*time.Second)
-		timer := time.NewTimer(timeout)
-		consumer := recv_cb(url_path)
-		defer consumer.Close()
-
-		select {
-		case msg, ok := <-consumer.C:
-			timer.Stop()
-			if !ok {
-				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
-				ctx.Write([]byte("queue is closed."))
-				return
-			}
-
-			ctx.Response.Header.Set("Content-Type", "text/plain")
-			ctx.SetStatusCode(fasthttp.StatusOK)
-			if msg.DataLength() > 0 {
-				ctx.Write(msg.Data())
-			}
-		case <-timer.C:
-			ctx.SetStatusCode(fasthttp.StatusNoContent)
-		}
-	} else if bytes.Equal(method, []byte("PUT")) || bytes.Equal(method, []byte("POST")) {
-		bs := ctx.PostBody()
-		timeout := GetTimeout(uri, 0)
-		msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(bs)+10).Append(bs).Build()
-		send := send_cb(url_path)
-		var err error
-		if timeout == 0 {
-			err = send.Send(msg)
-		} else {
-			err = send.SendTimeout(msg, timeout)
-		}
-		// fmt.Println("===================", msg.DataLength(), mq_client.ToCommandName(msg.Command()), err, timeout, url_path)
-		ctx.Response.Header.Set("Content-Type", "text/plain")
-		if err != nil {
-			ctx.SetStatusCode(fasthttp.StatusRequestTimeout)
-			ctx.Write([]byte(err.Error()))
-		} else {
-			ctx.SetStatusCode(fasthttp.StatusOK)
-			ctx.Write([]byte("OK"))
-		}
-	} else {
-		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
-		ctx.Write([]byte("Method must is PUT or GET."))
-	}
+func GetTimeout(uri *fasthttp.URI, value time.Duration) time.Duration {
+	return mq_server.ParseTimeout(string(uri.QueryArgs().Peek("timeout")), value)
 }
 
-func GetTimeout(uri *fasthttp.URI, value time.Duration) time.Duration {
-	s := uri.QueryArgs().Peek("timeout")
-	if len(s) == 0 {
-		return value
-	}
-	t, e := time.ParseDuration(string(s))
-	if nil != e {
-		return value
-	}
-	return t
+// fastContext is the HttpContext of fasthttp.
+type fastContext struct {
+	ctx *fasthttp.RequestCtx
+}
+
+func (self *fastContext) Method() string {
+	return string(self.ctx.Method())
+}
+
+func (self *fastContext) Path() string {
+	return string(self.ctx.Path())
+}
+
+func (self *fastContext) EscapedPath() string {
+	return string(self.ctx.URI().PathOriginal())
+}
+
+func (self *fastContext) Query(name string) string {
+	return string(self.ctx.QueryArgs().Peek(name))
+}
+
+func (self *fastContext) Header(name string) string {
+	return string(self.ctx.Request.Header.Peek(name))
+}
+
+func (self *fastContext) RemoteAddr() string {
+	return self.ctx.RemoteAddr().String()
+}
+
+func (self *fastContext) Body() ([]byte, error) {
+	return self.ctx.PostBody(), nil
 }
 
-func (self *fastEngine) queuesIndex(ctx *fasthttp.RequestCtx) {
-	ctx.SetStatusCode(fasthttp.StatusOK)
-	json.NewEncoder(ctx).Encode(self.srv.GetQueues())
+func (self *fastContext) SetHeader(name, value string) {
+	self.ctx.Response.Header.Set(name, value)
 }
 
-func (self *fastEngine) topicsIndex(ctx *fasthttp.RequestCtx) {
-	ctx.SetStatusCode(fasthttp.StatusOK)
-	json.NewEncoder(ctx).Encode(self.srv.GetTopics())
+func (self *fastContext) WriteHeader(code int) {
+	self.ctx.SetStatusCode(code)
 }
 
-func (self *fastEngine) clientsIndex(ctx *fasthttp.RequestCtx) {
-	ctx.SetStatusCode(fasthttp.StatusOK)
-	json.NewEncoder(ctx).Encode(self.srv.GetClients())
+func (self *fastContext) Write(bs []byte) (int, error) {
+	return self.ctx.Write(bs)
+}
+
+func (self *fastContext) Stream(cb func(w io.Writer, flush func() error, done <-chan struct{})) error {
+	self.ctx.SetStatusCode(fasthttp.StatusOK)
+	self.ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		// flush returns an error if the client is disconnected.
+		cb(w, w.Flush, nil)
+	})
+	return nil
+}
+
+func (self *fastContext) Hijack(cb func(conn net.Conn, br *bufio.Reader)) error {
+	self.ctx.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+	self.ctx.Hijack(func(conn net.Conn) {
+		cb(conn, nil)
+	})
+	return nil
 }
 
 func init() {
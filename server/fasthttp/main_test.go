@@ -1,11 +1,14 @@
 package fast
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	mq_client "github.com/runner-mei/fastmq/client"
 	mq_server "github.com/runner-mei/fastmq/server"
@@ -77,7 +80,7 @@ func TestServerHttpQueuePush(t *testing.T) {
 			t.Error("body is", string(bs))
 			return
 		}
-	default:
+	case <-time.After(1 * time.Second):
 		//fmt.Println("===========")
 		//case <-time.After(10 * time.Second):
 		t.Error("msg isnot recv")
@@ -94,7 +97,7 @@ func TestServerHttpQueueGet(t *testing.T) {
 	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
 
 	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, 8+3).Append([]byte("AAA")).Build()
-	srv.CreateQueueIfNotExists("aa").C <- msg
+	srv.CreateQueueIfNotExists("aa").Send(msg)
 
 	//fmt.Println(string(msg.Data()))
 	res, err := http.Get("http://127.0.0.1" + srv.GetOptions().TCPAddress + "/mq/queues/aa")
@@ -116,3 +119,347 @@ func TestServerHttpQueueGet(t *testing.T) {
 		return
 	}
 }
+
+func TestServerWebSocket(t *testing.T) {
+	srv, err := mq_server.NewServer(&mq_server.Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.GetOptions().TCPAddress
+	pub, err := mq_client.Connect("ws", address).ToQueue("ws")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+	if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, err := mq_client.DialWebSocket("ws://" + address + "/mq/ws?mode=json")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	ws.WriteMessage(mq_client.WS_TEXT, []byte(`{"command": "sub", "type": "queue", "name": "ws"}`))
+	for _, excepted := range []string{`{"command":"ack"}`, `{"command":"data","body":"hello"}`} {
+		_, payload, err := ws.ReadMessage()
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		if excepted != string(payload) {
+			t.Error("recv", string(payload))
+		}
+	}
+}
+
+func TestServerHttpTopicEvents(t *testing.T) {
+	srv, err := mq_server.NewServer(&mq_server.Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	res, err := http.Get("http://127.0.0.1" + srv.GetOptions().TCPAddress + "/mq/topics/t/events")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Error("content type is", ct)
+	}
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			srv.CreateTopicIfNotExists("t").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build())
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	rd := bufio.NewReader(res.Body)
+	for _, excepted := range []string{": keepalive\n", "\n", "id: 1\n", "data: hello\n", "\n"} {
+		line, err := rd.ReadString('\n')
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		if excepted != line {
+			t.Errorf("excepted is %q, actual is %q", excepted, line)
+		}
+	}
+}
+
+func TestServerHttpTopicSession(t *testing.T) {
+	srv, err := mq_server.NewServer(&mq_server.Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	url := "http://127.0.0.1" + srv.GetOptions().TCPAddress + "/mq/topics/t/sessions"
+	res, err := http.Post(url, "text/plain", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	location := res.Header.Get("Location")
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || !strings.HasPrefix(location, "/mq/topics/t/sessions/") {
+		t.Error("status code is", res.Status, location)
+		return
+	}
+
+	srv.CreateTopicIfNotExists("t").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("1")).Build())
+	res, err = http.Get("http://127.0.0.1" + srv.GetOptions().TCPAddress + location)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || "[1]" != string(bs) {
+		t.Error("recv", res.Status, string(bs))
+	}
+
+	req, _ := http.NewRequest("DELETE", "http://127.0.0.1"+srv.GetOptions().TCPAddress+location, nil)
+	res, err = http.DefaultClient.Do(req)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Error("status code is", res.Status)
+	}
+	if sessions := srv.GetSessions(); len(sessions) != 0 {
+		t.Error("sessions is", sessions)
+	}
+}
+
+func TestServerHttpBatchPush(t *testing.T) {
+	srv, err := mq_server.NewServer(&mq_server.Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	res, err := http.Post("http://127.0.0.1"+srv.GetOptions().TCPAddress+"/mq/queues/aa?batch=json", "application/json", strings.NewReader(`["a", 1]`))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	var result mq_server.BatchResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK || result.Total != 2 || result.Accepted != 2 {
+		t.Error("result is", res.Status, result)
+	}
+
+	q := srv.CreateQueueIfNotExists("aa")
+	for _, excepted := range []string{"a", "1"} {
+		select {
+		case msg := <-q.C:
+			if excepted != string(msg.Body()) {
+				t.Error("body is", string(msg.Body()))
+			}
+		case <-time.After(1 * time.Second):
+			t.Error("msg isnot recv")
+		}
+	}
+}
+
+func TestServerHttpBatchGet(t *testing.T) {
+	srv, err := mq_server.NewServer(&mq_server.Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	q := srv.CreateQueueIfNotExists("bb")
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte{0, 0xff}).Build())
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+
+	res, err := http.Get("http://127.0.0.1" + srv.GetOptions().TCPAddress + "/mq/queues/bb?format=json")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+
+	var items []struct {
+		Body []byte `json:"body"`
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("X-HW-Batch") != "2" {
+		t.Error("status code is", res.Status)
+	} else if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+		t.Error(err)
+	} else if len(items) != 2 || !bytes.Equal(items[0].Body, []byte{0, 0xff}) || string(items[1].Body) != "a" {
+		t.Error("items is", items)
+	}
+}
+
+func TestServerHttpAdmin(t *testing.T) {
+	srv, err := mq_server.NewServer(&mq_server.Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	q := srv.CreateQueueIfNotExists("q2")
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+
+	for _, test := range []struct {
+		method   string
+		path     string
+		excepted int
+		body     string
+	}{
+		{"GET", "/mq/queues/q2/stats", http.StatusOK, `"depth":1`},
+		{"POST", "/mq/queues/q2/purge", http.StatusOK, `{"purged":1}`},
+		{"DELETE", "/mq/queues/q2", http.StatusOK, `{"deleted":"q2"}`},
+		{"DELETE", "/mq/queues/q2", http.StatusNotFound, `{"code":404,"error":"queue isn't found."}`},
+		{"DELETE", "/mq/clients/abc", http.StatusNotFound, `{"code":404,"error":"client isn't found."}`},
+	} {
+		req, _ := http.NewRequest(test.method, "http://127.0.0.1"+srv.GetOptions().TCPAddress+test.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		bs, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.excepted || !strings.Contains(string(bs), test.body) {
+			t.Error(test.method, test.path, res.Status, string(bs))
+		}
+	}
+}
+
+type conformanceCase struct {
+	method   string
+	path     string
+	body     string
+	excepted int
+	contains string
+}
+
+// TestHttpConformance runs the same requests against all engines.
+func TestHttpConformance(t *testing.T) {
+	old := mq_server.ConnectionHandle
+	defer func() {
+		mq_server.ConnectionHandle = old
+	}()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	run := func(t *testing.T, opts *mq_server.Options, cases []conformanceCase) {
+		srv, err := mq_server.NewServer(opts)
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer srv.Close()
+		defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+		for _, test := range cases {
+			req, _ := http.NewRequest(test.method, "http://127.0.0.1"+srv.GetOptions().TCPAddress+test.path, strings.NewReader(test.body))
+			res, err := client.Do(req)
+			if nil != err {
+				t.Error(test.method, test.path, err)
+				return
+			}
+			bs, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != test.excepted {
+				t.Error(test.method, test.path, "status code is", res.Status, string(bs))
+			} else if !strings.Contains(string(bs), test.contains) &&
+				!strings.Contains(res.Header.Get("Location"), test.contains) {
+				t.Error(test.method, test.path, "body is", string(bs))
+			}
+		}
+		client.CloseIdleConnections()
+	}
+
+	for _, engine := range []struct {
+		name   string
+		handle func(srv *mq_server.Server) (mq_server.ByPass, error)
+	}{
+		{"standard", mq_server.StandardConnection},
+		{"fasthttp", FastConnection},
+	} {
+		mq_server.ConnectionHandle = engine.handle
+
+		t.Run(engine.name, func(t *testing.T) {
+			run(t, &mq_server.Options{HttpEnabled: true}, []conformanceCase{
+				{"GET", "/mq/queues", "", http.StatusOK, "null"},
+				{"GET", "/mq/topics/", "", http.StatusOK, "_sys.events"},
+				{"GET", "/mq/clients", "", http.StatusOK, "null"},
+				{"GET", "/mq/stats", "", http.StatusOK, "{"},
+				{"GET", "/mq/snapshot", "", http.StatusMethodNotAllowed, "Method must is POST."},
+				{"PUT", "/mq/queues/q1", "a", http.StatusOK, "OK"},
+				{"PUT", "/mq/queues/q1", "b", http.StatusOK, "OK"},
+				{"GET", "/mq/queues/q1?batch=true", "", http.StatusOK, "[a,b]"},
+				{"GET", "/mq/queues/q1?timeout=10ms", "", http.StatusNoContent, ""},
+				{"PATCH", "/mq/queues/q1", "", http.StatusMethodNotAllowed, "Method must is PUT or GET."},
+				{"POST", "/mq/queues/q1?batch=lines", "a\nb\n", http.StatusOK, `"accepted":2`},
+				{"GET", "/mq/queues/q1/stats", "", http.StatusOK, `"depth":2`},
+				{"GET", "/mq/queues/q1/peek?count=1", "", http.StatusOK, `"body":"YQ=="`},
+				{"POST", "/mq/queues/q1/peek", "", http.StatusMethodNotAllowed, `"code":405`},
+				{"GET", "/mq/queues/q1/peek", "", http.StatusOK, `"depth":2`},
+				{"DELETE", "/mq/queues/q1", "", http.StatusOK, `"deleted":"q1"`},
+				{"DELETE", "/mq/queues/q1", "", http.StatusNotFound, `"code":404`},
+				{"GET", "/mq/queues/q1/abc", "", http.StatusNotFound, "resource isn't found."},
+				{"PUT", "/mq/topics/topics%2Ft1", "a", http.StatusOK, "OK"},
+				{"GET", "/mq/topics/topics%2Ft1/stats", "", http.StatusOK, `"name":"topics/t1"`},
+				{"GET", "/mq/topics/t1/stats", "", http.StatusNotFound, `"code":404`},
+				{"POST", "/mq/topics/t1/sessions", "", http.StatusCreated, `"topic":"t1"`},
+				{"GET", "/mq/topics/t1/sessions/abc", "", http.StatusNotFound, "session isn't found."},
+				{"PUT", "/mq/topics/a%2Fsessions%2Fb", "a", http.StatusOK, "OK"},
+				{"GET", "/mq/topics/a%2Fsessions%2Fb/stats", "", http.StatusOK, `"name":"a/sessions/b"`},
+				{"PUT", "/mq/topics/a%2Fevents", "a", http.StatusOK, "OK"},
+				{"GET", "/mq/topics/a%2Fevents/stats", "", http.StatusOK, `"name":"a/events"`},
+				{"GET", "/mq/topics/a/stats", "", http.StatusNotFound, `"code":404`},
+				{"PUT", "/mq/topics/a/b", "a", http.StatusNotFound, "resource isn't found."},
+				{"GET", "/mq/ws", "", http.StatusBadRequest, "websocket upgrade is required."},
+				{"DELETE", "/mq/clients/abc", "", http.StatusNotFound, "client isn't found."},
+				{"DELETE", "/mq/shovels/abc", "", http.StatusNotFound, ""},
+				{"GET", "/debug/pprof", "", http.StatusMovedPermanently, "/debug/pprof/"},
+				{"GET", "/debug/pprof/", "", http.StatusOK, "goroutine"},
+				{"GET", "/abc", "", http.StatusNotFound, ""},
+			})
+
+			run(t, &mq_server.Options{HttpEnabled: true,
+				HttpPrefix:      "/hw",
+				HttpRedirectUrl: "/hw/index.html"}, []conformanceCase{
+				{"GET", "/hw/mq/queues", "", http.StatusOK, "null"},
+				{"PUT", "/hw/mq/queues/q1", "a", http.StatusOK, "OK"},
+				{"GET", "/hw/mq/queues/q1", "", http.StatusOK, "a"},
+				{"GET", "/mq/queues", "", http.StatusMovedPermanently, "/hw/index.html"},
+				{"GET", "/debug/pprof/", "", http.StatusOK, "goroutine"},
+			})
+		})
+	}
+}
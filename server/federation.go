@@ -0,0 +1,324 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+const (
+	HEADER_ORIGIN = "origin"
+	HEADER_HOPS   = "hops"
+)
+
+var ErrFederationSameID = errors.New("federation peer has the same id as this server.")
+
+// FederationLink subscribes the topics and queues on the upstream server and
+// republishes the messages to the same destinations of the local server.
+//
+// Messages are stamped with the id of the server that they are published
+// first, so servers that are linked each other must have different ID, a
+// link is refused by the upstream server that has the same ID.
+type FederationLink struct {
+	Name    string
+	Address string
+	Topics  []string
+	Queues  []string
+
+	// MaxHops is the maximum count of links that a message passes, default is 1.
+	MaxHops int
+}
+
+// stampFederation adds the origin and hops headers to the message that is
+// sent to the federation link of peer, it returns true if the message comes
+// from the peer.
+func (self *Server) stampFederation(msg mq_client.Message, peer string) (mq_client.Message, bool) {
+	origin := msg.Header(HEADER_ORIGIN)
+	if origin == peer {
+		return nil, true
+	}
+
+	hops := 0
+	if origin == "" {
+		origin = strconv.FormatInt(self.options.ID, 10)
+	} else {
+		hops, _ = strconv.Atoi(msg.Header(HEADER_HOPS))
+	}
+	return msg.WithHeaders(map[string]string{
+		HEADER_ORIGIN: origin,
+		HEADER_HOPS:   strconv.Itoa(hops + 1),
+	}), false
+}
+
+// checkPublished checks the headers of a message that is published by a
+// client and removes the federation headers, so that a client can't forge
+// where a message comes from.
+func checkPublished(msg mq_client.Message) (mq_client.Message, error) {
+	if mq_client.MSG_HDATA != msg.Command() {
+		return msg, nil
+	}
+	headers := msg.Headers()
+	if err := mq_client.CheckHeaders(headers); err != nil {
+		return nil, err
+	}
+	_, has_origin := headers[HEADER_ORIGIN]
+	_, has_hops := headers[HEADER_HOPS]
+	if !has_origin && !has_hops {
+		return msg, nil
+	}
+	delete(headers, HEADER_ORIGIN)
+	delete(headers, HEADER_HOPS)
+	return mq_client.BuildMessageWithHeaders(headers, msg.Body()), nil
+}
+
+type federation struct {
+	srv          *Server
+	config       FederationLink
+	id           string
+	closed       int32
+	S            chan struct{}
+	destinations []*federationDestination
+}
+
+func (self *federation) isClosed() bool {
+	return 0 != atomic.LoadInt32(&self.closed)
+}
+
+func (self *federation) Close() error {
+	if !atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		return ErrAlreadyClosed
+	}
+	close(self.S)
+
+	for _, dest := range self.destinations {
+		dest.lock.Lock()
+		if dest.sub != nil {
+			dest.sub.Close()
+		}
+		dest.lock.Unlock()
+	}
+	return nil
+}
+
+func (self *federation) Stats() map[string]interface{} {
+	destinations := make([]map[string]interface{}, 0, len(self.destinations))
+	for _, dest := range self.destinations {
+		destinations = append(destinations, dest.Stats())
+	}
+
+	return map[string]interface{}{
+		"name":         self.config.Name,
+		"address":      self.config.Address,
+		"max_hops":     self.config.MaxHops,
+		"destinations": destinations,
+	}
+}
+
+type federationDestination struct {
+	connect_last_at int64
+	connected       int32
+	connect_total   uint32
+	message_total   uint32
+	loop_total      uint32
+
+	link *federation
+	typ  string
+	name string
+
+	lock       sync.Mutex
+	sub        *mq_client.Subscription
+	last_error error
+}
+
+func (self *federationDestination) Stats() map[string]interface{} {
+	var lastErr string
+	self.lock.Lock()
+	if self.last_error != nil {
+		lastErr = self.last_error.Error()
+	}
+	self.lock.Unlock()
+
+	return map[string]interface{}{
+		"type":            self.typ,
+		"name":            self.name,
+		"connected":       0 != atomic.LoadInt32(&self.connected),
+		"connect_last_at": time.Unix(0, atomic.LoadInt64(&self.connect_last_at)),
+		"connect_total":   atomic.LoadUint32(&self.connect_total),
+		"message_total":   atomic.LoadUint32(&self.message_total),
+		"loop_total":      atomic.LoadUint32(&self.loop_total),
+		"last_error":      lastErr,
+	}
+}
+
+func (self *federationDestination) destination() Channel {
+	if self.typ == mq_client.QUEUE {
+		return self.link.srv.CreateQueueIfNotExists(self.name)
+	}
+	return self.link.srv.CreateTopicIfNotExists(self.name)
+}
+
+func (self *federationDestination) setSubscription(sub *mq_client.Subscription) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if sub != nil && self.link.isClosed() {
+		return false
+	}
+	self.sub = sub
+	return true
+}
+
+func (self *federationDestination) setError(err error) {
+	self.lock.Lock()
+	self.last_error = err
+	self.lock.Unlock()
+}
+
+func (self *federationDestination) runLoop() {
+	builder := mq_client.Connect("tcp", self.link.config.Address).
+		Id("_federation." + self.link.id)
+	options := map[string]string{"federation": self.link.id}
+
+	err_count := 0
+	for !self.link.isClosed() {
+		atomic.AddUint32(&self.connect_total, 1)
+		err := self.runOnce(builder, options)
+		if err != nil {
+			self.setError(err)
+			err_count++
+			if err_count < 5 || 0 == err_count%50 {
+				self.log().error("federation is disconnected", "error", err)
+			}
+		} else {
+			err_count = 0
+		}
+
+		interval := 200 * time.Millisecond
+		if err_count > 5 {
+			interval = 2 * time.Second
+		}
+		select {
+		case <-self.link.S:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (self *federationDestination) log() *logger {
+	return self.link.srv.logger(LogFederation).with("upstream", self.link.config.Address,
+		"type", self.typ, "dest", self.name)
+}
+
+func (self *federationDestination) runOnce(builder *mq_client.ClientBuilder, options map[string]string) error {
+	sub, err := builder.Listen(self.typ, self.name, options)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	if !self.setSubscription(sub) {
+		return nil
+	}
+	defer self.setSubscription(nil)
+
+	self.log().info("federation is connected")
+	atomic.StoreInt64(&self.connect_last_at, time.Now().UnixNano())
+	atomic.StoreInt32(&self.connected, 1)
+	defer atomic.StoreInt32(&self.connected, 0)
+
+	err = sub.Run(self.onMessage)
+	if err == nil && !self.link.isClosed() {
+		err = errors.New("connection is closed by upstream.")
+	}
+	if self.link.isClosed() {
+		return nil
+	}
+	return err
+}
+
+func (self *federationDestination) onMessage(sub *mq_client.Subscription, msg mq_client.Message) {
+	switch msg.Command() {
+	case mq_client.MSG_DATA, mq_client.MSG_HDATA:
+	case mq_client.MSG_NOOP:
+		return
+	default:
+		self.log().error("recv unexcepted message", "command", mq_client.ToCommandName(msg.Command()))
+		return
+	}
+
+	hops, _ := strconv.Atoi(msg.Header(HEADER_HOPS))
+	if msg.Header(HEADER_ORIGIN) == self.link.id || hops > self.link.config.MaxHops {
+		atomic.AddUint32(&self.loop_total, 1)
+		return
+	}
+
+	atomic.AddUint32(&self.message_total, 1)
+	if err := self.destination().Connect().Send(msg); err != nil {
+		self.log().error("fail to send message", "error", err)
+	}
+}
+
+// normalize returns the link that the defaults are filled.
+func (self FederationLink) normalize() FederationLink {
+	if self.MaxHops <= 0 {
+		self.MaxHops = 1
+	}
+	if self.Name == "" {
+		self.Name = self.Address
+	}
+	return self
+}
+
+func (self *Server) startFederation(config FederationLink) *federation {
+	config = config.normalize()
+
+	link := &federation{
+		srv:    self,
+		config: config,
+		id:     strconv.FormatInt(self.options.ID, 10),
+		S:      make(chan struct{}),
+	}
+	for _, name := range config.Topics {
+		link.destinations = append(link.destinations, &federationDestination{
+			link: link,
+			typ:  mq_client.TOPIC,
+			name: name,
+		})
+	}
+	for _, name := range config.Queues {
+		link.destinations = append(link.destinations, &federationDestination{
+			link: link,
+			typ:  mq_client.QUEUE,
+			name: name,
+		})
+	}
+
+	for _, dest := range link.destinations {
+		dest.destination()
+		self.RunItInGoroutine(dest.runLoop)
+	}
+	return link
+}
+
+func (self *Server) closeFederations() {
+	self.federations_lock.Lock()
+	defer self.federations_lock.Unlock()
+	for _, link := range self.federations {
+		link.Close()
+	}
+}
+
+func (self *Server) GetFederations() []map[string]interface{} {
+	self.federations_lock.Lock()
+	defer self.federations_lock.Unlock()
+
+	results := make([]map[string]interface{}, 0, len(self.federations))
+	for _, link := range self.federations {
+		results = append(results, link.Stats())
+	}
+	return results
+}
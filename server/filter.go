@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// subscription filter
+// a subscriber of a topic receives only the messages that match the 'filter'
+// option, the filter is conditions that are joined by '&&' and '||', '&&'
+// binds tighter than '||'. a condition is 'selector op value':
+//
+//	selector - header.<name>, body or json.<path>, path is names or indexes
+//	           of arrays that are separated by '.'.
+//	op       - '==', '!=', '^=' (prefix) or '~=' (regexp).
+//	value    - a quoted string, or a word without spaces, quotes and the
+//	           characters of operators.
+//
+// for example: header.type == alarm && json.device.id ^= "dev-1". a header
+// selector matches nothing if the header is missing, and a json selector
+// matches nothing if the body isn't json or the field is missing, except
+// '!='. a header with an empty value isn't missing.
+
+var ErrFilterUnsupported = errors.New("filter isn't supported by queues and consumer groups.")
+
+const (
+	selectHeader = iota
+	selectBody
+	selectJSON
+)
+
+type condition struct {
+	selector int
+	name     string
+	path     []string
+	op       string
+	value    string
+	re       *regexp.Regexp
+}
+
+type Filter struct {
+	expr string
+	or   [][]condition
+}
+
+func filterError(expr, msg string) error {
+	return errors.New("filter '" + expr + "' is invalid, " + msg + ".")
+}
+
+// ParseFilter parses a filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := splitFilter(expr)
+	if err != nil {
+		return nil, filterError(expr, err.Error())
+	}
+
+	filter := &Filter{expr: expr}
+	var and []condition
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, filterError(expr, "condition is incomplete")
+		}
+		cond, err := parseCondition(tokens[0], tokens[1], tokens[2])
+		if err != nil {
+			return nil, filterError(expr, err.Error())
+		}
+		and = append(and, cond)
+		tokens = tokens[3:]
+
+		if len(tokens) == 0 {
+			break
+		}
+		switch tokens[0] {
+		case "&&":
+		case "||":
+			filter.or = append(filter.or, and)
+			and = nil
+		default:
+			return nil, filterError(expr, "'&&' or '||' is excepted before '"+tokens[0]+"'")
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, filterError(expr, "condition is missing at the end")
+		}
+	}
+	if len(and) == 0 {
+		return nil, filterError(expr, "it is empty")
+	}
+	filter.or = append(filter.or, and)
+	return filter, nil
+}
+
+// splitFilter splits expr into words, quoted strings and operators.
+func splitFilter(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, errors.New("quote isn't closed")
+			}
+			tokens = append(tokens, expr[i:end+1])
+			i = end + 1
+		case i+1 < len(expr) && isFilterOperator(expr[i:i+2]):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			end := i
+			for ; end < len(expr) && !strings.ContainsRune(" \t\"=!^~&|", rune(expr[end])); end++ {
+			}
+			if end == i {
+				return nil, errors.New("'" + expr[i:i+1] + "' is unexcepted")
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func isFilterOperator(s string) bool {
+	switch s {
+	case "==", "!=", "^=", "~=", "&&", "||":
+		return true
+	}
+	return false
+}
+
+func parseCondition(selector, op, value string) (condition, error) {
+	var cond condition
+	switch {
+	case selector == "body":
+		cond.selector = selectBody
+	case strings.HasPrefix(selector, "header."):
+		cond.selector = selectHeader
+		cond.name = strings.TrimPrefix(selector, "header.")
+	case strings.HasPrefix(selector, "json."):
+		cond.selector = selectJSON
+		cond.path = strings.Split(strings.TrimPrefix(selector, "json."), ".")
+	default:
+		return cond, errors.New("selector '" + selector + "' is unknown")
+	}
+
+	if op == "&&" || op == "||" || !isFilterOperator(op) {
+		return cond, errors.New("operator is excepted after '" + selector + "'")
+	}
+	cond.op = op
+
+	if strings.HasPrefix(value, "\"") {
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return cond, errors.New("string " + value + " is invalid")
+		}
+		value = s
+	} else if isFilterOperator(value) {
+		return cond, errors.New("value is excepted after '" + op + "'")
+	}
+	cond.value = value
+
+	if op == "~=" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return cond, err
+		}
+		cond.re = re
+	}
+	return cond, nil
+}
+
+func (self *condition) match(value string, exists bool) bool {
+	if !exists {
+		return self.op == "!="
+	}
+	switch self.op {
+	case "==":
+		return value == self.value
+	case "!=":
+		return value != self.value
+	case "^=":
+		return strings.HasPrefix(value, self.value)
+	default:
+		return self.re.MatchString(value)
+	}
+}
+
+// jsonField returns the field at path as a string, a string field is
+// returned without quotes, other fields are returned as json.
+func jsonField(doc interface{}, path []string) (string, bool) {
+	for _, name := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			field, ok := v[name]
+			if !ok {
+				return "", false
+			}
+			doc = field
+		case []interface{}:
+			idx, err := strconv.Atoi(name)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return "", false
+			}
+			doc = v[idx]
+		default:
+			return "", false
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s, true
+	}
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		return "", false
+	}
+	return string(bs), true
+}
+
+func (self *Filter) String() string {
+	return self.expr
+}
+
+// Match returns true if msg matches the filter, the body is decoded once if
+// the filter has json selectors.
+func (self *Filter) Match(msg mq_client.Message) bool {
+	var doc interface{}
+	var decoded, invalid bool
+
+	for _, and := range self.or {
+		matched := true
+		for i := range and {
+			cond := &and[i]
+			var value string
+			exists := true
+			switch cond.selector {
+			case selectHeader:
+				value, exists = msg.LookupHeader(cond.name)
+			case selectBody:
+				value = string(msg.Body())
+			case selectJSON:
+				if !decoded {
+					decoded = true
+					decoder := json.NewDecoder(bytes.NewReader(msg.Body()))
+					decoder.UseNumber()
+					invalid = decoder.Decode(&doc) != nil
+				}
+				if invalid {
+					exists = false
+				} else {
+					value, exists = jsonField(doc, cond.path)
+				}
+			}
+			if !cond.match(value, exists) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// accept returns true if msg matches the filter of consumer, the count and
+// time of evaluations are added to the consumer and its topic.
+func (self *Consumer) accept(msg mq_client.Message) bool {
+	if self.filter == nil {
+		return true
+	}
+	started := time.Now()
+	ok := self.filter.Match(msg)
+	elapsed := uint64(time.Since(started))
+
+	atomic.AddUint32(&self.FilterCount, 1)
+	atomic.AddUint64(&self.filter_nanos, elapsed)
+	if !ok {
+		atomic.AddUint32(&self.FilteredCount, 1)
+	}
+	if self.topic != nil {
+		atomic.AddUint64(&self.topic.filter_total, 1)
+		atomic.AddUint64(&self.topic.filter_nanos, elapsed)
+		if !ok {
+			atomic.AddUint64(&self.topic.filtered_total, 1)
+		}
+	}
+	return ok
+}
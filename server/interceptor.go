@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// interceptors
+// Options.Interceptors are called in order when a message is published by a
+// native or http client, when it is delivered to a subscriber and when it is
+// dropped. they are called in the goroutines of clients, so they should
+// return quickly.
+
+var ErrSubscriberFull = errors.New("subscriber is full.")
+
+// MessageContext is the destination and the client of a message.
+type MessageContext struct {
+	// Type is 'queue' or 'topic'.
+	Type string
+	Name string
+
+	// Client is the id of client, it may be empty.
+	Client     string
+	RemoteAddr string
+}
+
+type Interceptor interface {
+	// OnPublish is called before msg is enqueued, it returns the message
+	// that is enqueued, or an error to reject msg.
+	OnPublish(ctx *MessageContext, msg mq_client.Message) (mq_client.Message, error)
+
+	// OnDeliver is called before msg is sent to a subscriber, it returns
+	// the message that is sent.
+	OnDeliver(ctx *MessageContext, msg mq_client.Message) mq_client.Message
+
+	// OnDrop is called if msg is rejected, it fails to be enqueued, or a
+	// subscriber of topic is full.
+	OnDrop(ctx *MessageContext, msg mq_client.Message, reason error)
+}
+
+// InterceptorFuncs is an Interceptor of functions, a nil function is skipped.
+type InterceptorFuncs struct {
+	Publish func(ctx *MessageContext, msg mq_client.Message) (mq_client.Message, error)
+	Deliver func(ctx *MessageContext, msg mq_client.Message) mq_client.Message
+	Drop    func(ctx *MessageContext, msg mq_client.Message, reason error)
+}
+
+func (self *InterceptorFuncs) OnPublish(ctx *MessageContext, msg mq_client.Message) (mq_client.Message, error) {
+	if self.Publish == nil {
+		return msg, nil
+	}
+	return self.Publish(ctx, msg)
+}
+
+func (self *InterceptorFuncs) OnDeliver(ctx *MessageContext, msg mq_client.Message) mq_client.Message {
+	if self.Deliver == nil {
+		return msg
+	}
+	return self.Deliver(ctx, msg)
+}
+
+func (self *InterceptorFuncs) OnDrop(ctx *MessageContext, msg mq_client.Message, reason error) {
+	if self.Drop != nil {
+		self.Drop(ctx, msg, reason)
+	}
+}
+
+type interceptors []Interceptor
+
+func (self interceptors) publish(ctx *MessageContext, msg mq_client.Message) (mq_client.Message, error) {
+	for _, interceptor := range self {
+		var err error
+		if msg, err = interceptor.OnPublish(ctx, msg); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+func (self interceptors) deliver(ctx *MessageContext, msg mq_client.Message) mq_client.Message {
+	for _, interceptor := range self {
+		msg = interceptor.OnDeliver(ctx, msg)
+	}
+	return msg
+}
+
+func (self interceptors) deliverAll(ctx *MessageContext, msgs []mq_client.Message) {
+	if len(self) == 0 {
+		return
+	}
+	for idx, msg := range msgs {
+		msgs[idx] = self.deliver(ctx, msg)
+	}
+}
+
+func (self interceptors) drop(ctx *MessageContext, msg mq_client.Message, reason error) {
+	for _, interceptor := range self {
+		interceptor.OnDrop(ctx, msg, reason)
+	}
+}
+
+// interceptedProducer calls the interceptors before messages are sent to
+// producer, the id of client is read when a message is sent, because the
+// client may change it.
+type interceptedProducer struct {
+	interceptors interceptors
+	ctx          MessageContext
+	client       *Client
+	producer     Producer
+}
+
+func (self *interceptedProducer) context() *MessageContext {
+	ctx := self.ctx
+	if self.client != nil {
+		ctx.Client = self.client.id()
+	}
+	return &ctx
+}
+
+func (self *interceptedProducer) Send(msg mq_client.Message) error {
+	return self.SendTimeout(msg, 0)
+}
+
+func (self *interceptedProducer) SendTimeout(msg mq_client.Message, timeout time.Duration) error {
+	ctx := self.context()
+	msg, err := self.interceptors.publish(ctx, msg)
+	if err == nil {
+		if timeout == 0 {
+			err = self.producer.Send(msg)
+		} else {
+			err = self.producer.SendTimeout(msg, timeout)
+		}
+	}
+	if err != nil {
+		self.interceptors.drop(ctx, msg, err)
+	}
+	return err
+}
+
+// intercept returns producer if there isn't any interceptor.
+func (self *Server) intercept(ctx MessageContext, client *Client, producer Producer) Producer {
+	if len(self.interceptors) == 0 {
+		return producer
+	}
+	return &interceptedProducer{interceptors: self.interceptors,
+		ctx:      ctx,
+		client:   client,
+		producer: producer}
+}
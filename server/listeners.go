@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerOptions is an additional listener of server, clients connect to
+// any listener with the same protocol.
+type ListenerOptions struct {
+	// Network is tcp, tcp4, tcp6 or unix, default is tcp.
+	Network string
+	// Address is the address to listen on, it is the path of socket file
+	// if Network is unix.
+	Address string
+	// Mode is the permissions of the unix socket file, default is 0660.
+	Mode os.FileMode
+
+	// TLS is enabled if both CertFile and KeyFile are set.
+	CertFile string
+	KeyFile  string
+
+	// HttpEnabled accepts the http requests on this listener, it works only
+	// if Options.HttpEnabled is true.
+	HttpEnabled bool
+
+	// HandshakeTimeout overrides Options.HandshakeTimeout if it isn't 0.
+	HandshakeTimeout time.Duration
+}
+
+type serverListener struct {
+	net.Listener
+	options ListenerOptions
+	closed  int32
+}
+
+// Close closes the listener once, so that Shutdown and Close can both close it.
+func (self *serverListener) Close() error {
+	if !atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		return nil
+	}
+	return self.Listener.Close()
+}
+
+func listen(opts ListenerOptions) (net.Listener, error) {
+	if opts.Address == "" {
+		return nil, errors.New("listener address is missing.")
+	}
+
+	var listener net.Listener
+	var err error
+	switch opts.Network {
+	case "", "tcp", "tcp4", "tcp6":
+		network := opts.Network
+		if network == "" {
+			network = "tcp"
+		}
+		listener, err = net.Listen(network, opts.Address)
+	case "unix":
+		// remove the socket file that is left by a crashed server.
+		if fi, e := os.Stat(opts.Address); e == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(opts.Address)
+		}
+		listener, err = net.Listen("unix", opts.Address)
+		if err == nil {
+			mode := opts.Mode
+			if mode == 0 {
+				mode = 0660
+			}
+			if err = os.Chmod(opts.Address, mode); err != nil {
+				listener.Close()
+			}
+		}
+	default:
+		return nil, errors.New("network '" + opts.Network + "' is unsupported.")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	return listener, nil
+}
+
+func (self *Server) closeListeners() error {
+	var err error
+	for _, l := range self.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// leveled logging
+// a log is written to Log.Logger if its level isn't less than the level of
+// its subsystem, the level of a subsystem is Log.Levels[subsystem] or
+// Log.Level. if Log.Logger is nil, the logs are written to the legacy
+// Options.Logger, or to Log.Output in Log.Format.
+
+type Logger = mq_client.Logger
+
+// the subsystems of logs.
+const (
+	LogServer     = "server"
+	LogTCP        = "tcp"
+	LogHTTP       = "http"
+	LogCluster    = "cluster"
+	LogQueue      = "queue"
+	LogTopic      = "topic"
+	LogStorage    = "storage"
+	LogFederation = "federation"
+	LogShovel     = "shovel"
+	LogSession    = "session"
+)
+
+var logSubsystems = []string{LogServer, LogTCP, LogHTTP, LogCluster, LogQueue,
+	LogTopic, LogStorage, LogFederation, LogShovel, LogSession}
+
+type LogOptions struct {
+	Logger Logger
+
+	// Format is 'text' (default) or 'json', Output is os.Stderr by default.
+	Format string
+	Output io.Writer
+
+	// Level is 'debug', 'info', 'warn' or 'error', the default is 'info', or
+	// 'debug' if Options.Verbose is true. Levels are the levels of
+	// subsystems.
+	Level  string
+	Levels map[string]string
+}
+
+// levels returns the levels of all subsystems.
+func (self *LogOptions) levels(verbose bool) (map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	if self.Level != "" {
+		var err error
+		if level, err = mq_client.ParseLevel(self.Level); err != nil {
+			return nil, err
+		}
+	}
+
+	levels := map[string]slog.Level{}
+	for _, name := range logSubsystems {
+		levels[name] = level
+	}
+	for name, s := range self.Levels {
+		if _, ok := levels[name]; !ok {
+			return nil, errors.New("log subsystem '" + name + "' is unknown.")
+		}
+		l, err := mq_client.ParseLevel(s)
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = l
+	}
+	return levels, nil
+}
+
+type logger struct {
+	out   Logger
+	level *slog.LevelVar
+	args  []any
+}
+
+// newLoggers creates the loggers of subsystems.
+func newLoggers(opts *Options) (map[string]*logger, error) {
+	levels, err := opts.Log.levels(opts.Verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	out := opts.Log.Logger
+	if out == nil {
+		if opts.Logger != nil {
+			out = mq_client.NewStdLogger(opts.Logger, slog.LevelDebug)
+		} else {
+			w := opts.Log.Output
+			if w == nil {
+				w = os.Stderr
+			}
+			if out, err = mq_client.NewLogger(w, opts.Log.Format, slog.LevelDebug); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	loggers := map[string]*logger{}
+	for name, level := range levels {
+		l := &logger{out: out, level: new(slog.LevelVar), args: []any{"subsystem", name}}
+		l.level.Set(level)
+		loggers[name] = l
+	}
+	return loggers, nil
+}
+
+func (self *logger) with(args ...any) *logger {
+	return &logger{out: self.out, level: self.level, args: self.fields(args)}
+}
+
+func (self *logger) fields(args []any) []any {
+	return append(append(make([]any, 0, len(self.args)+len(args)), self.args...), args...)
+}
+
+func (self *logger) enabled(level slog.Level) bool {
+	return level >= self.level.Level()
+}
+
+func (self *logger) debug(msg string, args ...any) {
+	if self.enabled(slog.LevelDebug) {
+		self.out.Debug(msg, self.fields(args)...)
+	}
+}
+
+func (self *logger) info(msg string, args ...any) {
+	if self.enabled(slog.LevelInfo) {
+		self.out.Info(msg, self.fields(args)...)
+	}
+}
+
+func (self *logger) warn(msg string, args ...any) {
+	if self.enabled(slog.LevelWarn) {
+		self.out.Warn(msg, self.fields(args)...)
+	}
+}
+
+func (self *logger) error(msg string, args ...any) {
+	if self.enabled(slog.LevelError) {
+		self.out.Error(msg, self.fields(args)...)
+	}
+}
+
+// logger returns the logger of subsystem.
+func (self *Server) logger(subsystem string) *logger {
+	if l, ok := self.loggers[subsystem]; ok {
+		return l
+	}
+	return self.loggers[LogServer]
+}
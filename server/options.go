@@ -1,20 +1,34 @@
 package server
 
 import (
-	"crypto/md5"
-	"hash/crc32"
-	"io"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
 )
 
 type Options struct {
 	// basic options
+	// ID is random by default, because the servers that are linked by
+	// federation must have different ID. the random id is kept in the
+	// storage dir or next to the snapshot file, so that it is the same after
+	// a restart, it is required by federation links if neither is set.
 	ID         int64
 	Verbose    bool
 	TCPAddress string
 
+	// Listeners are the listeners besides TCPAddress.
+	Listeners []ListenerOptions
+
 	// https options
 	SSLAddress  string
 	SSLCertFile string
@@ -26,27 +40,70 @@ type Options struct {
 	MsgQueueCapacity int
 	NoopInterval     time.Duration
 
+	// connection limits, 0 is unlimited.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	HandshakeTimeout    time.Duration
+
 	HttpEnabled     bool
 	HttpPrefix      string
 	HttpRedirectUrl string
 	HttpHandler     interface{}
 
-	Watch  Watcher
+	// SessionExpires is the default idle expiry of http consumer sessions.
+	SessionExpires time.Duration
+
+	Watch Watcher
+
+	// Log is the leveled logger, Logger is the legacy logger that is used
+	// if Log.Logger is nil.
+	Log    LogOptions
 	Logger *log.Logger
-}
 
-func (self *Options) ensureDefault() {
-	if self.ID == 0 {
-		hostname, err := os.Hostname()
-		if err != nil {
-			log.Fatal(err)
-		}
+	// EventFormat is the format of the events of _sys.events, it is
+	// 'text' (default) or 'json'.
+	EventFormat string
 
-		h := md5.New()
-		io.WriteString(h, hostname)
-		self.ID = int64(crc32.ChecksumIEEE(h.Sum(nil)) % 1024)
-	}
+	// Interceptors are called in order when a message is published,
+	// delivered or dropped.
+	Interceptors []Interceptor
+
+	// Dump receives the messages that are still in a queue when the server
+	// is closed, they are dropped if both Dump and SnapshotFile are empty.
+	// it receives the messages that are still buffered for the subscribers
+	// and the consumer groups of a topic too, a message that is buffered for
+	// several of them is passed once, they are dropped if Dump is nil.
+	Dump func(typ, name string, msgs []mq_client.Message) error
+
+	// SnapshotFile keeps the messages of all queues and the logs of topics
+	// while the server is closed, it is loaded again by NewServer, which
+	// fails if the file can't be loaded. the partitions of consumer groups
+	// aren't kept in it.
+	SnapshotFile string
 
+	// TopicLog keeps the messages of topics, so that subscribers can replay them.
+	TopicLog TopicLogOptions
+
+	// Partitions is the count of partitions of topics by name, subscribers
+	// of these topics join a consumer group with the 'group' option.
+	Partitions map[string]int
+
+	// Storage selects the storage engines of queues and topic logs.
+	Storage StorageOptions
+
+	Federation []FederationLink
+	Shovels    []Shovel
+
+	Cluster ClusterOptions
+
+	// Config is the config that the options are created from, ReloadConfig
+	// reads the config again for Reload. Reload is unsupported if either
+	// is nil.
+	Config       *Config
+	ReloadConfig func() (*Config, error)
+}
+
+func (self *Options) ensureDefault() {
 	if self.TCPAddress == "" {
 		self.TCPAddress = ":4150"
 	}
@@ -70,7 +127,73 @@ func (self *Options) ensureDefault() {
 		self.NoopInterval = 1 * time.Minute
 	}
 
-	if self.Logger == nil {
-		self.Logger = log.New(os.Stderr, "[aa] ", log.Ldate|log.Ltime|log.Lmicroseconds)
+	if self.SessionExpires <= 0 {
+		self.SessionExpires = 1 * time.Minute
+	}
+
+	if self.HandshakeTimeout <= 0 {
+		self.HandshakeTimeout = 10 * time.Second
+	}
+}
+
+var ErrFederationNoID = errors.New("id is required by federation links if neither storage dir nor snapshot file is set.")
+
+// ensureID generates the id if it isn't set, the id that is generated is
+// read from the id file again at the next start.
+func (self *Options) ensureID() error {
+	if self.ID != 0 {
+		return nil
+	}
+	file := self.idFile()
+	if file == "" {
+		if len(self.Federation) > 0 {
+			return ErrFederationNoID
+		}
+		self.ID = randomID()
+		return nil
+	}
+
+	bs, err := ioutil.ReadFile(file)
+	if err == nil {
+		id, err := strconv.ParseInt(strings.TrimSpace(string(bs)), 10, 64)
+		if err != nil || id <= 0 {
+			return errors.New("id file '" + file + "' is invalid.")
+		}
+		self.ID = id
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	id := randomID()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := writeFileSync(file, []byte(strconv.FormatInt(id, 10))); err != nil {
+		return err
+	}
+	self.ID = id
+	return nil
+}
+
+// idFile returns the file that keeps the generated id.
+func (self *Options) idFile() string {
+	if self.Storage.Dir != "" {
+		return filepath.Join(self.Storage.Dir, "server.id")
+	}
+	if self.SnapshotFile != "" {
+		return self.SnapshotFile + ".id"
+	}
+	return ""
+}
+
+// randomID returns a random positive id, so the servers that don't set ID
+// differ even if they run on the same host.
+func randomID() int64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()%math.MaxInt32 + 1
 	}
+	return int64(binary.BigEndian.Uint64(b[:])%math.MaxInt32) + 1
 }
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// partitioned topic
+// a topic that is listed in Options.Partitions spreads its messages over N
+// partitions, the partition of a message is the hash of the 'key' header,
+// so the messages with the same key keep their order. the messages without
+// a key are spread round robin.
+//
+// a subscriber joins a consumer group with the 'group=<name>' option. every
+// group keeps a queue for each partition, and every partition is assigned
+// to one member of the group. partitions are assigned again when a member
+// joins or leaves. a group is kept after its members leave, its queues keep
+// the messages until they are full.
+
+const HEADER_KEY = "key"
+
+var ErrTopicNotPartitioned = errors.New("topic isn't a partitioned topic.")
+
+type partitions struct {
+	srv      *Server
+	topic    *Topic
+	count    int
+	capacity int
+	next     uint32
+	last_id  int32
+
+	lock   sync.Mutex
+	groups map[string]*consumerGroup
+}
+
+func newPartitions(srv *Server, topic *Topic, count int) *partitions {
+	return &partitions{srv: srv,
+		topic:    topic,
+		count:    count,
+		capacity: topic.capacity,
+		groups:   map[string]*consumerGroup{}}
+}
+
+// partition returns the partition of msg.
+func (self *partitions) partition(msg mq_client.Message) int {
+	key := msg.Key()
+	if key == "" {
+		return int(atomic.AddUint32(&self.next, 1) % uint32(self.count))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(self.count))
+}
+
+// send appends msg to the partition of every group, it waits until timeout
+// if the partition is full, a message is dropped if timeout is 0. id is the
+// topic-level id of msg.
+func (self *partitions) send(msg mq_client.Message, id uint64, timeout time.Duration) {
+	p := self.partition(msg)
+
+	self.lock.Lock()
+	groups := make([]*consumerGroup, 0, len(self.groups))
+	for _, group := range self.groups {
+		groups = append(groups, group)
+	}
+	self.lock.Unlock()
+
+	for _, group := range groups {
+		if err := group.queues[p].enqueueId(msg, id, timeout, nil); err != nil {
+			atomic.AddUint32(&group.discard_count, 1)
+			self.topic.dropped(msg, err)
+		}
+	}
+}
+
+// join adds a member to the group, the group is created if it doesn't exist.
+func (self *partitions) join(name string) *Consumer {
+	self.lock.Lock()
+	group, ok := self.groups[name]
+	if !ok {
+		group = &consumerGroup{name: name,
+			queues:  make([]*Queue, self.count),
+			owners:  make([]*Consumer, self.count),
+			changed: make(chan struct{}),
+			closing: make(chan struct{})}
+		for p := range group.queues {
+			group.queues[p] = creatQueue(self.srv, self.topic.name+"/"+name+"/"+strconv.Itoa(p), self.capacity,
+				&partitionStorage{})
+			go group.feed(p)
+		}
+		self.groups[name] = group
+	}
+	self.lock.Unlock()
+
+	member := &Consumer{group: group,
+		id: int(atomic.AddInt32(&self.last_id, 1)),
+		C:  make(chan mq_client.Message)}
+	group.lock.Lock()
+	group.members = append(group.members, member)
+	group.rebalance()
+	group.lock.Unlock()
+	return member
+}
+
+func (self *partitions) queues() []*Queue {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var queues []*Queue
+	for _, group := range self.groups {
+		queues = append(queues, group.queues...)
+	}
+	return queues
+}
+
+// Len returns the count of messages that are in the partitions of groups.
+func (self *partitions) Len() int {
+	count := 0
+	for _, q := range self.queues() {
+		count += q.Len()
+	}
+	return count
+}
+
+// drain removes the messages that are still in the partitions of groups,
+// ids are their topic-level ids. a message that is being handed over to a
+// member isn't included.
+func (self *partitions) drain() (msgs []mq_client.Message, ids []uint64) {
+	for _, q := range self.queues() {
+		storage := q.storage.(*partitionStorage)
+		q.do(func() {
+			q.lock.Lock()
+			msgs = append(msgs, storage.messages...)
+			ids = append(ids, storage.ids...)
+			storage.Remove(storage.Len())
+			q.lock.Unlock()
+		})
+		notify(q.space)
+	}
+	return msgs, ids
+}
+
+func (self *partitions) Close() error {
+	self.lock.Lock()
+	groups := self.groups
+	self.groups = map[string]*consumerGroup{}
+	self.lock.Unlock()
+
+	for _, group := range groups {
+		group.Close()
+	}
+	return nil
+}
+
+func (self *partitions) Stats() map[string]interface{} {
+	self.lock.Lock()
+	groups := make(map[string]interface{}, len(self.groups))
+	for name, group := range self.groups {
+		groups[name] = group.Stats()
+	}
+	self.lock.Unlock()
+
+	return map[string]interface{}{
+		"partitions": self.count,
+		"groups":     groups,
+	}
+}
+
+// partitionStorage keeps the topic-level id of every message of a
+// partition, so that a message that is kept by several groups is dumped
+// once.
+type partitionStorage struct {
+	memoryStorage
+	ids []uint64
+}
+
+func (self *partitionStorage) appendId(msg mq_client.Message, id uint64) error {
+	self.memoryStorage.Append(msg)
+	self.ids = append(self.ids, id)
+	return nil
+}
+
+func (self *partitionStorage) Append(msg mq_client.Message) error {
+	return self.appendId(msg, 0)
+}
+
+func (self *partitionStorage) Remove(n int) error {
+	if n > len(self.ids) {
+		n = len(self.ids)
+	}
+	self.ids = self.ids[n:]
+	return self.memoryStorage.Remove(n)
+}
+
+func (self *partitionStorage) Close() error {
+	self.ids = nil
+	return self.memoryStorage.Close()
+}
+
+type consumerGroup struct {
+	name          string
+	queues        []*Queue
+	discard_count uint32
+
+	lock    sync.Mutex
+	members []*Consumer
+	owners  []*Consumer
+
+	// changed is closed and replaced when partitions are assigned again,
+	// sending is held by the feeders while they hand a message over, so
+	// that C of a member isn't closed at the same time.
+	changed    chan struct{}
+	sending    sync.RWMutex
+	closing    chan struct{}
+	close_once sync.Once
+}
+
+// rebalance needs the lock.
+func (self *consumerGroup) rebalance() {
+	for p := range self.owners {
+		if len(self.members) == 0 {
+			self.owners[p] = nil
+		} else {
+			self.owners[p] = self.members[p%len(self.members)]
+		}
+	}
+	close(self.changed)
+	self.changed = make(chan struct{})
+}
+
+func (self *consumerGroup) leave(member *Consumer) {
+	self.lock.Lock()
+	for idx, m := range self.members {
+		if m == member {
+			copy(self.members[idx:], self.members[idx+1:])
+			self.members = self.members[:len(self.members)-1]
+			self.rebalance()
+			break
+		}
+	}
+	self.lock.Unlock()
+
+	self.sending.Lock()
+	close(member.C)
+	self.sending.Unlock()
+}
+
+// feed hands the messages of partition p over to its owner.
+func (self *consumerGroup) feed(p int) {
+	for msg := range self.queues[p].C {
+		for !self.deliver(p, msg) {
+		}
+	}
+}
+
+// deliver returns false if the owner of p is changed before msg is handed over.
+func (self *consumerGroup) deliver(p int, msg mq_client.Message) bool {
+	self.sending.RLock()
+	defer self.sending.RUnlock()
+
+	self.lock.Lock()
+	owner, changed := self.owners[p], self.changed
+	self.lock.Unlock()
+
+	var out chan mq_client.Message
+	if owner != nil {
+		out = owner.C
+	}
+	select {
+	case out <- msg:
+		owner.add()
+		return true
+	case <-changed:
+		return false
+	case <-self.closing:
+		return true
+	}
+}
+
+func (self *consumerGroup) Close() error {
+	self.close_once.Do(func() {
+		close(self.closing)
+		for _, q := range self.queues {
+			q.Close()
+		}
+
+		self.lock.Lock()
+		members := self.members
+		self.lock.Unlock()
+		for _, member := range members {
+			member.Close()
+		}
+	})
+	return nil
+}
+
+func (self *consumerGroup) Stats() map[string]interface{} {
+	self.lock.Lock()
+	assignments := map[int][]int{}
+	for p, owner := range self.owners {
+		if owner != nil {
+			assignments[owner.id] = append(assignments[owner.id], p)
+		}
+	}
+	members := make([]map[string]interface{}, 0, len(self.members))
+	for _, member := range self.members {
+		members = append(members, map[string]interface{}{
+			"id":            member.id,
+			"partitions":    assignments[member.id],
+			"message_count": atomic.LoadUint32(&member.Count),
+		})
+	}
+	self.lock.Unlock()
+
+	depths := make([]int, len(self.queues))
+	for p, q := range self.queues {
+		depths[p] = q.Len()
+	}
+	return map[string]interface{}{
+		"members":       members,
+		"depths":        depths,
+		"discard_count": atomic.LoadUint32(&self.discard_count),
+	}
+}
+
+// GetTopicPartitions returns the consumer groups of the partitioned topic.
+func (self *Server) GetTopicPartitions(name string) (map[string]interface{}, error) {
+	topic := self.GetTopicIfExists(name)
+	if topic == nil {
+		return nil, ErrTopicNotFound
+	}
+	if topic.partitions == nil {
+		return nil, ErrTopicNotPartitioned
+	}
+	return topic.partitions.Stats(), nil
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,34 +33,194 @@ func (self *Anchor) Kill() error {
 }
 
 type Consumer struct {
+	filter_nanos uint64
 	closed       int32
+	overflow     int32
 	topic        *Topic
+	queue        *Queue
+	group        *consumerGroup
+	filter       *Filter
 	id           int
 	C            chan mq_client.Message
-	DiscardCount uint32
-	Count        uint32
+	// done is closed if a consumer that is fed by a topic log is closed.
+	done chan struct{}
+	// sent keeps the ids of the messages that are buffered in C if it is a
+	// subscriber of a topic.
+	sent          *sentIds
+	DiscardCount  uint32
+	Count         uint32
+	FilterCount   uint32
+	FilteredCount uint32
 }
 
-func (self *Consumer) addDiscard() {
-	atomic.AddUint32(&self.Count, 1)
+// addDiscard returns true if it is the first discard after a message is
+// received.
+func (self *Consumer) addDiscard() bool {
+	atomic.AddUint32(&self.DiscardCount, 1)
+	return atomic.CompareAndSwapInt32(&self.overflow, 0, 1)
 }
 
 func (self *Consumer) add() {
-	atomic.AddUint32(&self.DiscardCount, 1)
+	atomic.AddUint32(&self.Count, 1)
+	if atomic.LoadInt32(&self.overflow) != 0 {
+		atomic.StoreInt32(&self.overflow, 0)
+	}
+}
+
+// offer sends msg of a topic to a subscriber, it waits until expired if
+// expired isn't nil. id is the topic-level id of msg.
+func (self *Consumer) offer(msg mq_client.Message, id uint64, expired <-chan time.Time) bool {
+	self.sent.lock.Lock()
+	defer self.sent.lock.Unlock()
+
+	if expired == nil {
+		select {
+		case self.C <- msg:
+		default:
+			return false
+		}
+	} else {
+		select {
+		case self.C <- msg:
+		case <-expired:
+			return false
+		}
+	}
+	self.sent.push(id)
+	self.add()
+	return true
+}
+
+// drainSent removes the messages that are buffered for a subscriber of a
+// topic, ids are their topic-level ids.
+func (self *Consumer) drainSent() (msgs []mq_client.Message, ids []uint64) {
+	self.sent.lock.Lock()
+	defer self.sent.lock.Unlock()
+loop:
+	for {
+		select {
+		case msg, ok := <-self.C:
+			if !ok {
+				break loop
+			}
+			msgs = append(msgs, msg)
+		default:
+			break loop
+		}
+	}
+	return msgs, self.sent.last(len(msgs))
+}
+
+// sentIds keeps the topic-level ids of the last messages that are sent to a
+// subscriber, the messages that are still buffered are the last of them
+// because C is FIFO.
+type sentIds struct {
+	lock  sync.Mutex
+	ids   []uint64
+	next  int
+	count int
+}
+
+func newSentIds(capacity int) *sentIds {
+	return &sentIds{ids: make([]uint64, capacity)}
+}
+
+func (self *sentIds) push(id uint64) {
+	if len(self.ids) == 0 {
+		return
+	}
+	self.ids[self.next] = id
+	self.next = (self.next + 1) % len(self.ids)
+	if self.count < len(self.ids) {
+		self.count++
+	}
+}
+
+// last returns the ids of the last n messages, an id that isn't kept is 0.
+func (self *sentIds) last(n int) []uint64 {
+	ids := make([]uint64, n)
+	for i := range ids {
+		if n-i <= self.count {
+			ids[i] = self.ids[(self.next-n+i+len(self.ids))%len(self.ids)]
+		}
+	}
+	return ids
+}
+
+// Recv waits for a message until ctx is done.
+func (self *Consumer) Recv(ctx context.Context) (mq_client.Message, error) {
+	// a message isn't taken after ctx is done.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case msg, ok := <-self.C:
+		if !ok {
+			return nil, ErrConsumerClosed
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Pending returns the count of messages that are buffered for a subscriber
+// of a topic, the messages of a queue are handed over one by one.
+func (self *Consumer) Pending() int {
+	return len(self.C)
+}
+
+// TryRecv takes a message without waiting.
+func (self *Consumer) TryRecv() (mq_client.Message, bool) {
+	if self.queue != nil {
+		msg := self.queue.take()
+		return msg, msg != nil
+	}
+	select {
+	case msg, ok := <-self.C:
+		return msg, ok
+	default:
+		return nil, false
+	}
 }
 
 func (self *Consumer) Close() error {
+	if nil != self.group {
+		if atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+			self.group.leave(self)
+		}
+		return nil
+	}
 	if nil == self.topic {
 		return nil
 	}
 	if atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
 		self.topic.remove(self.id)
-		close(self.C)
+		if self.done != nil {
+			close(self.done)
+		} else {
+			close(self.C)
+		}
 	}
-	self.topic = nil
 	return nil
 }
 
+// doneContext returns a context that is done if done is closed, done may be
+// nil.
+func doneContext(done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
 type Producer interface {
 	Send(msg mq_client.Message) error
 	SendTimeout(msg mq_client.Message, timeout time.Duration) error
@@ -70,42 +232,298 @@ type Channel interface {
 	ListenOn() *Consumer
 }
 
+// Queue keeps the messages in a Storage, so that they can be peeked, and a
+// goroutine hands them over to the consumers through C one by one.
 type Queue struct {
-	name     string
-	C        chan mq_client.Message
-	consumer Consumer
+	enqueue_total uint64
+	srv           *Server
+	name          string
+	capacity      int
+	C             chan mq_client.Message
+	consumer      Consumer
+	cluster       *cluster
+	rates         rateMeter
+
+	lock    sync.Mutex
+	storage Storage
+
+	// ready and space are signaled when a message is appended or removed,
+	// requests are executed in the goroutine of run, so that they don't
+	// race with the message that is being handed over.
+	ready      chan struct{}
+	space      chan struct{}
+	requests   chan func()
+	closing    chan struct{}
+	stopped    chan struct{}
+	close_once sync.Once
 }
 
-func (self *Queue) Close() error {
-	close(self.C)
-	for range self.C {
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (self *Queue) run() {
+	defer close(self.stopped)
+
+	// head is read again only if it is handed over or a request is executed,
+	// because messages are removed only in this goroutine.
+	var head mq_client.Message
+	for {
+		if head == nil {
+			head = self.first()
+		}
+		var out chan mq_client.Message
+		if head != nil {
+			out = self.C
+		}
+
+		select {
+		case out <- head:
+			self.remove(1)
+			head = nil
+		case <-self.ready:
+		case fn := <-self.requests:
+			fn()
+			head = nil
+		case <-self.closing:
+			return
+		}
+	}
+}
+
+// first returns the first message, a message that can't be read is dropped.
+func (self *Queue) first() mq_client.Message {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for self.storage.Len() > 0 {
+		msgs, err := self.storage.Read(0, 1)
+		if err == nil && len(msgs) > 0 {
+			return msgs[0]
+		}
+		self.srv.logger(LogQueue).error("fail to read message, it is dropped", "dest", self.name, "error", err)
+		if err := self.storage.Remove(1); err != nil {
+			self.srv.logger(LogQueue).error("fail to remove message", "dest", self.name, "error", err)
+			return nil
+		}
+		notify(self.space)
 	}
 	return nil
 }
 
-func (self *Queue) Send(msg mq_client.Message) error {
-	self.C <- msg
+// remove removes the first n messages, it is called in the goroutine of run.
+func (self *Queue) remove(n int) {
+	self.lock.Lock()
+	err := self.storage.Remove(n)
+	self.lock.Unlock()
+
+	if err != nil {
+		self.srv.logger(LogQueue).error("fail to remove messages", "dest", self.name, "error", err)
+	}
+	notify(self.space)
+}
+
+// pop removes and returns the first n messages, it is called in the
+// goroutine of run.
+func (self *Queue) pop(n int) []mq_client.Message {
+	self.lock.Lock()
+	msgs, err := self.storage.Read(0, n)
+	if err != nil {
+		self.srv.logger(LogQueue).error("fail to read messages", "dest", self.name, "error", err)
+	}
+	if len(msgs) > 0 {
+		if err := self.storage.Remove(len(msgs)); err != nil {
+			self.srv.logger(LogQueue).error("fail to remove messages", "dest", self.name, "error", err)
+		}
+	}
+	self.lock.Unlock()
+
+	if len(msgs) > 0 {
+		notify(self.space)
+	}
+	return msgs
+}
+
+// do executes fn in the goroutine of run, so fn sees the messages that are
+// handed over are removed. fn is executed at once if the queue is closed.
+func (self *Queue) do(fn func()) {
+	done := make(chan struct{})
+	select {
+	case self.requests <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-self.stopped:
+		fn()
+	}
+}
+
+func (self *Queue) Close() error {
+	self.close_once.Do(func() {
+		close(self.closing)
+		<-self.stopped
+		close(self.C)
+
+		self.lock.Lock()
+		if err := self.storage.Close(); err != nil {
+			self.srv.logger(LogQueue).error("fail to close storage", "dest", self.name, "error", err)
+		}
+		self.lock.Unlock()
+	})
 	return nil
 }
 
-func (self *Queue) SendTimeout(msg mq_client.Message, timeout time.Duration) error {
-	if timeout == 0 {
+// Durable returns true if the messages are kept by the storage after the
+// queue is closed.
+func (self *Queue) Durable() bool {
+	return self.storage.Durable()
+}
+
+// Len returns the count of messages that are still in the queue.
+func (self *Queue) Len() (n int) {
+	self.do(func() {
+		self.lock.Lock()
+		n = self.storage.Len()
+		self.lock.Unlock()
+	})
+	return n
+}
+
+// Peek returns the first count messages without removing them.
+func (self *Queue) Peek(count int) (msgs []mq_client.Message) {
+	self.do(func() {
+		self.lock.Lock()
+		var err error
+		if msgs, err = self.storage.Read(0, count); err != nil {
+			self.srv.logger(LogQueue).error("fail to read messages", "dest", self.name, "error", err)
+		}
+		self.lock.Unlock()
+	})
+	return msgs
+}
+
+// take removes the first message if it exists.
+func (self *Queue) take() (msg mq_client.Message) {
+	self.do(func() {
+		if msgs := self.pop(1); len(msgs) > 0 {
+			msg = msgs[0]
+		}
+	})
+	return msg
+}
+
+// drain takes all messages that are still in the queue.
+func (self *Queue) drain() (msgs []mq_client.Message) {
+	self.do(func() {
+		self.lock.Lock()
+		n := self.storage.Len()
+		self.lock.Unlock()
+		msgs = self.pop(n)
+	})
+	return msgs
+}
+
+// restore appends msg even if the queue is full, the senders wait until the
+// messages are fewer than the capacity again.
+func (self *Queue) restore(msg mq_client.Message) error {
+	if self.cluster != nil {
+		return ErrQueueReplicated
+	}
+	self.lock.Lock()
+	err := self.storage.Append(msg)
+	self.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&self.enqueue_total, 1)
+	notify(self.ready)
+	return nil
+}
+
+// append needs the lock.
+func (self *Queue) append(msg mq_client.Message, id uint64) error {
+	if storage, ok := self.storage.(*partitionStorage); ok {
+		return storage.appendId(msg, id)
+	}
+	return self.storage.Append(msg)
+}
+
+// enqueue appends msg to the queue, it waits until timeout or cancel if the
+// queue is full, it waits forever if timeout < 0.
+func (self *Queue) enqueue(msg mq_client.Message, timeout time.Duration, cancel <-chan struct{}) error {
+	return self.enqueueId(msg, 0, timeout, cancel)
+}
+
+// enqueueId is enqueue with the topic-level id of msg, the id is kept only
+// by the storage of a partition.
+func (self *Queue) enqueueId(msg mq_client.Message, id uint64, timeout time.Duration, cancel <-chan struct{}) error {
+	var expired <-chan time.Time
+	for {
 		select {
-		case self.C <- msg:
-			return nil
+		case <-self.closing:
+			return ErrAlreadyClosed
 		default:
+		}
+
+		self.lock.Lock()
+		if self.storage.Len() < self.capacity {
+			if err := self.append(msg, id); err != nil {
+				self.lock.Unlock()
+				return err
+			}
+			more := self.storage.Len() < self.capacity
+			self.lock.Unlock()
+
+			atomic.AddUint64(&self.enqueue_total, 1)
+			notify(self.ready)
+			if more {
+				// wake up the next sender that is waiting.
+				notify(self.space)
+			}
+			return nil
+		}
+		self.lock.Unlock()
+
+		if timeout == 0 {
 			return mq_client.ErrQueueFull
 		}
+		if timeout > 0 && expired == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case <-self.space:
+		case <-expired:
+			return mq_client.ErrTimeout
+		case <-cancel:
+			return ErrAlreadyClosed
+		case <-self.closing:
+			return ErrAlreadyClosed
+		}
 	}
+}
 
-	timer := time.NewTimer(timeout)
-	select {
-	case self.C <- msg:
-		timer.Stop()
-		return nil
-	case <-timer.C:
-		return mq_client.ErrTimeout
+func (self *Queue) Send(msg mq_client.Message) error {
+	if self.cluster != nil {
+		return self.cluster.enqueue(self.name, msg, clusterProposeTimeout)
+	}
+	return self.enqueue(msg, -1, nil)
+}
+
+func (self *Queue) SendTimeout(msg mq_client.Message, timeout time.Duration) error {
+	if self.cluster != nil {
+		if timeout <= 0 {
+			timeout = clusterProposeTimeout
+		}
+		return self.cluster.enqueue(self.name, msg, timeout)
 	}
+	return self.enqueue(msg, timeout, nil)
 }
 
 func (self *Queue) ListenOn() *Consumer {
@@ -116,17 +534,89 @@ func (self *Queue) Connect() Producer {
 	return self
 }
 
-func creatQueue(srv *Server, name string, capacity int) *Queue {
-	c := make(chan mq_client.Message, capacity)
-	return &Queue{name: name, C: c, consumer: Consumer{C: c}}
+func creatQueue(srv *Server, name string, capacity int, storage Storage) *Queue {
+	c := make(chan mq_client.Message)
+	q := &Queue{srv: srv,
+		name:     name,
+		capacity: capacity,
+		storage:  storage,
+		C:        c,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		requests: make(chan func()),
+		closing:  make(chan struct{}),
+		stopped:  make(chan struct{})}
+	q.consumer = Consumer{C: c, queue: q}
+	if srv.cluster.isReplicated(name) {
+		q.cluster = srv.cluster
+	}
+	go q.run()
+	return q
 }
 
 type Topic struct {
-	name          string
-	capacity      int
-	last_id       int
-	channels      []*Consumer
-	channels_lock sync.RWMutex
+	publish_total  uint64
+	last_seq       uint64
+	filter_total   uint64
+	filtered_total uint64
+	filter_nanos   uint64
+	srv            *Server
+	name           string
+	capacity       int
+	last_id        int
+	channels       []*Consumer
+	channels_lock  sync.RWMutex
+	rates          rateMeter
+	log            *topicLog
+	partitions     *partitions
+}
+
+// drain removes the messages that are buffered for the subscribers and the
+// consumer groups. a message is copied into the buffer of every subscriber
+// and every group, so each of them is returned once by its topic-level id.
+// the buffers of the subscribers that are fed by a topic log are skipped,
+// the messages are still in the log.
+func (self *Topic) drain() []mq_client.Message {
+	var msgs []mq_client.Message
+	var ids []uint64
+	self.channels_lock.RLock()
+	for _, consumer := range self.channels {
+		if consumer.done != nil {
+			continue
+		}
+		buffered, buffered_ids := consumer.drainSent()
+		msgs = append(msgs, buffered...)
+		ids = append(ids, buffered_ids...)
+	}
+	self.channels_lock.RUnlock()
+
+	if self.partitions != nil {
+		buffered, buffered_ids := self.partitions.drain()
+		msgs = append(msgs, buffered...)
+		ids = append(ids, buffered_ids...)
+	}
+	return dedupeMessages(msgs, ids)
+}
+
+// dedupeMessages returns every message once by its topic-level id, in the
+// order that they are published.
+func dedupeMessages(msgs []mq_client.Message, ids []uint64) []mq_client.Message {
+	idx := make([]int, len(msgs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return ids[idx[a]] < ids[idx[b]]
+	})
+
+	results := make([]mq_client.Message, 0, len(msgs))
+	for i, n := range idx {
+		if i > 0 && ids[n] == ids[idx[i-1]] {
+			continue
+		}
+		results = append(results, msgs[n])
+	}
+	return results
 }
 
 func (self *Topic) Close() error {
@@ -138,25 +628,62 @@ func (self *Topic) Close() error {
 	for _, ch := range channels {
 		ch.Close()
 	}
+	if self.partitions != nil {
+		self.partitions.Close()
+	}
+	if self.log != nil {
+		self.log.Close()
+	}
 	return nil
 }
 
 func (self *Topic) Send(msg mq_client.Message) error {
-	self.channels_lock.RLock()
-	defer self.channels_lock.RUnlock()
+	atomic.AddUint64(&self.publish_total, 1)
+	if self.log != nil {
+		msg = self.log.append(msg)
+	}
+	id := atomic.AddUint64(&self.last_seq, 1)
+	if self.partitions != nil {
+		self.partitions.send(msg, id, 0)
+	}
+	var overflowed []*Consumer
+	func() {
+		self.channels_lock.RLock()
+		defer self.channels_lock.RUnlock()
 
-	for _, consumer := range self.channels {
-		select {
-		case consumer.C <- msg:
-			consumer.add()
-		default:
-			consumer.addDiscard()
+		for _, consumer := range self.channels {
+			if consumer.done != nil || !consumer.accept(msg) {
+				continue
+			}
+			if !consumer.offer(msg, id, nil) {
+				if consumer.addDiscard() {
+					overflowed = append(overflowed, consumer)
+				}
+				self.dropped(msg, ErrSubscriberFull)
+			}
 		}
-	}
+	}()
+	self.overflowed(overflowed)
 	return nil
 }
 
+// dropped calls the interceptors if msg is dropped.
+func (self *Topic) dropped(msg mq_client.Message, reason error) {
+	if self.srv == nil || len(self.srv.interceptors) == 0 {
+		return
+	}
+	self.srv.interceptors.drop(&MessageContext{Type: mq_client.TOPIC, Name: self.name}, msg, reason)
+}
+
 func (self *Topic) SendTimeout(msg mq_client.Message, timeout time.Duration) error {
+	atomic.AddUint64(&self.publish_total, 1)
+	if self.log != nil {
+		msg = self.log.append(msg)
+	}
+	id := atomic.AddUint64(&self.last_seq, 1)
+	if self.partitions != nil {
+		self.partitions.send(msg, id, timeout)
+	}
 	var channels []*Consumer
 
 	var timer *time.Timer
@@ -170,10 +697,10 @@ func (self *Topic) SendTimeout(msg mq_client.Message, timeout time.Duration) err
 		defer self.channels_lock.RUnlock()
 
 		for _, consumer := range self.channels {
-			select {
-			case consumer.C <- msg:
-				consumer.add()
-			default:
+			if consumer.done != nil || !consumer.accept(msg) {
+				continue
+			}
+			if !consumer.offer(msg, id, nil) {
 				channels = append(channels, consumer)
 			}
 		}
@@ -184,23 +711,23 @@ func (self *Topic) SendTimeout(msg mq_client.Message, timeout time.Duration) err
 	}
 
 	for idx, consumer := range channels {
-		select {
-		case consumer.C <- msg:
-			consumer.add()
-		case <-timer.C:
+		if !consumer.offer(msg, id, timer.C) {
 			channels = channels[idx+1:]
 			goto skip_ff
 		}
 	}
 
 skip_ff:
+	var overflowed []*Consumer
 	for _, consumer := range channels {
-		select {
-		case consumer.C <- msg:
-			consumer.add()
-		default:
+		if !consumer.offer(msg, id, nil) {
+			if consumer.addDiscard() {
+				overflowed = append(overflowed, consumer)
+			}
+			self.dropped(msg, ErrSubscriberFull)
 		}
 	}
+	self.overflowed(overflowed)
 	return nil
 }
 
@@ -209,7 +736,17 @@ func (self *Topic) Connect() Producer {
 }
 
 func (self *Topic) ListenOn() *Consumer {
-	listener := &Consumer{topic: self, C: make(chan mq_client.Message, self.capacity)}
+	return self.listen(nil, nil)
+}
+
+// listen adds a consumer with the filter, the consumer is fed by a topic log
+// if done isn't nil.
+func (self *Topic) listen(filter *Filter, done chan struct{}) *Consumer {
+	listener := &Consumer{topic: self,
+		filter: filter,
+		done:   done,
+		sent:   newSentIds(self.capacity),
+		C:      make(chan mq_client.Message, self.capacity)}
 
 	self.channels_lock.Lock()
 	self.last_id++
@@ -235,7 +772,15 @@ func (self *Topic) remove(id int) (ret *Consumer) {
 }
 
 func creatTopic(srv *Server, name string, capacity int) *Topic {
-	return &Topic{name: name, capacity: capacity}
+	topic := &Topic{srv: srv, name: name, capacity: capacity}
+	count, logged, _ := srv.destPolicy(name)
+	if logged {
+		topic.log = newTopicLog(srv, name, srv.options.TopicLog.Size)
+	}
+	if count > 0 {
+		topic.partitions = newPartitions(srv, topic, count)
+	}
+	return topic
 }
 
 type dummyProducer struct{}
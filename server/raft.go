@@ -0,0 +1,817 @@
+package server
+
+import (
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// a small raft implementation that replicates the operations of the
+// replicated queues, the term, the vote and the log are kept by raftStore.
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+const (
+	raftHeartbeatInterval  = 100 * time.Millisecond
+	raftElectionTimeout    = 500 * time.Millisecond
+	raftRPCTimeout         = 500 * time.Millisecond
+	raftMaxAppendEntries   = 256
+	raftCompactionInterval = 4096
+)
+
+var ErrNotLeader = errors.New("not leader.")
+var ErrRaftStore = errors.New("fail to save raft log.")
+
+type raftEntry struct {
+	Term uint64
+	Op   clusterOp
+}
+
+type raftVoteArgs struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type raftAppendArgs struct {
+	Term       uint64
+	Leader     string
+	LeaderAddr string
+	PrevIndex  uint64
+	PrevTerm   uint64
+	Entries    []raftEntry
+	Commit     uint64
+}
+
+type raftInstallArgs struct {
+	Term       uint64
+	Leader     string
+	LeaderAddr string
+	Snapshot   clusterSnapshot
+}
+
+type raftRequest struct {
+	Vote    *raftVoteArgs
+	Append  *raftAppendArgs
+	Install *raftInstallArgs
+}
+
+type raftReply struct {
+	Term    uint64
+	Success bool
+
+	// LastIndex is the last index of follower, it helps leader to find the
+	// next index quickly.
+	LastIndex uint64
+}
+
+type raftStateMachine interface {
+	apply(index uint64, op clusterOp)
+	snapshot() map[string]*clusterQueueState
+	restore(queues map[string]*clusterQueueState)
+	onRoleChanged(isLeader bool)
+}
+
+type raftPeer struct {
+	addr        string
+	next_index  uint64
+	match_index uint64
+	inflight    int32
+
+	conn_lock sync.Mutex
+	conn      net.Conn
+	enc       *gob.Encoder
+	dec       *gob.Decoder
+}
+
+func (self *raftPeer) close() {
+	self.conn_lock.Lock()
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+	self.conn_lock.Unlock()
+}
+
+func (self *raftPeer) call(req *raftRequest) (*raftReply, error) {
+	self.conn_lock.Lock()
+	defer self.conn_lock.Unlock()
+
+	if self.conn == nil {
+		conn, err := net.DialTimeout("tcp", self.addr, raftRPCTimeout)
+		if err != nil {
+			return nil, err
+		}
+		self.conn = conn
+		self.enc = gob.NewEncoder(conn)
+		self.dec = gob.NewDecoder(conn)
+	}
+
+	self.conn.SetDeadline(time.Now().Add(raftRPCTimeout))
+	var reply raftReply
+	err := self.enc.Encode(req)
+	if err == nil {
+		err = self.dec.Decode(&reply)
+	}
+	if err != nil {
+		self.conn.Close()
+		self.conn = nil
+		return nil, err
+	}
+	return &reply, nil
+}
+
+type raftNode struct {
+	srv      *Server
+	id       string
+	addr     string
+	sm       raftStateMachine
+	listener net.Listener
+	store    *raftStore
+	closed   int32
+	S        chan struct{}
+	// roles is signaled if the role is changed, runRoles reads the role
+	// again, so a signal is never blocked with the lock held.
+	roles     chan struct{}
+	waitGroup sync.WaitGroup
+
+	lock         sync.Mutex
+	role         int
+	term         uint64
+	voted_for    string
+	leader       string
+	leader_addr  string
+	last_contact time.Time
+	timeout      time.Duration
+
+	base_index   uint64
+	base_term    uint64
+	base_state   map[string]*clusterQueueState
+	log          []raftEntry
+	commit_index uint64
+	last_applied uint64
+	waiters      map[uint64]chan error
+
+	peers []*raftPeer
+}
+
+func newRaftNode(srv *Server, id, addr, dir string, peers []string, sm raftStateMachine) (*raftNode, error) {
+	store, state, err := openRaftStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", id)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	node := &raftNode{
+		srv:          srv,
+		id:           id,
+		addr:         addr,
+		sm:           sm,
+		listener:     listener,
+		store:        store,
+		S:            make(chan struct{}),
+		roles:        make(chan struct{}, 1),
+		last_contact: time.Now(),
+		timeout:      randomElectionTimeout(),
+		waiters:      map[uint64]chan error{},
+		term:         state.term,
+		voted_for:    state.voted_for,
+		base_index:   state.base_index,
+		base_term:    state.base_term,
+		base_state:   state.base_state,
+		log:          state.log,
+		commit_index: state.base_index,
+		last_applied: state.base_index,
+	}
+	if state.base_state != nil {
+		sm.restore(state.base_state)
+	}
+	for _, peer := range peers {
+		node.peers = append(node.peers, &raftPeer{addr: peer})
+	}
+
+	node.runItInGoroutine(node.runAccept)
+	node.runItInGoroutine(node.runLoop)
+	node.runItInGoroutine(node.runRoles)
+	return node, nil
+}
+
+func randomElectionTimeout() time.Duration {
+	return raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+}
+
+func (self *raftNode) runItInGoroutine(cb func()) {
+	self.waitGroup.Add(1)
+	go func() {
+		defer self.waitGroup.Done()
+		cb()
+	}()
+}
+
+func (self *raftNode) Close() error {
+	if !atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		return ErrAlreadyClosed
+	}
+	close(self.S)
+	err := self.listener.Close()
+	for _, peer := range self.peers {
+		peer.close()
+	}
+
+	self.lock.Lock()
+	self.failWaiters(ErrAlreadyClosed)
+	self.lock.Unlock()
+
+	self.waitGroup.Wait()
+	self.store.Close()
+	return err
+}
+
+func (self *raftNode) isClosed() bool {
+	return 0 != atomic.LoadInt32(&self.closed)
+}
+
+func (self *raftNode) runAccept() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			if !self.isClosed() {
+				self.srv.logger(LogCluster).error("accept failed", "error", err)
+			}
+			return
+		}
+		self.runItInGoroutine(func() {
+			self.serve(conn)
+		})
+	}
+}
+
+func (self *raftNode) serve(conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-self.S
+		conn.Close()
+	}()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	for !self.isClosed() {
+		var req raftRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		var reply raftReply
+		switch {
+		case req.Vote != nil:
+			reply = self.onVote(req.Vote)
+		case req.Append != nil:
+			reply = self.onAppend(req.Append)
+		case req.Install != nil:
+			reply = self.onInstall(req.Install)
+		}
+		if err := enc.Encode(&reply); err != nil {
+			return
+		}
+	}
+}
+
+// lastIndex and termAt need the lock.
+func (self *raftNode) lastIndex() uint64 {
+	return self.base_index + uint64(len(self.log))
+}
+
+func (self *raftNode) termAt(index uint64) uint64 {
+	if index == self.base_index {
+		return self.base_term
+	}
+	if index < self.base_index || index > self.lastIndex() {
+		return 0
+	}
+	return self.log[index-self.base_index-1].Term
+}
+
+// save needs the lock, it keeps the record with the term and the vote.
+func (self *raftNode) save(rec raftRecord) bool {
+	rec.Term, rec.VotedFor = self.term, self.voted_for
+	if err := self.store.save(&rec); err != nil {
+		self.srv.logger(LogCluster).error("fail to save raft state", "node", self.id, "error", err)
+		return false
+	}
+	return true
+}
+
+// saveLog needs the lock, it keeps the entries after index.
+func (self *raftNode) saveLog(index uint64) bool {
+	return self.save(raftRecord{Append: true,
+		Index:   index,
+		Entries: self.log[index-self.base_index:]})
+}
+
+func (self *raftNode) becomeFollower(term uint64) {
+	wasLeader := self.role == raftLeader
+	if term > self.term {
+		self.term = term
+		self.voted_for = ""
+		self.save(raftRecord{})
+	}
+	self.role = raftFollower
+	if wasLeader {
+		self.leader = ""
+		self.leader_addr = ""
+		self.failWaiters(ErrNotLeader)
+		notify(self.roles)
+	}
+}
+
+func (self *raftNode) failWaiters(err error) {
+	for index, waiter := range self.waiters {
+		waiter <- err
+		delete(self.waiters, index)
+	}
+}
+
+func (self *raftNode) onVote(args *raftVoteArgs) raftReply {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if args.Term > self.term {
+		self.becomeFollower(args.Term)
+	}
+
+	reply := raftReply{Term: self.term}
+	if args.Term < self.term {
+		return reply
+	}
+	if self.voted_for != "" && self.voted_for != args.Candidate {
+		return reply
+	}
+
+	lastTerm := self.termAt(self.lastIndex())
+	if args.LastTerm < lastTerm ||
+		(args.LastTerm == lastTerm && args.LastIndex < self.lastIndex()) {
+		return reply
+	}
+
+	self.voted_for = args.Candidate
+	if !self.save(raftRecord{}) {
+		self.voted_for = ""
+		return reply
+	}
+	self.last_contact = time.Now()
+	reply.Success = true
+	return reply
+}
+
+func (self *raftNode) onAppend(args *raftAppendArgs) raftReply {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	reply := raftReply{Term: self.term}
+	if args.Term < self.term {
+		return reply
+	}
+	if args.Term > self.term || self.role != raftFollower {
+		self.becomeFollower(args.Term)
+		reply.Term = self.term
+	}
+	self.leader = args.Leader
+	self.leader_addr = args.LeaderAddr
+	self.last_contact = time.Now()
+
+	if args.PrevIndex > self.lastIndex() {
+		reply.LastIndex = self.lastIndex()
+		return reply
+	}
+	if args.PrevIndex > self.base_index && self.termAt(args.PrevIndex) != args.PrevTerm {
+		// remove the conflicting entries, they are never committed.
+		self.log = self.log[:args.PrevIndex-self.base_index-1]
+		self.saveLog(args.PrevIndex - 1)
+		reply.LastIndex = self.lastIndex()
+		return reply
+	}
+
+	// the entries after from are changed.
+	from, changed := uint64(0), false
+	for idx, entry := range args.Entries {
+		index := args.PrevIndex + uint64(idx) + 1
+		if index <= self.base_index {
+			continue
+		}
+		if index <= self.lastIndex() {
+			if self.termAt(index) == entry.Term {
+				continue
+			}
+			self.log = self.log[:index-self.base_index-1]
+		}
+		if !changed {
+			from, changed = index-1, true
+		}
+		self.log = append(self.log, entry)
+	}
+	if changed && !self.saveLog(from) {
+		// the entries are appended again by the next request.
+		self.log = self.log[:from-self.base_index]
+		reply.LastIndex = self.lastIndex()
+		return reply
+	}
+
+	if args.Commit > self.commit_index {
+		commit := args.Commit
+		if last := args.PrevIndex + uint64(len(args.Entries)); commit > last {
+			commit = last
+		}
+		if commit > self.commit_index {
+			self.commit_index = commit
+			self.applyCommitted()
+		}
+	}
+
+	reply.Success = true
+	reply.LastIndex = self.lastIndex()
+	return reply
+}
+
+func (self *raftNode) onInstall(args *raftInstallArgs) raftReply {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	reply := raftReply{Term: self.term}
+	if args.Term < self.term {
+		return reply
+	}
+	if args.Term > self.term || self.role != raftFollower {
+		self.becomeFollower(args.Term)
+		reply.Term = self.term
+	}
+	self.leader = args.Leader
+	self.leader_addr = args.LeaderAddr
+	self.last_contact = time.Now()
+
+	if args.Snapshot.Index > self.commit_index {
+		if err := self.store.rewrite(&raftRecord{Term: self.term,
+			VotedFor: self.voted_for,
+			Snapshot: &args.Snapshot,
+			Append:   true,
+			Index:    args.Snapshot.Index}); err != nil {
+			self.srv.logger(LogCluster).error("fail to save raft snapshot", "node", self.id, "error", err)
+			reply.LastIndex = self.lastIndex()
+			return reply
+		}
+		self.log = nil
+		self.base_index = args.Snapshot.Index
+		self.base_term = args.Snapshot.Term
+		self.base_state = args.Snapshot.Queues
+		self.commit_index = args.Snapshot.Index
+		self.last_applied = args.Snapshot.Index
+		self.sm.restore(args.Snapshot.Queues)
+	}
+
+	reply.Success = true
+	reply.LastIndex = self.lastIndex()
+	return reply
+}
+
+// applyCommitted needs the lock.
+func (self *raftNode) applyCommitted() {
+	for self.last_applied < self.commit_index {
+		self.last_applied++
+		entry := self.log[self.last_applied-self.base_index-1]
+		self.sm.apply(self.last_applied, entry.Op)
+
+		if waiter, ok := self.waiters[self.last_applied]; ok {
+			delete(self.waiters, self.last_applied)
+			waiter <- nil
+		}
+	}
+
+	if self.last_applied-self.base_index >= raftCompactionInterval {
+		self.base_term = self.termAt(self.last_applied)
+		self.log = append([]raftEntry(nil), self.log[self.last_applied-self.base_index:]...)
+		self.base_index = self.last_applied
+		self.base_state = self.sm.snapshot()
+
+		// the old file is still valid if the rewrite fails.
+		if err := self.store.rewrite(&raftRecord{Term: self.term,
+			VotedFor: self.voted_for,
+			Snapshot: &clusterSnapshot{Index: self.base_index, Term: self.base_term, Queues: self.base_state},
+			Append:   true,
+			Index:    self.base_index,
+			Entries:  self.log}); err != nil {
+			self.srv.logger(LogCluster).error("fail to compact raft log", "node", self.id, "error", err)
+		}
+	}
+}
+
+// propose appends the operation to the log and waits until it is applied.
+func (self *raftNode) propose(op clusterOp, timeout time.Duration) error {
+	self.lock.Lock()
+	if self.isClosed() {
+		self.lock.Unlock()
+		return ErrAlreadyClosed
+	}
+	if self.role != raftLeader {
+		self.lock.Unlock()
+		return ErrNotLeader
+	}
+	self.log = append(self.log, raftEntry{Term: self.term, Op: op})
+	index := self.lastIndex()
+	if !self.saveLog(index - 1) {
+		self.log = self.log[:len(self.log)-1]
+		self.lock.Unlock()
+		return ErrRaftStore
+	}
+	waiter := make(chan error, 1)
+	self.waiters[index] = waiter
+	self.advanceCommit()
+	self.lock.Unlock()
+
+	self.replicate()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-waiter:
+		return err
+	case <-timer.C:
+		self.lock.Lock()
+		delete(self.waiters, index)
+		self.lock.Unlock()
+		return mq_client.ErrTimeout
+	}
+}
+
+// advanceCommit needs the lock.
+func (self *raftNode) advanceCommit() {
+	for index := self.lastIndex(); index > self.commit_index; index-- {
+		if self.termAt(index) != self.term {
+			break
+		}
+
+		count := 1
+		for _, peer := range self.peers {
+			if peer.match_index >= index {
+				count++
+			}
+		}
+		if count*2 > len(self.peers)+1 {
+			self.commit_index = index
+			self.applyCommitted()
+			break
+		}
+	}
+}
+
+func (self *raftNode) runLoop() {
+	tick := time.NewTicker(raftHeartbeatInterval / 4)
+	defer tick.Stop()
+
+	last_heartbeat := time.Now()
+	for {
+		select {
+		case <-self.S:
+			return
+		case <-tick.C:
+		}
+
+		self.lock.Lock()
+		role := self.role
+		expired := time.Since(self.last_contact) > self.timeout
+		self.lock.Unlock()
+
+		if role == raftLeader {
+			if time.Since(last_heartbeat) >= raftHeartbeatInterval {
+				last_heartbeat = time.Now()
+				self.replicate()
+			}
+		} else if expired {
+			self.elect()
+		}
+	}
+}
+
+// runRoles tells the state machine the role changes, the signals of a
+// flapping leadership are coalesced, but the leading of an old term is
+// always stopped before the leading of a new term is started.
+func (self *raftNode) runRoles() {
+	var leading_term uint64
+	for {
+		select {
+		case <-self.S:
+			return
+		case <-self.roles:
+			self.lock.Lock()
+			isLeader, term := self.role == raftLeader, self.term
+			self.lock.Unlock()
+
+			if leading_term != 0 && (!isLeader || term != leading_term) {
+				self.sm.onRoleChanged(false)
+				leading_term = 0
+			}
+			if isLeader && leading_term == 0 {
+				self.sm.onRoleChanged(true)
+				leading_term = term
+			}
+		}
+	}
+}
+
+func (self *raftNode) elect() {
+	self.lock.Lock()
+	self.role = raftCandidate
+	self.term++
+	self.voted_for = self.id
+	self.leader = ""
+	self.leader_addr = ""
+	self.last_contact = time.Now()
+	self.timeout = randomElectionTimeout()
+	if !self.save(raftRecord{}) {
+		self.lock.Unlock()
+		return
+	}
+	args := &raftVoteArgs{
+		Term:      self.term,
+		Candidate: self.id,
+		LastIndex: self.lastIndex(),
+		LastTerm:  self.termAt(self.lastIndex()),
+	}
+	self.lock.Unlock()
+
+	var votes int32 = 1
+	check := func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.role != raftCandidate || self.term != args.Term {
+			return
+		}
+		if int(atomic.LoadInt32(&votes))*2 > len(self.peers)+1 {
+			self.becomeLeader()
+		}
+	}
+	check()
+
+	for _, peer := range self.peers {
+		peer := peer
+		self.runItInGoroutine(func() {
+			reply, err := peer.call(&raftRequest{Vote: args})
+			if err != nil {
+				return
+			}
+			if reply.Term > args.Term {
+				self.lock.Lock()
+				if reply.Term > self.term {
+					self.becomeFollower(reply.Term)
+				}
+				self.lock.Unlock()
+				return
+			}
+			if reply.Success {
+				atomic.AddInt32(&votes, 1)
+				check()
+			}
+		})
+	}
+}
+
+// becomeLeader needs the lock.
+func (self *raftNode) becomeLeader() {
+	self.role = raftLeader
+	self.leader = self.id
+	self.leader_addr = self.addr
+	for _, peer := range self.peers {
+		peer.next_index = self.lastIndex() + 1
+		peer.match_index = 0
+	}
+	self.srv.logger(LogCluster).info("node is leader", "node", self.id, "term", self.term)
+
+	// commit the entries of previous terms by an entry of current term.
+	self.log = append(self.log, raftEntry{Term: self.term, Op: clusterOp{Type: clusterOpNoop}})
+	if !self.saveLog(self.lastIndex() - 1) {
+		self.log = self.log[:len(self.log)-1]
+	}
+	self.advanceCommit()
+	notify(self.roles)
+
+	go self.replicate()
+}
+
+func (self *raftNode) replicate() {
+	for _, peer := range self.peers {
+		if !atomic.CompareAndSwapInt32(&peer.inflight, 0, 1) {
+			continue
+		}
+		peer := peer
+		self.runItInGoroutine(func() {
+			defer atomic.StoreInt32(&peer.inflight, 0)
+			self.replicateTo(peer)
+		})
+	}
+}
+
+func (self *raftNode) replicateTo(peer *raftPeer) {
+	self.lock.Lock()
+	if self.role != raftLeader {
+		self.lock.Unlock()
+		return
+	}
+
+	term := self.term
+	var req raftRequest
+	// match is the index that the follower has if the request succeeds.
+	var match uint64
+	if peer.next_index <= self.base_index {
+		req.Install = &raftInstallArgs{
+			Term:       self.term,
+			Leader:     self.id,
+			LeaderAddr: self.addr,
+			Snapshot: clusterSnapshot{
+				Index:  self.base_index,
+				Term:   self.base_term,
+				Queues: self.base_state,
+			},
+		}
+		match = self.base_index
+	} else {
+		prev := peer.next_index - 1
+		end := self.lastIndex()
+		if end-prev > raftMaxAppendEntries {
+			end = prev + raftMaxAppendEntries
+		}
+		req.Append = &raftAppendArgs{
+			Term:       self.term,
+			Leader:     self.id,
+			LeaderAddr: self.addr,
+			PrevIndex:  prev,
+			PrevTerm:   self.termAt(prev),
+			Entries:    append([]raftEntry(nil), self.log[prev-self.base_index:end-self.base_index]...),
+			Commit:     self.commit_index,
+		}
+		match = prev + uint64(len(req.Append.Entries))
+	}
+	self.lock.Unlock()
+
+	reply, err := peer.call(&req)
+	if err != nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if reply.Term > self.term {
+		self.becomeFollower(reply.Term)
+		return
+	}
+	if self.role != raftLeader || self.term != term {
+		return
+	}
+
+	if reply.Success {
+		// the entries of follower after match aren't checked by the request.
+		if match > peer.match_index {
+			peer.match_index = match
+		}
+		peer.next_index = peer.match_index + 1
+		self.advanceCommit()
+	} else if reply.LastIndex+1 < peer.next_index {
+		peer.next_index = reply.LastIndex + 1
+	} else if peer.next_index > 1 {
+		peer.next_index--
+	}
+}
+
+func (self *raftNode) Leader() (string, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.leader_addr, self.role == raftLeader
+}
+
+func (self *raftNode) Stats() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	roles := []string{"follower", "candidate", "leader"}
+	return map[string]interface{}{
+		"id":           self.id,
+		"role":         roles[self.role],
+		"term":         self.term,
+		"leader":       self.leader,
+		"leader_addr":  self.leader_addr,
+		"last_index":   self.lastIndex(),
+		"commit_index": self.commit_index,
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// raft state file
+// the term, the vote and the log of a raft node are kept in 'raft.log' of
+// ClusterOptions.Dir, so that a restarted node doesn't vote twice in a term
+// and doesn't lose the committed entries. the file is a list of records, a
+// record is a 4 bytes length and a gob encoded raftRecord, it is synced
+// before the node replies to other nodes. the file is rewritten with a
+// snapshot when the log is compacted. a record that is partially written by
+// a crash isn't synced, so it is discarded when the file is loaded.
+
+type raftRecord struct {
+	Term     uint64
+	VotedFor string
+
+	// Append removes the entries after Index, then appends Entries.
+	Append  bool
+	Index   uint64
+	Entries []raftEntry
+
+	// Snapshot replaces the log, it is in the first record of file.
+	Snapshot *clusterSnapshot
+}
+
+type raftState struct {
+	term       uint64
+	voted_for  string
+	base_index uint64
+	base_term  uint64
+	base_state map[string]*clusterQueueState
+	log        []raftEntry
+}
+
+func (self *raftState) apply(rec *raftRecord) error {
+	self.term = rec.Term
+	self.voted_for = rec.VotedFor
+	if rec.Snapshot != nil {
+		self.base_index = rec.Snapshot.Index
+		self.base_term = rec.Snapshot.Term
+		self.base_state = rec.Snapshot.Queues
+		self.log = nil
+	}
+	if rec.Append {
+		if rec.Index < self.base_index || rec.Index > self.base_index+uint64(len(self.log)) {
+			return errors.New("raft log is broken.")
+		}
+		self.log = append(self.log[:rec.Index-self.base_index], rec.Entries...)
+	}
+	return nil
+}
+
+type raftStore struct {
+	file string
+	f    *os.File
+}
+
+// openRaftStore loads the state of dir, the state is empty if the file
+// doesn't exist.
+func openRaftStore(dir string) (*raftStore, *raftState, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	file := filepath.Join(dir, "raft.log")
+	bs, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	state := &raftState{}
+	offset := 0
+	for offset+4 <= len(bs) {
+		n := int(binary.BigEndian.Uint32(bs[offset:]))
+		if offset+4+n > len(bs) {
+			break
+		}
+		var rec raftRecord
+		if err := gob.NewDecoder(bytes.NewReader(bs[offset+4 : offset+4+n])).Decode(&rec); err != nil {
+			return nil, nil, errors.New("raft log '" + file + "' is broken, " + err.Error())
+		}
+		if err := state.apply(&rec); err != nil {
+			return nil, nil, errors.New("raft log '" + file + "' is broken.")
+		}
+		offset += 4 + n
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.Truncate(int64(offset)); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &raftStore{file: file, f: f}, state, nil
+}
+
+// save appends the record and syncs the file.
+func (self *raftStore) save(rec *raftRecord) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	bs := buf.Bytes()
+	binary.BigEndian.PutUint32(bs, uint32(len(bs)-4))
+	if _, err := self.f.Write(bs); err != nil {
+		return err
+	}
+	return self.f.Sync()
+}
+
+// rewrite replaces the file with the record, the old file is kept if it
+// fails.
+func (self *raftStore) rewrite(rec *raftRecord) error {
+	tmp := self.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	old := self.f
+	self.f = f
+	err = self.save(rec)
+	if err == nil {
+		err = os.Rename(tmp, self.file)
+	}
+	if err != nil {
+		self.f = old
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	old.Close()
+	return syncDir(filepath.Dir(self.file))
+}
+
+func (self *raftStore) Close() error {
+	return self.f.Close()
+}
+
+// syncDir syncs the directory, so that a renamed file is kept by a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
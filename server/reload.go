@@ -0,0 +1,380 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// live reload
+// Reload reads the config again by Options.ReloadConfig and applies the
+// settings that can be changed without dropping connections: the levels of
+// logs, the connection limits, the destination policies (partitions, topic
+// logs and engines of the destinations that are created later), the declared
+// destinations, federation links and shovels. the users and policies aren't
+// enforced by the server, they are reported as unsupported. the other
+// settings are reported as needing a restart. a setting that fails to be
+// applied, e.g. a shovel that is refused or a declared queue whose storage
+// can't be opened, is reported as failed. the connections that exceed the
+// new limits aren't closed.
+
+var ErrReloadUnsupported = errors.New("server isn't started with a config, it can't be reloaded.")
+
+// ReloadReport is the settings that are changed by Reload, a setting is its
+// config key, or 'destinations.<name>' for the partitions, the log or the
+// engine of an existing destination. the errors of Failed are logged.
+type ReloadReport struct {
+	Applied     []string `json:"applied"`
+	Failed      []string `json:"failed"`
+	Restart     []string `json:"restart"`
+	Unsupported []string `json:"unsupported"`
+}
+
+// fail moves key from Applied to Failed.
+func (self *ReloadReport) fail(key string) {
+	for idx, applied := range self.Applied {
+		if applied == key {
+			self.Applied = append(self.Applied[:idx], self.Applied[idx+1:]...)
+			break
+		}
+	}
+	for _, failed := range self.Failed {
+		if failed == key {
+			return
+		}
+	}
+	self.Failed = append(self.Failed, key)
+}
+
+// the config keys that are applied by Reload.
+var reloadableKeys = map[string]bool{
+	"verbose":                       true,
+	"shutdown_timeout":              true,
+	"limits_max_connections":        true,
+	"limits_max_connections_per_ip": true,
+	"limits_handshake_timeout":      true,
+	"log_level":                     true,
+	"log_levels":                    true,
+	"partitions":                    true,
+	"topic_log_topics":              true,
+	"storage_engines":               true,
+	"federation":                    true,
+	"shovels":                       true,
+	"destinations":                  true,
+}
+
+// the config keys that aren't enforced by the server.
+var unsupportedKeys = map[string]bool{
+	"users":    true,
+	"policies": true,
+}
+
+// Config returns the config that the server is started or reloaded with,
+// it is nil if the server isn't started with a config.
+func (self *Server) Config() *Config {
+	self.reload_lock.Lock()
+	defer self.reload_lock.Unlock()
+	return self.config
+}
+
+// Reload reads the config again and applies it.
+func (self *Server) Reload() (*ReloadReport, error) {
+	if self.options.ReloadConfig == nil {
+		return nil, ErrReloadUnsupported
+	}
+	cfg, err := self.options.ReloadConfig()
+	if err == nil {
+		var report *ReloadReport
+		if report, err = self.ApplyConfig(cfg); err == nil {
+			return report, nil
+		}
+	}
+	self.logger(LogServer).error("fail to reload config", "error", err)
+	return nil, err
+}
+
+// ApplyConfig applies the changeable settings of cfg, nothing is applied if
+// cfg is invalid.
+func (self *Server) ApplyConfig(cfg *Config) (*ReloadReport, error) {
+	opts, err := cfg.Options()
+	if err != nil {
+		return nil, err
+	}
+	opts.ensureDefault()
+	levels, err := opts.Log.levels(opts.Verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	self.reload_lock.Lock()
+	defer self.reload_lock.Unlock()
+	if self.config == nil {
+		return nil, ErrReloadUnsupported
+	}
+	if 0 != atomic.LoadInt32(&self.is_stopped) {
+		return nil, ErrAlreadyClosed
+	}
+
+	report := &ReloadReport{Applied: []string{}, Failed: []string{}, Restart: []string{}, Unsupported: []string{}}
+	for _, key := range diffConfig(self.config, cfg) {
+		if reloadableKeys[key] {
+			report.Applied = append(report.Applied, key)
+		} else if unsupportedKeys[key] {
+			report.Unsupported = append(report.Unsupported, key)
+		} else {
+			report.Restart = append(report.Restart, key)
+		}
+	}
+
+	for name, level := range levels {
+		if l, ok := self.loggers[name]; ok {
+			l.level.Set(level)
+		}
+	}
+	self.setLimits(opts.MaxConnections, opts.MaxConnectionsPerIP, opts.HandshakeTimeout)
+	for _, name := range self.policies.replace(self, opts) {
+		report.Restart = append(report.Restart, "destinations."+name)
+	}
+	self.reloadFederations(opts.Federation)
+	if err := self.reloadShovels(self.config.Shovels, cfg.Shovels); err != nil {
+		report.fail("shovels")
+	}
+	if err := cfg.Declare(self); err != nil {
+		self.logger(LogServer).error("fail to declare destinations", "error", err)
+		report.fail("destinations")
+	}
+	self.config = cfg
+
+	logger := self.logger(LogServer)
+	if len(report.Failed) > 0 {
+		logger.error("config is reloaded partially",
+			"applied", strings.Join(report.Applied, ","),
+			"failed", strings.Join(report.Failed, ","),
+			"restart", strings.Join(report.Restart, ","),
+			"unsupported", strings.Join(report.Unsupported, ","))
+		return report, nil
+	}
+	logger.info("config is reloaded",
+		"applied", strings.Join(report.Applied, ","),
+		"restart", strings.Join(report.Restart, ","),
+		"unsupported", strings.Join(report.Unsupported, ","))
+	return report, nil
+}
+
+// diffConfig returns the keys of the fields that are different, a list of
+// objects is compared as a whole.
+func diffConfig(a, b *Config) []string {
+	var keys []string
+	fa, fb := a.fields(), b.fields()
+	for idx := range fa {
+		if !sameConfigValue(fa[idx].value, fb[idx].value) {
+			keys = append(keys, fa[idx].key)
+		}
+	}
+
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		if f.Type.Kind() != reflect.Slice || f.Type.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		if !sameConfigValue(va.Field(i), vb.Field(i)) {
+			keys = append(keys, strings.Split(f.Tag.Get("json"), ",")[0])
+		}
+	}
+	return keys
+}
+
+// sameConfigValue returns true if a equals b, a nil list or map equals an
+// empty one.
+func sameConfigValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Slice, reflect.Map:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// destPolicies are the partitions, the topic logs and the storage engines
+// of the queues and the topics that are created later, they are replaced by
+// Reload.
+type destPolicies struct {
+	lock       sync.RWMutex
+	partitions map[string]int
+	log_topics map[string]bool
+	engines    map[string]string
+}
+
+func (self *destPolicies) set(opts *Options) {
+	log_topics := map[string]bool{}
+	for _, name := range opts.TopicLog.Topics {
+		log_topics[name] = true
+	}
+
+	self.lock.Lock()
+	self.partitions = opts.Partitions
+	self.log_topics = log_topics
+	self.engines = opts.Storage.Engines
+	self.lock.Unlock()
+}
+
+func (self *destPolicies) get(name string) (partitions int, logged bool, engine string) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.partitions[name], self.log_topics[name], self.engines[name]
+}
+
+// replace sets the policies of opts, it returns the names of the existing
+// destinations whose policies are changed, they are kept until restart.
+func (self *destPolicies) replace(srv *Server, opts *Options) []string {
+	self.lock.RLock()
+	names := map[string]bool{}
+	for name := range self.partitions {
+		names[name] = true
+	}
+	for name := range self.log_topics {
+		names[name] = true
+	}
+	for name := range self.engines {
+		names[name] = true
+	}
+	self.lock.RUnlock()
+	for name := range opts.Partitions {
+		names[name] = true
+	}
+	for _, name := range opts.TopicLog.Topics {
+		names[name] = true
+	}
+	for name := range opts.Storage.Engines {
+		names[name] = true
+	}
+
+	type policy struct {
+		partitions int
+		logged     bool
+		engine     string
+	}
+	old := map[string]policy{}
+	for name := range names {
+		partitions, logged, engine := self.get(name)
+		old[name] = policy{partitions, logged, engine}
+	}
+	self.set(opts)
+
+	var changed []string
+	for name := range names {
+		partitions, logged, engine := self.get(name)
+		if old[name] == (policy{partitions, logged, engine}) {
+			continue
+		}
+		if srv.destinationExists(mq_client.TOPIC, name) || srv.destinationExists(mq_client.QUEUE, name) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// destPolicy returns the policies of the queue or the topic.
+func (self *Server) destPolicy(name string) (partitions int, logged bool, engine string) {
+	partitions, logged, engine = self.policies.get(name)
+	if engine == "" {
+		engine = self.options.Storage.engine("")
+	}
+	return partitions, logged, engine
+}
+
+func (self *Server) destinationExists(typ, name string) bool {
+	if typ == mq_client.QUEUE {
+		self.queues_lock.RLock()
+		defer self.queues_lock.RUnlock()
+		_, ok := self.queues[name]
+		return ok
+	}
+	self.topics_lock.RLock()
+	defer self.topics_lock.RUnlock()
+	_, ok := self.topics[name]
+	return ok
+}
+
+// reloadFederations closes the links that are removed or changed and starts
+// the new links, the unchanged links are kept.
+func (self *Server) reloadFederations(links []FederationLink) {
+	var wanted []FederationLink
+	for _, config := range links {
+		wanted = append(wanted, config.normalize())
+	}
+
+	self.federations_lock.Lock()
+	defer self.federations_lock.Unlock()
+	if 0 != atomic.LoadInt32(&self.is_stopped) {
+		return
+	}
+
+	var kept []*federation
+	for _, link := range self.federations {
+		found := false
+		for idx, config := range wanted {
+			if reflect.DeepEqual(config, link.config) {
+				wanted = append(wanted[:idx], wanted[idx+1:]...)
+				found = true
+				break
+			}
+		}
+		if found {
+			kept = append(kept, link)
+		} else {
+			self.logger(LogFederation).info("federation link is closed by reload", "name", link.config.Name)
+			link.Close()
+		}
+	}
+	for _, config := range wanted {
+		self.logger(LogFederation).info("federation link is started by reload", "name", config.Name)
+		kept = append(kept, self.startFederation(config))
+	}
+	self.federations = kept
+}
+
+// reloadShovels removes the shovels of old config that are removed or
+// changed and adds the new shovels, the shovels that are added by the http
+// api are kept. it returns the errors of the shovels that fail.
+func (self *Server) reloadShovels(old, shovels []Shovel) error {
+	var errs []error
+	olds := map[string]Shovel{}
+	for _, config := range old {
+		olds[config.fullName()] = config
+	}
+	news := map[string]Shovel{}
+	for _, config := range shovels {
+		news[config.fullName()] = config
+	}
+
+	for _, config := range old {
+		name := config.fullName()
+		if s, ok := news[name]; ok && reflect.DeepEqual(s, config) {
+			continue
+		}
+		if err := self.RemoveShovel(name); err != nil && err != ErrShovelNotFound {
+			self.logger(LogShovel).error("fail to remove shovel", "name", name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, config := range shovels {
+		name := config.fullName()
+		if s, ok := olds[name]; ok && reflect.DeepEqual(s, config) {
+			continue
+		}
+		if err := self.AddShovel(config); err != nil {
+			self.logger(LogShovel).error("fail to add shovel", "name", name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
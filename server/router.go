@@ -0,0 +1,678 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var (
+	ErrStreamUnsupported = errors.New("streaming is unsupported.")
+	ErrHijackUnsupported = errors.New("websocket is unsupported.")
+)
+
+// HttpContext is a http request and its response of a bypass engine, the
+// http api is served by HttpRouter for all engines through it.
+type HttpContext interface {
+	Method() string
+	// Path is the decoded path of url.
+	Path() string
+	// EscapedPath is the path of url as it is sent, a '/' in a name of
+	// queue or topic is sent as '%2F'.
+	EscapedPath() string
+	Query(name string) string
+	Header(name string) string
+	RemoteAddr() string
+	// Body reads the whole body of request.
+	Body() ([]byte, error)
+
+	SetHeader(name, value string)
+	WriteHeader(code int)
+	Write(bs []byte) (int, error)
+
+	// Stream sends the headers with the status code 200, then cb writes the
+	// body, every chunk is sent by flush. done is closed if the client is
+	// disconnected, it may be nil. cb may be called after Stream returns.
+	Stream(cb func(w io.Writer, flush func() error, done <-chan struct{})) error
+
+	// Hijack sends the headers with the status code 101, then takes over the
+	// connection, br is the buffered reader of conn, it may be nil.
+	Hijack(cb func(conn net.Conn, br *bufio.Reader)) error
+}
+
+// the results of HttpRouter.Serve, ROUTE_DEBUG means the request is served
+// by http.DefaultServeMux (e.g. /debug/pprof/), ROUTE_HANDLER means it is
+// served by Options.HttpHandler.
+const (
+	ROUTE_DONE = iota
+	ROUTE_DEBUG
+	ROUTE_HANDLER
+)
+
+// HttpRouter routes the requests of the bypass engines.
+type HttpRouter struct {
+	srv          *Server
+	prefix       string
+	redirect_url string
+}
+
+func NewHttpRouter(srv *Server) *HttpRouter {
+	return &HttpRouter{srv: srv,
+		prefix:       srv.GetOptions().HttpPrefix,
+		redirect_url: srv.GetOptions().HttpRedirectUrl}
+}
+
+// Serve handles the request if it is a request of the mq api, otherwise it
+// returns who handles the request.
+func (self *HttpRouter) Serve(ctx HttpContext) int {
+	url_path := ctx.EscapedPath()
+	if url_path == "/debug/pprof" {
+		self.redirect(ctx, "/debug/pprof/")
+		return ROUTE_DONE
+	}
+	if strings.HasPrefix(url_path, "/debug/") {
+		return ROUTE_DEBUG
+	}
+
+	if "" != self.prefix {
+		if !strings.HasPrefix(url_path, self.prefix) {
+			if "" != self.redirect_url {
+				self.redirect(ctx, self.redirect_url)
+				return ROUTE_DONE
+			}
+			return ROUTE_DEBUG
+		}
+		url_path = strings.TrimPrefix(url_path, self.prefix)
+		if !strings.HasPrefix(url_path, "/") {
+			url_path = "/" + url_path
+		}
+	}
+	if !strings.HasPrefix(url_path, "/mq/") {
+		return ROUTE_HANDLER
+	}
+	url_path = strings.TrimPrefix(url_path, "/mq/")
+
+	switch url_path {
+	case "queues", "queues/":
+		self.writeJSON(ctx, http.StatusOK, self.srv.GetQueues())
+	case "topics", "topics/":
+		self.writeJSON(ctx, http.StatusOK, self.srv.GetTopics())
+	case "clients":
+		self.writeJSON(ctx, http.StatusOK, self.srv.GetClients())
+	case "stats":
+		self.writeJSON(ctx, http.StatusOK, self.srv.Stats())
+	case "snapshot":
+		self.snapshot(ctx)
+	case "reload":
+		self.reload(ctx)
+	case "federation":
+		self.writeJSON(ctx, http.StatusOK, self.srv.GetFederations())
+	case "cluster":
+		self.writeJSON(ctx, http.StatusOK, self.srv.GetCluster())
+	case "shovels":
+		self.shovelsIndex(ctx)
+	case "ws":
+		self.websocket(ctx)
+	default:
+		switch {
+		case strings.HasPrefix(url_path, "clients/"):
+			self.admin(ctx, "client", unescapePath(strings.TrimPrefix(url_path, "clients/")), "")
+		case strings.HasPrefix(url_path, "shovels/"):
+			self.shovelDelete(ctx, unescapePath(strings.TrimPrefix(url_path, "shovels/")))
+		case strings.HasPrefix(url_path, "queues/"):
+			self.queues(ctx, strings.TrimSuffix(strings.TrimPrefix(url_path, "queues/"), "/"))
+		case strings.HasPrefix(url_path, "topics/"):
+			self.topics(ctx, strings.TrimSuffix(strings.TrimPrefix(url_path, "topics/"), "/"))
+		default:
+			return ROUTE_HANDLER
+		}
+	}
+	return ROUTE_DONE
+}
+
+func unescapePath(s string) string {
+	if name, err := url.PathUnescape(s); err == nil {
+		return name
+	}
+	return s
+}
+
+func (self *HttpRouter) queues(ctx HttpContext, url_path string) {
+	name, action, _, err := SplitRoutePath(mq_client.QUEUE, url_path)
+	if err != nil {
+		self.writeJSON(ctx, http.StatusNotFound, ErrorResult(http.StatusNotFound, err))
+		return
+	}
+	if action == "peek" {
+		self.peek(ctx, name)
+		return
+	} else if action != "" || ctx.Method() == "DELETE" {
+		self.admin(ctx, mq_client.QUEUE, name, action)
+		return
+	}
+	if err := self.srv.CheckLeader(mq_client.QUEUE, name); err != nil {
+		self.writeText(ctx, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	self.doHandler(ctx, mq_client.QUEUE, name,
+		func(name string) (Receiver, error) {
+			if ctx.Query("filter") != "" {
+				return nil, ErrFilterUnsupported
+			}
+			return self.srv.CreateQueueIfNotExists(name).ListenOn(), nil
+		},
+		func(name string) Producer {
+			return self.srv.intercept(self.messageContext(ctx, mq_client.QUEUE, name), nil,
+				self.srv.CreateQueueIfNotExists(name))
+		})
+}
+
+func (self *HttpRouter) topics(ctx HttpContext, url_path string) {
+	name, action, arg, err := SplitRoutePath(mq_client.TOPIC, url_path)
+	if err != nil {
+		self.writeJSON(ctx, http.StatusNotFound, ErrorResult(http.StatusNotFound, err))
+		return
+	}
+	switch action {
+	case "events":
+		self.topicEvents(ctx, name)
+		return
+	case "sessions":
+		self.topicSessions(ctx, name, arg)
+		return
+	case "offsets":
+		self.offsets(ctx, name)
+		return
+	case "":
+		if ctx.Method() == "DELETE" {
+			self.admin(ctx, mq_client.TOPIC, name, action)
+			return
+		}
+	default:
+		self.admin(ctx, mq_client.TOPIC, name, action)
+		return
+	}
+
+	self.doHandler(ctx, mq_client.TOPIC, name,
+		func(name string) (Receiver, error) {
+			return self.srv.CreateTopicIfNotExists(name).ListenWith(map[string]string{
+				"filter": ctx.Query("filter"),
+			})
+		},
+		func(name string) Producer {
+			return self.srv.intercept(self.messageContext(ctx, mq_client.TOPIC, name), nil,
+				self.srv.CreateTopicIfNotExists(name))
+		})
+}
+
+func (self *HttpRouter) redirect(ctx HttpContext, url string) {
+	ctx.SetHeader("Location", url)
+	ctx.WriteHeader(http.StatusMovedPermanently)
+}
+
+func (self *HttpRouter) writeText(ctx HttpContext, code int, s string) {
+	ctx.WriteHeader(code)
+	ctx.Write([]byte(s))
+}
+
+func (self *HttpRouter) writeJSON(ctx HttpContext, code int, result interface{}) {
+	ctx.SetHeader("Content-Type", "application/json")
+	ctx.WriteHeader(code)
+	json.NewEncoder(ctx).Encode(result)
+}
+
+func (self *HttpRouter) writeBatch(ctx HttpContext, format string, msgList []mq_client.Message) {
+	contentType, body, err := EncodeBatch(format, msgList)
+	if err != nil {
+		self.writeText(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.SetHeader("Content-Type", contentType)
+	ctx.SetHeader("X-HW-Batch", strconv.FormatInt(int64(len(msgList)), 10))
+	ctx.WriteHeader(http.StatusOK)
+	ctx.Write(body)
+}
+
+func batchParams(ctx HttpContext) (string, BatchOptions, error) {
+	format, err := ConsumeFormat(ctx.Query("format"), ctx.Header("Accept"))
+	return format, ParseBatchOptions(ctx.Query("max"),
+		ctx.Query("max_bytes"), ctx.Query("wait")), err
+}
+
+// messageContext returns the MessageContext of a http request, the id of
+// client is the X-HW-Client header.
+func (self *HttpRouter) messageContext(ctx HttpContext, typ, name string) MessageContext {
+	return MessageContext{Type: typ,
+		Name:       name,
+		Client:     ctx.Header("X-HW-Client"),
+		RemoteAddr: "http:" + ctx.RemoteAddr()}
+}
+
+func (self *HttpRouter) doHandler(ctx HttpContext, typ, name string,
+	recv_cb func(name string) (Receiver, error), send_cb func(name string) Producer) {
+	switch ctx.Method() {
+	case "GET":
+		is_batch := IsBatchConsume(ctx.Query("batch"), ctx.Query("format"),
+			ctx.Query("max"), ctx.Query("max_bytes"), ctx.Query("wait"))
+		format, batch_opts, err := batchParams(ctx)
+		if is_batch && err != nil {
+			self.writeText(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		consumer, err := recv_cb(name)
+		if err != nil {
+			self.writeText(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer consumer.Close()
+
+		wait, cancel := context.WithTimeout(context.Background(), ParseTimeout(ctx.Query("timeout"), 1*time.Second))
+		msg, err := consumer.Recv(wait)
+		cancel()
+		switch err {
+		case nil:
+			deliver_ctx := self.messageContext(ctx, typ, name)
+			if is_batch {
+				msgList := ReadBatch(consumer, msg, batch_opts)
+				self.srv.interceptors.deliverAll(&deliver_ctx, msgList)
+				self.writeBatch(ctx, format, msgList)
+				return
+			}
+			if len(self.srv.interceptors) > 0 {
+				msg = self.srv.interceptors.deliver(&deliver_ctx, msg)
+			}
+
+			ctx.SetHeader("Content-Type", "text/plain")
+			ctx.WriteHeader(http.StatusOK)
+			if body := msg.Body(); len(body) > 0 {
+				ctx.Write(body)
+			}
+		case ErrConsumerClosed:
+			self.writeText(ctx, http.StatusServiceUnavailable, "queue is closed.")
+		default:
+			ctx.WriteHeader(http.StatusNoContent)
+		}
+	case "PUT", "POST":
+		if self.srv.IsShuttingDown() {
+			self.writeText(ctx, http.StatusServiceUnavailable, ErrShuttingDown.Error())
+			return
+		}
+
+		bs, err := ctx.Body()
+		if err != nil {
+			self.writeText(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		timeout := ParseTimeout(ctx.Query("timeout"), 0)
+		if format := BatchFormat(ctx.Query("batch"), ctx.Header("Content-Type")); format != "" {
+			items, err := ParseBatch(format, bs)
+			if err != nil {
+				self.writeText(ctx, http.StatusBadRequest, err.Error())
+				return
+			}
+			result := PublishBatch(send_cb(name), items, timeout)
+			if result.Accepted != result.Total {
+				self.writeJSON(ctx, http.StatusRequestTimeout, result)
+			} else {
+				self.writeJSON(ctx, http.StatusOK, result)
+			}
+			return
+		}
+
+		msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(bs)+10).Append(bs).Build()
+		if key := ctx.Query("key"); key != "" {
+			headers := map[string]string{HEADER_KEY: key}
+			if err := mq_client.CheckHeaders(headers); err != nil {
+				self.writeText(ctx, http.StatusBadRequest, err.Error())
+				return
+			}
+			msg = mq_client.BuildMessageWithHeaders(headers, bs)
+		}
+		send := send_cb(name)
+		if timeout == 0 {
+			err = send.Send(msg)
+		} else {
+			err = send.SendTimeout(msg, timeout)
+		}
+		ctx.SetHeader("Content-Type", "text/plain")
+		if err != nil {
+			self.writeText(ctx, http.StatusRequestTimeout, err.Error())
+		} else {
+			self.writeText(ctx, http.StatusOK, "OK")
+		}
+	default:
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is PUT or GET.")
+	}
+}
+
+// ParseTimeout parses the 'timeout' query parameter, value is returned if
+// it is empty or invalid.
+func ParseTimeout(s string, value time.Duration) time.Duration {
+	if "" == s {
+		return value
+	}
+	t, e := time.ParseDuration(s)
+	if nil != e {
+		return value
+	}
+	return t
+}
+
+func (self *HttpRouter) snapshot(ctx HttpContext) {
+	if ctx.Method() != "POST" {
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is POST.")
+		return
+	}
+
+	queues, topics, err := self.srv.Snapshot()
+	if err != nil {
+		self.writeText(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	self.writeJSON(ctx, http.StatusOK, map[string]interface{}{
+		"file":   self.srv.GetOptions().SnapshotFile,
+		"queues": queues,
+		"topics": topics,
+	})
+}
+
+func (self *HttpRouter) reload(ctx HttpContext) {
+	if ctx.Method() != "POST" {
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is POST.")
+		return
+	}
+
+	report, err := self.srv.Reload()
+	if err != nil {
+		self.writeText(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	self.writeJSON(ctx, http.StatusOK, report)
+}
+
+func (self *HttpRouter) shovelsIndex(ctx HttpContext) {
+	switch ctx.Method() {
+	case "GET":
+		self.writeJSON(ctx, http.StatusOK, self.srv.GetShovels())
+	case "POST", "PUT":
+		var config Shovel
+		bs, err := ctx.Body()
+		if err == nil {
+			err = json.Unmarshal(bs, &config)
+		}
+		if err == nil {
+			err = self.srv.AddShovel(config)
+		}
+		if err != nil {
+			self.writeText(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		self.writeText(ctx, http.StatusOK, "OK")
+	default:
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is GET or POST.")
+	}
+}
+
+func (self *HttpRouter) shovelDelete(ctx HttpContext, name string) {
+	if ctx.Method() != "DELETE" {
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is DELETE.")
+		return
+	}
+	if err := self.srv.RemoveShovel(name); err != nil {
+		self.writeText(ctx, http.StatusNotFound, err.Error())
+		return
+	}
+	self.writeText(ctx, http.StatusOK, "OK")
+}
+
+func (self *HttpRouter) admin(ctx HttpContext, typ, name, action string) {
+	code, result := self.srv.DoAdmin(ctx.Method(), typ, strings.TrimSuffix(name, "/"), action)
+	self.writeJSON(ctx, code, result)
+}
+
+func (self *HttpRouter) peek(ctx HttpContext, name string) {
+	if ctx.Method() != "GET" {
+		self.writeJSON(ctx, http.StatusMethodNotAllowed, ErrorResult(http.StatusMethodNotAllowed,
+			errors.New("method '"+ctx.Method()+"' isn't allowed.")))
+		return
+	}
+
+	count, _ := strconv.Atoi(ctx.Query("count"))
+	msgList, err := self.srv.PeekQueue(name, count)
+	if err != nil {
+		code := ErrorStatus(err)
+		self.writeJSON(ctx, code, ErrorResult(code, err))
+		return
+	}
+
+	results := make([]PeekMessage, 0, len(msgList))
+	for idx, msg := range msgList {
+		body := msg.Body()
+		results = append(results, PeekMessage{Position: idx,
+			Size:    len(body),
+			Headers: msg.Headers(),
+			Body:    body})
+	}
+	var depth int
+	if queue := self.srv.GetQueueIfExists(name); queue != nil {
+		depth = queue.Len()
+	}
+	self.writeJSON(ctx, http.StatusOK, map[string]interface{}{
+		"name":     name,
+		"depth":    depth,
+		"messages": results,
+	})
+}
+
+func (self *HttpRouter) offsets(ctx HttpContext, name string) {
+	var result interface{}
+	var err error
+	switch ctx.Method() {
+	case "GET":
+		result, err = self.srv.GetTopicOffsets(name)
+	case "POST", "PUT":
+		var offset uint64
+		if offset, err = strconv.ParseUint(ctx.Query("offset"), 10, 64); err != nil {
+			err = ErrInvalidOffset
+		} else {
+			err = self.srv.CommitOffset(name, ctx.Query("consumer"), offset)
+		}
+		result = map[string]interface{}{"consumer": ctx.Query("consumer"), "offset": offset}
+	default:
+		err = errors.New("method '" + ctx.Method() + "' isn't allowed.")
+		self.writeJSON(ctx, http.StatusMethodNotAllowed, ErrorResult(http.StatusMethodNotAllowed, err))
+		return
+	}
+	if err != nil {
+		code := ErrorStatus(err)
+		self.writeJSON(ctx, code, ErrorResult(code, err))
+		return
+	}
+	self.writeJSON(ctx, http.StatusOK, result)
+}
+
+func (self *HttpRouter) topicSessions(ctx HttpContext, name, id string) {
+	if id == "" {
+		if ctx.Method() != "POST" {
+			self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is POST.")
+			return
+		}
+		if self.srv.IsShuttingDown() {
+			self.writeText(ctx, http.StatusServiceUnavailable, ErrShuttingDown.Error())
+			return
+		}
+
+		var filter *Filter
+		if s := ctx.Query("filter"); s != "" {
+			var err error
+			if filter, err = ParseFilter(s); err != nil {
+				self.writeText(ctx, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		expires, _ := time.ParseDuration(ctx.Query("expires"))
+		session, err := self.srv.CreateSession(name, expires, filter)
+		if err != nil {
+			self.writeText(ctx, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		ctx.SetHeader("Location", strings.TrimSuffix(ctx.EscapedPath(), "/")+"/"+url.PathEscape(session.Id()))
+		self.writeJSON(ctx, http.StatusCreated, map[string]interface{}{
+			"id":      session.Id(),
+			"topic":   name,
+			"expires": session.Expires().String(),
+		})
+		return
+	}
+
+	switch ctx.Method() {
+	case "GET":
+		session := self.srv.GetSession(name, id)
+		if session == nil {
+			self.writeText(ctx, http.StatusNotFound, ErrSessionNotFound.Error())
+			return
+		}
+		format, batch_opts, err := batchParams(ctx)
+		if err != nil {
+			self.writeText(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		msgList, err := session.Poll(batch_opts, ParseTimeout(ctx.Query("timeout"), 1*time.Second))
+		if err != nil {
+			self.writeText(ctx, http.StatusGone, err.Error())
+			return
+		}
+		if len(msgList) == 0 {
+			ctx.WriteHeader(http.StatusNoContent)
+			return
+		}
+		deliver_ctx := self.messageContext(ctx, mq_client.TOPIC, name)
+		self.srv.interceptors.deliverAll(&deliver_ctx, msgList)
+		self.writeBatch(ctx, format, msgList)
+	case "DELETE":
+		if err := self.srv.CloseSession(name, id); err != nil {
+			self.writeText(ctx, http.StatusNotFound, err.Error())
+			return
+		}
+		self.writeText(ctx, http.StatusOK, "OK")
+	default:
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is GET or DELETE.")
+	}
+}
+
+func (self *HttpRouter) topicEvents(ctx HttpContext, name string) {
+	if ctx.Method() != "GET" {
+		self.writeText(ctx, http.StatusMethodNotAllowed, "Method must is GET.")
+		return
+	}
+
+	topic := self.srv.CreateTopicIfNotExists(name)
+	options := map[string]string{"filter": ctx.Query("filter")}
+	id, resume := ParseLastEventID(ctx.Header("Last-Event-ID"))
+	if resume && topic.log != nil {
+		// continue from the message after the last event.
+		options["offset"] = strconv.FormatUint(id+1, 10)
+	}
+	consumer, err := topic.ListenWith(options)
+	if err != nil {
+		self.writeText(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	deliver_ctx := self.messageContext(ctx, mq_client.TOPIC, name)
+	interval := self.srv.GetOptions().NoopInterval
+
+	ctx.SetHeader("Content-Type", "text/event-stream")
+	ctx.SetHeader("Cache-Control", "no-cache")
+	// the stream is ended only if the topic is closed, the connection
+	// isn't reused.
+	ctx.SetHeader("Connection", "close")
+	err = ctx.Stream(func(w io.Writer, flush func() error, done <-chan struct{}) {
+		defer consumer.Close()
+
+		// send the headers at once.
+		if _, err := w.Write(SSE_KEEPALIVE_BYTES); err != nil {
+			return
+		}
+		if err := flush(); err != nil {
+			return
+		}
+
+		stream, cancel := doneContext(done)
+		defer cancel()
+
+		for {
+			// a keepalive is sent if no message is received in interval.
+			wait, cancel := context.WithTimeout(stream, interval)
+			msg, err := consumer.Recv(wait)
+			cancel()
+			switch {
+			case err == nil:
+				if offset, ok := msg.Offset(); ok && topic.log != nil {
+					id = offset
+				} else {
+					id++
+				}
+				if len(self.srv.interceptors) > 0 {
+					msg = self.srv.interceptors.deliver(&deliver_ctx, msg)
+				}
+				if err := WriteSSEEvent(w, id, msg); err != nil {
+					return
+				}
+			case err == context.DeadlineExceeded && stream.Err() == nil:
+				if _, err := w.Write(SSE_KEEPALIVE_BYTES); err != nil {
+					return
+				}
+			default:
+				return
+			}
+			// an error is returned if the client is disconnected.
+			if err := flush(); err != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		consumer.Close()
+		self.writeText(ctx, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (self *HttpRouter) websocket(ctx HttpContext) {
+	key := ctx.Header("Sec-WebSocket-Key")
+	if !IsWebSocketUpgrade(ctx.Method(), ctx.Header("Connection"), ctx.Header("Upgrade"), key) {
+		self.writeText(ctx, http.StatusBadRequest, "websocket upgrade is required.")
+		return
+	}
+	if self.srv.IsShuttingDown() {
+		self.writeText(ctx, http.StatusServiceUnavailable, ErrShuttingDown.Error())
+		return
+	}
+
+	mode, protocol := WebSocketMode(ctx.Query("mode"), ctx.Header("Sec-WebSocket-Protocol"))
+	ctx.SetHeader("Upgrade", "websocket")
+	ctx.SetHeader("Connection", "Upgrade")
+	ctx.SetHeader("Sec-WebSocket-Accept", mq_client.WebSocketAccept(key))
+	if protocol != "" {
+		ctx.SetHeader("Sec-WebSocket-Protocol", protocol)
+	}
+	err := ctx.Hijack(func(conn net.Conn, br *bufio.Reader) {
+		self.srv.ServeWebSocket(conn, br, mode)
+	})
+	if err != nil {
+		self.writeText(ctx, http.StatusInternalServerError, err.Error())
+	}
+}
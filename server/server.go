@@ -11,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	mq_client "github.com/runner-mei/fastmq/client"
 )
@@ -26,16 +27,30 @@ type ByPass interface {
 var ConnectionHandle func(srv *Server) (ByPass, error)
 
 type Server struct {
-	options      Options
-	is_stopped   int32
-	waitGroup    sync.WaitGroup
-	listener     net.Listener
-	bypass       ByPass
-	watcher      watcher
-	clients_lock sync.Mutex
-	clients      *list.List
-	queues_lock  sync.RWMutex
-	queues       map[string]*Queue
+	options          Options
+	loggers          map[string]*logger
+	is_stopped       int32
+	is_draining      int32
+	waitGroup        sync.WaitGroup
+	listener         net.Listener
+	listeners        []*serverListener
+	bypass           ByPass
+	admission        admission
+	reload_lock      sync.Mutex
+	config           *Config
+	policies         destPolicies
+	federations_lock sync.Mutex
+	federations      []*federation
+	cluster          *cluster
+	shovels_lock     sync.Mutex
+	shovels          []*shovel
+	sessions         sessions
+	watcher          watcher
+	interceptors     interceptors
+	clients_lock     sync.Mutex
+	clients          *list.List
+	queues_lock      sync.RWMutex
+	queues           map[string]*Queue
 
 	topics_lock sync.RWMutex
 	topics      map[string]*Topic
@@ -49,7 +64,14 @@ func (self *Server) Close() error {
 		self.bypass.Close()
 	}
 
-	err := self.listener.Close()
+	err := self.closeListeners()
+	self.closeFederations()
+	self.closeShovels()
+	self.closeSessions()
+	if self.cluster != nil {
+		self.cluster.Close()
+	}
+
 	func() {
 		self.clients_lock.Lock()
 		defer self.clients_lock.Unlock()
@@ -60,21 +82,39 @@ func (self *Server) Close() error {
 		}
 	}()
 
+	leftover := map[string][]mq_client.Message{}
 	func() {
 		self.queues_lock.Lock()
 		defer self.queues_lock.Unlock()
-		for _, v := range self.queues {
+		for name, v := range self.queues {
+			if v.cluster != nil || v.Durable() {
+				// the messages are kept by other nodes or the storage.
+				v.Close()
+				continue
+			}
+			if msgs := v.drain(); len(msgs) > 0 {
+				leftover[name] = msgs
+			}
 			v.Close()
 		}
 	}()
 
+	var logs map[string]*topicLogState
+	if self.options.SnapshotFile != "" {
+		logs = self.snapshotLogs()
+	}
+	topic_leftover := map[string][]mq_client.Message{}
 	func() {
 		self.topics_lock.Lock()
 		defer self.topics_lock.Unlock()
-		for _, v := range self.topics {
+		for name, v := range self.topics {
+			if msgs := v.drain(); len(msgs) > 0 {
+				topic_leftover[name] = msgs
+			}
 			v.Close()
 		}
 	}()
+	self.dumpAll(leftover, topic_leftover, logs)
 
 	self.waitGroup.Wait()
 	return err
@@ -139,10 +179,16 @@ func (self *Server) GetClients() []map[string]interface{} {
 	for el := self.clients.Front(); el != nil; el = el.Next() {
 		if cli, ok := el.Value.(*Client); ok {
 			cli.mu.Lock()
-			results = append(results, map[string]interface{}{
+			result := map[string]interface{}{
 				"name":        cli.name,
 				"remote_addr": cli.remoteAddr,
-			})
+			}
+			if cli.role != "" {
+				result["role"] = cli.role
+				result["type"] = cli.target_type
+				result["target"] = cli.target
+			}
+			results = append(results, result)
 			cli.mu.Unlock()
 		}
 	}
@@ -150,18 +196,10 @@ func (self *Server) GetClients() []map[string]interface{} {
 	return results
 }
 
-func (self *Server) log(args ...interface{}) {
-	self.options.Logger.Println(args...)
-}
-
-func (self *Server) logf(format string, args ...interface{}) {
-	self.options.Logger.Printf(format, args...)
-}
-
-func (self *Server) catchThrow(ctx string, cb func()) {
+// catchThrow logs the panic with the fields of logger.
+func (self *Server) catchThrow(logger *logger, cb func()) {
 	if e := recover(); nil != e {
 		var buffer bytes.Buffer
-		buffer.WriteString(fmt.Sprintf("[panic] %s %v", ctx, e))
 		for i := 1; ; i += 1 {
 			pc, file, line, ok := runtime.Caller(i)
 			if !ok {
@@ -178,7 +216,7 @@ func (self *Server) catchThrow(ctx string, cb func()) {
 		if cb != nil {
 			cb()
 		}
-		self.logf(buffer.String())
+		logger.error("panic", "error", e, "stack", buffer.String())
 	}
 }
 
@@ -190,8 +228,9 @@ func (self *Server) RunItInGoroutine(cb func()) {
 	}()
 }
 
-func (self *Server) runLoop(listener net.Listener) {
-	self.logf("TCP: listening on %s", listener.Addr())
+func (self *Server) runLoop(listener *serverListener) {
+	logger := self.logger(LogTCP)
+	logger.info("listening", "addr", listener.Addr().String())
 
 	defer listener.Close()
 
@@ -199,106 +238,151 @@ func (self *Server) runLoop(listener net.Listener) {
 		clientConn, err := listener.Accept()
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				self.logf("NOTICE: temporary Accept() failure - %s", err)
+				logger.warn("temporary Accept() failure", "error", err)
 				runtime.Gosched()
 				continue
 			}
 
 			// theres no direct way to detect this error because it is not exposed
 			if !strings.Contains(err.Error(), "use of closed network connection") {
-				self.logf("ERROR: listener.Accept() - %s", err)
+				logger.error("listener.Accept() failed", "error", err)
 			}
 			break
 		}
 
-		self.handleConnection(clientConn)
+		conn, err := self.admit(clientConn)
+		if err != nil {
+			self.reject(clientConn, err)
+			continue
+		}
+		self.handleConnection(conn, listener)
 	}
 
-	self.logf("TCP: closing %s", listener.Addr())
+	logger.info("closing", "addr", listener.Addr().String())
 }
 
-func (self *Server) handleConnection(clientConn net.Conn) {
+func (self *Server) handleConnection(clientConn net.Conn, listener *serverListener) {
 	self.RunItInGoroutine(func() {
 		remoteAddr := clientConn.RemoteAddr().String()
+		if remoteAddr == "" {
+			// unix socket clients are unnamed.
+			remoteAddr = listener.Addr().Network() + ":" + listener.Addr().String()
+		}
+
+		logger := self.logger(LogTCP).with("remote_addr", remoteAddr)
 
 		////////////////////// begin check magic bytes  //////////////////////////
 		buf := make([]byte, len(mq_client.HEAD_MAGIC))
+		clientConn.SetReadDeadline(time.Now().Add(self.handshakeTimeout(listener)))
 		_, err := io.ReadFull(clientConn, buf)
 		if err != nil {
-			if io.EOF != err {
-				self.logf("ERROR: client(%s) failed to read protocol version - %s",
-					remoteAddr, err)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				atomic.AddUint32(&self.admission.handshake_timeout_total, 1)
+				logger.error("handshake timeout")
+			} else if io.EOF != err {
+				logger.error("failed to read protocol version", "error", err)
 			}
 			clientConn.Close()
 			return
 		}
+		clientConn.SetReadDeadline(time.Time{})
+
 		if !bytes.Equal(buf, mq_client.HEAD_MAGIC) {
-			if nil != self.bypass {
+			if nil != self.bypass && listener.options.HttpEnabled {
 				self.bypass.On(wrap(buf, clientConn))
 			} else {
-				self.logf("ERROR: client(%s) bad protocol magic '%s'",
-					remoteAddr, string(buf))
+				logger.error("bad protocol magic", "magic", string(buf))
 				clientConn.Close()
 			}
 			return
 		}
 		if err := mq_client.SendFull(clientConn, mq_client.HEAD_MAGIC); err != nil {
-			self.logf("ERROR: client(%s) fail to send magic bytes, %s", remoteAddr, err)
+			logger.error("fail to send magic bytes", "error", err)
+			clientConn.Close()
 			return
 		}
 		////////////////////// end check magic bytes  //////////////////////////
 
-		client := &Client{
-			srv:        self,
-			remoteAddr: remoteAddr,
-			conn:       clientConn,
-		}
+		self.serveClient(clientConn, remoteAddr)
+	})
+}
+
+// serveClient runs the native protocol on the connection until it is closed.
+func (self *Server) serveClient(clientConn net.Conn, remoteAddr string) {
+	client := &Client{
+		srv:        self,
+		remoteAddr: remoteAddr,
+		conn:       clientConn,
+		goaway:     make(chan struct{}),
+	}
+
+	defer self.catchThrow(self.logger(LogTCP).with("remote_addr", remoteAddr), nil)
 
-		defer self.catchThrow("["+remoteAddr+"]", nil)
+	self.clients_lock.Lock()
+	el := self.clients.PushBack(client)
+	self.clients_lock.Unlock()
+	self.watcher.onConnect(client.info())
 
+	defer func() {
 		self.clients_lock.Lock()
-		el := self.clients.PushBack(client)
+		self.clients.Remove(el)
 		self.clients_lock.Unlock()
 
-		defer func() {
-			self.clients_lock.Lock()
-			self.clients.Remove(el)
-			self.clients_lock.Unlock()
+		client.Close()
+		self.watcher.onDisconnect(client.info())
+	}()
 
-			client.Close()
-		}()
+	ch := make(chan interface{}, 10)
+	done := make(chan struct{})
+	self.RunItInGoroutine(func() {
+		defer close(done)
+		defer self.catchThrow(client.log(), nil)
 
-		ch := make(chan interface{}, 10)
-		self.RunItInGoroutine(func() {
-			defer self.catchThrow("["+remoteAddr+"]", nil)
+		client.runWrite(ch)
+		client.Close()
+	})
 
-			client.runWrite(ch)
-			client.Close()
-		})
+	client.runRead(ch)
+	close(ch)
 
-		client.runRead(ch)
-		close(ch)
-	})
+	// the connection may be released by the caller after returned, so wait
+	// until the writer is stopped.
+	client.Close()
+	<-done
 }
 
 func (self *Server) KillQueueIfExists(name string) {
+	if self.cluster.isReplicated(name) {
+		self.logger(LogQueue).warn("queue is replicated, it can't be killed", "dest", name)
+		return
+	}
+	self.removeQueue(name)
+}
+
+func (self *Server) removeQueue(name string) {
 	self.queues_lock.Lock()
 	queue, ok := self.queues[name]
 	if ok {
 		delete(self.queues, name)
 	}
 	self.queues_lock.Unlock()
-	queue.Close()
+	if ok {
+		queue.Close()
+		self.watcher.onRemoveQueue(name)
+	}
 }
 
 func (self *Server) KillTopicIfExists(name string) {
-	self.topics_lock.RLock()
+	self.topics_lock.Lock()
 	topic, ok := self.topics[name]
 	if ok {
 		delete(self.topics, name)
 	}
-	self.topics_lock.RUnlock()
-	topic.Close()
+	self.topics_lock.Unlock()
+	if ok {
+		topic.Close()
+		self.watcher.onRemoveTopic(name)
+	}
 }
 
 func (self *Server) GetQueueIfExists(name string) *Queue {
@@ -331,7 +415,8 @@ func (self *Server) CreateQueueIfNotExists(name string) *Queue {
 		return queue
 	}
 
-	queue = creatQueue(self, name, self.options.MsgQueueCapacity)
+	queue = creatQueue(self, name, self.options.MsgQueueCapacity,
+		self.openStorage(mq_client.QUEUE, name, self.options.MsgQueueCapacity))
 	self.queues[name] = queue
 	self.queues_lock.Unlock()
 
@@ -364,19 +449,56 @@ func (self *Server) CreateTopicIfNotExists(name string) *Topic {
 
 func NewServer(opts *Options) (*Server, error) {
 	opts.ensureDefault()
+	if err := opts.Storage.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.ensureID(); err != nil {
+		return nil, err
+	}
+	switch opts.EventFormat {
+	case "", EventText, EventJSON:
+	default:
+		return nil, errors.New("event format '" + opts.EventFormat + "' is unknown.")
+	}
+	loggers, err := newLoggers(opts)
+	if err != nil {
+		return nil, err
+	}
 
 	listener, err := net.Listen("tcp", opts.TCPAddress)
 	if err != nil {
 		return nil, err
 	}
 
+	listeners := []*serverListener{{Listener: listener,
+		options: ListenerOptions{Network: "tcp",
+			Address:     opts.TCPAddress,
+			HttpEnabled: true}}}
+	for _, lopts := range opts.Listeners {
+		l, err := listen(lopts)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, &serverListener{Listener: l, options: lopts})
+	}
+
 	srv := &Server{
-		options:  *opts,
-		listener: listener,
-		clients:  list.New(),
-		queues:   map[string]*Queue{},
-		topics:   map[string]*Topic{},
+		options:      *opts,
+		loggers:      loggers,
+		listener:     listener,
+		listeners:    listeners,
+		clients:      list.New(),
+		queues:       map[string]*Queue{},
+		topics:       map[string]*Topic{},
+		interceptors: interceptors(opts.Interceptors),
 	}
+	srv.admission.per_ip = map[string]int{}
+	srv.config = opts.Config
+	srv.policies.set(opts)
+	srv.setLimits(opts.MaxConnections, opts.MaxConnectionsPerIP, opts.HandshakeTimeout)
 
 	if opts.HttpEnabled {
 		if nil == ConnectionHandle {
@@ -385,21 +507,64 @@ func NewServer(opts *Options) (*Server, error) {
 
 		srv.bypass, err = ConnectionHandle(srv)
 		if nil != err {
-			listener.Close()
+			srv.closeListeners()
+			return nil, err
+		}
+	}
+
+	if opts.Cluster.Address != "" {
+		srv.cluster, err = newCluster(srv, &opts.Cluster)
+		if nil != err {
+			if nil != srv.bypass {
+				srv.bypass.Close()
+			}
+			srv.closeListeners()
 			return nil, err
 		}
 	}
 
 	srv.watcher.topic = DummyProducer
+	srv.watcher.json = opts.EventFormat == EventJSON
+	srv.watcher.server_id = opts.ID
 	if opts.Watch != nil {
-		srv.watcher.watch = opts.Watch
+		srv.watcher.watch = AdaptWatcher(opts.Watch)
 	} else {
 		srv.watcher.watch = DummyWatcher
 	}
 	srv.watcher.topic = srv.CreateTopicIfNotExists(mq_client.SYS_EVENTS)
 
-	srv.RunItInGoroutine(func() {
-		srv.runLoop(listener)
-	})
+	if err := srv.loadStorages(); err != nil {
+		srv.Close()
+		return nil, err
+	}
+
+	if opts.SnapshotFile != "" {
+		if err := srv.loadSnapshot(opts.SnapshotFile); err != nil {
+			// the file isn't overwritten by Close, the messages that are
+			// restored before the error are still in it.
+			srv.options.SnapshotFile = ""
+			srv.options.Dump = nil
+			srv.Close()
+			return nil, err
+		}
+	}
+
+	for _, config := range opts.Federation {
+		srv.federations = append(srv.federations, srv.startFederation(config))
+	}
+
+	for _, config := range opts.Shovels {
+		if err := srv.AddShovel(config); err != nil {
+			srv.Close()
+			return nil, err
+		}
+	}
+
+	for _, l := range listeners {
+		l := l
+		srv.RunItInGoroutine(func() {
+			srv.runLoop(l)
+		})
+	}
 	return srv, nil
 }
@@ -1,17 +1,29 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"math"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -174,7 +186,7 @@ func TestServerHttpQueuePush(t *testing.T) {
 			t.Error("body is", string(bs))
 			return
 		}
-	default:
+	case <-time.After(1 * time.Second):
 		//fmt.Println("===========")
 		//case <-time.After(10 * time.Second):
 		t.Error("msg isnot recv")
@@ -191,7 +203,7 @@ func TestServerHttpQueueGet(t *testing.T) {
 	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
 
 	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, 8+3).Append([]byte("AAA")).Build()
-	srv.CreateQueueIfNotExists("aa").C <- msg
+	srv.CreateQueueIfNotExists("aa").Send(msg)
 
 	//fmt.Println(string(msg.Data()))
 	res, err := http.Get("http://127.0.0.1" + srv.options.TCPAddress + "/mq/queues/aa")
@@ -334,3 +346,3188 @@ func TestBenchmarkMqServer(t *testing.T) {
 
 	wait.Wait()
 }
+
+func TestServerMaxConnections(t *testing.T) {
+	srv, err := NewServer(&Options{MaxConnections: 1})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+
+	first, err := mq_client.Connect("", address).ToQueue("a")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer first.Close()
+
+	_, err = mq_client.Connect("", address).ToQueue("a")
+	if nil == err {
+		t.Error("excepted error is", ErrTooManyConnections)
+		return
+	}
+	if err.Error() != ErrTooManyConnections.Error() {
+		t.Error("excepted error is", ErrTooManyConnections, ", actual is", err)
+	}
+
+	stats := srv.Stats()
+	if 1 != stats["connections"] {
+		t.Error("connections is", stats["connections"])
+	}
+	if uint32(1) != stats["connections_rejected_total"] {
+		t.Error("connections_rejected_total is", stats["connections_rejected_total"])
+	}
+
+	// the connection is closed at once if too many connections are being rejected.
+	atomic.AddInt32(&srv.admission.rejecting, maxRejecting)
+	defer atomic.AddInt32(&srv.admission.rejecting, -maxRejecting)
+	conn, err := net.Dial("tcp", address)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Error("connection isn't closed at once")
+	}
+}
+
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+	srv, err := NewServer(&Options{MaxConnectionsPerIP: 1})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+
+	first, err := mq_client.Connect("", address).ToQueue("a")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+
+	_, err = mq_client.Connect("", address).ToQueue("a")
+	if nil == err || err.Error() != ErrTooManyConnectionsPerIP.Error() {
+		t.Error("excepted error is", ErrTooManyConnectionsPerIP, ", actual is", err)
+	}
+
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	second, err := mq_client.Connect("", address).ToQueue("a")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	second.Close()
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	srv, err := NewServer(&Options{HandshakeTimeout: 100 * time.Millisecond})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1"+srv.options.TCPAddress)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); io.EOF != err {
+		t.Error("excepted is EOF, actual is", err)
+	}
+
+	stats := srv.Stats()
+	if uint32(1) != stats["handshake_timeout_total"] {
+		t.Error("handshake_timeout_total is", stats["handshake_timeout_total"])
+	}
+	if 0 != stats["connections"] {
+		t.Error("connections is", stats["connections"])
+	}
+}
+
+func TestServerShutdownGoAway(t *testing.T) {
+	srv, err := NewServer(&Options{})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+
+	pub, err := mq_client.Connect("", address).ToQueue("a")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+
+	pingMessage := mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("aa")).Build()
+	for i := 0; i < 10; i++ {
+		if err := pub.Send(pingMessage); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		srv.Shutdown(1 * time.Second)
+	}()
+
+	msg, err := pub.Read()
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if mq_client.MSG_GOAWAY != msg.Command() {
+		t.Error("excepted is MSG_GOAWAY, actual is", mq_client.ToCommandName(msg.Command()))
+		return
+	}
+
+	msg_count := 0
+	err = mq_client.Connect("", address).SubscribeQueue("a", func(cli *mq_client.Subscription, recvMessage mq_client.Message) {
+		msg_count++
+	})
+	if nil == err {
+		t.Error("subscribe is ok while server is shutting down")
+	}
+
+	srv.Wait()
+	if 0 != msg_count {
+		t.Error("msg_count is", msg_count)
+	}
+}
+
+func TestServerShutdownDrain(t *testing.T) {
+	srv, err := NewServer(&Options{})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	pingMessage := mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("aa")).Build()
+	q := srv.CreateQueueIfNotExists("a")
+	for i := 0; i < 10; i++ {
+		q.Send(pingMessage)
+	}
+
+	sub := mq_client.Connect("", "127.0.0.1"+srv.options.TCPAddress)
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	msg_count := 0
+	go func() {
+		defer wait.Done()
+		sub.SubscribeQueue("a", func(cli *mq_client.Subscription, recvMessage mq_client.Message) {
+			if msg_count == 0 {
+				time.Sleep(500 * time.Millisecond)
+			}
+			msg_count++
+		})
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := srv.Shutdown(5 * time.Second); err != nil {
+		t.Error(err)
+	}
+	wait.Wait()
+
+	if 10 != msg_count {
+		t.Error("excepted message count is 10, actual is", msg_count)
+	}
+}
+
+func TestServerShutdownDump(t *testing.T) {
+	var dumped []mq_client.Message
+	srv, err := NewServer(&Options{Dump: func(typ, name string, msgs []mq_client.Message) error {
+		if typ != mq_client.QUEUE || name != "a" {
+			t.Error("dump", typ, name)
+		}
+		dumped = append(dumped, msgs...)
+		return nil
+	}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	pingMessage := mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("aa")).Build()
+	q := srv.CreateQueueIfNotExists("a")
+	for i := 0; i < 3; i++ {
+		q.Send(pingMessage)
+	}
+
+	if err := srv.Shutdown(100 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	if 3 != len(dumped) {
+		t.Error("excepted dump count is 3, actual is", len(dumped))
+	}
+}
+
+func TestServerShutdownDumpTopic(t *testing.T) {
+	var lock sync.Mutex
+	dumped := map[string]int{}
+	srv, err := NewServer(&Options{Partitions: map[string]int{"p": 1},
+		Dump: func(typ, name string, msgs []mq_client.Message) error {
+			lock.Lock()
+			dumped[typ+"/"+name] += len(msgs)
+			lock.Unlock()
+			return nil
+		}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	topic := srv.CreateTopicIfNotExists("t")
+	// the messages are buffered for both subscribers, but dumped once.
+	topic.ListenOn()
+	topic.ListenOn()
+	partitioned := srv.CreateTopicIfNotExists("p")
+	if _, err := partitioned.ListenWith(map[string]string{"group": "g"}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pingMessage := mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("aa")).Build()
+	for i := 0; i < 3; i++ {
+		topic.Send(pingMessage)
+		partitioned.Send(pingMessage)
+	}
+
+	if err := srv.Shutdown(100 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if 3 != dumped["topic/t"] {
+		t.Error("excepted dump count of t is 3, actual is", dumped["topic/t"])
+	}
+	// a message is being handed over to the member of group.
+	if 2 != dumped["topic/p"] {
+		t.Error("excepted dump count of p is 2, actual is", dumped["topic/p"])
+	}
+}
+
+func TestTopicDrain(t *testing.T) {
+	srv, err := NewServer(&Options{Partitions: map[string]int{"t": 1}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	topic := creatTopic(srv, "t", 2)
+	defer topic.Close()
+	sub1 := topic.ListenOn()
+	topic.ListenOn()
+	if _, err := topic.ListenWith(map[string]string{"group": "g"}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	build := func(s string) mq_client.Message {
+		return mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(s)).Build()
+	}
+	topic.Send(build("m1"))
+	topic.Send(build("m2"))
+	// m1 is handed over to the member of group.
+	for i := 0; topic.partitions.Len() != 1; i++ {
+		if i > 100 {
+			t.Error("excepted m1 is handed over to the member of group")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// m3 is dropped by the subscribers.
+	topic.Send(build("m3"))
+	if msg, ok := sub1.TryRecv(); !ok || "m1" != string(msg.Data()) {
+		t.Error("excepted m1, actual is", string(msg.Data()))
+	}
+
+	// m1 is buffered for the second subscriber, m2 for all, m3 for group.
+	msgs := topic.drain()
+	if 3 != len(msgs) {
+		t.Error("excepted drain count is 3, actual is", len(msgs))
+		return
+	}
+	for i, excepted := range []string{"m1", "m2", "m3"} {
+		if excepted != string(msgs[i].Data()) {
+			t.Error("excepted", excepted, "actual is", string(msgs[i].Data()))
+		}
+	}
+}
+
+func TestServerSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "snapshot")
+
+	func() {
+		srv, err := NewServer(&Options{SnapshotFile: file})
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer srv.Close()
+
+		q := srv.CreateQueueIfNotExists("a")
+		for i := 0; i < 3; i++ {
+			q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(strconv.Itoa(i))).Build())
+		}
+
+		counts, _, err := srv.Snapshot()
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		if 3 != counts["a"] {
+			t.Error("excepted count is 3, actual is", counts["a"])
+		}
+		if 3 != q.Len() {
+			t.Error("messages is removed by snapshot")
+		}
+	}()
+
+	srv, err := NewServer(&Options{SnapshotFile: file})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	q := srv.GetQueueIfExists("a")
+	if nil == q {
+		t.Error("queue isn't restored")
+		return
+	}
+	if 3 != q.Len() {
+		t.Error("excepted count is 3, actual is", q.Len())
+		return
+	}
+	for i := 0; i < 3; i++ {
+		msg := <-q.C
+		if strconv.Itoa(i) != string(msg.Data()) {
+			t.Error("excepted is", i, ", actual is", string(msg.Data()))
+		}
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("snapshot isn't removed after it is loaded", err)
+	}
+}
+
+func TestServerSnapshotOverCapacity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "snapshot")
+
+	var msgs []mq_client.Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(strconv.Itoa(i))).Build())
+	}
+	if err := writeSnapshot(file, map[string][]mq_client.Message{"a": msgs}, nil); nil != err {
+		t.Error(err)
+		return
+	}
+
+	srv, err := NewServer(&Options{SnapshotFile: file, MsgQueueCapacity: 2})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	q := srv.GetQueueIfExists("a")
+	if nil == q {
+		t.Error("queue isn't restored")
+		return
+	}
+	if 5 != q.Len() {
+		t.Error("excepted count is 5, actual is", q.Len())
+		return
+	}
+	for i := 0; i < 5; i++ {
+		msg := <-q.C
+		if strconv.Itoa(i) != string(msg.Data()) {
+			t.Error("excepted is", i, ", actual is", string(msg.Data()))
+		}
+	}
+}
+
+func TestServerSnapshotTopicLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "snapshot")
+	opts := func() *Options {
+		return &Options{SnapshotFile: file, TopicLog: TopicLogOptions{Topics: []string{"t"}, Size: 3}}
+	}
+
+	func() {
+		srv, err := NewServer(opts())
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer srv.Close()
+
+		topic := srv.CreateTopicIfNotExists("t")
+		for i := 0; i < 5; i++ {
+			topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(strconv.Itoa(i))).Build())
+		}
+		if err := srv.CommitOffset("t", "c1", 3); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	srv, err := NewServer(opts())
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	stats, err := srv.GetTopicOffsets("t")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if stats["earliest"] != uint64(2) || stats["latest"] != uint64(5) ||
+		stats["commits"].(map[string]uint64)["c1"] != 3 {
+		t.Error("offsets are", stats)
+	}
+
+	consumer, err := srv.CreateTopicIfNotExists("t").ListenWith(map[string]string{"consumer": "c1"})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer consumer.Close()
+	select {
+	case msg := <-consumer.C:
+		if offset, _ := msg.Offset(); offset != 3 || string(msg.Body()) != "3" {
+			t.Error("message is", offset, string(msg.Body()))
+		}
+	case <-time.After(time.Second):
+		t.Error("log isn't restored")
+	}
+}
+
+func TestServerSnapshotInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "snapshot")
+
+	if err := ioutil.WriteFile(file, []byte("abc"), 0666); nil != err {
+		t.Error(err)
+		return
+	}
+	if _, err := NewServer(&Options{SnapshotFile: file}); err == nil {
+		t.Error("invalid snapshot is loaded")
+	}
+	if bs, err := ioutil.ReadFile(file); err != nil || string(bs) != "abc" {
+		t.Error("invalid snapshot is overwritten,", string(bs), err)
+	}
+}
+
+func TestServerHttpSnapshot(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	res, err := http.Post("http://127.0.0.1"+srv.options.TCPAddress+"/mq/snapshot", "text/plain", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Error("status code is", res.Status)
+	}
+	if ErrSnapshotDisabled.Error() != string(bs) {
+		t.Error("body is", string(bs))
+	}
+}
+
+func waitFederationConnected(t *testing.T, srv *Server) bool {
+	for i := 0; i < 50; i++ {
+		connected := true
+		for _, link := range srv.GetFederations() {
+			for _, dest := range link["destinations"].([]map[string]interface{}) {
+				if !dest["connected"].(bool) {
+					connected = false
+				}
+			}
+		}
+		if connected {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("federation isn't connected -", srv.GetFederations())
+	return false
+}
+
+func TestServerFederation(t *testing.T) {
+	srv1, err := NewServer(&Options{ID: 1,
+		TCPAddress: ":4150",
+		Federation: []FederationLink{{Address: "127.0.0.1:4151", Topics: []string{"t"}}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv1.Close()
+
+	srv2, err := NewServer(&Options{ID: 2,
+		TCPAddress: ":4151",
+		Federation: []FederationLink{{Address: "127.0.0.1:4150", Topics: []string{"t"}}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv2.Close()
+
+	if !waitFederationConnected(t, srv1) || !waitFederationConnected(t, srv2) {
+		return
+	}
+
+	sub1 := srv1.CreateTopicIfNotExists("t").ListenOn()
+	defer sub1.Close()
+	sub2 := srv2.CreateTopicIfNotExists("t").ListenOn()
+	defer sub2.Close()
+
+	srv1.CreateTopicIfNotExists("t").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("aa")).Build())
+
+	select {
+	case msg := <-sub2.C:
+		if "aa" != string(msg.Body()) {
+			t.Error("body is", string(msg.Body()))
+		}
+		if "1" != msg.Header(HEADER_ORIGIN) {
+			t.Error("origin is", msg.Header(HEADER_ORIGIN))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("message isn't forwarded")
+		return
+	}
+
+	select {
+	case <-sub1.C:
+	case <-time.After(time.Second):
+		t.Error("message isn't recv")
+	}
+
+	select {
+	case msg := <-sub1.C:
+		t.Error("message is looped back -", string(msg.ToBytes()))
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestServerFederationSameID(t *testing.T) {
+	// the id is random even if the server has no federation links.
+	opts1, opts2 := &Options{}, &Options{}
+	opts1.ensureID()
+	opts2.ensureID()
+	if opts1.ID <= 0 || opts2.ID <= 0 || opts1.ID == opts2.ID {
+		t.Error("id isn't generated -", opts1.ID, opts2.ID)
+	}
+
+	srv1, err := NewServer(&Options{ID: 1,
+		TCPAddress: ":4150",
+		Federation: []FederationLink{{Address: "127.0.0.1:4151", Topics: []string{"t"}}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv1.Close()
+
+	srv2, err := NewServer(&Options{ID: 1, TCPAddress: ":4151"})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv2.Close()
+
+	var last_error interface{}
+	for i := 0; i < 100; i++ {
+		dest := srv1.GetFederations()[0]["destinations"].([]map[string]interface{})[0]
+		if last_error = dest["last_error"]; last_error != "" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if last_error != ErrFederationSameID.Error() {
+		t.Error("last error is", last_error)
+	}
+}
+
+func TestServerFederationID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// the generated id is kept after a restart.
+	opts1 := &Options{SnapshotFile: filepath.Join(dir, "snapshot")}
+	opts2 := &Options{SnapshotFile: filepath.Join(dir, "snapshot")}
+	if err := opts1.ensureID(); err != nil {
+		t.Error(err)
+	}
+	if err := opts2.ensureID(); err != nil {
+		t.Error(err)
+	}
+	if opts1.ID <= 0 || opts1.ID != opts2.ID {
+		t.Error("id isn't kept -", opts1.ID, opts2.ID)
+	}
+
+	_, err = NewServer(&Options{Federation: []FederationLink{{Address: "127.0.0.1:4151", Topics: []string{"t"}}}})
+	if err != ErrFederationNoID {
+		t.Error("excepted error is", ErrFederationNoID, "actual is", err)
+	}
+}
+
+func TestServerPublishFederationHeaders(t *testing.T) {
+	srv, err := NewServer(&Options{ID: 1})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	sub := srv.CreateTopicIfNotExists("t").ListenOn()
+	defer sub.Close()
+
+	pub, err := mq_client.Connect("", address).ToTopic("t")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+
+	// a client can't forge the origin of a message.
+	pub.Send(mq_client.BuildMessageWithHeaders(map[string]string{HEADER_ORIGIN: "2", HEADER_HOPS: "1", "a": "1"},
+		[]byte("body")))
+	select {
+	case msg := <-sub.C:
+		if "body" != string(msg.Body()) || "1" != msg.Header("a") {
+			t.Error("message is", string(msg.ToBytes()))
+		}
+		if _, ok := msg.LookupHeader(HEADER_ORIGIN); ok {
+			t.Error("origin isn't removed -", string(msg.ToBytes()))
+		}
+		if _, ok := msg.LookupHeader(HEADER_HOPS); ok {
+			t.Error("hops isn't removed -", string(msg.ToBytes()))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("message isn't recv")
+	}
+}
+
+func TestServerSubscribeHeaders(t *testing.T) {
+	srv, err := NewServer(&Options{})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	q := srv.CreateQueueIfNotExists("a")
+
+	for _, headers := range []bool{false, true} {
+		q.Send(mq_client.BuildMessageWithHeaders(map[string]string{"a": "1"}, []byte("body")))
+
+		var options map[string]string
+		if headers {
+			options = map[string]string{"headers": "true"}
+		}
+		err = mq_client.Connect("", address).SubscribeWith(mq_client.QUEUE, "a", options,
+			func(cli *mq_client.Subscription, msg mq_client.Message) {
+				defer cli.Stop()
+
+				if "body" != string(msg.Body()) {
+					t.Error("body is", string(msg.Body()))
+				}
+				if headers {
+					if mq_client.MSG_HDATA != msg.Command() || "1" != msg.Header("a") {
+						t.Error("headers is missing -", string(msg.ToBytes()))
+					}
+				} else if mq_client.MSG_DATA != msg.Command() {
+					t.Error("headers isn't removed -", string(msg.ToBytes()))
+				}
+			})
+		if nil != err {
+			t.Error(err)
+		}
+	}
+}
+
+func waitClusterLeader(t *testing.T, srvs []*Server) *Server {
+	for i := 0; i < 100; i++ {
+		for _, srv := range srvs {
+			if srv.GetCluster()["role"] == "leader" {
+				return srv
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("leader isn't elected")
+	return nil
+}
+
+func waitClusterPending(t *testing.T, srvs []*Server, name string, pending int) bool {
+	for i := 0; i < 100; i++ {
+		ok := true
+		for _, srv := range srvs {
+			queues := srv.GetCluster()["queues"].(map[string]interface{})
+			if queues[name].(map[string]interface{})["pending"] != pending {
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, srv := range srvs {
+		t.Error(srv.GetCluster())
+	}
+	return false
+}
+
+type roleRecorder struct {
+	raftStateMachine
+	c chan bool
+}
+
+func (self *roleRecorder) onRoleChanged(isLeader bool) {
+	self.c <- isLeader
+}
+
+func TestRaftRoles(t *testing.T) {
+	recorder := &roleRecorder{c: make(chan bool, 10)}
+	node := &raftNode{sm: recorder, S: make(chan struct{}), roles: make(chan struct{}, 1)}
+	go node.runRoles()
+	defer close(node.S)
+
+	expect := func(excepted ...bool) {
+		for _, isLeader := range excepted {
+			select {
+			case actual := <-recorder.c:
+				if actual != isLeader {
+					t.Error("excepted is", isLeader, ", actual is", actual)
+				}
+			case <-time.After(time.Second):
+				t.Error("role isn't changed")
+				return
+			}
+		}
+	}
+
+	node.lock.Lock()
+	node.role, node.term = raftLeader, 1
+	notify(node.roles)
+	node.lock.Unlock()
+	expect(true)
+
+	// a flapping leadership doesn't block with the lock held, and the
+	// leading of the old term is stopped.
+	node.lock.Lock()
+	for i := 0; i < 100; i++ {
+		node.role = raftFollower
+		notify(node.roles)
+		node.role, node.term = raftLeader, node.term+1
+		notify(node.roles)
+	}
+	node.lock.Unlock()
+	expect(false, true)
+
+	node.lock.Lock()
+	node.role = raftFollower
+	notify(node.roles)
+	node.lock.Unlock()
+	expect(false)
+}
+
+func TestServerCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var srvs []*Server
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		var peers []string
+		for j := 0; j < 3; j++ {
+			if j != i {
+				peers = append(peers, "127.0.0.1:"+strconv.Itoa(4160+j))
+			}
+		}
+
+		srv, err := NewServer(&Options{ID: int64(i + 1),
+			TCPAddress: ":" + strconv.Itoa(4150+i),
+			Cluster: ClusterOptions{Address: "127.0.0.1:" + strconv.Itoa(4160+i),
+				Peers:  peers,
+				Queues: []string{"q"},
+				Dir:    filepath.Join(dir, strconv.Itoa(i))}})
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer srv.Close()
+		srvs = append(srvs, srv)
+		addresses = append(addresses, "127.0.0.1:"+strconv.Itoa(4150+i))
+	}
+
+	leader := waitClusterLeader(t, srvs)
+	if leader == nil {
+		return
+	}
+
+	// publish to a follower, the client follows the leader.
+	var follower string
+	for idx, srv := range srvs {
+		if srv != leader {
+			follower = addresses[idx]
+			break
+		}
+	}
+	// the builder follows the leader in concurrent dials.
+	builder := mq_client.Connect("tcp", follower)
+	var wait sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			pub, err := builder.ToQueue("q")
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			pub.Close()
+		}()
+	}
+	wait.Wait()
+
+	pub, err := builder.ToQueue("q")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("msg" + strconv.Itoa(i))).Build()); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	pub.Close()
+	if !waitClusterPending(t, srvs, "q", 10) {
+		return
+	}
+
+	// fail over
+	var alive []*Server
+	for _, srv := range srvs {
+		if srv != leader {
+			alive = append(alive, srv)
+		}
+	}
+	leader.Close()
+	if waitClusterLeader(t, alive) == nil {
+		return
+	}
+
+	sub, err := mq_client.ConnectCluster("tcp", addresses...).Listen(mq_client.QUEUE, "q", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer sub.Close()
+
+	c := make(chan string, 20)
+	go sub.Run(func(cli *mq_client.Subscription, msg mq_client.Message) {
+		if msg.Command() == mq_client.MSG_DATA {
+			c <- string(msg.Data())
+		}
+	})
+
+	var recvs []string
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for len(recvs) < 10 {
+		select {
+		case s := <-c:
+			recvs = append(recvs, s)
+		case <-timer.C:
+			t.Error("recv", recvs)
+			return
+		}
+	}
+	for i, s := range recvs {
+		if s != "msg"+strconv.Itoa(i) {
+			t.Error("recv", recvs)
+			break
+		}
+	}
+
+	waitClusterPending(t, alive, "q", 0)
+}
+
+func TestServerClusterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &Options{ID: 1, Cluster: ClusterOptions{Address: "127.0.0.1:4160", Queues: []string{"q"}}}
+	if _, err := NewServer(opts); err != ErrClusterDirMissing {
+		t.Error("excepted error is", ErrClusterDirMissing, ", actual is", err)
+	}
+	opts.Cluster.Dir = dir
+
+	func() {
+		srv, err := NewServer(opts)
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer srv.Close()
+		if waitClusterLeader(t, []*Server{srv}) == nil {
+			return
+		}
+
+		pub, err := mq_client.Connect("tcp", "127.0.0.1:4150").ToQueue("q")
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer pub.Close()
+		for i := 0; i < 3; i++ {
+			if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("msg" + strconv.Itoa(i))).Build()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		waitClusterPending(t, []*Server{srv}, "q", 3)
+	}()
+
+	// a partially written record is discarded.
+	f, err := os.OpenFile(filepath.Join(dir, "raft.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	srv, err := NewServer(opts)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	if term := srv.GetCluster()["term"].(uint64); term < 1 {
+		t.Error("term isn't restored -", term)
+	}
+	if waitClusterLeader(t, []*Server{srv}) == nil {
+		return
+	}
+	waitClusterPending(t, []*Server{srv}, "q", 3)
+}
+
+func recvMessages(t *testing.T, c chan mq_client.Message, count int) []string {
+	var recvs []string
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for len(recvs) < count {
+		select {
+		case msg := <-c:
+			recvs = append(recvs, string(msg.Body()))
+		case <-timer.C:
+			t.Error("recv", recvs)
+			return recvs
+		}
+	}
+	return recvs
+}
+
+func TestServerShovel(t *testing.T) {
+	srv2, err := NewServer(&Options{ID: 2, TCPAddress: ":4151"})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv2.Close()
+
+	srv1, err := NewServer(&Options{ID: 1,
+		HttpEnabled: true,
+		Shovels: []Shovel{{Name: "a_to_b",
+			Source:      ShovelEndpoint{Type: mq_client.QUEUE, Name: "a"},
+			Destination: ShovelEndpoint{Address: "127.0.0.1:4151", Type: mq_client.QUEUE, Name: "b"}}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv1.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	for i := 0; i < 10; i++ {
+		srv1.CreateQueueIfNotExists("a").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("msg" + strconv.Itoa(i))).Build())
+	}
+	recvs := recvMessages(t, srv2.CreateQueueIfNotExists("b").C, 10)
+	for i, s := range recvs {
+		if s != "msg"+strconv.Itoa(i) {
+			t.Error("recv", recvs)
+			break
+		}
+	}
+
+	// add a shovel that pulls from the remote server by the admin api.
+	body := `{"name": "c_to_d", "source": {"address": "127.0.0.1:4151", "type": "queue", "name": "c"}, "destination": {"type": "queue", "name": "d"}}`
+	res, err := http.Post("http://127.0.0.1"+srv1.options.TCPAddress+"/mq/shovels", "application/json", strings.NewReader(body))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Error("status code is", res.Status)
+		return
+	}
+
+	srv2.CreateQueueIfNotExists("c").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build())
+	if recvs := recvMessages(t, srv1.CreateQueueIfNotExists("d").C, 1); len(recvs) != 1 || recvs[0] != "hello" {
+		t.Error("recv", recvs)
+	}
+
+	shovels := srv1.GetShovels()
+	if len(shovels) != 2 {
+		t.Error("shovels is", shovels)
+	} else if shovels[0]["message_total"] != uint32(10) || shovels[1]["message_total"] != uint32(1) {
+		t.Error("shovels is", shovels)
+	}
+
+	req, _ := http.NewRequest("DELETE", "http://127.0.0.1"+srv1.options.TCPAddress+"/mq/shovels/c_to_d", nil)
+	res, err = http.DefaultClient.Do(req)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Error("status code is", res.Status)
+	}
+	if shovels := srv1.GetShovels(); len(shovels) != 1 {
+		t.Error("shovels is", shovels)
+	}
+}
+
+func TestServerShovelLoopAndStop(t *testing.T) {
+	srv, err := NewServer(&Options{MsgQueueCapacity: 1})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	if err := srv.AddShovel(Shovel{Source: ShovelEndpoint{Type: mq_client.QUEUE, Name: "a"},
+		Destination: ShovelEndpoint{Type: mq_client.QUEUE, Name: "a"}}); err != ErrShovelLoop {
+		t.Error("excepted error is", ErrShovelLoop, ", actual is", err)
+	}
+
+	// the destination is full, the shovel waits until it is removed.
+	for i := 0; i < 3; i++ {
+		srv.CreateQueueIfNotExists("a").SendTimeout(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("msg"+strconv.Itoa(i))).Build(), 0)
+	}
+	srv.CreateQueueIfNotExists("b").SendTimeout(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("full")).Build(), 0)
+	if err := srv.AddShovel(Shovel{Name: "a_to_b",
+		Source:      ShovelEndpoint{Type: mq_client.QUEUE, Name: "a"},
+		Destination: ShovelEndpoint{Type: mq_client.QUEUE, Name: "b"}}); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := srv.RemoveShovel("a_to_b"); err != nil {
+		t.Error(err)
+	}
+
+	b := srv.CreateQueueIfNotExists("b")
+	if msg := <-b.C; "full" != string(msg.Data()) {
+		t.Error("recv", string(msg.Data()))
+	}
+	select {
+	case msg := <-b.C:
+		t.Error("shovel isn't stopped, recv", string(msg.Data()))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestServerUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mq.sock")
+
+	srv, err := NewServer(&Options{HttpEnabled: true,
+		Listeners: []ListenerOptions{{Network: "unix", Address: file, Mode: 0600}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	if fi, err := os.Stat(file); nil != err {
+		t.Error(err)
+		return
+	} else if fi.Mode().Perm() != 0600 {
+		t.Error("mode is", fi.Mode())
+	}
+
+	pub, err := mq_client.Connect("unix", file).ToQueue("a")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+	if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build()); err != nil {
+		t.Error(err)
+		return
+	}
+	if recvs := recvMessages(t, srv.CreateQueueIfNotExists("a").C, 1); len(recvs) != 1 || recvs[0] != "hello" {
+		t.Error("recv", recvs)
+	}
+
+	// http isn't enabled on the unix listener.
+	conn, err := net.Dial("unix", file)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /mq/queues HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if bs, _ := ioutil.ReadAll(conn); len(bs) != 0 {
+		t.Error("recv", string(bs))
+	}
+}
+
+func TestServerUnixMaxConnectionsPerIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mq.sock")
+
+	srv, err := NewServer(&Options{MaxConnectionsPerIP: 1,
+		Listeners: []ListenerOptions{{Network: "unix", Address: file}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	// the clients of unix socket aren't limited by MaxConnectionsPerIP.
+	for i := 0; i < 2; i++ {
+		pub, err := mq_client.Connect("unix", file).ToQueue("a")
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer pub.Close()
+	}
+}
+
+func TestServerWebSocket(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+
+	// binary mode carries the native protocol.
+	pub, err := mq_client.Connect("ws", address).ToQueue("a")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+	if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build()); err != nil {
+		t.Error(err)
+		return
+	}
+	err = mq_client.Connect("ws", address).SubscribeQueue("a",
+		func(cli *mq_client.Subscription, msg mq_client.Message) {
+			defer cli.Stop()
+			if "hello" != string(msg.Body()) {
+				t.Error("body is", string(msg.Body()))
+			}
+		})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+
+	// json mode
+	ws, err := mq_client.DialWebSocket("ws://" + address + "/mq/ws?mode=json")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	readJSON := func() map[string]interface{} {
+		_, payload, err := ws.ReadMessage()
+		if nil != err {
+			t.Error(err)
+			return nil
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(payload, &m); err != nil {
+			t.Error(err)
+		}
+		return m
+	}
+
+	ws.WriteMessage(mq_client.WS_TEXT, []byte(`{"command": "sub", "type": "topic", "name": "t", "options": {"headers": "true"}}`))
+	if m := readJSON(); m == nil || m["command"] != "ack" {
+		t.Error("recv", m)
+		return
+	}
+
+	srv.CreateTopicIfNotExists("t").Send(mq_client.BuildMessageWithHeaders(map[string]string{"k": "v"}, []byte("world")))
+	if m := readJSON(); m == nil || m["command"] != "data" || m["body"] != "world" {
+		t.Error("recv", m)
+	} else if headers, _ := m["headers"].(map[string]interface{}); headers["k"] != "v" {
+		t.Error("headers is", m["headers"])
+	}
+
+	ws.WriteMessage(mq_client.WS_TEXT, []byte(`{"command": "unknown"}`))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("connection isn't closed")
+	}
+}
+
+func TestServerWebSocketUnmasked(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	ws, err := mq_client.DialWebSocket("ws://127.0.0.1" + srv.options.TCPAddress + "/mq/ws?mode=json")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer ws.Close()
+
+	// a frame from client isn't masked, it is closed with 1002.
+	if err := mq_client.SendFull(ws.Conn, []byte{0x81, 0x02, '{', '}'}); err != nil {
+		t.Error(err)
+		return
+	}
+	ws.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bs, err := ioutil.ReadAll(ws.Conn)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal([]byte{0x80 | mq_client.WS_CLOSE, 0x02, 0x03, 0xEA}, bs) {
+		t.Errorf("excepted close frame with 1002, actual is %x", bs)
+	}
+}
+
+func TestServerHttpTopicEvents(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true, NoopInterval: 100 * time.Millisecond})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1"+srv.options.TCPAddress+"/mq/topics/t/events", nil)
+	req.Header.Set("Last-Event-ID", "5")
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Error("content type is", ct)
+	}
+
+	topic := srv.CreateTopicIfNotExists("t")
+	for i := 0; i < 100; i++ {
+		topic.channels_lock.RLock()
+		count := len(topic.channels)
+		topic.channels_lock.RUnlock()
+		if count > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a\nb")).Build())
+
+	var lines []string
+	scanner := bufio.NewScanner(res.Body)
+	for len(lines) < 8 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if excepted := []string{": keepalive", "", "id: 6", "data: a", "data: b", "", ": keepalive", ""}; fmt.Sprint(lines) != fmt.Sprint(excepted) {
+		t.Errorf("excepted is %q, actual is %q", excepted, lines)
+	}
+}
+
+func TestServerHttpTopicEventsResume(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true,
+		TopicLog: TopicLogOptions{Topics: []string{"t"}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	topic := srv.CreateTopicIfNotExists("t")
+	send := func(s string) {
+		topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(s)).Build())
+	}
+	// open returns the id and data lines of the first count events.
+	open := func(lastEventID string, count int, publish func()) []string {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1"+srv.options.TCPAddress+"/mq/topics/t/events", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return nil
+		}
+		defer res.Body.Close()
+
+		scanner := bufio.NewScanner(res.Body)
+		// wait for the keepalive that is sent after subscribed.
+		scanner.Scan()
+		if publish != nil {
+			publish()
+		}
+		var lines []string
+		for len(lines) < 2*count && scanner.Scan() {
+			if line := scanner.Text(); line != "" && !strings.HasPrefix(line, ":") {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	lines := open("", 1, func() { send("a") })
+	if excepted := []string{"id: 0", "data: a"}; fmt.Sprint(lines) != fmt.Sprint(excepted) {
+		t.Errorf("excepted is %q, actual is %q", excepted, lines)
+	}
+
+	// the messages that are published while the client is away.
+	send("b")
+	send("c")
+
+	lines = open("0", 2, nil)
+	if excepted := []string{"id: 1", "data: b", "id: 2", "data: c"}; fmt.Sprint(lines) != fmt.Sprint(excepted) {
+		t.Errorf("excepted is %q, actual is %q", excepted, lines)
+	}
+}
+
+func TestServerHttpTopicSession(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	url := "http://127.0.0.1" + srv.options.TCPAddress + "/mq/topics/t/sessions"
+	create := func(query string) string {
+		res, err := http.Post(url+query, "text/plain", nil)
+		if nil != err {
+			t.Error(err)
+			return ""
+		}
+		defer res.Body.Close()
+		var result struct {
+			Id string `json:"id"`
+		}
+		if res.StatusCode != http.StatusCreated {
+			t.Error("status code is", res.Status)
+		} else if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Error(err)
+		}
+		return result.Id
+	}
+	do := func(method, id string) (int, string) {
+		req, _ := http.NewRequest(method, url+"/"+id+"?timeout=100ms", nil)
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return 0, ""
+		}
+		defer res.Body.Close()
+		bs, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(bs)
+	}
+
+	id := create("")
+	if id == "" {
+		return
+	}
+
+	// the messages that are published between two polls are kept.
+	topic := srv.CreateTopicIfNotExists("t")
+	for _, s := range []string{"1", "2", "3"} {
+		topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(s)).Build())
+	}
+	if code, body := do("GET", id); code != http.StatusOK || body != "[1,2,3]" {
+		t.Error("recv", code, body)
+	}
+	if code, body := do("GET", id); code != http.StatusNoContent {
+		t.Error("recv", code, body)
+	}
+	topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("4")).Build())
+	if code, body := do("GET", id); code != http.StatusOK || body != "[4]" {
+		t.Error("recv", code, body)
+	}
+
+	if code, body := do("DELETE", id); code != http.StatusOK {
+		t.Error("delete", code, body)
+	}
+	if code, body := do("GET", id); code != http.StatusNotFound {
+		t.Error("recv", code, body)
+	}
+
+	// expired
+	id = create("?expires=100ms")
+	time.Sleep(300 * time.Millisecond)
+	if code, body := do("GET", id); code != http.StatusNotFound {
+		t.Error("recv", code, body)
+	}
+	if sessions := srv.GetSessions(); len(sessions) != 0 {
+		t.Error("sessions is", sessions)
+	}
+}
+
+func TestServerHttpBatchPush(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true, MsgQueueCapacity: 5})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	push := func(query, contentType string, body []byte) (int, *BatchResult) {
+		res, err := http.Post("http://127.0.0.1"+srv.options.TCPAddress+"/mq/queues/aa"+query, contentType, bytes.NewReader(body))
+		if nil != err {
+			t.Error(err)
+			return 0, nil
+		}
+		defer res.Body.Close()
+		var result BatchResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Error(err)
+			return res.StatusCode, nil
+		}
+		return res.StatusCode, &result
+	}
+
+	var binaryBody bytes.Buffer
+	for _, s := range []string{"b1", "", "b2"} {
+		binary.Write(&binaryBody, binary.BigEndian, uint32(len(s)))
+		binaryBody.WriteString(s)
+	}
+
+	for _, test := range []struct {
+		query       string
+		contentType string
+		body        []byte
+		excepted    []string
+	}{
+		{"?batch=json", "application/json", []byte(`["a", {"b":1}, 3]`), []string{"a", `{"b":1}`, "3"}},
+		{"", "application/x-ndjson", []byte("l1\r\nl2\n\nl3\n"), []string{"l1", "l2", "l3"}},
+		{"?batch=binary", "application/octet-stream", binaryBody.Bytes(), []string{"b1", "", "b2"}},
+	} {
+		code, result := push(test.query, test.contentType, test.body)
+		if code != http.StatusOK || result == nil || result.Accepted != len(test.excepted) {
+			t.Error(test.query, "status code is", code, result)
+			continue
+		}
+		if recvs := recvMessages(t, srv.CreateQueueIfNotExists("aa").C, len(test.excepted)); fmt.Sprint(recvs) != fmt.Sprint(test.excepted) {
+			t.Errorf("excepted is %q, actual is %q", test.excepted, recvs)
+		}
+	}
+
+	// the queue is full after 5 messages.
+	code, result := push("?batch=lines&timeout=10ms", "text/plain", []byte("1\n2\n3\n4\n5\n6\n7"))
+	if code != http.StatusRequestTimeout || result == nil {
+		t.Error("status code is", code, result)
+	} else if result.Total != 7 || result.Accepted != 5 || !result.Results[4].Ok ||
+		result.Results[5].Ok || result.Results[6].Error != ErrBatchItemSkipped.Error() {
+		t.Error("result is", result)
+	}
+
+	res, err := http.Post("http://127.0.0.1"+srv.options.TCPAddress+"/mq/queues/aa?batch=json", "application/json", strings.NewReader("{}"))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Error("status code is", res.Status)
+	}
+}
+
+func TestServerHttpBatchGet(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	q := srv.CreateQueueIfNotExists("bb")
+	get := func(query, accept string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", "http://127.0.0.1"+srv.options.TCPAddress+"/mq/queues/bb"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return nil, nil
+		}
+		defer res.Body.Close()
+		bs, _ := ioutil.ReadAll(res.Body)
+		return res, bs
+	}
+
+	type item struct {
+		Headers map[string]string `json:"headers"`
+		Body    []byte            `json:"body"`
+	}
+
+	// json
+	q.Send(mq_client.BuildMessageWithHeaders(map[string]string{"k": "v"}, []byte{0, 0xff}))
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("b")).Build())
+	res, bs := get("?format=json&max=2", "")
+	var items []item
+	if res == nil || res.StatusCode != http.StatusOK || res.Header.Get("X-HW-Batch") != "2" {
+		t.Error("result is", res, string(bs))
+	} else if err := json.Unmarshal(bs, &items); err != nil {
+		t.Error(err)
+	} else if len(items) != 2 || !bytes.Equal(items[0].Body, []byte{0, 0xff}) ||
+		items[0].Headers["k"] != "v" || string(items[1].Body) != "a" {
+		t.Error("items is", items)
+	}
+
+	// ndjson by Accept
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("cc")).Build())
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("d")).Build())
+	res, bs = get("?max_bytes=3", "application/x-ndjson")
+	if res == nil || res.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Error("result is", res, string(bs))
+	} else if lines := strings.Split(strings.TrimSpace(string(bs)), "\n"); len(lines) != 2 {
+		t.Error("body is", string(bs))
+	} else {
+		var last item
+		if err := json.Unmarshal([]byte(lines[1]), &last); err != nil || string(last.Body) != "cc" {
+			t.Error("body is", string(bs), err)
+		}
+	}
+
+	// multipart
+	res, bs = get("?format=multipart", "")
+	if res == nil {
+		return
+	}
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var bodies []string
+	mr := multipart.NewReader(bytes.NewReader(bs), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		bodies = append(bodies, string(body))
+	}
+	if len(bodies) != 1 || bodies[0] != "d" {
+		t.Error("bodies is", bodies)
+	}
+
+	// wait for more messages
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("f")).Build())
+	}()
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("e")).Build())
+	res, bs = get("?wait=2s&max=2", "")
+	if res == nil || string(bs) != "[e,f]" {
+		t.Error("body is", string(bs))
+	}
+
+	res, bs = get("?format=xml", "")
+	if res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Error("body is", string(bs))
+	}
+}
+
+func TestServerHttpAdmin(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	do := func(method, path string, excepted int) map[string]interface{} {
+		req, _ := http.NewRequest(method, "http://"+address+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return nil
+		}
+		defer res.Body.Close()
+		bs, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != excepted {
+			t.Error(method, path, "status code is", res.Status, string(bs))
+		}
+		var result map[string]interface{}
+		if bytes.HasPrefix(bs, []byte("{")) {
+			if err := json.Unmarshal(bs, &result); err != nil {
+				t.Error(err)
+			}
+		}
+		return result
+	}
+
+	q := srv.CreateQueueIfNotExists("q2")
+	for i := 0; i < 3; i++ {
+		q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+	}
+	if stats := do("GET", "/mq/queues/q2/stats", http.StatusOK); stats["depth"] != 3.0 ||
+		stats["capacity"] != 200.0 || stats["enqueue_total"] != 3.0 {
+		t.Error("stats is", stats)
+	}
+	if result := do("POST", "/mq/queues/q2/purge", http.StatusOK); result["purged"] != 3.0 {
+		t.Error("purge is", result)
+	}
+	do("DELETE", "/mq/queues/q2", http.StatusOK)
+	if result := do("DELETE", "/mq/queues/q2", http.StatusNotFound); result["error"] != ErrQueueNotFound.Error() || result["code"] != 404.0 {
+		t.Error("result is", result)
+	}
+
+	sub, err := mq_client.Connect("", address).Id("c1").Listen(mq_client.QUEUE, "q1", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer sub.Close()
+	if stats := do("GET", "/mq/queues/q1/stats", http.StatusOK); stats["consumers"] != 1.0 {
+		t.Error("stats is", stats)
+	}
+
+	tsub, err := mq_client.Connect("", address).Id("c2").Listen(mq_client.TOPIC, "t1", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer tsub.Close()
+	if stats := do("GET", "/mq/topics/t1/stats", http.StatusOK); stats["subscribers"] != 1.0 {
+		t.Error("stats is", stats)
+	}
+
+	res, err := http.Get("http://" + address + "/mq/topics/t1/subscribers")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	var subscribers []map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&subscribers)
+	res.Body.Close()
+	if nil != err {
+		t.Error(err)
+	} else if len(subscribers) != 1 || subscribers[0]["client"] != "c2" || subscribers[0]["owner"] != "client" {
+		t.Error("subscribers is", subscribers)
+	}
+
+	if result := do("DELETE", "/mq/clients/c2", http.StatusOK); result["disconnected"] != 1.0 {
+		t.Error("result is", result)
+	}
+	do("DELETE", "/mq/clients/c2", http.StatusNotFound)
+	do("GET", "/mq/clients/c1", http.StatusMethodNotAllowed)
+
+	do("DELETE", "/mq/topics/t1", http.StatusOK)
+	do("GET", "/mq/topics/t1/stats", http.StatusNotFound)
+}
+
+func TestConsumerRecv(t *testing.T) {
+	srv, err := NewServer(&Options{})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	var receiver Receiver = srv.CreateTopicIfNotExists("t").ListenOn()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := receiver.Recv(ctx); err != context.DeadlineExceeded {
+		t.Error("err is", err)
+	}
+
+	srv.CreateTopicIfNotExists("t").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+	if receiver.Pending() != 1 {
+		t.Error("pending is", receiver.Pending())
+	}
+	if msg, err := receiver.Recv(context.Background()); err != nil || string(msg.Body()) != "a" {
+		t.Error(msg, err)
+	}
+
+	receiver.Close()
+	if _, err := receiver.Recv(context.Background()); err != ErrConsumerClosed {
+		t.Error("err is", err)
+	}
+}
+
+func TestServerQueuePeek(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	q := srv.CreateQueueIfNotExists("a")
+	q.Send(mq_client.BuildMessageWithHeaders(map[string]string{"k": "v"}, []byte("1")))
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("2")).Build())
+	q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("3")).Build())
+
+	msgs, err := mq_client.Connect("", address).Peek("a", 2)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if len(msgs) != 2 || string(msgs[0].Body()) != "1" || msgs[0].Headers()["k"] != "v" || string(msgs[1].Body()) != "2" {
+		t.Error("msgs is", msgs)
+	}
+	if _, err := mq_client.Connect("", address).Peek("notfound", 2); err == nil || err.Error() != ErrQueueNotFound.Error() {
+		t.Error("err is", err)
+	}
+
+	res, err := http.Get("http://" + address + "/mq/queues/a/peek?count=5")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	var result struct {
+		Depth    int           `json:"depth"`
+		Messages []PeekMessage `json:"messages"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK || result.Depth != 3 || len(result.Messages) != 3 {
+		t.Error("result is", res.Status, result)
+	} else if result.Messages[0].Headers["k"] != "v" || result.Messages[2].Position != 2 ||
+		string(result.Messages[2].Body) != "3" || result.Messages[2].Size != 1 {
+		t.Error("messages is", result.Messages)
+	}
+
+	// the messages are still delivered in order.
+	for _, excepted := range []string{"1", "2", "3"} {
+		select {
+		case msg := <-q.C:
+			if excepted != string(msg.Body()) {
+				t.Error("body is", string(msg.Body()))
+			}
+		case <-time.After(1 * time.Second):
+			t.Error("msg isnot recv")
+		}
+	}
+	if msgs := q.Peek(10); len(msgs) != 0 {
+		t.Error("msgs is", msgs)
+	}
+}
+
+func TestServerTopicLog(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true,
+		TopicLog: TopicLogOptions{Topics: []string{"t"}, Size: 3}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	topic := srv.CreateTopicIfNotExists("t")
+	for i := 0; i < 4; i++ {
+		topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(strconv.Itoa(i))).Build())
+	}
+
+	replay := func(options map[string]string, excepted ...uint64) {
+		options["headers"] = "true"
+		sub, err := mq_client.Connect("", address).Listen(mq_client.TOPIC, "t", options)
+		if nil != err {
+			t.Error(options, err)
+			return
+		}
+		defer sub.Close()
+
+		c := make(chan mq_client.Message, 10)
+		go sub.Run(func(cli *mq_client.Subscription, msg mq_client.Message) {
+			c <- msg
+		})
+		for _, offset := range excepted {
+			select {
+			case msg := <-c:
+				if o, ok := msg.Offset(); !ok || o != offset || string(msg.Body()) != strconv.FormatUint(offset, 10) {
+					t.Error(options, "offset is", o, ok, string(msg.Body()))
+				}
+			case <-time.After(1 * time.Second):
+				t.Error(options, "msg isnot recv")
+				return
+			}
+		}
+	}
+
+	replay(map[string]string{"offset": "earliest"}, 1, 2, 3)
+	replay(map[string]string{"offset": "2"}, 2, 3)
+	replay(map[string]string{"offset": "0"}, 1, 2, 3)
+
+	if err := mq_client.Connect("", address).Commit("t", "c1", 3); nil != err {
+		t.Error(err)
+		return
+	}
+	replay(map[string]string{"consumer": "c1"}, 3)
+
+	srv.CreateTopicIfNotExists("t2")
+	if _, err := mq_client.Connect("", address).Listen(mq_client.TOPIC, "t2", map[string]string{"offset": "earliest"}); err == nil || err.Error() != ErrTopicNotLogged.Error() {
+		t.Error("err is", err)
+	}
+
+	res, err := http.Get("http://" + address + "/mq/topics/t/offsets")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	var result struct {
+		Earliest uint64            `json:"earliest"`
+		Latest   uint64            `json:"latest"`
+		Commits  map[string]uint64 `json:"commits"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if result.Earliest != 1 || result.Latest != 4 || result.Commits["c1"] != 3 {
+		t.Error("result is", result)
+	}
+
+	res, err = http.Post("http://"+address+"/mq/topics/t/offsets?consumer=c1&offset=abc", "text/plain", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Error("status is", res.Status)
+	}
+}
+
+func TestServerPartitionedTopic(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true,
+		Partitions: map[string]int{"p": 4}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	topic := srv.CreateTopicIfNotExists("p")
+
+	type received struct {
+		member int
+		msg    mq_client.Message
+	}
+	c := make(chan received, 100)
+	var subs []*mq_client.Subscription
+	for i := 0; i < 2; i++ {
+		sub, err := mq_client.Connect("", address).Listen(mq_client.TOPIC, "p",
+			map[string]string{"group": "g", "headers": "true"})
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+
+		member := i
+		go sub.Run(func(cli *mq_client.Subscription, msg mq_client.Message) {
+			c <- received{member: member, msg: msg}
+		})
+	}
+
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			key := "k" + strconv.Itoa(i%4)
+			topic.Send(mq_client.BuildMessageWithKey(key, []byte(strconv.Itoa(i))))
+		}
+	}
+	recv := func(count int) map[string][]received {
+		results := map[string][]received{}
+		for i := 0; i < count; i++ {
+			select {
+			case r := <-c:
+				results[r.msg.Key()] = append(results[r.msg.Key()], r)
+			case <-time.After(1 * time.Second):
+				t.Error("msg isnot recv")
+				return results
+			}
+		}
+		return results
+	}
+
+	publish(40)
+	members := map[int]bool{}
+	for key, results := range recv(40) {
+		last := -1
+		for _, r := range results {
+			if r.member != results[0].member {
+				t.Error(key, "is received by", r.member, results[0].member)
+			}
+			members[r.member] = true
+
+			i, _ := strconv.Atoi(string(r.msg.Body()))
+			if i <= last {
+				t.Error(key, "isnot in order,", i, last)
+			}
+			last = i
+		}
+	}
+	if len(members) != 2 {
+		t.Error("members is", members)
+	}
+
+	// the partitions of the member that leaves are assigned to the other.
+	subs[0].Close()
+	for i := 0; ; i++ {
+		stats, err := srv.GetTopicPartitions("p")
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		group := stats["groups"].(map[string]interface{})["g"].(map[string]interface{})
+		if len(group["members"].([]map[string]interface{})) == 1 {
+			break
+		}
+		if i > 100 {
+			t.Error("member isnot removed")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publish(8)
+	for key, results := range recv(8) {
+		for _, r := range results {
+			if r.member != 1 {
+				t.Error(key, "is received by", r.member)
+			}
+		}
+	}
+
+	res, err := http.Post("http://"+address+"/mq/topics/p?key=abc", "text/plain", strings.NewReader("http"))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if r := recv(1); len(r["abc"]) != 1 || string(r["abc"][0].msg.Body()) != "http" {
+		t.Error("result is", r)
+	}
+
+	// a key that breaks the headers is refused.
+	res, err = http.Post("http://"+address+"/mq/topics/p?key=a%0Aorigin:%201", "text/plain", strings.NewReader("http"))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if http.StatusBadRequest != res.StatusCode {
+		t.Error("excepted status is 400, actual is", res.StatusCode)
+	}
+
+	res, err = http.Get("http://" + address + "/mq/topics/p/partitions")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	var result struct {
+		Partitions int `json:"partitions"`
+		Groups     map[string]struct {
+			Members []struct {
+				Partitions []int `json:"partitions"`
+			} `json:"members"`
+		} `json:"groups"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if result.Partitions != 4 || len(result.Groups["g"].Members) != 1 || len(result.Groups["g"].Members[0].Partitions) != 4 {
+		t.Error("result is", result)
+	}
+
+	srv.CreateTopicIfNotExists("t")
+	if _, err := mq_client.Connect("", address).Listen(mq_client.TOPIC, "t", map[string]string{"group": "g"}); err == nil || err.Error() != ErrTopicNotPartitioned.Error() {
+		t.Error("err is", err)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	msg := mq_client.BuildMessageWithHeaders(map[string]string{"type": "alarm", "level": "2", "empty": ""},
+		[]byte(`{"device":{"id":"dev-12","tags":["a","b"]},"value":3.5,"ok":true}`))
+	for _, test := range []struct {
+		expr     string
+		excepted bool
+	}{
+		{`header.type == alarm`, true},
+		{`header.type == "event"`, false},
+		{`header.type != event`, true},
+		{`header.missing != x`, true},
+		{`header.missing != ""`, true},
+		{`header.missing == ""`, false},
+		{`header.missing ~= ".*"`, false},
+		{`header.empty == ""`, true},
+		{`header.empty != ""`, false},
+		{`header.type ^= al`, true},
+		{`header.level ~= "^[0-3]$"`, true},
+		{`body ~= "dev-1[0-9]"`, true},
+		{`json.device.id == dev-12`, true},
+		{`json.device.id ^= "dev-2"`, false},
+		{`json.device.tags.1 == b`, true},
+		{`json.value == 3.5`, true},
+		{`json.ok == true`, true},
+		{`json.missing == x`, false},
+		{`json.missing != x`, true},
+		{`header.type == event && json.ok == true`, false},
+		{`header.type == event || json.ok == true`, true},
+		{`header.type == alarm && header.level == 1 || json.value == 3.5`, true},
+	} {
+		filter, err := ParseFilter(test.expr)
+		if nil != err {
+			t.Error(test.expr, err)
+			continue
+		}
+		if actual := filter.Match(msg); actual != test.excepted {
+			t.Error(test.expr, "excepted is", test.excepted, ", actual is", actual)
+		}
+	}
+
+	if filter, _ := ParseFilter(`json.a == 1`); filter.Match(mq_client.BuildMessageWithHeaders(nil, []byte("abc"))) {
+		t.Error("a body that isn't json is matched")
+	}
+
+	for _, expr := range []string{"", "header.a", "header.a ==", "header.a == b &&", "a.b == c",
+		"header.a < b", `header.a == "b`, `header.a ~= "("`, "header.a == b c == d"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Error(expr, "is parsed")
+		}
+	}
+}
+
+func TestServerTopicFilter(t *testing.T) {
+	srv, err := NewServer(&Options{HttpEnabled: true})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	topic := srv.CreateTopicIfNotExists("t")
+
+	sub, err := mq_client.Connect("", address).Listen(mq_client.TOPIC, "t",
+		map[string]string{"filter": "header.type == alarm"})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer sub.Close()
+	c := make(chan string, 10)
+	go sub.Run(func(cli *mq_client.Subscription, msg mq_client.Message) {
+		c <- string(msg.Body())
+	})
+
+	topic.Send(mq_client.BuildMessageWithHeaders(map[string]string{"type": "event"}, []byte("1")))
+	topic.Send(mq_client.BuildMessageWithHeaders(map[string]string{"type": "alarm"}, []byte("2")))
+	select {
+	case body := <-c:
+		if body != "2" {
+			t.Error("body is", body)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("msg isnot recv")
+	}
+
+	stats, err := srv.GetTopicStats("t")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if stats["filter_total"] != uint64(2) || stats["filtered_total"] != uint64(1) {
+		t.Error("stats is", stats)
+	}
+
+	if _, err := mq_client.Connect("", address).Listen(mq_client.TOPIC, "t",
+		map[string]string{"filter": "header.type <> alarm"}); err == nil || !strings.Contains(err.Error(), "is invalid") {
+		t.Error("err is", err)
+	}
+	if _, err := mq_client.Connect("", address).Listen(mq_client.QUEUE, "q",
+		map[string]string{"filter": "header.type == alarm"}); err == nil || err.Error() != ErrFilterUnsupported.Error() {
+		t.Error("err is", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		topic.Send(mq_client.BuildMessageWithHeaders(nil, []byte(`{"id":"a"}`)))
+		topic.Send(mq_client.BuildMessageWithHeaders(nil, []byte(`{"id":"b"}`)))
+	}()
+	res, err := http.Get("http://" + address + "/mq/topics/t?timeout=2s&filter=" + url.QueryEscape("json.id == b"))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(bs) != `{"id":"b"}` {
+		t.Error("result is", res.Status, string(bs))
+	}
+
+	res, err = http.Get("http://" + address + "/mq/topics/t?filter=" + url.QueryEscape("json.id"))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Error("status is", res.Status)
+	}
+}
+
+func TestStorageEngines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &StorageOptions{Dir: dir, SegmentSize: 30}
+	for _, engine := range []string{"memory", "ring", "disk"} {
+		storage, err := StorageEngines[engine](mq_client.QUEUE, "a/b", 10, opts)
+		if nil != err {
+			t.Error(engine, err)
+			continue
+		}
+		for i := 0; i < 5; i++ {
+			if err := storage.Append(mq_client.BuildMessageWithHeaders(map[string]string{"i": strconv.Itoa(i)},
+				[]byte(strconv.Itoa(i)))); err != nil {
+				t.Error(engine, err)
+			}
+		}
+		if err := storage.Remove(2); err != nil {
+			t.Error(engine, err)
+		}
+		msgs, err := storage.Read(1, 5)
+		if nil != err {
+			t.Error(engine, err)
+		}
+		if storage.Len() != 3 || len(msgs) != 2 || string(msgs[0].Body()) != "3" ||
+			msgs[1].Header("i") != "4" {
+			t.Error(engine, storage.Len(), msgs)
+		}
+		storage.Close()
+	}
+
+	// the disk engine keeps the messages after it is closed.
+	storage, err := openDiskStorage(mq_client.QUEUE, "a/b", 10, opts)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer storage.Close()
+	msgs, err := storage.Read(0, 5)
+	if nil != err {
+		t.Error(err)
+	}
+	if storage.Len() != 3 || len(msgs) != 3 || string(msgs[0].Body()) != "2" {
+		t.Error(storage.Len(), msgs)
+	}
+}
+
+func TestDiskStorageSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, sync := range []string{SYNC_NEVER, SYNC_INTERVAL} {
+		opts := &StorageOptions{Dir: dir, Sync: sync, SyncInterval: 10 * time.Millisecond}
+		storage, err := openDiskStorage(mq_client.QUEUE, sync, 10, opts)
+		if nil != err {
+			t.Error(sync, err)
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			if err := storage.Append(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(strconv.Itoa(i))).Build()); err != nil {
+				t.Error(sync, err)
+			}
+		}
+		if err := storage.Remove(1); err != nil {
+			t.Error(sync, err)
+		}
+
+		// the position of the first message isn't written by Remove.
+		head := filepath.Join(dir, mq_client.QUEUE, sync, "head")
+		if sync == SYNC_NEVER {
+			if _, err := os.Stat(head); !os.IsNotExist(err) {
+				t.Error(sync, "head is written by remove,", err)
+			}
+		} else {
+			for i := 0; i < 100; i++ {
+				if _, err := os.Stat(head); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if _, err := os.Stat(head); err != nil {
+				t.Error(sync, "head isn't written in interval,", err)
+			}
+		}
+		if err := storage.Close(); err != nil {
+			t.Error(sync, err)
+		}
+
+		storage, err = openDiskStorage(mq_client.QUEUE, sync, 10, opts)
+		if nil != err {
+			t.Error(sync, err)
+			continue
+		}
+		if msgs, err := storage.Read(0, 5); err != nil || len(msgs) != 2 || string(msgs[0].Body()) != "1" {
+			t.Error(sync, msgs, err)
+		}
+		storage.Close()
+	}
+
+	if err := (&StorageOptions{Sync: "abc"}).validate(); err == nil {
+		t.Error("invalid sync is accepted")
+	}
+}
+
+func TestServerDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewServer(&Options{Storage: StorageOptions{Engine: "disk"}}); err == nil {
+		t.Error("disk engine without dir is accepted")
+	}
+	if _, err := NewServer(&Options{Storage: StorageOptions{Engines: map[string]string{"a": "abc"}}}); err == nil {
+		t.Error("unknown engine is accepted")
+	}
+
+	opts := Options{
+		TopicLog: TopicLogOptions{Topics: []string{"t"}},
+		Storage:  StorageOptions{Dir: dir, Engines: map[string]string{"q": "disk", "t": "disk"}},
+	}
+	srv, err := NewServer(&opts)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	q := srv.CreateQueueIfNotExists("q")
+	for _, s := range []string{"1", "2", "3"} {
+		q.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte(s)).Build())
+	}
+	select {
+	case msg := <-q.C:
+		if string(msg.Body()) != "1" {
+			t.Error("body is", string(msg.Body()))
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("msg isnot recv")
+	}
+	topic := srv.CreateTopicIfNotExists("t")
+	topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+	topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("b")).Build())
+	if err := srv.CommitOffset("t", "c1", 1); err != nil {
+		t.Error(err)
+	}
+	// a replay subscriber that is still open is stopped by Close.
+	if _, err := topic.ListenWith(map[string]string{"offset": "earliest"}); err != nil {
+		t.Error(err)
+	}
+	srv.Close()
+
+	opts = Options{
+		TopicLog: TopicLogOptions{Topics: []string{"t"}},
+		Storage:  StorageOptions{Dir: dir, Engines: map[string]string{"q": "disk", "t": "disk"}},
+	}
+	srv, err = NewServer(&opts)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	q = srv.GetQueueIfExists("q")
+	if q == nil {
+		t.Error("queue isnot loaded")
+		return
+	}
+	if msgs := q.Peek(10); len(msgs) != 2 || string(msgs[0].Body()) != "2" || string(msgs[1].Body()) != "3" {
+		t.Error("msgs is", msgs)
+	}
+
+	stats, err := srv.GetTopicOffsets("t")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if stats["earliest"] != uint64(0) || stats["latest"] != uint64(2) ||
+		stats["commits"].(map[string]uint64)["c1"] != 1 {
+		t.Error("stats is", stats)
+	}
+	if consumer, err := srv.CreateTopicIfNotExists("t").ListenWith(map[string]string{"consumer": "c1"}); err != nil {
+		t.Error(err)
+	} else {
+		if msg := <-consumer.C; string(msg.Body()) != "b" {
+			t.Error("body is", string(msg.Body()))
+		}
+		consumer.Close()
+	}
+	srv.CreateTopicIfNotExists("t").Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("c")).Build())
+	if stats, _ := srv.GetTopicOffsets("t"); stats["latest"] != uint64(3) {
+		t.Error("stats is", stats)
+	}
+
+	if err := srv.DeleteQueue("q"); err != nil {
+		t.Error(err)
+	}
+	if q := srv.CreateQueueIfNotExists("q"); q.Len() != 0 {
+		t.Error("len is", q.Len())
+	}
+	srv.Close()
+
+	// a queue whose storage is corrupted isn't loaded into memory silently.
+	if err := ioutil.WriteFile(filepath.Join(dir, mq_client.QUEUE, "q", "head"), []byte("1"), 0644); nil != err {
+		t.Error(err)
+		return
+	}
+	if srv, err := NewServer(&opts); err == nil {
+		srv.Close()
+		t.Error("corrupted storage is loaded")
+	} else if !strings.Contains(err.Error(), ErrStorageCorrupted.Error()) {
+		t.Error(err)
+	}
+}
+
+func TestServerInterceptors(t *testing.T) {
+	var lock sync.Mutex
+	var published, delivered []MessageContext
+	var dropped []error
+
+	srv, err := NewServer(&Options{HttpEnabled: true,
+		MsgQueueCapacity: 2,
+		Interceptors: []Interceptor{
+			&InterceptorFuncs{Publish: func(ctx *MessageContext, msg mq_client.Message) (mq_client.Message, error) {
+				if string(msg.Body()) == "bad" {
+					return msg, errors.New("bad message.")
+				}
+				return msg.WithHeaders(map[string]string{"stamp": "1"}), nil
+			}},
+			&InterceptorFuncs{Publish: func(ctx *MessageContext, msg mq_client.Message) (mq_client.Message, error) {
+				lock.Lock()
+				published = append(published, *ctx)
+				lock.Unlock()
+				return msg, nil
+			}, Deliver: func(ctx *MessageContext, msg mq_client.Message) mq_client.Message {
+				lock.Lock()
+				delivered = append(delivered, *ctx)
+				lock.Unlock()
+				return msg.WithHeaders(map[string]string{"delivered": "yes"})
+			}, Drop: func(ctx *MessageContext, msg mq_client.Message, reason error) {
+				lock.Lock()
+				dropped = append(dropped, reason)
+				lock.Unlock()
+			}},
+		}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+
+	pub, err := mq_client.Connect("", address).Id("p1").ToQueue("q")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+	if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build()); nil != err {
+		t.Error(err)
+		return
+	}
+
+	sub, err := mq_client.Connect("", address).Id("s1").Listen(mq_client.QUEUE, "q", map[string]string{"headers": "true"})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer sub.Close()
+	c := make(chan mq_client.Message, 10)
+	go sub.Run(func(cli *mq_client.Subscription, msg mq_client.Message) {
+		c <- msg
+	})
+	select {
+	case msg := <-c:
+		if string(msg.Body()) != "hello" || msg.Header("stamp") != "1" || msg.Header("delivered") != "yes" {
+			t.Error("msg is", string(msg.Body()), msg.Headers())
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("msg isnot recv")
+	}
+
+	req, _ := http.NewRequest("POST", "http://"+address+"/mq/queues/q2", strings.NewReader("bad"))
+	req.Header.Set("X-HW-Client", "h1")
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK || !strings.Contains(string(bs), "bad message.") {
+		t.Error("result is", res.Status, string(bs))
+	}
+
+	topic := srv.CreateTopicIfNotExists("t")
+	consumer := topic.ListenOn()
+	defer consumer.Close()
+	for i := 0; i < 3; i++ {
+		topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("a")).Build())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(published) != 1 || published[0] != (MessageContext{Type: "queue", Name: "q", Client: "p1", RemoteAddr: published[0].RemoteAddr}) {
+		t.Error("published is", published)
+	}
+	if len(delivered) != 1 || delivered[0].Client != "s1" || delivered[0].Name != "q" {
+		t.Error("delivered is", delivered)
+	}
+	if len(dropped) != 2 || dropped[0].Error() != "bad message." || dropped[1] != ErrSubscriberFull {
+		t.Error("dropped is", dropped)
+	}
+}
+
+type lifecycleRecorder struct {
+	dummyWatcher
+	lock   sync.Mutex
+	events []string
+}
+
+func (self *lifecycleRecorder) add(event string) {
+	self.lock.Lock()
+	self.events = append(self.events, event)
+	self.lock.Unlock()
+}
+
+func (self *lifecycleRecorder) OnSubscribe(typ, name string, client ClientInfo) {
+	self.add("subscribe " + typ + " " + name + " " + client.Name)
+}
+
+func (self *lifecycleRecorder) OnUnsubscribe(typ, name string, client ClientInfo) {
+	self.add("unsubscribe " + typ + " " + name + " " + client.Name)
+}
+
+func (self *lifecycleRecorder) OnKill(typ, name string) {
+	self.add("kill " + typ + " " + name)
+}
+
+func (self *lifecycleRecorder) OnOverflow(typ, name string, client ClientInfo) {
+	self.add("overflow " + typ + " " + name)
+}
+
+type legacyWatcher struct {
+	queues []string
+}
+
+func (self *legacyWatcher) OnNewQueue(name string)    { self.queues = append(self.queues, name) }
+func (self *legacyWatcher) OnRemoveQueue(name string) {}
+func (self *legacyWatcher) OnNewTopic(name string)    {}
+func (self *legacyWatcher) OnRemoveTopic(name string) {}
+
+func TestServerLifecycleEvents(t *testing.T) {
+	legacy := &legacyWatcher{}
+	adapted := AdaptWatcher(legacy)
+	adapted.OnConnect(ClientInfo{Name: "a"})
+	adapted.OnNewQueue("q")
+	if len(legacy.queues) != 1 || legacy.queues[0] != "q" {
+		t.Error("legacy watcher isn't adapted -", legacy.queues)
+	}
+
+	recorder := &lifecycleRecorder{}
+	if AdaptWatcher(recorder) != LifecycleWatcher(recorder) {
+		t.Error("lifecycle watcher is adapted")
+	}
+	srv, err := NewServer(&Options{MsgQueueCapacity: 4, Watch: recorder})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	lines := make(chan string, 100)
+	events := srv.GetTopicIfExists(mq_client.SYS_EVENTS).ListenOn()
+	go func() {
+		for msg := range events.C {
+			lines <- strings.TrimSpace(string(msg.Body()))
+		}
+	}()
+	defer events.Close()
+
+	waitEvent := func(prefix string) string {
+		for {
+			select {
+			case line := <-lines:
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("event '" + prefix + "' isn't received")
+				return ""
+			}
+		}
+	}
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	sub, err := mq_client.Connect("", address).Id("s 1").Listen(mq_client.TOPIC, "t", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if line := waitEvent("connect client"); !strings.Contains(line, "remoteAddr=127.0.0.1") {
+		t.Error(line)
+	}
+	if line := waitEvent("subscribe"); !strings.HasPrefix(line, "subscribe topic t name=s+1 remoteAddr=127.0.0.1") {
+		t.Error(line)
+	}
+	sub.Close()
+	if line := waitEvent("unsubscribe"); !strings.HasPrefix(line, "unsubscribe topic t name=s+1 ") {
+		t.Error(line)
+	}
+	if line := waitEvent("disconnect client"); !strings.HasPrefix(line, "disconnect client name=s+1 ") {
+		t.Error(line)
+	}
+
+	topic := srv.CreateTopicIfNotExists("o")
+	consumer := topic.ListenOn()
+	defer consumer.Close()
+	for i := 0; i < 7; i++ {
+		topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 1).Append([]byte("a")).Build())
+	}
+	if line := waitEvent("overflow"); !strings.HasPrefix(line, "overflow topic o name= remoteAddr= consumer=") {
+		t.Error(line)
+	}
+	<-consumer.C
+	topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 1).Append([]byte("a")).Build())
+	topic.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 1).Append([]byte("a")).Build())
+	waitEvent("overflow topic o")
+
+	pub, err := mq_client.Connect("", address).Id("k1").ToQueue("q")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+	waitEvent("connect client")
+	for i := 0; i < 100; i++ {
+		if _, err := srv.DisconnectClient("k1"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if line := waitEvent("kill"); line != "kill client k1" {
+		t.Error(line)
+	}
+	srv.KillQueueIfExists("q")
+	waitEvent("del queue q")
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	excepted := []string{"subscribe topic t s 1", "unsubscribe topic t s 1",
+		"overflow topic o", "overflow topic o", "kill client k1"}
+	if fmt.Sprint(recorder.events) != fmt.Sprint(excepted) {
+		t.Error("excepted is", excepted)
+		t.Error("actual is  ", recorder.events)
+	}
+}
+
+func TestServerJSONEvents(t *testing.T) {
+	if _, err := NewServer(&Options{EventFormat: "xml"}); err == nil {
+		t.Error("unknown event format is accepted")
+	}
+
+	srv, err := NewServer(&Options{ID: 7, EventFormat: EventJSON})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	events := srv.GetTopicIfExists(mq_client.SYS_EVENTS).ListenOn()
+	defer events.Close()
+
+	srv.CreateQueueIfNotExists("q1")
+	select {
+	case msg := <-events.C:
+		if !bytes.HasPrefix(msg.Body(), []byte("{")) {
+			t.Error(string(msg.Body()))
+		}
+		event, err := mq_client.ParseEvent(msg.Body())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if event.Type != "new" || event.Kind != mq_client.QUEUE || event.Name != "q1" ||
+			event.ServerID != 7 || event.Timestamp.IsZero() {
+			t.Error(string(msg.Body()))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("event isn't received")
+	}
+}
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *syncBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *syncBuffer) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.String()
+}
+
+func TestServerLogging(t *testing.T) {
+	for _, log := range []LogOptions{{Level: "trace"},
+		{Format: "xml"},
+		{Levels: map[string]string{"unknown": "info"}}} {
+		if _, err := NewServer(&Options{Log: log}); err == nil {
+			t.Error("invalid log options is accepted -", log)
+		}
+	}
+
+	var out syncBuffer
+	srv, err := NewServer(&Options{Log: LogOptions{Format: "json",
+		Output: &out,
+		Level:  "error",
+		Levels: map[string]string{LogTCP: "debug"}}})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+
+	srv.logger(LogQueue).warn("skipped")
+	srv.logger(LogQueue).error("logged", "dest", "q1")
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	pub, err := mq_client.Connect("", address).Id("c1").ToQueue("q1")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	pub.Close()
+
+	var records []map[string]interface{}
+	for i := 0; i < 100; i++ {
+		records = nil
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Error(line, err)
+				return
+			}
+			records = append(records, record)
+		}
+		if len(records) > 0 && records[len(records)-1]["msg"] == "client is closed" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var logged, closed bool
+	for _, record := range records {
+		switch record["msg"] {
+		case "skipped":
+			t.Error("warn log of queue is written")
+		case "logged":
+			logged = record["level"] == "ERROR" && record["subsystem"] == LogQueue && record["dest"] == "q1"
+		case "client is closed":
+			closed = record["subsystem"] == LogTCP && record["client"] == "c1" &&
+				strings.HasPrefix(record["remote_addr"].(string), "127.0.0.1:")
+		}
+	}
+	if !logged || !closed {
+		t.Error(out.String())
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.json": `{"address": ":4151", "msg": {"timeout": "2s", "queue_capacity": 10},
+	"log": {"levels": {"tcp": "debug"}},
+	"cluster": {"peers": ["a:1", "b:2"]},
+	"shovels": [{"name": "s1", "source": {"type": "queue", "name": "q1"}, "destination": {"address": "h:1", "type": "topic", "name": "t1"}}],
+	"destinations": [{"type": "topic", "name": "t1", "partitions": 2, "log": true}],
+	"users": [{"name": "u1", "password": "p # 1"}],
+	"policies": [{"user": "u1", "type": "queue", "name": "q*", "actions": ["publish", "subscribe"]}]}`,
+		"a.yaml": `# comment
+address: ":4151"
+msg:
+  timeout: 2s       # comment
+  queue_capacity: 10
+log:
+  levels: {tcp: debug}
+cluster:
+  peers:
+  - a:1
+  - "b:2"
+shovels:
+  - name: s1
+    source: {type: queue, name: q1}
+    destination:
+      address: h:1
+      type: topic
+      name: t1
+destinations:
+  - type: topic
+    name: t1
+    partitions: 2
+    log: true
+users:
+  - name: u1
+    password: "p # 1"
+policies:
+  - user: u1
+    type: queue
+    name: 'q*'
+    actions: [publish, subscribe]
+`,
+		"a.toml": `# comment
+address = ":4151"
+log.levels = { tcp = "debug" }
+
+[msg]
+timeout = "2s" # comment
+queue_capacity = 1_0
+
+[cluster]
+peers = [
+  "a:1",
+  'b:2',
+]
+
+[[shovels]]
+name = "s1"
+source = { type = "queue", name = "q1" }
+[shovels.destination]
+address = "h:1"
+type = "topic"
+name = "t1"
+
+[[destinations]]
+type = "topic"
+name = "t1"
+partitions = 2
+log = true
+
+[[users]]
+name = "u1"
+password = "p # 1"
+
+[[policies]]
+user = "u1"
+type = "queue"
+name = "q*"
+actions = ["publish", "subscribe"]
+`,
+	}
+
+	var excepted string
+	for _, name := range []string{"a.json", "a.yaml", "a.toml"} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(files[name]), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(file)
+		if err != nil {
+			t.Error(name, err)
+			continue
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Error(name, err)
+			continue
+		}
+		bs, _ := json.Marshal(cfg)
+		if excepted == "" {
+			excepted = string(bs)
+		} else if string(bs) != excepted {
+			t.Error(name, "excepted is", excepted)
+			t.Error(name, "actual is  ", string(bs))
+		}
+
+		opts, err := cfg.Options()
+		if err != nil {
+			t.Error(name, err)
+			continue
+		}
+		if opts.TCPAddress != ":4151" || opts.MsgTimeout != 2*time.Second || opts.MsgQueueCapacity != 10 ||
+			!opts.HttpEnabled || opts.Partitions["t1"] != 2 || len(opts.TopicLog.Topics) != 1 ||
+			len(opts.Cluster.Peers) != 2 || opts.Log.Levels[LogTCP] != "debug" {
+			t.Errorf("%s %#v", name, opts)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(bad, []byte("address: 4150\nlisteners:\n- {network: unix, address: /tmp/a, mode: 0660}\n"), 0666)
+	if cfg, err := LoadConfig(bad); err != nil {
+		t.Error(err)
+	} else if opts, err := cfg.Options(); err != nil || cfg.Address != "4150" || opts.Listeners[0].Mode != 0660 {
+		t.Error(cfg.Address, err)
+	}
+	ioutil.WriteFile(bad, []byte("address: 1\nunknown: 2\n"), 0666)
+	if _, err := LoadConfig(bad); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Error(err)
+	}
+
+	// block scalars, anchors and multi-line strings are read by the parsers.
+	yml := filepath.Join(dir, "b.yaml")
+	ioutil.WriteFile(yml, []byte("snapshot: >-\n  /tmp/a\nshovels:\n- name: s1\n  source: &q {type: queue, name: q1}\n"+
+		"  destination:\n    <<: *q\n    address: h:1\n"), 0666)
+	if cfg, err := LoadConfig(yml); err != nil {
+		t.Error(err)
+	} else if cfg.Snapshot != "/tmp/a" || len(cfg.Shovels) != 1 ||
+		cfg.Shovels[0].Destination != (ShovelEndpoint{Address: "h:1", Type: "queue", Name: "q1"}) {
+		t.Errorf("%#v", cfg)
+	}
+	tml := filepath.Join(dir, "b.toml")
+	ioutil.WriteFile(tml, []byte("snapshot = \"\"\"\n/tmp/a\"\"\"\naddress = 1979-05-27\n"), 0666)
+	if cfg, err := LoadConfig(tml); err != nil {
+		t.Error(err)
+	} else if cfg.Snapshot != "/tmp/a" || cfg.Address != "1979-05-27" {
+		t.Errorf("%#v", cfg)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.json")
+	ioutil.WriteFile(file, []byte(`{"address": ":1", "snapshot": "a", "verbose": true, "event_format": "json"}`), 0666)
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flags := NewConfigFlags(fs)
+	if err := fs.Parse([]string{"-address", ":3", "-verbose=false", "-cluster_peers", "a:1,b:2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ReadConfig("", []string{"FASTMQ_CONFIG=" + file,
+		"FASTMQ_ADDRESS=:2",
+		"FASTMQ_SNAPSHOT=b",
+		"FASTMQ_PARTITIONS=t1=3",
+		"FASTMQ_MSG_TIMEOUT=3s"}, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != ":3" || cfg.Snapshot != "b" || cfg.Verbose || cfg.EventFormat != EventJSON ||
+		cfg.Partitions["t1"] != 3 || time.Duration(cfg.Msg.Timeout) != 3*time.Second ||
+		strings.Join(cfg.Cluster.Peers, ",") != "a:1,b:2" || !cfg.HTTP.Enabled {
+		t.Errorf("%#v", cfg)
+	}
+
+	if err := fs.Parse([]string{"-msg_timeout", "abc"}); err == nil {
+		t.Error("invalid flag is accepted")
+	}
+	if _, err := ReadConfig("", []string{"FASTMQ_VERBOSE=abc"}, nil); err == nil {
+		t.Error("invalid environment variable is accepted")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EventFormat = "xml"
+	cfg.Log.Level = "trace"
+	cfg.Storage.Engine = "disk"
+	cfg.Destinations = []DestinationConfig{{Type: "queue", Name: "q1", Partitions: 2}, {Type: "queue", Name: "q1"}}
+	cfg.Policies = []PolicyConfig{{User: "u1", Type: "queue", Name: "q1", Actions: []string{"read"}}}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config is accepted")
+	}
+	for _, s := range []string{"event format", "log level", "storage dir", "partitions", "declared twice",
+		"user 'u1'", "action 'read'"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Error("'"+s+"' isn't reported -", err)
+		}
+	}
+	if _, err := cfg.Options(); err == nil {
+		t.Error("invalid config is accepted by Options")
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastmq-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fastmq.json")
+	ioutil.WriteFile(file, []byte(`{"log": {"level": "error"},
+  "limits": {"max_connections": 2},
+  "destinations": [{"type": "queue", "name": "q1"}, {"type": "topic", "name": "t0"}]}`), 0666)
+
+	cfg, err := ReadConfig(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := cfg.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out syncBuffer
+	opts.Log.Output = &out
+	opts.ReloadConfig = func() (*Config, error) {
+		return ReadConfig(file, nil, nil)
+	}
+	srv, err := NewServer(opts)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Close()
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	cfg.Declare(srv)
+
+	address := "127.0.0.1" + srv.options.TCPAddress
+	pub, err := mq_client.Connect("", address).ToQueue("q1")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer pub.Close()
+
+	ioutil.WriteFile(file, []byte(`{"address": ":4151",
+  "log": {"level": "info", "levels": {"queue": "debug"}},
+  "limits": {"max_connections": 3},
+  "partitions": {"t0": 2},
+  "destinations": [{"type": "queue", "name": "q1"}, {"type": "topic", "name": "t0"},
+    {"type": "topic", "name": "t1", "partitions": 2}],
+  "users": [{"name": "u1", "password": "p1"}]}`), 0666)
+
+	res, err := http.Post("http://"+address+"/mq/reload", "text/plain", nil)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	var report ReloadReport
+	err = json.NewDecoder(res.Body).Decode(&report)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Error(res.Status, err)
+		return
+	}
+	if strings.Join(report.Applied, ",") != "limits_max_connections,log_level,log_levels,partitions,destinations" ||
+		strings.Join(report.Restart, ",") != "address,destinations.t0" ||
+		strings.Join(report.Unsupported, ",") != "users" {
+		t.Errorf("%#v", report)
+	}
+
+	if srv.loggers[LogQueue].level.Level() != slog.LevelDebug ||
+		srv.loggers[LogTCP].level.Level() != slog.LevelInfo {
+		t.Error("levels aren't reloaded")
+	}
+	srv.admission.lock.Lock()
+	max_connections := srv.admission.max_connections
+	srv.admission.lock.Unlock()
+	if max_connections != 3 {
+		t.Error("excepted max connections is 3, actual is", max_connections)
+	}
+	if t1 := srv.GetTopicIfExists("t1"); t1 == nil || t1.partitions == nil {
+		t.Error("topic t1 isn't created with partitions")
+	}
+	if srv.GetTopicIfExists("t0").partitions != nil {
+		t.Error("partitions of existing topic t0 are changed")
+	}
+	if srv.Config().Address != ":4151" || srv.options.TCPAddress != ":4150" {
+		t.Error("address is changed")
+	}
+
+	if err := pub.Send(mq_client.NewMessageWriter(mq_client.MSG_DATA, 10).Append([]byte("hello")).Build()); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 100 && srv.GetQueueIfExists("q1").Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if 1 != srv.GetQueueIfExists("q1").Len() {
+		t.Error("connection is dropped by reload")
+	}
+
+	ioutil.WriteFile(file, []byte(`{"log": {"level": "trace"}, "limits": {"max_connections": 1}}`), 0666)
+	if _, err := srv.Reload(); err == nil {
+		t.Error("invalid config is reloaded")
+	}
+	srv.admission.lock.Lock()
+	max_connections = srv.admission.max_connections
+	srv.admission.lock.Unlock()
+	if max_connections != 3 || srv.Config().Address != ":4151" {
+		t.Error("invalid config is applied")
+	}
+
+	// a shovel that is refused is reported as failed, the others are applied.
+	ioutil.WriteFile(file, []byte(`{"address": ":4151",
+  "log": {"level": "info", "levels": {"queue": "debug"}},
+  "limits": {"max_connections": 4},
+  "partitions": {"t0": 2},
+  "destinations": [{"type": "queue", "name": "q1"}, {"type": "topic", "name": "t0"},
+    {"type": "topic", "name": "t1", "partitions": 2}],
+  "shovels": [{"source": {"name": "q1"}, "destination": {"name": "q1"}}],
+  "users": [{"name": "u1", "password": "p1"}]}`), 0666)
+	reloaded, err := srv.Reload()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(reloaded.Applied, ",") != "limits_max_connections" ||
+		strings.Join(reloaded.Failed, ",") != "shovels" {
+		t.Errorf("%#v", reloaded)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session isn't found.")
+	ErrSessionClosed   = errors.New("session is closed.")
+)
+
+// Session keeps a consumer of topic between the polls of a http client, so
+// the messages that are published between two polls aren't lost. it is
+// closed if it isn't polled in the expires duration.
+type Session struct {
+	closed      int32
+	last_access int64
+	id          string
+	name        string
+	expires     time.Duration
+	consumer    *Consumer
+	timer       *time.Timer
+}
+
+func (self *Session) Id() string {
+	return self.id
+}
+
+func (self *Session) Expires() time.Duration {
+	return self.expires
+}
+
+func (self *Session) isClosed() bool {
+	return 0 != atomic.LoadInt32(&self.closed)
+}
+
+func (self *Session) close() {
+	if atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		self.timer.Stop()
+		self.consumer.Close()
+	}
+}
+
+// Poll waits for a message until timeout, then reads a batch of messages
+// by opts.
+func (self *Session) Poll(opts BatchOptions, timeout time.Duration) ([]mq_client.Message, error) {
+	if self.isClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	// the session doesn't expire while it is polled.
+	self.timer.Stop()
+	defer func() {
+		atomic.StoreInt64(&self.last_access, time.Now().UnixNano())
+		if !self.isClosed() {
+			self.timer.Reset(self.expires)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	msg, err := self.consumer.Recv(ctx)
+	if err != nil {
+		if err == ErrConsumerClosed {
+			return nil, ErrSessionClosed
+		}
+		return nil, nil
+	}
+	return ReadBatch(self.consumer, msg, opts), nil
+}
+
+func (self *Session) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          self.id,
+		"topic":       self.name,
+		"expires":     self.expires.String(),
+		"last_access": time.Unix(0, atomic.LoadInt64(&self.last_access)),
+		"pending":     self.consumer.Pending(),
+	}
+}
+
+type sessions struct {
+	lock sync.Mutex
+	all  map[string]*Session
+}
+
+func newSessionId() string {
+	var bs [16]byte
+	rand.Read(bs[:])
+	return hex.EncodeToString(bs[:])
+}
+
+// CreateSession creates a session on topic, expires is
+// Options.SessionExpires if it is 0, filter may be nil.
+func (self *Server) CreateSession(name string, expires time.Duration, filter *Filter) (*Session, error) {
+	if 0 != atomic.LoadInt32(&self.is_stopped) {
+		return nil, ErrAlreadyClosed
+	}
+	if expires <= 0 {
+		expires = self.options.SessionExpires
+	}
+
+	session := &Session{
+		last_access: time.Now().UnixNano(),
+		id:          newSessionId(),
+		name:        name,
+		expires:     expires,
+		consumer:    self.CreateTopicIfNotExists(name).listen(filter, nil),
+	}
+
+	self.sessions.lock.Lock()
+	if self.sessions.all == nil {
+		self.sessions.all = map[string]*Session{}
+	}
+	self.sessions.all[session.id] = session
+	session.timer = time.AfterFunc(expires, func() {
+		self.logger(LogSession).info("session is expired", "session", session.id, "type", mq_client.TOPIC, "dest", session.name)
+		self.CloseSession(name, session.id)
+	})
+	self.sessions.lock.Unlock()
+	return session, nil
+}
+
+// GetSession returns the session of topic, it is nil if the session isn't found.
+func (self *Server) GetSession(name, id string) *Session {
+	self.sessions.lock.Lock()
+	defer self.sessions.lock.Unlock()
+	session := self.sessions.all[id]
+	if session == nil || session.name != name {
+		return nil
+	}
+	return session
+}
+
+func (self *Server) CloseSession(name, id string) error {
+	self.sessions.lock.Lock()
+	session := self.sessions.all[id]
+	if session == nil || session.name != name {
+		self.sessions.lock.Unlock()
+		return ErrSessionNotFound
+	}
+	delete(self.sessions.all, id)
+	self.sessions.lock.Unlock()
+
+	session.close()
+	return nil
+}
+
+func (self *Server) GetSessions() []map[string]interface{} {
+	self.sessions.lock.Lock()
+	defer self.sessions.lock.Unlock()
+
+	results := make([]map[string]interface{}, 0, len(self.sessions.all))
+	for _, session := range self.sessions.all {
+		results = append(results, session.Stats())
+	}
+	return results
+}
+
+func (self *Server) closeSessions() {
+	self.sessions.lock.Lock()
+	all := self.sessions.all
+	self.sessions.all = nil
+	self.sessions.lock.Unlock()
+
+	for _, session := range all {
+		session.close()
+	}
+}
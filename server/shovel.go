@@ -0,0 +1,342 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var (
+	ErrShovelExists   = errors.New("shovel is already exists.")
+	ErrShovelNotFound = errors.New("shovel isn't found.")
+	ErrShovelLoop     = errors.New("shovel source and destination are the same.")
+)
+
+// ShovelEndpoint is a queue or topic, it is on the local server if Address
+// is empty.
+type ShovelEndpoint struct {
+	Address string `json:"address,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+}
+
+func (self *ShovelEndpoint) validate(prefix string) error {
+	if self.Type == "" {
+		self.Type = mq_client.QUEUE
+	}
+	if self.Type != mq_client.QUEUE && self.Type != mq_client.TOPIC {
+		return errors.New(prefix + " type must is 'queue' or 'topic'.")
+	}
+	if self.Name == "" {
+		return errors.New(prefix + " name is missing.")
+	}
+	return nil
+}
+
+// Shovel moves the messages from the source to the destination, a message
+// that fails to be sent is kept in memory and sent again after reconnected.
+// messages aren't acked, so the message that is kept and the messages that
+// are buffered by the subscription of a remote source are lost if the
+// shovel is removed or the server is closed.
+type Shovel struct {
+	Name        string         `json:"name"`
+	Source      ShovelEndpoint `json:"source"`
+	Destination ShovelEndpoint `json:"destination"`
+}
+
+// fullName returns Name, or the name that is built from the source and the
+// destination if Name is empty.
+func (self *Shovel) fullName() string {
+	if self.Name != "" {
+		return self.Name
+	}
+	return self.Source.Type + "." + self.Source.Name +
+		"->" + self.Destination.Type + "." + self.Destination.Name
+}
+
+type shovel struct {
+	connect_last_at int64
+	connected       int32
+	connect_total   uint32
+	message_total   uint32
+	error_total     uint32
+
+	srv    *Server
+	config Shovel
+	closed int32
+	S      chan struct{}
+
+	lock       sync.Mutex
+	sub        *mq_client.Subscription
+	pending    mq_client.Message
+	last_error error
+}
+
+func (self *shovel) isClosed() bool {
+	return 0 != atomic.LoadInt32(&self.closed)
+}
+
+func (self *shovel) Close() error {
+	if !atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		return ErrAlreadyClosed
+	}
+	close(self.S)
+
+	self.lock.Lock()
+	if self.sub != nil {
+		self.sub.Close()
+	}
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *shovel) Stats() map[string]interface{} {
+	var lastErr string
+	self.lock.Lock()
+	if self.last_error != nil {
+		lastErr = self.last_error.Error()
+	}
+	pending := self.pending != nil
+	self.lock.Unlock()
+
+	return map[string]interface{}{
+		"name":            self.config.Name,
+		"source":          self.config.Source,
+		"destination":     self.config.Destination,
+		"connected":       0 != atomic.LoadInt32(&self.connected),
+		"connect_last_at": time.Unix(0, atomic.LoadInt64(&self.connect_last_at)),
+		"connect_total":   atomic.LoadUint32(&self.connect_total),
+		"message_total":   atomic.LoadUint32(&self.message_total),
+		"error_total":     atomic.LoadUint32(&self.error_total),
+		"pending":         pending,
+		"last_error":      lastErr,
+	}
+}
+
+func (self *shovel) setSubscription(sub *mq_client.Subscription) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if sub != nil && self.isClosed() {
+		return false
+	}
+	self.sub = sub
+	return true
+}
+
+func (self *shovel) setError(err error) {
+	self.lock.Lock()
+	self.last_error = err
+	self.lock.Unlock()
+}
+
+func (self *shovel) builder(address string) *mq_client.ClientBuilder {
+	return mq_client.Connect("tcp", address).Id("_shovel." + self.config.Name)
+}
+
+func (self *shovel) runLoop() {
+	err_count := 0
+	for !self.isClosed() {
+		atomic.AddUint32(&self.connect_total, 1)
+		err := self.runOnce()
+		if err != nil {
+			atomic.AddUint32(&self.error_total, 1)
+			self.setError(err)
+			err_count++
+			if err_count < 5 || 0 == err_count%50 {
+				self.srv.logger(LogShovel).error("shovel is disconnected", "shovel", self.config.Name, "error", err)
+			}
+		} else {
+			err_count = 0
+		}
+
+		interval := 200 * time.Millisecond
+		if err_count > 5 {
+			interval = 2 * time.Second
+		}
+		select {
+		case <-self.S:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (self *shovel) openDestination() (func(msg mq_client.Message) error, func(), error) {
+	dest := self.config.Destination
+	if dest.Address == "" {
+		if dest.Type == mq_client.TOPIC {
+			return self.srv.CreateTopicIfNotExists(dest.Name).Send, func() {}, nil
+		}
+		queue := self.srv.CreateQueueIfNotExists(dest.Name)
+		return func(msg mq_client.Message) error {
+			if queue.cluster != nil {
+				return queue.Send(msg)
+			}
+			// stop waiting for a full queue if the shovel is closed.
+			return queue.enqueue(msg, -1, self.S)
+		}, func() {}, nil
+	}
+
+	pub, err := self.builder(dest.Address).To(dest.Type, dest.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub.Send, func() { pub.Close() }, nil
+}
+
+func (self *shovel) forward(send func(msg mq_client.Message) error, msg mq_client.Message) error {
+	if err := send(msg); err != nil {
+		self.lock.Lock()
+		self.pending = msg
+		self.lock.Unlock()
+		return err
+	}
+	atomic.AddUint32(&self.message_total, 1)
+	return nil
+}
+
+func (self *shovel) runOnce() error {
+	send, closeDestination, err := self.openDestination()
+	if err != nil {
+		return err
+	}
+	defer closeDestination()
+
+	self.lock.Lock()
+	pending := self.pending
+	self.pending = nil
+	self.lock.Unlock()
+	if pending != nil {
+		if err := self.forward(send, pending); err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreInt64(&self.connect_last_at, time.Now().UnixNano())
+	atomic.StoreInt32(&self.connected, 1)
+	defer atomic.StoreInt32(&self.connected, 0)
+
+	source := self.config.Source
+	if source.Address == "" {
+		var consumer *Consumer
+		if source.Type == mq_client.QUEUE {
+			consumer = self.srv.CreateQueueIfNotExists(source.Name).ListenOn()
+		} else {
+			consumer = self.srv.CreateTopicIfNotExists(source.Name).ListenOn()
+		}
+		defer consumer.Close()
+
+		ctx, cancel := doneContext(self.S)
+		defer cancel()
+		for {
+			msg, err := consumer.Recv(ctx)
+			if err != nil {
+				if err == ErrConsumerClosed {
+					return errors.New("source is closed.")
+				}
+				return nil
+			}
+			if err := self.forward(send, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	sub, err := self.builder(source.Address).Listen(source.Type, source.Name, map[string]string{"headers": "true"})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if !self.setSubscription(sub) {
+		return nil
+	}
+	defer self.setSubscription(nil)
+
+	var sendErr error
+	err = sub.Run(func(cli *mq_client.Subscription, msg mq_client.Message) {
+		switch msg.Command() {
+		case mq_client.MSG_DATA, mq_client.MSG_HDATA:
+		default:
+			return
+		}
+		if sendErr = self.forward(send, msg); sendErr != nil {
+			cli.Close()
+		}
+	})
+	if self.isClosed() {
+		return nil
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	if err == nil {
+		err = errors.New("connection is closed by upstream.")
+	}
+	return err
+}
+
+// AddShovel starts a shovel, the name of shovel must be unique.
+func (self *Server) AddShovel(config Shovel) error {
+	if err := config.Source.validate("source"); err != nil {
+		return err
+	}
+	if err := config.Destination.validate("destination"); err != nil {
+		return err
+	}
+	if config.Source == config.Destination {
+		return ErrShovelLoop
+	}
+	config.Name = config.fullName()
+
+	if 0 != atomic.LoadInt32(&self.is_stopped) {
+		return ErrAlreadyClosed
+	}
+
+	self.shovels_lock.Lock()
+	defer self.shovels_lock.Unlock()
+	for _, s := range self.shovels {
+		if s.config.Name == config.Name {
+			return ErrShovelExists
+		}
+	}
+
+	s := &shovel{srv: self, config: config, S: make(chan struct{})}
+	self.shovels = append(self.shovels, s)
+	self.RunItInGoroutine(s.runLoop)
+	return nil
+}
+
+func (self *Server) RemoveShovel(name string) error {
+	self.shovels_lock.Lock()
+	defer self.shovels_lock.Unlock()
+	for idx, s := range self.shovels {
+		if s.config.Name == name {
+			copy(self.shovels[idx:], self.shovels[idx+1:])
+			self.shovels = self.shovels[:len(self.shovels)-1]
+			return s.Close()
+		}
+	}
+	return ErrShovelNotFound
+}
+
+func (self *Server) closeShovels() {
+	self.shovels_lock.Lock()
+	defer self.shovels_lock.Unlock()
+	for _, s := range self.shovels {
+		s.Close()
+	}
+}
+
+func (self *Server) GetShovels() []map[string]interface{} {
+	self.shovels_lock.Lock()
+	defer self.shovels_lock.Unlock()
+
+	results := make([]map[string]interface{}, 0, len(self.shovels))
+	for _, s := range self.shovels {
+		results = append(results, s.Stats())
+	}
+	return results
+}
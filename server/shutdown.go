@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down.")
+
+func (self *Server) IsShuttingDown() bool {
+	return 0 != atomic.LoadInt32(&self.is_draining)
+}
+
+// Shutdown stops accepting new connections, tells the connected clients to
+// go away and keeps delivering to consumers until all queues are empty or
+// the timeout is elapsed, then closes the server. Messages that are still
+// not delivered are passed to Options.Dump or Options.SnapshotFile.
+func (self *Server) Shutdown(timeout time.Duration) error {
+	if 0 != atomic.LoadInt32(&self.is_stopped) {
+		return ErrAlreadyClosed
+	}
+	if !atomic.CompareAndSwapInt32(&self.is_draining, 0, 1) {
+		return ErrShuttingDown
+	}
+
+	self.logger(LogServer).info("shutting down, wait for consumers", "timeout", timeout.String())
+	self.closeListeners()
+	self.closeFederations()
+	self.closeShovels()
+
+	func() {
+		self.clients_lock.Lock()
+		defer self.clients_lock.Unlock()
+		for el := self.clients.Front(); el != nil; el = el.Next() {
+			if cli, ok := el.Value.(*Client); ok {
+				cli.goAway()
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for self.pendingCount() > 0 && time.Now().Before(deadline) {
+		<-tick.C
+	}
+
+	if err := self.Close(); err != nil && err != ErrAlreadyClosed {
+		return err
+	}
+	return nil
+}
+
+// pendingCount returns the count of messages that are not yet delivered.
+func (self *Server) pendingCount() int {
+	count := 0
+
+	self.queues_lock.RLock()
+	for _, q := range self.queues {
+		if q.cluster != nil {
+			continue
+		}
+		count += q.Len()
+	}
+	self.queues_lock.RUnlock()
+
+	self.topics_lock.RLock()
+	for _, topic := range self.topics {
+		topic.channels_lock.RLock()
+		for _, consumer := range topic.channels {
+			count += consumer.Pending()
+		}
+		topic.channels_lock.RUnlock()
+		if topic.partitions != nil {
+			count += topic.partitions.Len()
+		}
+	}
+	self.topics_lock.RUnlock()
+	return count
+}
+
+// dumpAll passes the messages that are left in queues and topics to
+// Options.Dump and Options.SnapshotFile, the topic logs are written to
+// Options.SnapshotFile too. the messages of topics are the unacked buffers
+// of subscribers and the partitions of consumer groups, a message that is
+// buffered for several of them is passed once. they aren't kept by the
+// snapshot because they can't be delivered to the same subscribers again,
+// so they are dropped if Dump is nil.
+func (self *Server) dumpAll(queues, topics map[string][]mq_client.Message, logs map[string]*topicLogState) {
+	if self.options.SnapshotFile != "" {
+		if err := writeSnapshot(self.options.SnapshotFile, queues, logs); err != nil {
+			self.logger(LogServer).error("fail to write snapshot", "file", self.options.SnapshotFile, "error", err)
+		}
+	}
+
+	for name, msgs := range queues {
+		if self.options.Dump != nil {
+			if err := self.options.Dump(mq_client.QUEUE, name, msgs); err != nil {
+				self.logger(LogQueue).error("fail to dump messages", "dest", name, "count", len(msgs), "error", err)
+			}
+		} else if self.options.SnapshotFile == "" {
+			self.logger(LogQueue).warn("drop messages", "dest", name, "count", len(msgs))
+		}
+	}
+
+	for name, msgs := range topics {
+		if self.options.Dump != nil {
+			if err := self.options.Dump(mq_client.TOPIC, name, msgs); err != nil {
+				self.logger(LogTopic).error("fail to dump messages", "dest", name, "count", len(msgs), "error", err)
+			}
+		} else {
+			self.logger(LogTopic).warn("drop unacked subscriber buffers", "dest", name, "count", len(msgs))
+		}
+	}
+}
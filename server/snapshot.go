@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+var ErrSnapshotDisabled = errors.New("snapshot file isn't configured.")
+
+// snapshot file format
+// magic bytes followed by messages in the wire format, a MSG_PUB message
+// ("queue name") selects the queue that the following MSG_DATA messages
+// belong to. a MSG_PUB message ("topic name\nnext=N\ncommits={...}")
+// selects the log of a topic, the following messages are the messages in
+// the log, next is the offset of the next message and commits are the
+// committed offsets in json.
+//
+// the queues and the topic logs whose storage is durable aren't kept, the
+// storage keeps them. the buffers of subscribers and the partitions of
+// consumer groups aren't kept at all.
+
+func writeSnapshot(file string, queues map[string][]mq_client.Message, logs map[string]*topicLogState) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = writeSnapshotTo(w, queues, logs)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func writeSnapshotTo(w io.Writer, queues map[string][]mq_client.Message, logs map[string]*topicLogState) error {
+	if err := mq_client.SendMagic(w); err != nil {
+		return err
+	}
+	writeSection := func(command string, msgs []mq_client.Message) error {
+		head := mq_client.NewMessageWriter(mq_client.MSG_PUB, len(command)).
+			Append([]byte(command)).
+			Build()
+		if err := mq_client.SendFull(w, head.ToBytes()); err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := mq_client.SendFull(w, msg.ToBytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for name, msgs := range queues {
+		if err := writeSection(mq_client.QUEUE+" "+name, msgs); err != nil {
+			return err
+		}
+	}
+	for name, state := range logs {
+		commits, err := json.Marshal(state.commits)
+		if err != nil {
+			return err
+		}
+		if err := writeSection(mq_client.TOPIC+" "+name+
+			"\nnext="+strconv.FormatUint(state.next, 10)+
+			"\ncommits="+string(commits), state.msgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSnapshot puts the messages in the snapshot file back to the queues
+// and the topic logs, the file is removed after it is loaded. the messages
+// are restored even if they are more than the capacity of a queue, the file
+// is kept if a message can't be restored.
+func (self *Server) loadSnapshot(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	if err := mq_client.ReadMagic(rd); err != nil {
+		return errors.New("read snapshot '" + file + "': " + err.Error())
+	}
+
+	var queue *Queue
+	var topic *Topic
+	var state *topicLogState
+	var count int
+	// restoreLog puts the log that is read back to the topic.
+	restoreLog := func() error {
+		if topic == nil {
+			return nil
+		}
+		defer func() { topic, state = nil, nil }()
+		if topic.log == nil {
+			self.logger(LogTopic).warn("topic isn't a log topic, its log in snapshot is dropped",
+				"dest", topic.name, "count", len(state.msgs))
+			return nil
+		}
+		if err := topic.log.restore(state); err != nil {
+			return errors.New("restore snapshot '" + file + "' to topic '" + topic.name + "': " + err.Error())
+		}
+		count += len(state.msgs)
+		return nil
+	}
+
+	for {
+		msg, err := mq_client.ReadMessage(rd)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.New("read snapshot '" + file + "': " + err.Error())
+		}
+
+		switch msg.Command() {
+		case mq_client.MSG_PUB:
+			if err := restoreLog(); err != nil {
+				return err
+			}
+			queue = nil
+
+			typ, name, options, ok := parseCommand(msg.Data())
+			switch {
+			case ok && string(typ) == mq_client.QUEUE && options == nil:
+				queue = self.CreateQueueIfNotExists(string(name))
+			case ok && string(typ) == mq_client.TOPIC:
+				state = &topicLogState{commits: map[string]uint64{}}
+				state.next, err = strconv.ParseUint(options["next"], 10, 64)
+				if err == nil && options["commits"] != "" {
+					err = json.Unmarshal([]byte(options["commits"]), &state.commits)
+				}
+				if err != nil {
+					return errors.New("read snapshot '" + file + "': invalid command - '" + string(msg.Data()) + "'.")
+				}
+				topic = self.CreateTopicIfNotExists(string(name))
+			default:
+				return errors.New("read snapshot '" + file + "': invalid command - '" + string(msg.Data()) + "'.")
+			}
+		case mq_client.MSG_DATA, mq_client.MSG_HDATA:
+			switch {
+			case queue != nil:
+				if err := queue.restore(msg); err != nil {
+					return errors.New("restore snapshot '" + file + "' to queue '" + queue.name + "': " + err.Error())
+				}
+				count++
+			case topic != nil:
+				state.msgs = append(state.msgs, msg)
+			default:
+				return errors.New("read snapshot '" + file + "': queue is missing.")
+			}
+		default:
+			return errors.New("read snapshot '" + file + "': unexcepted message - " + mq_client.ToCommandName(msg.Command()))
+		}
+	}
+	if err := restoreLog(); err != nil {
+		return err
+	}
+	f.Close()
+
+	self.logger(LogServer).info("load messages from snapshot", "file", file, "count", count)
+	return os.Remove(file)
+}
+
+// Snapshot writes the messages in all queues and the topic logs to
+// Options.SnapshotFile and keeps them, the queues and the topic logs whose
+// storage is durable are skipped. it returns the counts of messages by the
+// names of queues and topics.
+func (self *Server) Snapshot() (queue_counts, topic_counts map[string]int, err error) {
+	if self.options.SnapshotFile == "" {
+		return nil, nil, ErrSnapshotDisabled
+	}
+
+	self.queues_lock.RLock()
+	queues := make(map[string]*Queue, len(self.queues))
+	for name, q := range self.queues {
+		if q.cluster == nil && !q.Durable() {
+			queues[name] = q
+		}
+	}
+	self.queues_lock.RUnlock()
+
+	all := map[string][]mq_client.Message{}
+	queue_counts = map[string]int{}
+	for name, q := range queues {
+		msgs := q.Peek(q.Len())
+		if len(msgs) > 0 {
+			all[name] = msgs
+		}
+		queue_counts[name] = len(msgs)
+	}
+
+	logs := self.snapshotLogs()
+	topic_counts = map[string]int{}
+	for name, state := range logs {
+		topic_counts[name] = len(state.msgs)
+	}
+
+	if err := writeSnapshot(self.options.SnapshotFile, all, logs); err != nil {
+		return nil, nil, err
+	}
+	return queue_counts, topic_counts, nil
+}
+
+// snapshotLogs returns the topic logs that aren't kept by their storage.
+func (self *Server) snapshotLogs() map[string]*topicLogState {
+	self.topics_lock.RLock()
+	defer self.topics_lock.RUnlock()
+
+	logs := map[string]*topicLogState{}
+	for name, topic := range self.topics {
+		if topic.log == nil {
+			continue
+		}
+		if state, ok := topic.log.snapshot(); ok {
+			logs[name] = state
+		}
+	}
+	return logs
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// server-sent events
+// GET /mq/topics/{name}/events streams the messages of a topic as the
+// 'text/event-stream', every message is an event with an id, a comment is
+// sent as keepalive every Options.NoopInterval.
+//
+// the id of an event is the offset of the message if the topic keeps a log,
+// a client that reconnects with the Last-Event-ID header receives the
+// messages from the next offset, so the messages that are published while
+// it is disconnected aren't lost unless they are dropped from the log.
+// other topics don't retain the messages, the ids of their events only
+// count the events and continue from Last-Event-ID.
+
+var SSE_KEEPALIVE_BYTES = []byte(": keepalive\n\n")
+
+// ParseLastEventID returns the id in the Last-Event-ID header, ok is false
+// if the header is missing or invalid.
+func ParseLastEventID(s string) (id uint64, ok bool) {
+	id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// WriteSSEEvent writes a message as an event, every line of the body is a
+// 'data' field.
+func WriteSSEEvent(w io.Writer, id uint64, msg mq_client.Message) error {
+	var buf bytes.Buffer
+	buf.WriteString("id: ")
+	buf.WriteString(strconv.FormatUint(id, 10))
+	buf.WriteString("\n")
+
+	body := bytes.Replace(msg.Body(), []byte("\r\n"), []byte("\n"), -1)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return mq_client.SendFull(w, buf.Bytes())
+}
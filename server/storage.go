@@ -0,0 +1,752 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// storage engines
+// a queue keeps its messages and a topic keeps its log in a Storage, the
+// engine of a storage is selected by the name of the queue or the topic:
+//
+//	memory - a slice in memory, it is the default engine.
+//	ring   - a ring buffer in memory that is allocated once.
+//	disk   - segment files in StorageOptions.Dir, the messages are kept
+//	         after the server is closed, and the queues and the topic logs
+//	         are created again by NewServer. they are synced to disk by
+//	         StorageOptions.Sync.
+//
+// other engines are added to StorageEngines before NewServer is called.
+//
+// a storage keeps the messages of a queue or the log of a topic only, the
+// subscribers of a topic are fed in memory. the connections and the http
+// handlers take the messages through Receiver, whatever keeps them.
+
+var (
+	ErrStorageCorrupted = errors.New("storage is corrupted.")
+	ErrConsumerClosed   = errors.New("consumer is closed.")
+)
+
+const defaultSegmentSize = 16 * 1024 * 1024
+
+// Storage keeps messages in order, it is called with the lock of the queue
+// or the topic held, so it needn't be safe for concurrent use.
+type Storage interface {
+	// Len returns the count of messages.
+	Len() int
+
+	// Append adds msg at the end.
+	Append(msg mq_client.Message) error
+
+	// Read returns at most count messages from the position start.
+	Read(start, count int) ([]mq_client.Message, error)
+
+	// Remove removes the first n messages.
+	Remove(n int) error
+
+	// Durable returns true if the messages are kept after Close.
+	Durable() bool
+
+	Close() error
+}
+
+// Receiver is the receiving side of a queue or a topic.
+type Receiver interface {
+	// Recv waits for a message until ctx is done, it returns
+	// ErrConsumerClosed if the receiver is closed.
+	Recv(ctx context.Context) (mq_client.Message, error)
+
+	// TryRecv takes a message without waiting.
+	TryRecv() (mq_client.Message, bool)
+
+	// Pending returns the count of messages that are handed over to the
+	// receiver but aren't received yet.
+	Pending() int
+
+	Close() error
+}
+
+// MetaStorage is implemented by a Storage that keeps small values besides
+// the messages, e.g. the committed offsets of a topic log.
+type MetaStorage interface {
+	// LoadMeta returns nil if the value doesn't exist.
+	LoadMeta(name string) ([]byte, error)
+
+	SaveMeta(name string, data []byte) error
+}
+
+type StorageOptions struct {
+	// Engine is the engine of queues and topic logs, default is "memory".
+	Engine string
+
+	// Engines overrides Engine by the name of queues and topics.
+	Engines map[string]string
+
+	// Dir is the directory of the disk engine.
+	Dir string
+
+	// SegmentSize is the max size of a segment file of the disk engine,
+	// default is 16M.
+	SegmentSize int64
+
+	// Sync is when the disk engine syncs the messages and the position of
+	// the first message to disk, it is SYNC_ALWAYS, SYNC_INTERVAL or
+	// SYNC_NEVER, default is SYNC_INTERVAL.
+	Sync string
+
+	// SyncInterval is the interval of SYNC_INTERVAL, default is 1s.
+	SyncInterval time.Duration
+}
+
+// the sync policies of the disk engine, the position of the first message
+// is synced every SyncInterval or on Close only, a message that is removed
+// after it is synced may be received again after a crash.
+//
+//	always   - every message is synced before Append returns.
+//	interval - the messages are synced every SyncInterval.
+//	never    - the messages are synced on Close only.
+const (
+	SYNC_ALWAYS   = "always"
+	SYNC_INTERVAL = "interval"
+	SYNC_NEVER    = "never"
+)
+
+// StorageFactory opens the storage of a queue or a topic log, typ is
+// 'queue' or 'topic', capacity is the max count of messages.
+type StorageFactory func(typ, name string, capacity int, opts *StorageOptions) (Storage, error)
+
+var StorageEngines = map[string]StorageFactory{
+	"memory": func(typ, name string, capacity int, opts *StorageOptions) (Storage, error) {
+		return newMemoryStorage(), nil
+	},
+	"ring": func(typ, name string, capacity int, opts *StorageOptions) (Storage, error) {
+		return newRingStorage(capacity), nil
+	},
+	"disk": openDiskStorage,
+}
+
+func (self *StorageOptions) engine(name string) string {
+	if engine := self.Engines[name]; engine != "" {
+		return engine
+	}
+	if self.Engine != "" {
+		return self.Engine
+	}
+	return "memory"
+}
+
+func (self *StorageOptions) validate() error {
+	engines := []string{self.engine("")}
+	for _, engine := range self.Engines {
+		engines = append(engines, engine)
+	}
+	for _, engine := range engines {
+		if _, ok := StorageEngines[engine]; !ok {
+			return errors.New("storage engine '" + engine + "' isn't found.")
+		}
+		if engine == "disk" && self.Dir == "" {
+			return errors.New("storage dir is required by the disk engine.")
+		}
+	}
+	switch self.Sync {
+	case "", SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER:
+	default:
+		return errors.New("storage sync '" + self.Sync + "' isn't always, interval or never.")
+	}
+	return nil
+}
+
+// openStorage opens the storage of a queue or a topic log, a storage that
+// fails every read and write is returned if the engine fails, so that the
+// messages aren't kept silently in memory instead.
+func (self *Server) openStorage(typ, name string, capacity int) Storage {
+	_, _, engine := self.destPolicy(name)
+	storage, err := StorageEngines[engine](typ, name, capacity, &self.options.Storage)
+	if err != nil {
+		self.logger(LogStorage).error("fail to open storage",
+			"type", typ, "dest", name, "engine", engine, "error", err)
+		return &failedStorage{err: errors.New("storage of " + typ + " '" + name + "' can't be opened: " + err.Error())}
+	}
+	return storage
+}
+
+// loadStorages creates the queues and the topics with logs that are kept
+// by the disk engine, it fails if any of them can't be opened.
+func (self *Server) loadStorages() error {
+	if self.options.Storage.Dir == "" {
+		return nil
+	}
+	logged := map[string]bool{}
+	for _, name := range self.options.TopicLog.Topics {
+		logged[name] = true
+	}
+
+	for _, typ := range []string{mq_client.QUEUE, mq_client.TOPIC} {
+		dirs, err := ioutil.ReadDir(filepath.Join(self.options.Storage.Dir, typ))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				self.logger(LogStorage).error("fail to load storages", "error", err)
+			}
+			continue
+		}
+		for _, dir := range dirs {
+			name, err := url.PathUnescape(dir.Name())
+			if err != nil || !dir.IsDir() || self.options.Storage.engine(name) != "disk" {
+				continue
+			}
+			var storage Storage
+			if typ == mq_client.QUEUE {
+				storage = self.CreateQueueIfNotExists(name).storage
+			} else if logged[name] {
+				if log := self.CreateTopicIfNotExists(name).log; log != nil {
+					storage = log.storage
+				}
+			}
+			if failed, ok := storage.(*failedStorage); ok {
+				return failed.err
+			}
+		}
+	}
+	return nil
+}
+
+// failedStorage is the storage of a destination whose engine fails to open.
+type failedStorage struct {
+	err error
+}
+
+// storageError returns the error of a storage that fails to open.
+func storageError(storage Storage) error {
+	if failed, ok := storage.(*failedStorage); ok {
+		return failed.err
+	}
+	return nil
+}
+
+func (self *failedStorage) Len() int {
+	return 0
+}
+
+func (self *failedStorage) Append(msg mq_client.Message) error {
+	return self.err
+}
+
+func (self *failedStorage) Read(start, count int) ([]mq_client.Message, error) {
+	return nil, self.err
+}
+
+func (self *failedStorage) Remove(n int) error {
+	return self.err
+}
+
+// Durable returns true, so the destination isn't drained as a memory one.
+func (self *failedStorage) Durable() bool {
+	return true
+}
+
+func (self *failedStorage) Close() error {
+	return nil
+}
+
+type memoryStorage struct {
+	messages []mq_client.Message
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{}
+}
+
+func (self *memoryStorage) Len() int {
+	return len(self.messages)
+}
+
+func (self *memoryStorage) Append(msg mq_client.Message) error {
+	self.messages = append(self.messages, msg)
+	return nil
+}
+
+func (self *memoryStorage) Read(start, count int) ([]mq_client.Message, error) {
+	if start >= len(self.messages) {
+		return nil, nil
+	}
+	if count > len(self.messages)-start {
+		count = len(self.messages) - start
+	}
+	return append([]mq_client.Message(nil), self.messages[start:start+count]...), nil
+}
+
+func (self *memoryStorage) Remove(n int) error {
+	if n > len(self.messages) {
+		n = len(self.messages)
+	}
+	self.messages = self.messages[n:]
+	return nil
+}
+
+func (self *memoryStorage) Durable() bool {
+	return false
+}
+
+func (self *memoryStorage) Close() error {
+	self.messages = nil
+	return nil
+}
+
+type ringStorage struct {
+	buffer []mq_client.Message
+	first  int
+	count  int
+}
+
+func newRingStorage(capacity int) *ringStorage {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &ringStorage{buffer: make([]mq_client.Message, capacity)}
+}
+
+func (self *ringStorage) Len() int {
+	return self.count
+}
+
+func (self *ringStorage) Append(msg mq_client.Message) error {
+	if self.count == len(self.buffer) {
+		return mq_client.ErrQueueFull
+	}
+	self.buffer[(self.first+self.count)%len(self.buffer)] = msg
+	self.count++
+	return nil
+}
+
+func (self *ringStorage) Read(start, count int) ([]mq_client.Message, error) {
+	var msgs []mq_client.Message
+	for i := start; i < self.count && len(msgs) < count; i++ {
+		msgs = append(msgs, self.buffer[(self.first+i)%len(self.buffer)])
+	}
+	return msgs, nil
+}
+
+func (self *ringStorage) Remove(n int) error {
+	if n > self.count {
+		n = self.count
+	}
+	for i := 0; i < n; i++ {
+		self.buffer[self.first] = nil
+		self.first = (self.first + 1) % len(self.buffer)
+	}
+	self.count -= n
+	return nil
+}
+
+func (self *ringStorage) Durable() bool {
+	return false
+}
+
+func (self *ringStorage) Close() error {
+	for i := range self.buffer {
+		self.buffer[i] = nil
+	}
+	self.count = 0
+	return nil
+}
+
+// disk storage
+// the messages are appended to segment files in the wire format, a segment
+// file is named by its sequence and it is removed after all messages in it
+// are removed. the 'head' file keeps the sequence of the first segment and
+// the count of messages that are removed from it.
+
+type diskSegment struct {
+	seq   uint64
+	file  *os.File
+	dirty bool
+
+	// offsets are the offsets of messages, and the size of file at the end.
+	offsets []int64
+}
+
+func (self *diskSegment) count() int {
+	return len(self.offsets) - 1
+}
+
+type diskStorage struct {
+	dir          string
+	segment_size int64
+	sync         string
+
+	// lock guards the fields below against the goroutine of runSync.
+	lock       sync.Mutex
+	next_seq   uint64
+	segments   []*diskSegment
+	head       int
+	count      int
+	head_dirty bool
+	// sync_err is the error of the last sync by runSync, it is returned by
+	// the next Append or Remove.
+	sync_err error
+
+	closing chan struct{}
+	stopped chan struct{}
+}
+
+func openDiskStorage(typ, name string, capacity int, opts *StorageOptions) (Storage, error) {
+	segment_size := opts.SegmentSize
+	if segment_size <= 0 {
+		segment_size = defaultSegmentSize
+	}
+	dir := filepath.Join(opts.Dir, typ, url.PathEscape(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	self := &diskStorage{dir: dir, segment_size: segment_size, sync: opts.Sync}
+	if self.sync == "" {
+		self.sync = SYNC_INTERVAL
+	}
+	if err := self.load(); err != nil {
+		self.Close()
+		return nil, err
+	}
+	if self.sync == SYNC_INTERVAL {
+		interval := opts.SyncInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		self.closing = make(chan struct{})
+		self.stopped = make(chan struct{})
+		go self.runSync(interval)
+	}
+	return self, nil
+}
+
+func (self *diskStorage) runSync(interval time.Duration) {
+	defer close(self.stopped)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			self.lock.Lock()
+			if err := self.flush(); err != nil && self.sync_err == nil {
+				self.sync_err = err
+			}
+			self.lock.Unlock()
+		case <-self.closing:
+			return
+		}
+	}
+}
+
+// flush syncs the segments that are written and the position of the first
+// message.
+func (self *diskStorage) flush() error {
+	var err error
+	for _, segment := range self.segments {
+		if !segment.dirty {
+			continue
+		}
+		if e := segment.file.Sync(); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		segment.dirty = false
+	}
+	if self.head_dirty {
+		head_seq := self.next_seq
+		if len(self.segments) > 0 {
+			head_seq = self.segments[0].seq
+		}
+		if e := writeFileSync(filepath.Join(self.dir, "head"),
+			[]byte(strconv.FormatUint(head_seq, 10)+" "+strconv.Itoa(self.head)+"\n")); e != nil {
+			if err == nil {
+				err = e
+			}
+		} else {
+			self.head_dirty = false
+		}
+	}
+	return err
+}
+
+// syncErr returns the error of the last sync by runSync once.
+func (self *diskStorage) syncErr() error {
+	err := self.sync_err
+	self.sync_err = nil
+	return err
+}
+
+func (self *diskStorage) segmentFile(seq uint64) string {
+	return filepath.Join(self.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+func (self *diskStorage) load() error {
+	var head_seq uint64
+	var head int
+	if bs, err := ioutil.ReadFile(filepath.Join(self.dir, "head")); err == nil {
+		ss := strings.Fields(string(bs))
+		if len(ss) != 2 {
+			return ErrStorageCorrupted
+		}
+		if head_seq, err = strconv.ParseUint(ss[0], 10, 64); err != nil {
+			return ErrStorageCorrupted
+		}
+		if head, err = strconv.Atoi(ss[1]); err != nil {
+			return ErrStorageCorrupted
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(self.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < head_seq {
+			os.Remove(file)
+			continue
+		}
+		segment, err := openSegment(file, seq)
+		if err != nil {
+			return err
+		}
+		self.segments = append(self.segments, segment)
+		self.count += segment.count()
+		self.next_seq = seq + 1
+	}
+	if self.next_seq < head_seq {
+		self.next_seq = head_seq
+	}
+
+	if len(self.segments) > 0 && self.segments[0].seq == head_seq {
+		if head > self.segments[0].count() {
+			head = self.segments[0].count()
+		}
+		self.head = head
+		self.count -= head
+	}
+	return nil
+}
+
+// openSegment scans the messages in file, a message that is written partly
+// is truncated.
+func openSegment(file string, seq uint64) (*diskSegment, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := &diskSegment{seq: seq, file: f, offsets: []int64{0}}
+	rd := bufio.NewReader(f)
+	var offset int64
+	for {
+		msg, err := mq_client.ReadMessage(rd)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				f.Close()
+				return nil, err
+			}
+			break
+		}
+		offset += int64(len(msg))
+		segment.offsets = append(segment.offsets, offset)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+func (self *diskStorage) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.count
+}
+
+func (self *diskStorage) Append(msg mq_client.Message) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.syncErr(); err != nil {
+		return err
+	}
+
+	var last *diskSegment
+	if len(self.segments) > 0 {
+		last = self.segments[len(self.segments)-1]
+	}
+	if last == nil || (last.offsets[last.count()] >= self.segment_size && last.count() > 0) {
+		f, err := os.OpenFile(self.segmentFile(self.next_seq), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if err := syncDir(self.dir); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		last = &diskSegment{seq: self.next_seq, file: f, offsets: []int64{0}}
+		self.segments = append(self.segments, last)
+		self.next_seq++
+	}
+
+	end := last.offsets[last.count()]
+	bs := msg.ToBytes()
+	if _, err := last.file.WriteAt(bs, end); err != nil {
+		last.file.Truncate(end)
+		return err
+	}
+	if self.sync == SYNC_ALWAYS {
+		if err := last.file.Sync(); err != nil {
+			last.file.Truncate(end)
+			return err
+		}
+	} else {
+		last.dirty = true
+	}
+	last.offsets = append(last.offsets, end+int64(len(bs)))
+	self.count++
+	return nil
+}
+
+func (self *diskStorage) Read(start, count int) ([]mq_client.Message, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var msgs []mq_client.Message
+	idx := self.head + start
+	for _, segment := range self.segments {
+		if len(msgs) >= count {
+			break
+		}
+		if idx >= segment.count() {
+			idx -= segment.count()
+			continue
+		}
+		for ; idx < segment.count() && len(msgs) < count; idx++ {
+			bs := make([]byte, segment.offsets[idx+1]-segment.offsets[idx])
+			if _, err := segment.file.ReadAt(bs, segment.offsets[idx]); err != nil {
+				return msgs, err
+			}
+			msgs = append(msgs, mq_client.Message(bs))
+		}
+		idx = 0
+	}
+	return msgs, nil
+}
+
+// Remove removes the first n messages, the position of the first message
+// is synced later by the sync policy.
+func (self *diskStorage) Remove(n int) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.syncErr(); err != nil {
+		return err
+	}
+
+	if n > self.count {
+		n = self.count
+	}
+	if n <= 0 {
+		return nil
+	}
+	self.head += n
+	self.count -= n
+	self.head_dirty = true
+	for len(self.segments) > 0 && self.head >= self.segments[0].count() {
+		segment := self.segments[0]
+		self.head -= segment.count()
+		self.segments = self.segments[1:]
+		segment.file.Close()
+		os.Remove(segment.file.Name())
+	}
+	return nil
+}
+
+func (self *diskStorage) Durable() bool {
+	return true
+}
+
+func (self *diskStorage) metaFile(name string) string {
+	return filepath.Join(self.dir, url.PathEscape(name)+".meta")
+}
+
+func (self *diskStorage) LoadMeta(name string) ([]byte, error) {
+	bs, err := ioutil.ReadFile(self.metaFile(name))
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	return bs, err
+}
+
+func (self *diskStorage) SaveMeta(name string, data []byte) error {
+	return writeFileSync(self.metaFile(name), data)
+}
+
+// writeFileSync replaces file with data, data is written to a temporary
+// file and synced before it is renamed, so file is either the old one or
+// the new one after a crash.
+func writeFileSync(file string, data []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
+
+func (self *diskStorage) Close() error {
+	if self.closing != nil {
+		close(self.closing)
+		<-self.stopped
+		self.closing = nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err := self.flush()
+	for _, segment := range self.segments {
+		if e := segment.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	self.segments = nil
+	self.count = 0
+	return err
+}
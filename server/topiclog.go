@@ -0,0 +1,471 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// topic log
+// a topic that is listed in TopicLogOptions.Topics keeps the last messages
+// in a ring buffer, every message gets an increasing offset and a timestamp
+// which are added to the headers of message. a subscriber replays the log
+// if it subscribes with one of the following options:
+//
+//	offset=earliest - the first message that is still in the log.
+//	offset=latest   - the next message that is published.
+//	offset=<n>      - the message with offset n.
+//	time=<t>        - the first message that is published at t or later, t
+//	                  is RFC3339 or milliseconds since the epoch.
+//	consumer=<name> - the offset that is committed under name, it is used
+//	                  if offset and time are missing.
+//
+// a replay subscriber is fed from the log in the order of offsets, it skips
+// the messages that are dropped from the log before they are delivered.
+//
+// the committed offsets are kept with the log if its storage is a
+// MetaStorage (e.g. the disk engine), otherwise the log and the committed
+// offsets are kept by the snapshot file if Options.SnapshotFile is set.
+
+const (
+	HEADER_OFFSET    = "offset"
+	HEADER_TIMESTAMP = "timestamp"
+
+	defaultTopicLogSize = 10000
+)
+
+var (
+	ErrTopicNotLogged = errors.New("topic isn't a log topic.")
+	ErrInvalidOffset  = errors.New("offset is invalid.")
+	ErrNoConsumer     = errors.New("consumer is missing.")
+)
+
+type TopicLogOptions struct {
+	Topics []string
+
+	// Size is the max count of messages that are kept by a topic, default
+	// is 10000.
+	Size int
+}
+
+type topicLog struct {
+	srv     *Server
+	name    string
+	size    int
+	lock    sync.Mutex
+	storage Storage
+	next    uint64
+	commits map[string]uint64
+	closed  bool
+
+	// appended is closed and replaced when a message is appended.
+	appended chan struct{}
+
+	// closing is closed by Close, followers are the goroutines that feed
+	// the replay subscribers.
+	closing   chan struct{}
+	followers sync.WaitGroup
+}
+
+const commitsMeta = "commits"
+
+func newTopicLog(srv *Server, name string, size int) *topicLog {
+	if size <= 0 {
+		size = defaultTopicLogSize
+	}
+	log := &topicLog{srv: srv,
+		name:     name,
+		size:     size,
+		storage:  srv.openStorage(mq_client.TOPIC, name, size),
+		commits:  map[string]uint64{},
+		appended: make(chan struct{}),
+		closing:  make(chan struct{})}
+
+	if meta, ok := log.storage.(MetaStorage); ok {
+		bs, err := meta.LoadMeta(commitsMeta)
+		if err == nil && len(bs) > 0 {
+			err = json.Unmarshal(bs, &log.commits)
+		}
+		if err != nil {
+			srv.logger(LogTopic).error("fail to load committed offsets", "dest", name, "error", err)
+		}
+	}
+
+	// a durable log continues from the offset of its last message.
+	if n := log.storage.Len(); n > 0 {
+		if msgs, err := log.storage.Read(n-1, 1); err == nil && len(msgs) > 0 {
+			if offset, ok := msgs[0].Offset(); ok {
+				log.next = offset + 1
+			}
+		}
+		if log.next < uint64(n) {
+			log.next = uint64(n)
+		}
+	}
+	return log
+}
+
+// append stamps the offset and timestamp on msg and keeps it.
+func (self *topicLog) append(msg mq_client.Message) mq_client.Message {
+	now := time.Now()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	offset := self.next
+	self.next++
+	msg = msg.WithHeaders(map[string]string{
+		HEADER_OFFSET:    strconv.FormatUint(offset, 10),
+		HEADER_TIMESTAMP: now.UTC().Format(time.RFC3339Nano),
+	})
+
+	if self.closed {
+		return msg
+	}
+	if self.storage.Len() >= self.size {
+		if err := self.storage.Remove(1); err != nil {
+			self.srv.logger(LogTopic).error("fail to remove message from log", "dest", self.name, "error", err)
+		}
+	}
+	if err := self.storage.Append(msg); err != nil {
+		self.srv.logger(LogTopic).error("fail to append message to log", "dest", self.name, "error", err)
+		// offsets in the log must be continuous, so the log is cleared.
+		self.storage.Remove(self.storage.Len())
+	}
+
+	close(self.appended)
+	self.appended = make(chan struct{})
+	return msg
+}
+
+// earliest needs the lock.
+func (self *topicLog) earliest() uint64 {
+	return self.next - uint64(self.storage.Len())
+}
+
+// read returns at most max messages from offset, skipped is the count of
+// messages that are dropped before offset is read. the returned channel is
+// closed when more messages are appended.
+func (self *topicLog) read(offset uint64, max int) (msgs []mq_client.Message, next uint64, skipped uint64, appended chan struct{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if earliest := self.earliest(); offset < earliest {
+		skipped = earliest - offset
+		offset = earliest
+	}
+	if offset < self.next {
+		var err error
+		msgs, err = self.storage.Read(int(offset-self.earliest()), max)
+		if err != nil {
+			self.srv.logger(LogTopic).error("fail to read log", "dest", self.name, "error", err)
+		}
+		if len(msgs) == 0 {
+			// skip the messages that can't be read.
+			skipped += self.next - offset
+			offset = self.next
+		}
+	}
+	return msgs, offset + uint64(len(msgs)), skipped, self.appended
+}
+
+// seek returns the offset of the first message that is published at t or later.
+func (self *topicLog) seek(t time.Time) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	earliest := self.earliest()
+	for start := 0; start < self.storage.Len(); {
+		msgs, err := self.storage.Read(start, 100)
+		if err != nil || len(msgs) == 0 {
+			break
+		}
+		for idx, msg := range msgs {
+			timestamp, err := time.Parse(time.RFC3339Nano, msg.Header(HEADER_TIMESTAMP))
+			if err == nil && !timestamp.Before(t) {
+				return earliest + uint64(start+idx)
+			}
+		}
+		start += len(msgs)
+	}
+	return self.next
+}
+
+// position returns the offset that a subscriber starts at by the options,
+// ok is false if it isn't a replay subscription.
+func (self *topicLog) position(options map[string]string) (uint64, bool, error) {
+	if s := options["offset"]; s != "" {
+		switch s {
+		case "earliest":
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			return self.earliest(), true, nil
+		case "latest":
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			return self.next, true, nil
+		}
+		offset, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, false, ErrInvalidOffset
+		}
+		return offset, true, nil
+	}
+
+	if s := options["time"]; s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			ms, e := strconv.ParseInt(s, 10, 64)
+			if e != nil {
+				return 0, false, errors.New("time is invalid, " + err.Error())
+			}
+			t = time.Unix(0, ms*int64(time.Millisecond))
+		}
+		return self.seek(t), true, nil
+	}
+
+	if name := options["consumer"]; name != "" {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if offset, ok := self.commits[name]; ok {
+			return offset, true, nil
+		}
+		return self.next, true, nil
+	}
+	return 0, false, nil
+}
+
+// commit keeps offset under name, offset is the next message that the
+// consumer reads.
+func (self *topicLog) commit(name string, offset uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.commits[name] = offset
+
+	meta, ok := self.storage.(MetaStorage)
+	if !ok || self.closed {
+		return nil
+	}
+	bs, err := json.Marshal(self.commits)
+	if err != nil {
+		return err
+	}
+	return meta.SaveMeta(commitsMeta, bs)
+}
+
+// topicLogState is a topic log in a snapshot.
+type topicLogState struct {
+	next    uint64
+	commits map[string]uint64
+	msgs    []mq_client.Message
+}
+
+// snapshot returns the state of the log, ok is false if the log is kept by
+// its storage.
+func (self *topicLog) snapshot() (state *topicLogState, ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed || self.storage.Durable() {
+		return nil, false
+	}
+
+	msgs, err := self.storage.Read(0, self.storage.Len())
+	if err != nil {
+		self.srv.logger(LogTopic).error("fail to read log", "dest", self.name, "error", err)
+	}
+	commits := make(map[string]uint64, len(self.commits))
+	for name, offset := range self.commits {
+		commits[name] = offset
+	}
+	return &topicLogState{next: self.next, commits: commits, msgs: msgs}, true
+}
+
+// restore puts state back to the log, the log must be empty.
+func (self *topicLog) restore(state *topicLogState) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.next > 0 || self.storage.Len() > 0 {
+		return errors.New("log isn't empty.")
+	}
+
+	msgs := state.msgs
+	if len(msgs) > self.size {
+		msgs = msgs[len(msgs)-self.size:]
+	}
+	for _, msg := range msgs {
+		if err := self.storage.Append(msg); err != nil {
+			self.storage.Remove(self.storage.Len())
+			return err
+		}
+	}
+	self.next = state.next
+	if self.next < uint64(len(msgs)) {
+		self.next = uint64(len(msgs))
+	}
+	for name, offset := range state.commits {
+		self.commits[name] = offset
+	}
+	return nil
+}
+
+// Close stops the followers and waits for them, then closes the storage.
+func (self *topicLog) Close() error {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return nil
+	}
+	self.closed = true
+	close(self.closing)
+	self.lock.Unlock()
+
+	self.followers.Wait()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.storage.Close()
+}
+
+func (self *topicLog) Stats() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	commits := make(map[string]uint64, len(self.commits))
+	for name, offset := range self.commits {
+		commits[name] = offset
+	}
+	return map[string]interface{}{
+		"earliest": self.earliest(),
+		"latest":   self.next,
+		"size":     self.storage.Len(),
+		"capacity": self.size,
+		"commits":  commits,
+	}
+}
+
+// startFollow runs follow in a goroutine that is waited by Close.
+func (self *topicLog) startFollow(consumer *Consumer, offset uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		close(consumer.C)
+		return
+	}
+	self.followers.Add(1)
+	go func() {
+		defer self.followers.Done()
+		self.follow(consumer, offset)
+	}()
+}
+
+// follow feeds consumer from the log until it or the log is closed.
+func (self *topicLog) follow(consumer *Consumer, offset uint64) {
+	defer close(consumer.C)
+
+	for {
+		msgs, next, skipped, appended := self.read(offset, 100)
+		if skipped > 0 {
+			atomic.AddUint32(&consumer.DiscardCount, uint32(skipped))
+		}
+		for _, msg := range msgs {
+			if !consumer.accept(msg) {
+				continue
+			}
+			select {
+			case consumer.C <- msg:
+				consumer.add()
+			case <-consumer.done:
+				return
+			case <-self.closing:
+				return
+			}
+		}
+		offset = next
+
+		if len(msgs) == 0 {
+			select {
+			case <-appended:
+			case <-consumer.done:
+				return
+			case <-self.closing:
+				return
+			}
+		}
+	}
+}
+
+// ListenWith subscribes the topic with the options, it replays the log if
+// any of the replay options is given, it joins a consumer group if the
+// group option is given, and it receives only the messages that match the
+// filter option.
+func (self *Topic) ListenWith(options map[string]string) (*Consumer, error) {
+	var filter *Filter
+	if s := options["filter"]; s != "" {
+		var err error
+		if filter, err = ParseFilter(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if group := options["group"]; group != "" {
+		if self.partitions == nil {
+			return nil, ErrTopicNotPartitioned
+		}
+		if filter != nil {
+			return nil, ErrFilterUnsupported
+		}
+		return self.partitions.join(group), nil
+	}
+
+	if self.log == nil {
+		if options["offset"] != "" || options["time"] != "" || options["consumer"] != "" {
+			return nil, ErrTopicNotLogged
+		}
+		return self.listen(filter, nil), nil
+	}
+
+	offset, ok, err := self.log.position(options)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return self.listen(filter, nil), nil
+	}
+
+	listener := self.listen(filter, make(chan struct{}))
+	self.log.startFollow(listener, offset)
+	return listener, nil
+}
+
+// CommitOffset keeps the offset of consumer of the topic.
+func (self *Server) CommitOffset(name, consumer string, offset uint64) error {
+	if consumer == "" {
+		return ErrNoConsumer
+	}
+	topic := self.GetTopicIfExists(name)
+	if topic == nil {
+		return ErrTopicNotFound
+	}
+	if topic.log == nil {
+		return ErrTopicNotLogged
+	}
+	return topic.log.commit(consumer, offset)
+}
+
+// GetTopicOffsets returns the range of offsets in the log and the committed
+// offsets of the topic.
+func (self *Server) GetTopicOffsets(name string) (map[string]interface{}, error) {
+	topic := self.GetTopicIfExists(name)
+	if topic == nil {
+		return nil, ErrTopicNotFound
+	}
+	if topic.log == nil {
+		return nil, ErrTopicNotLogged
+	}
+	return topic.log.Stats(), nil
+}
@@ -1,9 +1,28 @@
 package server
 
 import (
+	"strconv"
+	"time"
+
 	mq_client "github.com/runner-mei/fastmq/client"
 )
 
+// system events
+// the server publishes a line of text to the _sys.events topic for every
+// event, the line is 'action type name' and the following 'key=value'
+// fields, the values are query escaped:
+//
+//	new queue <name>, del queue <name>, new topic <name>, del topic <name>
+//	kill queue <name>, kill topic <name>, kill client <name>
+//	connect client name=<name> remoteAddr=<addr>
+//	disconnect client name=<name> remoteAddr=<addr>
+//	subscribe queue <name> name=<client> remoteAddr=<addr>
+//	unsubscribe queue <name> name=<client> remoteAddr=<addr>
+//	overflow topic <name> name=<client> remoteAddr=<addr> consumer=<id>
+//
+// the queue of subscribe and unsubscribe may be a topic. if EventFormat is
+// 'json', an event is a json object of mq_client.Event instead.
+
 type Watcher interface {
 	OnNewQueue(name string)
 	OnRemoveQueue(name string)
@@ -11,51 +30,179 @@ type Watcher interface {
 	OnRemoveTopic(name string)
 }
 
+// ClientInfo is the client of an event, Name is empty if the client doesn't
+// send its id.
+type ClientInfo struct {
+	Name       string
+	RemoteAddr string
+}
+
+// LifecycleWatcher is a Watcher that is notified of clients and
+// subscriptions too, a Watcher is adapted by AdaptWatcher.
+type LifecycleWatcher interface {
+	Watcher
+
+	OnConnect(client ClientInfo)
+	OnDisconnect(client ClientInfo)
+	OnSubscribe(typ, name string, client ClientInfo)
+	OnUnsubscribe(typ, name string, client ClientInfo)
+
+	// OnKill is called if a queue or a topic is killed by a client, or a
+	// client is killed by the admin api, typ is 'queue', 'topic' or 'client'.
+	OnKill(typ, name string)
+
+	// OnOverflow is called if a subscriber of topic is full, it is called
+	// again only after the subscriber receives a message.
+	OnOverflow(typ, name string, client ClientInfo)
+}
+
+// AdaptWatcher returns w if it is a LifecycleWatcher, otherwise the new
+// events are ignored.
+func AdaptWatcher(w Watcher) LifecycleWatcher {
+	if lw, ok := w.(LifecycleWatcher); ok {
+		return lw
+	}
+	return &watcherAdapter{Watcher: w}
+}
+
+type watcherAdapter struct {
+	Watcher
+}
+
+func (self *watcherAdapter) OnConnect(client ClientInfo)                       {}
+func (self *watcherAdapter) OnDisconnect(client ClientInfo)                    {}
+func (self *watcherAdapter) OnSubscribe(typ, name string, client ClientInfo)   {}
+func (self *watcherAdapter) OnUnsubscribe(typ, name string, client ClientInfo) {}
+func (self *watcherAdapter) OnKill(typ, name string)                           {}
+func (self *watcherAdapter) OnOverflow(typ, name string, client ClientInfo)    {}
+
+const (
+	EventText = "text"
+	EventJSON = "json"
+)
+
 type watcher struct {
 	topic Producer
-	watch Watcher
+	watch LifecycleWatcher
+
+	// json and server_id are used by the json format of events.
+	json      bool
+	server_id int64
 }
 
-func (w *watcher) onNewQueue(name string) {
-	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(name)+1).
-		Append([]byte("new queue ")).
-		Append([]byte(name)).
-		Append([]byte("\n")).
+func (w *watcher) send(action, typ, name string, fields ...string) {
+	event := &mq_client.Event{Version: mq_client.EVENT_VERSION,
+		Type: action,
+		Kind: typ,
+		Name: name}
+
+	var keys []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if event.Attributes == nil {
+			event.Attributes = map[string]string{}
+		}
+		event.Attributes[fields[i]] = fields[i+1]
+		keys = append(keys, fields[i])
+	}
+
+	var data []byte
+	if w.json {
+		event.Timestamp = time.Now()
+		event.ServerID = w.server_id
+		data = event.Bytes()
+	} else {
+		data = event.Text(keys...)
+	}
+
+	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(data)).
+		Append(data).
 		Build()
 	w.topic.Send(msg)
+}
+
+func (w *watcher) onNewQueue(name string) {
+	w.send("new", mq_client.QUEUE, name)
 	w.watch.OnNewQueue(name)
 }
 
 func (w *watcher) onRemoveQueue(name string) {
-	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(name)+1).
-		Append([]byte("del queue ")).
-		Append([]byte(name)).
-		Append([]byte("\n")).
-		Build()
-	w.topic.Send(msg)
+	w.send("del", mq_client.QUEUE, name)
 	w.watch.OnRemoveQueue(name)
 }
 
 func (w *watcher) onNewTopic(name string) {
-	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(name)+1).
-		Append([]byte("new topic ")).
-		Append([]byte(name)).
-		Append([]byte("\n")).
-		Build()
-	w.topic.Send(msg)
+	w.send("new", mq_client.TOPIC, name)
 	w.watch.OnNewTopic(name)
 }
 
 func (w *watcher) onRemoveTopic(name string) {
-	msg := mq_client.NewMessageWriter(mq_client.MSG_DATA, len(name)+1).
-		Append([]byte("del topic ")).
-		Append([]byte(name)).
-		Append([]byte("\n")).
-		Build()
-	w.topic.Send(msg)
+	w.send("del", mq_client.TOPIC, name)
 	w.watch.OnRemoveTopic(name)
 }
 
+func (w *watcher) onConnect(client ClientInfo) {
+	w.send("connect", "client", "", "name", client.Name, "remoteAddr", client.RemoteAddr)
+	w.watch.OnConnect(client)
+}
+
+func (w *watcher) onDisconnect(client ClientInfo) {
+	w.send("disconnect", "client", "", "name", client.Name, "remoteAddr", client.RemoteAddr)
+	w.watch.OnDisconnect(client)
+}
+
+func (w *watcher) onSubscribe(typ, name string, client ClientInfo) {
+	w.send("subscribe", typ, name, "name", client.Name, "remoteAddr", client.RemoteAddr)
+	w.watch.OnSubscribe(typ, name, client)
+}
+
+func (w *watcher) onUnsubscribe(typ, name string, client ClientInfo) {
+	w.send("unsubscribe", typ, name, "name", client.Name, "remoteAddr", client.RemoteAddr)
+	w.watch.OnUnsubscribe(typ, name, client)
+}
+
+func (w *watcher) onKill(typ, name string) {
+	w.send("kill", typ, name)
+	w.watch.OnKill(typ, name)
+}
+
+func (w *watcher) onOverflow(typ, name string, client ClientInfo, id int) {
+	w.send("overflow", typ, name, "name", client.Name, "remoteAddr", client.RemoteAddr,
+		"consumer", strconv.Itoa(id))
+	w.watch.OnOverflow(typ, name, client)
+}
+
+// overflowed publishes the overflow events of consumers, the events of the
+// _sys.events topic are skipped, otherwise they may overflow again.
+func (self *Topic) overflowed(consumers []*Consumer) {
+	if len(consumers) == 0 || self.srv == nil || self.name == mq_client.SYS_EVENTS {
+		return
+	}
+	for _, consumer := range consumers {
+		self.srv.watcher.onOverflow(mq_client.TOPIC, self.name,
+			self.srv.clientOf(consumer), consumer.id)
+	}
+}
+
+// clientOf returns the native client that owns consumer, it is empty if
+// consumer is owned by a http client.
+func (self *Server) clientOf(consumer *Consumer) ClientInfo {
+	self.clients_lock.Lock()
+	defer self.clients_lock.Unlock()
+	for el := self.clients.Front(); el != nil; el = el.Next() {
+		cli, ok := el.Value.(*Client)
+		if !ok {
+			continue
+		}
+		cli.mu.Lock()
+		owned := cli.consumer == consumer
+		cli.mu.Unlock()
+		if owned {
+			return cli.info()
+		}
+	}
+	return ClientInfo{}
+}
+
 type dummyWatcher struct{}
 
 func (self *dummyWatcher) OnNewQueue(name string) {
@@ -70,4 +217,22 @@ func (self *dummyWatcher) OnNewTopic(name string) {
 func (self *dummyWatcher) OnRemoveTopic(name string) {
 }
 
-var DummyWatcher Watcher = &dummyWatcher{}
+func (self *dummyWatcher) OnConnect(client ClientInfo) {
+}
+
+func (self *dummyWatcher) OnDisconnect(client ClientInfo) {
+}
+
+func (self *dummyWatcher) OnSubscribe(typ, name string, client ClientInfo) {
+}
+
+func (self *dummyWatcher) OnUnsubscribe(typ, name string, client ClientInfo) {
+}
+
+func (self *dummyWatcher) OnKill(typ, name string) {
+}
+
+func (self *dummyWatcher) OnOverflow(typ, name string, client ClientInfo) {
+}
+
+var DummyWatcher LifecycleWatcher = &dummyWatcher{}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mq_client "github.com/runner-mei/fastmq/client"
+)
+
+// websocket endpoint
+// in binary mode a websocket connection carries the native protocol, every
+// websocket message is a native message. in json mode every websocket
+// message is a json object that is translated to a native message and the
+// magic bytes are skipped, for example:
+//
+//	{"command": "sub", "type": "queue", "name": "a", "options": {"headers": "true"}}
+//	{"command": "pub", "type": "queue", "name": "a"}
+//	{"command": "data", "body": "hello", "headers": {"k": "v"}}
+//
+// the server replies with {"command": "ack"}, {"command": "error", "error": "..."}
+// and {"command": "data", "body": "..."}, a body that isn't utf-8 is encoded
+// by base64 and marked with "encoding": "base64".
+
+const (
+	WEBSOCKET_JSON   = "json"
+	WEBSOCKET_BINARY = "binary"
+)
+
+// WebSocketMode selects the frame mode by the 'mode' query parameter or the
+// Sec-WebSocket-Protocol header ("fastmq.json" or "fastmq.binary"), it
+// returns the mode and the protocol that is sent back.
+func WebSocketMode(query, protocols string) (string, string) {
+	for _, p := range strings.Split(protocols, ",") {
+		switch strings.TrimSpace(p) {
+		case "fastmq." + WEBSOCKET_JSON:
+			return WEBSOCKET_JSON, "fastmq." + WEBSOCKET_JSON
+		case "fastmq." + WEBSOCKET_BINARY:
+			return WEBSOCKET_BINARY, "fastmq." + WEBSOCKET_BINARY
+		}
+	}
+	if query == WEBSOCKET_BINARY {
+		return WEBSOCKET_BINARY, ""
+	}
+	return WEBSOCKET_JSON, ""
+}
+
+// IsWebSocketUpgrade checks the headers of a websocket handshake request.
+func IsWebSocketUpgrade(method, connection, upgrade, key string) bool {
+	if method != "GET" || key == "" {
+		return false
+	}
+	if !strings.EqualFold(upgrade, "websocket") {
+		return false
+	}
+	for _, s := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeWebSocket serves a connection that the websocket handshake is done,
+// br is the buffered reader of conn, it may be nil.
+func (self *Server) ServeWebSocket(conn net.Conn, br *bufio.Reader, mode string) {
+	remoteAddr := "ws:" + conn.RemoteAddr().String()
+	ws := mq_client.NewWebSocketConn(conn, br, false)
+	if mode == WEBSOCKET_JSON {
+		self.serveClient(&wsJSONConn{WebSocketConn: ws}, remoteAddr)
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(self.handshakeTimeout(nil)))
+	if err := mq_client.ReadMagic(ws); err != nil {
+		self.logger(LogTCP).error("failed to read protocol version", "remote_addr", remoteAddr, "error", err)
+		ws.Close()
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+	if err := mq_client.SendMagic(ws); err != nil {
+		self.logger(LogTCP).error("fail to send magic bytes", "remote_addr", remoteAddr, "error", err)
+		ws.Close()
+		return
+	}
+	self.serveClient(ws, remoteAddr)
+}
+
+// wsJSONConn translates the json messages to native messages.
+type wsJSONConn struct {
+	*mq_client.WebSocketConn
+	rbuf []byte
+}
+
+func (self *wsJSONConn) Read(b []byte) (int, error) {
+	for len(self.rbuf) == 0 {
+		op, payload, err := self.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if op != mq_client.WS_TEXT && op != mq_client.WS_BINARY {
+			continue
+		}
+		msg, err := wsFromJSON(payload)
+		if err != nil {
+			return 0, err
+		}
+		self.rbuf = msg.ToBytes()
+	}
+
+	n := copy(b, self.rbuf)
+	self.rbuf = self.rbuf[n:]
+	return n, nil
+}
+
+// Write sends a native message, the caller writes a whole message at once.
+func (self *wsJSONConn) Write(b []byte) (int, error) {
+	msg, err := mq_client.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	bs, err := wsToJSON(msg)
+	if err != nil {
+		return 0, err
+	}
+	if err := self.WriteMessage(mq_client.WS_TEXT, bs); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type wsJSONMessage struct {
+	Command  string            `json:"command"`
+	Type     string            `json:"type,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Encoding string            `json:"encoding,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+func wsFromJSON(payload []byte) (mq_client.Message, error) {
+	var m wsJSONMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, errors.New("invalid json message, " + err.Error())
+	}
+
+	switch m.Command {
+	case "pub":
+		return mq_client.BuildCommand(mq_client.MSG_PUB, m.Type, m.Name, m.Options), nil
+	case "sub":
+		return mq_client.BuildCommand(mq_client.MSG_SUB, m.Type, m.Name, m.Options), nil
+	case "data":
+		body := []byte(m.Body)
+		if m.Encoding == "base64" {
+			bs, err := base64.StdEncoding.DecodeString(m.Body)
+			if err != nil {
+				return nil, errors.New("invalid base64 body, " + err.Error())
+			}
+			body = bs
+		}
+		if err := mq_client.CheckHeaders(m.Headers); err != nil {
+			return nil, err
+		}
+		return mq_client.BuildMessageWithHeaders(m.Headers, body), nil
+	case "close":
+		return mq_client.Message(mq_client.MSG_CLOSE_BYTES), nil
+	case "noop":
+		return mq_client.Message(mq_client.MSG_NOOP_BYTES), nil
+	case "id":
+		return mq_client.NewMessageWriter(mq_client.MSG_ID, len(m.Name)).Append([]byte(m.Name)).Build(), nil
+	case "kill":
+		return mq_client.NewMessageWriter(mq_client.MSG_KILL, len(m.Name)+8).
+			Append([]byte(m.Type + " " + m.Name)).Build(), nil
+	case "error":
+		return mq_client.BuildErrorMessage(m.Error), nil
+	default:
+		return nil, errors.New("unknown command - '" + m.Command + "'.")
+	}
+}
+
+func wsToJSON(msg mq_client.Message) ([]byte, error) {
+	var m wsJSONMessage
+	switch msg.Command() {
+	case mq_client.MSG_ACK:
+		m.Command = "ack"
+	case mq_client.MSG_NOOP:
+		m.Command = "noop"
+	case mq_client.MSG_GOAWAY:
+		m.Command = "goaway"
+	case mq_client.MSG_ERROR:
+		m.Command = "error"
+		m.Error = string(msg.Data())
+	case mq_client.MSG_DATA, mq_client.MSG_HDATA:
+		m.Command = "data"
+		m.Headers = msg.Headers()
+		if body := msg.Body(); utf8.Valid(body) {
+			m.Body = string(body)
+		} else {
+			m.Body = base64.StdEncoding.EncodeToString(body)
+			m.Encoding = "base64"
+		}
+	default:
+		m.Command = strings.ToLower(strings.TrimPrefix(mq_client.ToCommandName(msg.Command()), "MSG_"))
+	}
+	return json.Marshal(&m)
+}